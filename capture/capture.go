@@ -0,0 +1,307 @@
+// Package capture records requests and responses of runtime into local directory,
+// and reads them back to replay.
+//
+// Layout of the directory is:
+//
+//	<dir>/captures.jsonl       one Record per line
+//	<dir>/payloads/<id>/...    files of request contents and response body
+//
+// Paths in Record are relative to <dir>.
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+const recordsFileName = "captures.jsonl"
+const payloadsDirName = "payloads"
+
+// redactedHeaders are not recorded, because they contain credentials.
+var redactedHeaders = map[string]bool{
+	"authorization":                    true,
+	"cookie":                           true,
+	"x-abeja-arms-async-request-token": true,
+}
+
+// Record is a pair of request and response of runtime.
+type Record struct {
+	ID         string             `json:"id"`
+	CapturedAt time.Time          `json:"captured_at"`
+	RequestID  string             `json:"request_id,omitempty"`
+	Request    entity.ContentList `json:"request"`
+	Response   entity.Response    `json:"response"`
+}
+
+// Store writes Records into the directory until its size reaches the limit.
+type Store struct {
+	dir        string
+	sampleRate int
+	maxBytes   int64
+
+	mu   sync.Mutex
+	size int64
+	full bool
+	seq  int
+}
+
+// NewStore returns Store which writes into dir.
+// sampleRate is the percentage of requests to capture, and maxBytes is the limit of size of dir.
+func NewStore(dir string, sampleRate int, maxBytes int64) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, payloadsDirName), 0755); err != nil {
+		return nil, errors.Errorf("failed to create capture directory: %w", err)
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return nil, errors.Errorf("failed to get size of capture directory: %w", err)
+	}
+	return &Store{dir: dir, sampleRate: sampleRate, maxBytes: maxBytes, size: size}, nil
+}
+
+// Sample returns whether the request should be captured or not.
+func (s *Store) Sample() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.full {
+		return false
+	}
+	return s.sampleRate >= 100 || rand.Intn(100) < s.sampleRate
+}
+
+// Capture copies files of cl and res, and appends Record of them.
+// It must be called before the files are removed.
+func (s *Store) Capture(ctx context.Context, requestID string, cl *entity.ContentList, res *entity.Response) error {
+	var srcs []string
+	for _, c := range cl.Contents {
+		if c.Path != nil {
+			srcs = append(srcs, *c.Path)
+		}
+	}
+	if res.Path != nil {
+		srcs = append(srcs, *res.Path)
+	}
+	for _, part := range res.Parts {
+		if part.Path != nil {
+			srcs = append(srcs, *part.Path)
+		}
+	}
+	var payloadSize int64
+	for _, src := range srcs {
+		info, err := os.Stat(src)
+		if err != nil {
+			return errors.Errorf("failed to stat file [%s]: %w", src, err)
+		}
+		payloadSize += info.Size()
+	}
+
+	s.mu.Lock()
+	s.seq++
+	id := fmt.Sprintf("%d-%d", time.Now().UnixNano(), s.seq)
+	if s.full || s.size+payloadSize > s.maxBytes {
+		if !s.full {
+			log.Warningf(ctx, "capture directory reached its limit of %d bytes, stop capturing.", s.maxBytes)
+			s.full = true
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	// reserve the size, so that concurrent captures don't exceed the limit.
+	s.size += payloadSize
+	s.mu.Unlock()
+
+	if err := s.write(ctx, id, requestID, cl, res); err != nil {
+		cleanutil.RemoveAll(ctx, filepath.Join(s.dir, payloadsDirName, id))
+		s.mu.Lock()
+		s.size -= payloadSize
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Store) write(
+	ctx context.Context, id string, requestID string, cl *entity.ContentList, res *entity.Response) error {
+
+	record := Record{
+		ID:         id,
+		CapturedAt: time.Now().UTC(),
+		RequestID:  requestID,
+		Request: entity.ContentList{
+			Method:      cl.Method,
+			ContentType: cl.ContentType,
+			Headers:     redact(cl.Headers),
+		},
+		Response: entity.Response{
+			ContentType: res.ContentType,
+			Metadata:    res.Metadata,
+			ErrMsg:      res.ErrMsg,
+			StatusCode:  res.StatusCode,
+		},
+	}
+	payloadDir := filepath.Join(payloadsDirName, id)
+	if err := os.MkdirAll(filepath.Join(s.dir, payloadDir), 0755); err != nil {
+		return errors.Errorf("failed to create payload directory: %w", err)
+	}
+	for i, c := range cl.Contents {
+		content := *c
+		if c.Path != nil {
+			path := filepath.Join(payloadDir, fmt.Sprintf("request-%d", i))
+			if err := s.copyFile(*c.Path, path); err != nil {
+				return err
+			}
+			content.Path = &path
+		}
+		record.Request.Contents = append(record.Request.Contents, &content)
+	}
+	if res.Path != nil {
+		path := filepath.Join(payloadDir, "response")
+		if err := s.copyFile(*res.Path, path); err != nil {
+			return err
+		}
+		record.Response.Path = &path
+	}
+	for i, p := range res.Parts {
+		part := *p
+		if p.Path != nil {
+			path := filepath.Join(payloadDir, fmt.Sprintf("response-%d", i))
+			if err := s.copyFile(*p.Path, path); err != nil {
+				return err
+			}
+			part.Path = &path
+		}
+		record.Response.Parts = append(record.Response.Parts, &part)
+	}
+
+	line, err := json.Marshal(&record)
+	if err != nil {
+		return errors.Errorf("json encode error: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp, err := os.OpenFile(
+		filepath.Join(s.dir, recordsFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Errorf("failed to open records file: %w", err)
+	}
+	defer cleanutil.Close(ctx, fp, fp.Name())
+	if _, err := fp.Write(line); err != nil {
+		return errors.Errorf("failed to write record: %w", err)
+	}
+	s.size += int64(len(line))
+	return nil
+}
+
+func (s *Store) copyFile(src string, rel string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Errorf("failed to open file [%s]: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(s.dir, rel))
+	if err != nil {
+		return errors.Errorf("failed to create file [%s]: %w", rel, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Errorf("failed to copy file [%s]: %w", src, err)
+	}
+	return out.Close()
+}
+
+func redact(headers []*entity.Header) []*entity.Header {
+	var ret []*entity.Header
+	for _, h := range headers {
+		if redactedHeaders[strings.ToLower(h.Key)] {
+			continue
+		}
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// ReadRecords reads all Records in dir. Paths in Records are resolved to absolute paths.
+func ReadRecords(dir string) ([]*Record, error) {
+	fp, err := os.Open(filepath.Join(dir, recordsFileName))
+	if err != nil {
+		return nil, errors.Errorf("failed to open records file: %w", err)
+	}
+	defer fp.Close()
+
+	var records []*Record
+	reader := bufio.NewReader(fp)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			record := &Record{}
+			if jsonErr := json.Unmarshal(line, record); jsonErr != nil {
+				return nil, errors.Errorf("invalid record at line %d: %w", lineNo, jsonErr)
+			}
+			resolve(dir, record)
+			records = append(records, record)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Errorf("failed to read records file: %w", err)
+		}
+	}
+	return records, nil
+}
+
+func resolve(dir string, record *Record) {
+	abs := func(p *string) *string {
+		if p == nil {
+			return nil
+		}
+		path := filepath.Join(dir, *p)
+		return &path
+	}
+	for _, c := range record.Request.Contents {
+		c.Path = abs(c.Path)
+	}
+	record.Response.Path = abs(record.Response.Path)
+	for _, part := range record.Response.Parts {
+		part.Path = abs(part.Path)
+	}
+}
+
+// StatusCode returns status code of response, which is 200 when runtime doesn't set it.
+func StatusCode(res *entity.Response) int {
+	if res.StatusCode == nil {
+		return http.StatusOK
+	}
+	return *res.StatusCode
+}
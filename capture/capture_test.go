@@ -0,0 +1,195 @@
+package capture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+)
+
+func writeTempFile(t *testing.T, dir string, body string) *string {
+	t.Helper()
+	fp, err := ioutil.TempFile(dir, "capture")
+	if err != nil {
+		t.Fatal("failed to create temp file:", err)
+	}
+	defer fp.Close()
+	if _, err := fp.WriteString(body); err != nil {
+		t.Fatal("failed to write temp file:", err)
+	}
+	path := fp.Name()
+	return &path
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestStore_CaptureAndRead(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	captureDir := filepath.Join(tempDir, "captures")
+
+	store, err := NewStore(captureDir, 100, 1024*1024)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if !store.Sample() {
+		t.Error("all requests should be sampled when sample rate is 100")
+	}
+
+	cl := &entity.ContentList{
+		Method:      "POST",
+		ContentType: "application/json",
+		Headers: []*entity.Header{
+			{Key: "Authorization", Values: []string{"Bearer secret"}},
+			{Key: "X-Foo", Values: []string{"bar"}},
+		},
+		Contents: []*entity.Content{
+			{ContentType: strPtr("application/json"), Path: writeTempFile(t, tempDir, `{"x": 1}`)},
+		},
+	}
+	res := &entity.Response{
+		ContentType: strPtr("application/json"),
+		Path:        writeTempFile(t, tempDir, `{"y": 2}`),
+		StatusCode:  intPtr(201),
+	}
+	if err := store.Capture(context.Background(), "req-1", cl, res); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	records, err := ReadRecords(captureDir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("1 record should be read, but %d", len(records))
+	}
+	record := records[0]
+	if record.RequestID != "req-1" {
+		t.Errorf("request id should be req-1, but %s", record.RequestID)
+	}
+	if len(record.Request.Headers) != 1 || record.Request.Headers[0].Key != "X-Foo" {
+		t.Errorf("Authorization header should be redacted, but %+v", record.Request.Headers)
+	}
+	if len(record.Request.Contents) != 1 {
+		t.Fatalf("1 content should be recorded, but %d", len(record.Request.Contents))
+	}
+	reqPath := *record.Request.Contents[0].Path
+	if !strings.HasPrefix(reqPath, captureDir) {
+		t.Errorf("path of content should be in capture directory, but %s", reqPath)
+	}
+	if b, _ := ioutil.ReadFile(reqPath); string(b) != `{"x": 1}` {
+		t.Errorf("request payload should be copied, but %s", string(b))
+	}
+	if b, _ := ioutil.ReadFile(*record.Response.Path); string(b) != `{"y": 2}` {
+		t.Errorf("response body should be copied, but %s", string(b))
+	}
+	if StatusCode(&record.Response) != 201 {
+		t.Errorf("status code should be 201, but %d", StatusCode(&record.Response))
+	}
+}
+
+func TestStore_SizeLimit(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	captureDir := filepath.Join(tempDir, "captures")
+
+	store, err := NewStore(captureDir, 100, 10)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	cl := &entity.ContentList{
+		Method: "POST",
+		Contents: []*entity.Content{
+			{Path: writeTempFile(t, tempDir, "larger than the limit")},
+		},
+	}
+	if err := store.Capture(context.Background(), "", cl, &entity.Response{}); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if _, err := os.Stat(filepath.Join(captureDir, recordsFileName)); !os.IsNotExist(err) {
+		t.Error("record should not be written over the limit")
+	}
+	if store.Sample() {
+		t.Error("no request should be sampled after reaching the limit")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cases := []struct {
+		name     string
+		expected entity.Response
+		actual   entity.Response
+		diffs    []string
+	}{
+		{
+			name: "same",
+			expected: entity.Response{
+				ContentType: strPtr("application/json"),
+				Path:        writeTempFile(t, tempDir, `{"a": 1, "b": [1, 2]}`),
+			},
+			actual: entity.Response{
+				ContentType: strPtr("application/json"),
+				StatusCode:  intPtr(200),
+				Path:        writeTempFile(t, tempDir, `{"b":[1,2],"a":1}`),
+			},
+			diffs: nil,
+		}, {
+			name: "json differs",
+			expected: entity.Response{
+				ContentType: strPtr("application/json"),
+				Path:        writeTempFile(t, tempDir, `{"a": 1, "b": [1, 2], "c": "x"}`),
+			},
+			actual: entity.Response{
+				ContentType: strPtr("application/json"),
+				Path:        writeTempFile(t, tempDir, `{"a": 1, "b": [1, 3], "d": true}`),
+			},
+			diffs: []string{"body.b[1]: 2 != 3", "body.c: missing", "body.d: unexpected true"},
+		}, {
+			name: "status and binary differ",
+			expected: entity.Response{
+				ContentType: strPtr("image/png"),
+				Path:        writeTempFile(t, tempDir, "abc"),
+			},
+			actual: entity.Response{
+				ContentType: strPtr("image/png"),
+				StatusCode:  intPtr(500),
+				Path:        writeTempFile(t, tempDir, "abcd"),
+			},
+			diffs: []string{"status_code: 200 != 500", "body: 3 byte(s) != 4 byte(s), contents differ"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			diffs, err := Diff(&c.expected, &c.actual)
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			if strings.Join(diffs, "\n") != strings.Join(c.diffs, "\n") {
+				t.Errorf("diffs should be\n%s\nbut\n%s", strings.Join(c.diffs, "\n"), strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
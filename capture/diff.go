@@ -0,0 +1,166 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+)
+
+// maxDifferences is the max number of differences reported per response.
+const maxDifferences = 20
+
+// Diff compares actual response with expected one, and returns their differences.
+// Bodies are compared as JSON when both of them are valid JSON, otherwise as bytes.
+func Diff(expected *entity.Response, actual *entity.Response) ([]string, error) {
+	var diffs []string
+	if StatusCode(expected) != StatusCode(actual) {
+		diffs = append(diffs, fmt.Sprintf(
+			"status_code: %d != %d", StatusCode(expected), StatusCode(actual)))
+	}
+	if str(expected.ContentType) != str(actual.ContentType) {
+		diffs = append(diffs, fmt.Sprintf(
+			"content_type: %q != %q", str(expected.ContentType), str(actual.ContentType)))
+	}
+	if str(expected.ErrMsg) != str(actual.ErrMsg) {
+		diffs = append(diffs, fmt.Sprintf(
+			"error_message: %q != %q", str(expected.ErrMsg), str(actual.ErrMsg)))
+	}
+
+	bodyDiffs, err := diffFile("body", expected.Path, actual.Path)
+	if err != nil {
+		return nil, err
+	}
+	diffs = append(diffs, bodyDiffs...)
+
+	if len(expected.Parts) != len(actual.Parts) {
+		diffs = append(diffs, fmt.Sprintf(
+			"parts: %d part(s) != %d part(s)", len(expected.Parts), len(actual.Parts)))
+	} else {
+		for i := range expected.Parts {
+			partDiffs, err := diffFile(
+				fmt.Sprintf("parts[%d]", i), expected.Parts[i].Path, actual.Parts[i].Path)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, partDiffs...)
+		}
+	}
+
+	if len(diffs) > maxDifferences {
+		omitted := len(diffs) - maxDifferences
+		diffs = append(diffs[:maxDifferences], fmt.Sprintf("... and %d more difference(s)", omitted))
+	}
+	return diffs, nil
+}
+
+func diffFile(name string, expectedPath *string, actualPath *string) ([]string, error) {
+	expected, err := readFile(expectedPath)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := readFile(actualPath)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(expected, actual) {
+		return nil, nil
+	}
+
+	var expectedJSON, actualJSON interface{}
+	if json.Unmarshal(expected, &expectedJSON) == nil && json.Unmarshal(actual, &actualJSON) == nil {
+		var diffs []string
+		diffJSON(name, expectedJSON, actualJSON, &diffs)
+		return diffs, nil
+	}
+	return []string{fmt.Sprintf(
+		"%s: %d byte(s) != %d byte(s), contents differ", name, len(expected), len(actual))}, nil
+}
+
+func diffJSON(path string, expected interface{}, actual interface{}, diffs *[]string) {
+	if len(*diffs) > maxDifferences {
+		return
+	}
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, key := range unionKeys(e, a) {
+			ev, eok := e[key]
+			av, aok := a[key]
+			childPath := fmt.Sprintf("%s.%s", path, key)
+			switch {
+			case !aok:
+				*diffs = append(*diffs, fmt.Sprintf("%s: missing", childPath))
+			case !eok:
+				*diffs = append(*diffs, fmt.Sprintf("%s: unexpected %s", childPath, toJSON(av)))
+			default:
+				diffJSON(childPath, ev, av, diffs)
+			}
+		}
+		return
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(e) != len(a) {
+			break
+		}
+		for i := range e {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), e[i], a[i], diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", path, toJSON(expected), toJSON(actual)))
+	}
+}
+
+func unionKeys(a map[string]interface{}, b map[string]interface{}) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if len(b) > 80 {
+		return string(b[:77]) + "..."
+	}
+	return string(b)
+}
+
+func readFile(path *string) ([]byte, error) {
+	if path == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(*path)
+	if err != nil {
+		return nil, errors.Errorf("failed to read file [%s]: %w", *path, err)
+	}
+	return b, nil
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
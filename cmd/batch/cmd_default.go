@@ -47,10 +47,22 @@ func newCmdRoot(ctx context.Context) *cobra.Command {
 		cmdutil.BindPlatformUserID,
 		cmdutil.BindPlatformPersonalAccessToken,
 		cmdutil.BindRuntime,
+		cmdutil.BindIPCProtocolVersion,
 		cmdutil.BindUserModelRoot,
 		cmdutil.BindTrainingResultDir,
 		cmdutil.BindInput,
 		cmdutil.BindOutput,
+		cmdutil.BindManifest,
+		cmdutil.BindBatchConcurrency,
+		cmdutil.BindBatchCheckpoint,
+		cmdutil.BindBatchReport,
+		cmdutil.BindOutputFileName,
+		cmdutil.BindS3Endpoint,
+		cmdutil.BindS3Region,
+		cmdutil.BindS3AccessKeyID,
+		cmdutil.BindS3SecretAccessKey,
+		cmdutil.BindModelCacheDir,
+		cmdutil.BindModelCacheMaxSize,
 	}
 	if err := cmdutil.BindOptions(cmdRoot, options); err != nil {
 		// NOTE: This cobra/viper's error don't occur basically...
@@ -64,6 +76,9 @@ func newCmdRoot(ctx context.Context) *cobra.Command {
 }
 
 func setupDefaultConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confDefault); err != nil {
 		return err
 	}
@@ -92,6 +107,21 @@ func validateDefaultConfiguration() error {
 		confDefault.ModelVersionID); err != nil {
 		return err
 	}
+	if err := cmdutil.ValidateManifest(confDefault.Manifest, confDefault.Input); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateBatchConcurrency(confDefault.BatchConcurrency); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateIPCProtocolVersion(confDefault.IPCProtocolVersion); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateOutputFileName(confDefault.OutputFileName); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateModelCacheMaxSize(confDefault.ModelCacheMaxSize); err != nil {
+		return err
+	}
 	if err := cmdutil.ValidateTrainedModel(
 		confDefault.TrainingModelDownload,
 		confDefault.OrganizationID,
@@ -36,10 +36,20 @@ func newCmdRun() *cobra.Command {
 		cmdutil.BindPlatformUserID,
 		cmdutil.BindPlatformPersonalAccessToken,
 		cmdutil.BindRuntime,
+		cmdutil.BindIPCProtocolVersion,
 		cmdutil.BindUserModelRoot,
 		cmdutil.BindTrainingResultDir,
 		cmdutil.BindInput,
 		cmdutil.BindOutput,
+		cmdutil.BindManifest,
+		cmdutil.BindBatchConcurrency,
+		cmdutil.BindBatchCheckpoint,
+		cmdutil.BindBatchReport,
+		cmdutil.BindOutputFileName,
+		cmdutil.BindS3Endpoint,
+		cmdutil.BindS3Region,
+		cmdutil.BindS3AccessKeyID,
+		cmdutil.BindS3SecretAccessKey,
 	}
 	if err := cmdutil.BindOptions(cmdRun, options); err != nil {
 		// NOTE: This cobra/viper's error don't occur basically...
@@ -52,6 +62,9 @@ func newCmdRun() *cobra.Command {
 }
 
 func setupRunConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confRun); err != nil {
 		return err
 	}
@@ -59,7 +72,19 @@ func setupRunConfiguration(cmd *cobra.Command, args []string) error {
 }
 
 func validateRunConfiguration() error {
-	if strings.Contains(confRun.Input, "$datalake:1") || confRun.Output != "" {
+	if err := cmdutil.ValidateManifest(confRun.Manifest, confRun.Input); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateBatchConcurrency(confRun.BatchConcurrency); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateIPCProtocolVersion(confRun.IPCProtocolVersion); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateOutputFileName(confRun.OutputFileName); err != nil {
+		return err
+	}
+	if strings.Contains(confRun.Input, "$datalake:1") || strings.Contains(confRun.Output, "$datalake:1") {
 		if err := cmdutil.ValidateAuthParts(
 			confRun.PlatformAuthToken,
 			confRun.PlatformUserID,
@@ -54,6 +54,72 @@ func TestSetupRunConfiguration(t *testing.T) {
 				Input:               "$datalake:1:5555555555555",
 			},
 			errMsg: "",
+		}, {
+			name: "manifest with input",
+			optionEnv: cmdutil.AllOptions{
+				Input:    "{\"foo\": 1}",
+				Manifest: "/tmp/manifest.jsonl",
+			},
+			hasError: true,
+			expects:  cmdutil.AllOptions{},
+			errMsg:   "Error: manifest and input can't be set at the same time",
+		}, {
+			name: "manifest",
+			optionEnv: cmdutil.AllOptions{
+				Manifest:         "/tmp/manifest.jsonl",
+				BatchConcurrency: 8,
+				BatchCheckpoint:  "/tmp/checkpoint.jsonl",
+				BatchReport:      "/tmp/report.json",
+			},
+			hasError: false,
+			expects: cmdutil.AllOptions{
+				AbejaApiUrl:      config.DefaultAbejaAPIURL,
+				Manifest:         "/tmp/manifest.jsonl",
+				BatchConcurrency: 8,
+				BatchCheckpoint:  "/tmp/checkpoint.jsonl",
+				BatchReport:      "/tmp/report.json",
+			},
+			errMsg: "",
+		}, {
+			name: "missing auth when datalake output",
+			optionEnv: cmdutil.AllOptions{
+				Manifest: "/tmp/manifest.jsonl",
+				Output:   "[{\"$local\": \"/mnt/results\"}, {\"$datalake:1\": \"5555555555555\"}]",
+			},
+			hasError: true,
+			expects:  cmdutil.AllOptions{},
+			errMsg:   "Error: platform_auth_token or (abeja_platform_user_id and abeja_platform_personal_access_token) need but not set.",
+		}, {
+			name: "local output",
+			optionEnv: cmdutil.AllOptions{
+				Manifest:          "/tmp/manifest.jsonl",
+				Output:            "{\"$local\": \"/mnt/results\"}",
+				OutputFileName:    "{{.InputBase}}.json",
+				S3Endpoint:        "http://minio:9000",
+				S3AccessKeyId:     "AKID",
+				S3SecretAccessKey: "secret",
+			},
+			hasError: false,
+			expects: cmdutil.AllOptions{
+				AbejaApiUrl:       config.DefaultAbejaAPIURL,
+				Manifest:          "/tmp/manifest.jsonl",
+				Output:            "{\"$local\": \"/mnt/results\"}",
+				OutputFileName:    "{{.InputBase}}.json",
+				S3Endpoint:        "http://minio:9000",
+				S3Region:          config.DefaultS3Region,
+				S3AccessKeyId:     "AKID",
+				S3SecretAccessKey: "secret",
+			},
+			errMsg: "",
+		}, {
+			name: "invalid output file name",
+			optionEnv: cmdutil.AllOptions{
+				Manifest:       "/tmp/manifest.jsonl",
+				OutputFileName: "{{.InputBase",
+			},
+			hasError: true,
+			expects:  cmdutil.AllOptions{},
+			errMsg:   "Error: output_file_name [{{.InputBase] is invalid template",
 		},
 	}
 
@@ -111,6 +177,36 @@ func TestSetupRunConfiguration(t *testing.T) {
 				if confRun.Input != c.expects.Input {
 					t.Errorf("Input should be %s, but %s", c.expects.Input, confRun.Input)
 				}
+				if confRun.Manifest != c.expects.Manifest {
+					t.Errorf("Manifest should be %s, but %s", c.expects.Manifest, confRun.Manifest)
+				}
+				if c.expects.BatchConcurrency != 0 && confRun.BatchConcurrency != c.expects.BatchConcurrency {
+					t.Errorf("BatchConcurrency should be %d, but %d", c.expects.BatchConcurrency, confRun.BatchConcurrency)
+				}
+				if confRun.BatchCheckpoint != c.expects.BatchCheckpoint {
+					t.Errorf("BatchCheckpoint should be %s, but %s", c.expects.BatchCheckpoint, confRun.BatchCheckpoint)
+				}
+				if confRun.BatchReport != c.expects.BatchReport {
+					t.Errorf("BatchReport should be %s, but %s", c.expects.BatchReport, confRun.BatchReport)
+				}
+				if c.expects.Output != "" && confRun.Output != c.expects.Output {
+					t.Errorf("Output should be %s, but %s", c.expects.Output, confRun.Output)
+				}
+				if c.expects.OutputFileName != "" && confRun.OutputFileName != c.expects.OutputFileName {
+					t.Errorf("OutputFileName should be %s, but %s", c.expects.OutputFileName, confRun.OutputFileName)
+				}
+				if c.expects.S3Region != "" && confRun.S3Region != c.expects.S3Region {
+					t.Errorf("S3Region should be %s, but %s", c.expects.S3Region, confRun.S3Region)
+				}
+				if confRun.S3Endpoint != c.expects.S3Endpoint {
+					t.Errorf("S3Endpoint should be %s, but %s", c.expects.S3Endpoint, confRun.S3Endpoint)
+				}
+				if confRun.S3AccessKeyID != c.expects.S3AccessKeyId {
+					t.Errorf("S3AccessKeyID should be %s, but %s", c.expects.S3AccessKeyId, confRun.S3AccessKeyID)
+				}
+				if confRun.S3SecretAccessKey != c.expects.S3SecretAccessKey {
+					t.Errorf("S3SecretAccessKey should be %s, but %s", c.expects.S3SecretAccessKey, confRun.S3SecretAccessKey)
+				}
 			}
 		})
 	}
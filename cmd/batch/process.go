@@ -77,7 +77,7 @@ func run(ctx context.Context, conf *config.Configuration) error {
 	notifyToMain := make(chan int)
 
 	// subprocess logger
-	scopeChan := make(chan context.Context, 1)
+	scopeChan := make(chan subprocess.LogScope, 1)
 	defer close(scopeChan)
 	runtimeLogger := subprocess.NewRuntimeLogger(ctx, runtime.Cmd, scopeChan)
 
@@ -89,14 +89,15 @@ func run(ctx context.Context, conf *config.Configuration) error {
 	runtimeLogger.Run()
 	defer runtimeLogger.Flush(3) // wait 3 seconds for flush all logs.
 
-	if err := runtime.WaitUntilStarted(ctx, udsFilePath); err != nil {
-		shutdownOnError(ctx, errOnBoot)
-		return errors.Errorf(": %w", err)
+	// transport connects to runtime once it listens on the socket.
+	if conf.Manifest != "" {
+		go proxy.TransportBatchMessages(
+			ctx, conf, udsFilePath, errOnBoot, notifyFromMain, notifyToMain, nil)
+	} else {
+		go proxy.TransportOneshotMessage(
+			ctx, conf, udsFilePath, errOnBoot, notifyFromMain, notifyToMain, nil)
 	}
 
-	go proxy.TransportOneshotMessage(
-		ctx, conf, udsFilePath, errOnBoot, notifyFromMain, notifyToMain, nil)
-
 	exitStatus := handleSignal(
 		ctx, conf.RequestedDataDir, errOnBoot, errOnSub, notifyFromMain, notifyToMain)
 	if exitStatus > 0 {
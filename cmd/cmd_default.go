@@ -6,6 +6,7 @@ import (
 	"github.com/spf13/cobra"
 
 	batchcmd "github.com/abeja-inc/abeja-platform-model-proxy/cmd/batch"
+	replaycmd "github.com/abeja-inc/abeja-platform-model-proxy/cmd/replay"
 	servecmd "github.com/abeja-inc/abeja-platform-model-proxy/cmd/service"
 	tensorboardcmd "github.com/abeja-inc/abeja-platform-model-proxy/cmd/tensorboard"
 	traincmd "github.com/abeja-inc/abeja-platform-model-proxy/cmd/training"
@@ -36,6 +37,9 @@ func initCommand() *cobra.Command {
 	serveCmd := servecmd.InitServeCommand(procCtx)
 	cmdRoot.AddCommand(serveCmd)
 
+	devCmd := servecmd.InitDevCommand(procCtx)
+	cmdRoot.AddCommand(devCmd)
+
 	trainCmd := traincmd.InitTrainCommand(procCtx)
 	cmdRoot.AddCommand(trainCmd)
 
@@ -45,6 +49,9 @@ func initCommand() *cobra.Command {
 	tensorBoardCmd := tensorboardcmd.InitTensorBoardCommand(procCtx)
 	cmdRoot.AddCommand(tensorBoardCmd)
 
+	replayCmd := replaycmd.InitReplayCommand(procCtx)
+	cmdRoot.AddCommand(replayCmd)
+
 	return cmdRoot
 }
 
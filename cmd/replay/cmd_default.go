@@ -0,0 +1,90 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	errors "golang.org/x/xerrors"
+
+	cmdutil "github.com/abeja-inc/abeja-platform-model-proxy/cmd/util"
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/version"
+)
+
+var (
+	procCtx     context.Context
+	confDefault = config.NewConfiguration()
+)
+
+func newCmdRoot(ctx context.Context) *cobra.Command {
+	procCtx = ctx
+	cmdRoot := &cobra.Command{
+		Use:          "replay",
+		Short:        "replay captured requests to local runtime and diff responses",
+		PreRunE:      setupDefaultConfiguration,
+		RunE:         execDefault,
+		PostRun:      teardownDefault,
+		SilenceUsage: true,
+	}
+
+	// bind options with viper
+	options := []func(*cobra.Command) error{
+		cmdutil.BindUserModelRoot,
+		cmdutil.BindRuntime,
+		cmdutil.BindMaxRestarts,
+		cmdutil.BindRequestTimeout,
+		cmdutil.BindIPCProtocolVersion,
+		cmdutil.BindTrainingResultDir,
+		cmdutil.BindCaptureDir,
+	}
+	if err := cmdutil.BindOptions(cmdRoot, options); err != nil {
+		// NOTE: This cobra/viper's error don't occur basically...
+		log.Warningf(procCtx, "unexpected error occurred when binding command line options: "+log.ErrorFormat, err)
+	}
+
+	return cmdRoot
+}
+
+func setupDefaultConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
+	if err := viper.Unmarshal(&confDefault); err != nil {
+		return err
+	}
+	return validateDefaultConfiguration()
+}
+
+func validateDefaultConfiguration() error {
+	if confDefault.CaptureDir == "" {
+		return errors.New("require flag(s) capture_dir not set")
+	}
+	if err := cmdutil.ValidateMaxRestarts(confDefault.MaxRestarts); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateRequestTimeout(confDefault.RequestTimeout); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateIPCProtocolVersion(confDefault.IPCProtocolVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+func execDefault(cmd *cobra.Command, args []string) error {
+	log.Info(
+		procCtx, fmt.Sprintf("abeja-runner version: [%s] start replay.", version.Version))
+	return run(procCtx, &confDefault, cmd.OutOrStdout())
+}
+
+func teardownDefault(cmd *cobra.Command, args []string) {
+	cleanutil.RemoveAll(procCtx, confDefault.RequestedDataDir)
+}
+
+func InitReplayCommand(ctx context.Context) *cobra.Command {
+	return newCmdRoot(ctx)
+}
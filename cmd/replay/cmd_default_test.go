@@ -0,0 +1,111 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	cmdutil "github.com/abeja-inc/abeja-platform-model-proxy/cmd/util"
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+)
+
+func TestSetupDefaultConfiguration(t *testing.T) {
+
+	cases := []struct {
+		name          string
+		optionEnv     cmdutil.AllOptions
+		optionCmdLine cmdutil.AllOptions
+		hasError      bool
+		expects       cmdutil.AllOptions
+		errMsg        string
+	}{
+		{
+			name:          "missing capture_dir",
+			optionEnv:     cmdutil.AllOptions{},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      true,
+			expects:       cmdutil.AllOptions{},
+			errMsg:        "Error: require flag(s) capture_dir not set",
+		}, {
+			name: "env",
+			optionEnv: cmdutil.AllOptions{
+				CaptureDir:     "/tmp/captures",
+				RequestTimeout: 10,
+			},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      false,
+			expects: cmdutil.AllOptions{
+				CaptureDir:     "/tmp/captures",
+				AbejaRuntime:   config.DefaultRuntime,
+				RequestTimeout: 10,
+			},
+			errMsg: "",
+		}, {
+			name: "cmdline takes precedence",
+			optionEnv: cmdutil.AllOptions{
+				CaptureDir:   "/tmp/captures",
+				AbejaRuntime: "golang",
+			},
+			optionCmdLine: cmdutil.AllOptions{
+				CaptureDir:   "/tmp/other",
+				AbejaRuntime: "python37",
+			},
+			hasError: false,
+			expects: cmdutil.AllOptions{
+				CaptureDir:     "/tmp/other",
+				AbejaRuntime:   "python37",
+				RequestTimeout: config.DefaultRequestTimeout,
+			},
+			errMsg: "",
+		}, {
+			name:      "negative request_timeout",
+			optionEnv: cmdutil.AllOptions{},
+			optionCmdLine: cmdutil.AllOptions{
+				CaptureDir:     "/tmp/captures",
+				RequestTimeout: -1,
+			},
+			hasError: true,
+			expects:  cmdutil.AllOptions{},
+			errMsg:   "Error: request_timeout [-1] must be positive",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cmdutil.CleanUp(t)
+			confDefault = config.NewConfiguration()
+			cmdutil.SetOptionsToEnv(c.optionEnv)
+			cmdutil.SetOptionsToCmdline("", c.optionCmdLine)
+			cmdRoot := newCmdRoot(context.TODO())
+			cmdRoot.RunE = cmdutil.DummyRunEFunc
+			buf := new(bytes.Buffer)
+			cmdRoot.SetOutput(buf)
+
+			err := cmdRoot.Execute()
+			if err != nil {
+				if c.hasError {
+					get := buf.String()
+					if !strings.HasPrefix(get, c.errMsg) {
+						t.Fatalf("error message should be start with [%s], but [%s]", c.errMsg, get)
+					}
+					return
+				}
+				t.Fatalf("unexpected error occurred: %s", err.Error())
+			}
+			if c.hasError {
+				t.Fatal("error should be occurred")
+			}
+
+			if confDefault.CaptureDir != c.expects.CaptureDir {
+				t.Errorf("CaptureDir should be %s, but %s", c.expects.CaptureDir, confDefault.CaptureDir)
+			}
+			if confDefault.Runtime != c.expects.AbejaRuntime {
+				t.Errorf("AbejaRuntime should be %s, but %s", c.expects.AbejaRuntime, confDefault.Runtime)
+			}
+			if confDefault.RequestTimeout != c.expects.RequestTimeout {
+				t.Errorf("RequestTimeout should be %d, but %d", c.expects.RequestTimeout, confDefault.RequestTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/capture"
+	cmdutil "github.com/abeja-inc/abeja-platform-model-proxy/cmd/util"
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/proxy"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+func run(ctx context.Context, conf *config.Configuration, out io.Writer) error {
+
+	records, err := capture.ReadRecords(conf.CaptureDir)
+	if err != nil {
+		return errors.Errorf(": %w", err)
+	}
+	if len(records) == 0 {
+		return errors.Errorf("no captured request in %s", conf.CaptureDir)
+	}
+
+	workingDir, err := conf.GetWorkingDir()
+	if err != nil {
+		log.Fatalf(ctx, "failed to get working direcoty path: "+log.ErrorFormat, err)
+		return errors.Errorf(": %w", err)
+	}
+	if err := os.Chdir(workingDir); err != nil {
+		log.Fatalf(
+			ctx,
+			"failed to move working direcoty path: %s, error: "+log.ErrorFormat,
+			workingDir, err)
+		return errors.Errorf(": %w", err)
+	}
+
+	trainingResultDir, err := conf.GetTrainingResultDir()
+	if err != nil {
+		log.Fatalf(ctx, "failed to get path for training-result: "+log.ErrorFormat, err)
+		return errors.Errorf(": %w", err)
+	}
+
+	udsFilePath, err := cmdutil.MakeUDSFilePath()
+	if err != nil {
+		log.Fatalf(
+			ctx,
+			"failed to build path to socket file for communication to runtime: "+log.ErrorFormat,
+			err)
+		return errors.Errorf(": %w", err)
+	}
+	defer cleanutil.RemoveAll(ctx, filepath.Dir(udsFilePath))
+
+	createRuntime := func() (*subprocess.Runtime, error) {
+		return subprocess.CreateServiceRuntime(conf, udsFilePath, trainingResultDir)
+	}
+	supervisor, err := subprocess.NewSupervisor(createRuntime, udsFilePath, conf.MaxRestarts)
+	if err != nil {
+		log.Fatalf(ctx, "failed to CreateServiceRuntime: "+log.ErrorFormat, err)
+		return errors.Errorf(": %w", err)
+	}
+
+	// subprocess logger
+	scopeChan := make(chan subprocess.LogScope)
+	defer close(scopeChan)
+	runtimeLogger := supervisor.AttachLogger(ctx, scopeChan)
+	defer runtimeLogger.Flush(3) // wait 3 seconds for flush all logs.
+
+	errOnSub := make(chan error, 1)
+	if err := supervisor.Start(ctx, errOnSub); err != nil {
+		return errors.Errorf(": %w", err)
+	}
+	defer supervisor.Shutdown(ctx, 25*time.Second)
+
+	request := make(chan entity.ContentList)
+	errOnDial := make(chan int)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	go proxy.TransportMessages(
+		ctx, conf, udsFilePath, supervisor, request,
+		errOnDial, notifyFromMain, notifyToMain, scopeChan, nil)
+	defer func() {
+		close(notifyFromMain)
+		select {
+		case <-notifyToMain:
+		case <-errOnDial:
+		}
+	}()
+	if err := supervisor.WaitUntilReady(ctx); err != nil {
+		return errors.Errorf(": %w", err)
+	}
+
+	var differed int
+	for _, record := range records {
+		diffs, err := replay(ctx, conf, record, request, errOnDial)
+		if err != nil {
+			return errors.Errorf("failed to replay request [%s]: %w", record.ID, err)
+		}
+		if len(diffs) == 0 {
+			fmt.Fprintf(out, "[OK]   %s\n", record.ID)
+			continue
+		}
+		differed++
+		fmt.Fprintf(out, "[DIFF] %s\n", record.ID)
+		for _, diff := range diffs {
+			fmt.Fprintf(out, "       %s\n", diff)
+		}
+	}
+	fmt.Fprintf(out, "%d request(s) replayed, %d response(s) differ.\n", len(records), differed)
+	if differed > 0 {
+		return errors.Errorf("%d of %d response(s) differ from captured ones", differed, len(records))
+	}
+	return nil
+}
+
+// replay sends captured request to runtime, and returns differences of response.
+func replay(
+	ctx context.Context,
+	conf *config.Configuration,
+	record *capture.Record,
+	request chan entity.ContentList,
+	errOnDial chan int) ([]string, error) {
+
+	ctx = context.WithValue(ctx, log.KeyRequestID, record.ID) //nolint // SA1029: should not use built-in type string as key for value; define your own type to avoid collisions
+
+	// copy payloads, so that runtime can't modify captured ones.
+	var tempFiles []string
+	defer func() {
+		for _, path := range tempFiles {
+			cleanutil.Remove(ctx, path)
+		}
+	}()
+	var contents []*entity.Content
+	for _, c := range record.Request.Contents {
+		content := *c
+		if c.Path != nil {
+			path, err := copyToTemp(*c.Path, conf.RequestedDataDir)
+			if err != nil {
+				return nil, err
+			}
+			tempFiles = append(tempFiles, path)
+			content.Path = &path
+		}
+		contents = append(contents, &content)
+	}
+
+	response := make(chan entity.Response, 1)
+	cl := entity.ContentList{
+		Method:       record.Request.Method,
+		ContentType:  record.Request.ContentType,
+		Headers:      record.Request.Headers,
+		Contents:     contents,
+		Ctx:          ctx,
+		ResponseChan: response,
+		Timeout:      conf.GetRequestTimeout(),
+	}
+	select {
+	case request <- cl:
+	case <-errOnDial:
+		return nil, errors.New("failed to connect to runtime")
+	}
+
+	var res entity.Response
+	select {
+	case res = <-response:
+	case <-errOnDial:
+		return nil, errors.New("failed to connect to runtime")
+	}
+	if res.Path != nil {
+		tempFiles = append(tempFiles, *res.Path)
+	}
+	for _, part := range res.Parts {
+		if part.Path != nil {
+			tempFiles = append(tempFiles, *part.Path)
+		}
+	}
+	if res.Chunks != nil {
+		path, err := collectChunks(res.Chunks, conf.RequestedDataDir)
+		if path != "" {
+			tempFiles = append(tempFiles, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Path = &path
+	}
+	return capture.Diff(&record.Response, &res)
+}
+
+func copyToTemp(src string, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", errors.Errorf("failed to open captured file: %w", err)
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(dir, "replay")
+	if err != nil {
+		return "", errors.Errorf("failed to create temporary file: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", errors.Errorf("failed to copy captured file: %w", err)
+	}
+	return out.Name(), out.Close()
+}
+
+// collectChunks writes chunks of streaming response into temporary file.
+func collectChunks(chunks <-chan entity.Chunk, dir string) (string, error) {
+	out, err := ioutil.TempFile(dir, "replay")
+	if err != nil {
+		return "", errors.Errorf("failed to create temporary file: %w", err)
+	}
+	defer out.Close()
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return out.Name(), errors.Errorf("streaming response is broken: %w", chunk.Err)
+		}
+		if _, err := out.Write(chunk.Data); err != nil {
+			return out.Name(), errors.Errorf("failed to write chunk: %w", err)
+		}
+	}
+	return out.Name(), nil
+}
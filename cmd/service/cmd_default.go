@@ -50,7 +50,27 @@ func newCmdRoot(ctx context.Context) *cobra.Command {
 		cmdutil.BindRuntime,
 		cmdutil.BindPort,
 		cmdutil.BindHealthCheckPort,
+		cmdutil.BindGRPCPort,
+		cmdutil.BindWorkers,
+		cmdutil.BindMaxRestarts,
+		cmdutil.BindRequestTimeout,
+		cmdutil.BindStartupTimeout,
+		cmdutil.BindIPCProtocolVersion,
 		cmdutil.BindTrainingResultDir,
+		cmdutil.BindCaptureDir,
+		cmdutil.BindCaptureSampleRate,
+		cmdutil.BindCaptureMaxSize,
+		cmdutil.BindQueueMaxDepth,
+		cmdutil.BindQueueMaxWait,
+		cmdutil.BindDynamicBatchMaxSize,
+		cmdutil.BindDynamicBatchMaxLatency,
+		cmdutil.BindAsyncJournalDir,
+		cmdutil.BindAsyncDeadLetterDir,
+		cmdutil.BindARMSMaxRetries,
+		cmdutil.BindCallbackSecret,
+		cmdutil.BindModelCacheDir,
+		cmdutil.BindModelCacheMaxSize,
+		cmdutil.BindV2ModelName,
 	}
 	if err := cmdutil.BindOptions(cmdRoot, options); err != nil {
 		// NOTE: This cobra/viper's error don't occur basically...
@@ -61,6 +81,9 @@ func newCmdRoot(ctx context.Context) *cobra.Command {
 }
 
 func setupDefaultConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confDefault); err != nil {
 		return err
 	}
@@ -87,6 +110,48 @@ func validateDefaultConfiguration() error {
 	if err := cmdutil.ValidatePortNumber(confDefault.Port); err != nil {
 		return err
 	}
+	if err := cmdutil.ValidateGRPCPort(confDefault.GRPCPort); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateWorkers(confDefault.Workers); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateMaxRestarts(confDefault.MaxRestarts); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateRequestTimeout(confDefault.RequestTimeout); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateStartupTimeout(confDefault.StartupTimeout); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateIPCProtocolVersion(confDefault.IPCProtocolVersion); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateCaptureSampleRate(confDefault.CaptureSampleRate); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateCaptureMaxSize(confDefault.CaptureMaxSize); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateQueueMaxDepth(confDefault.QueueMaxDepth); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateQueueMaxWait(confDefault.QueueMaxWait); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateDynamicBatchMaxSize(confDefault.DynamicBatchMaxSize); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateDynamicBatchMaxLatency(confDefault.DynamicBatchMaxLatency); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateARMSMaxRetries(confDefault.ARMSMaxRetries); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateModelCacheMaxSize(confDefault.ModelCacheMaxSize); err != nil {
+		return err
+	}
 	if confDefault.ServiceID != "" && confDefault.DeploymentID == "" {
 		return errors.New("flag abeja_deployment_id needs when you set abeja_service_id")
 	}
@@ -99,7 +164,7 @@ func validateDefaultConfiguration() error {
 func execDefault(cmd *cobra.Command, args []string) error {
 	log.Info(
 		procCtx, fmt.Sprintf("abeja-runner version: [%s] start download & serve.", version.Version))
-	return run(procCtx, &confDefault, true)
+	return run(procCtx, &confDefault, runOptions{download: true})
 }
 
 func teardownDefault(cmd *cobra.Command, args []string) {
@@ -109,8 +174,9 @@ func teardownDefault(cmd *cobra.Command, args []string) {
 func InitServeCommand(ctx context.Context) *cobra.Command {
 
 	cmdRoot := newCmdRoot(ctx)
-	cmdRoot.AddCommand(newCmdDownload()) // for download only
-	cmdRoot.AddCommand(newCmdRun())      // for run only
+	cmdRoot.AddCommand(newCmdDownload())  // for download only
+	cmdRoot.AddCommand(newCmdRun())       // for run only
+	cmdRoot.AddCommand(newCmdRedeliver()) // for redelivery of dead-letters
 
 	return cmdRoot
 }
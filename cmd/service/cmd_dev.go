@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"math"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	errors "golang.org/x/xerrors"
+
+	cmdutil "github.com/abeja-inc/abeja-platform-model-proxy/cmd/util"
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/version"
+)
+
+var confDev = config.NewConfiguration()
+
+func newCmdDev() *cobra.Command {
+	cmdDev := &cobra.Command{
+		Use:          "dev",
+		Short:        "run local model without platform credentials, and reload it on changes",
+		PreRunE:      setupDevConfiguration,
+		RunE:         execDev,
+		PostRun:      teardownDev,
+		SilenceUsage: true,
+	}
+
+	// bind options with viper
+	options := []func(*cobra.Command) error{
+		cmdutil.BindUserModelRoot,
+		cmdutil.BindRuntime,
+		cmdutil.BindPort,
+		cmdutil.BindHealthCheckPort,
+		cmdutil.BindRequestTimeout,
+		cmdutil.BindIPCProtocolVersion,
+		cmdutil.BindTrainingResultDir,
+	}
+	if err := cmdutil.BindOptions(cmdDev, options); err != nil {
+		// NOTE: This cobra/viper's error don't occur basically...
+		log.Warningf(
+			procCtx,
+			"unexpected error occurred when binding command line options: "+log.ErrorFormat,
+			err)
+	}
+
+	return cmdDev
+}
+
+func setupDevConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
+	if err := viper.Unmarshal(&confDev); err != nil {
+		return err
+	}
+	return validateDevConfiguration()
+}
+
+func validateDevConfiguration() error {
+	if err := cmdutil.ValidatePortNumber(confDev.Port); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateRequestTimeout(confDev.RequestTimeout); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateIPCProtocolVersion(confDev.IPCProtocolVersion); err != nil {
+		return err
+	}
+	if confDev.GetListenAddress() == confDev.GetHealthCheckAddress() {
+		return errors.New("port and healthcheck_port should be different value")
+	}
+	return nil
+}
+
+func execDev(cmd *cobra.Command, args []string) error {
+	log.Infof(procCtx, "abeja-runner version: [%s] start serving in dev mode.", version.Version)
+	// runtime with broken source code keeps restarting until it is fixed.
+	confDev.Workers = 1
+	confDev.MaxRestarts = math.MaxInt32
+	return run(procCtx, &confDev, runOptions{dev: true})
+}
+
+func teardownDev(cmd *cobra.Command, args []string) {
+	cleanutil.RemoveAll(procCtx, confDev.RequestedDataDir)
+}
+
+// InitDevCommand returns the command to run local model in development.
+func InitDevCommand(ctx context.Context) *cobra.Command {
+	procCtx = ctx
+	return newCmdDev()
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	cmdutil "github.com/abeja-inc/abeja-platform-model-proxy/cmd/util"
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+)
+
+func TestSetupDevConfiguration(t *testing.T) {
+
+	cases := []struct {
+		name          string
+		optionEnv     cmdutil.AllOptions
+		optionCmdLine cmdutil.AllOptions
+		hasError      bool
+		expects       cmdutil.AllOptions
+		errMsg        string
+	}{
+		{
+			name:          "no platform credentials",
+			optionEnv:     cmdutil.AllOptions{},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      false,
+			expects: cmdutil.AllOptions{
+				AbejaRuntime: config.DefaultRuntime,
+				Port:         config.DefaultHTTPListenPort,
+			},
+			errMsg: "",
+		}, {
+			name: "cmdline takes precedence",
+			optionEnv: cmdutil.AllOptions{
+				AbejaUserModelRoot: "/tmp/env",
+				Port:               8080,
+			},
+			optionCmdLine: cmdutil.AllOptions{
+				AbejaUserModelRoot: "/tmp/cmdline",
+				Port:               8081,
+			},
+			hasError: false,
+			expects: cmdutil.AllOptions{
+				AbejaRuntime:       config.DefaultRuntime,
+				AbejaUserModelRoot: "/tmp/cmdline",
+				Port:               8081,
+			},
+			errMsg: "",
+		}, {
+			name:      "same port as healthcheck_port",
+			optionEnv: cmdutil.AllOptions{},
+			optionCmdLine: cmdutil.AllOptions{
+				Port: config.DefaultHealthCheckListenPort,
+			},
+			hasError: true,
+			expects:  cmdutil.AllOptions{},
+			errMsg:   "Error: port and healthcheck_port should be different value",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cmdutil.CleanUp(t)
+			confDev = config.NewConfiguration()
+			cmdutil.SetOptionsToEnv(c.optionEnv)
+			cmdutil.SetOptionsToCmdline("", c.optionCmdLine)
+			cmdDev := InitDevCommand(context.TODO())
+			cmdDev.RunE = cmdutil.DummyRunEFunc
+			buf := new(bytes.Buffer)
+			cmdDev.SetOutput(buf)
+
+			err := cmdDev.Execute()
+			if err != nil {
+				if c.hasError {
+					get := buf.String()
+					if !strings.HasPrefix(get, c.errMsg) {
+						t.Fatalf("error message should be start with [%s], but [%s]", c.errMsg, get)
+					}
+					return
+				}
+				t.Fatalf("unexpected error occurred: %s", err.Error())
+			}
+			if c.hasError {
+				t.Fatal("error should be occurred")
+			}
+
+			if confDev.Runtime != c.expects.AbejaRuntime {
+				t.Errorf("AbejaRuntime should be %s, but %s", c.expects.AbejaRuntime, confDev.Runtime)
+			}
+			if confDev.UserModelRoot != c.expects.AbejaUserModelRoot {
+				t.Errorf("UserModelRoot should be %s, but %s", c.expects.AbejaUserModelRoot, confDev.UserModelRoot)
+			}
+			if confDev.Port != c.expects.Port {
+				t.Errorf("Port should be %d, but %d", c.expects.Port, confDev.Port)
+			}
+		})
+	}
+}
@@ -38,6 +38,8 @@ func newCmdDownload() *cobra.Command {
 		cmdutil.BindTrainingJobID,
 		cmdutil.BindTrainingJobDefinitionName,
 		cmdutil.BindTrainingResultDir,
+		cmdutil.BindModelCacheDir,
+		cmdutil.BindModelCacheMaxSize,
 	}
 	if err := cmdutil.BindOptions(cmdDownload, options); err != nil {
 		// NOTE: This cobra/viper's error don't occur basically...
@@ -48,6 +50,9 @@ func newCmdDownload() *cobra.Command {
 }
 
 func setupDownloadConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confDownload); err != nil {
 		return err
 	}
@@ -71,7 +76,7 @@ func validateDownloadConfiguration() error {
 	if len(notSetRequires) > 0 {
 		return errors.Errorf("require flag(s) %s not set", strings.Join(notSetRequires, ", "))
 	}
-	return nil
+	return cmdutil.ValidateModelCacheMaxSize(confDownload.ModelCacheMaxSize)
 }
 
 func execDownload(cmd *cobra.Command, args []string) error {
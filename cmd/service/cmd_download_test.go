@@ -276,6 +276,41 @@ func TestSetupDownloadConfiguration(t *testing.T) {
 				TrainingJobDefinitionName:   "5555555555555",
 			},
 			errMsg: "",
+		}, {
+			name: "model cache",
+			optionEnv: cmdutil.AllOptions{
+				AbejaOrganizationID: "1111111111111",
+				AbejaModelID:        "2222222222222",
+				AbejaModelVersionID: "3333333333333",
+				PlatformAuthToken:   "aaaaaaaaaa",
+				ModelCacheDir:       "/mnt/cache",
+				ModelCacheMaxSize:   512,
+			},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      false,
+			expects: cmdutil.AllOptions{
+				AbejaApiUrl:         "https://api.abeja.io",
+				AbejaOrganizationID: "1111111111111",
+				AbejaModelID:        "2222222222222",
+				AbejaModelVersionID: "3333333333333",
+				PlatformAuthToken:   "aaaaaaaaaa",
+				ModelCacheDir:       "/mnt/cache",
+				ModelCacheMaxSize:   512,
+			},
+			errMsg: "",
+		}, {
+			name: "model cache max size too small",
+			optionEnv: cmdutil.AllOptions{
+				AbejaOrganizationID: "1111111111111",
+				AbejaModelID:        "2222222222222",
+				AbejaModelVersionID: "3333333333333",
+				PlatformAuthToken:   "aaaaaaaaaa",
+				ModelCacheMaxSize:   -1,
+			},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      true,
+			expects:       cmdutil.AllOptions{},
+			errMsg:        "Error: model_cache_max_size [-1] must be greater than 0",
 		},
 	}
 
@@ -333,6 +368,12 @@ func TestSetupDownloadConfiguration(t *testing.T) {
 			if confDownload.TrainingJobDefinitionName != c.expects.TrainingJobDefinitionName {
 				t.Errorf("TrainingJobDefinitionName should be %s, but %s", c.expects.TrainingJobDefinitionName, confDownload.TrainingJobDefinitionName)
 			}
+			if confDownload.ModelCacheDir != c.expects.ModelCacheDir {
+				t.Errorf("ModelCacheDir should be %s, but %s", c.expects.ModelCacheDir, confDownload.ModelCacheDir)
+			}
+			if c.expects.ModelCacheMaxSize != 0 && confDownload.ModelCacheMaxSize != c.expects.ModelCacheMaxSize {
+				t.Errorf("ModelCacheMaxSize should be %d, but %d", c.expects.ModelCacheMaxSize, confDownload.ModelCacheMaxSize)
+			}
 		})
 	}
 }
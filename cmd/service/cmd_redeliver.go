@@ -0,0 +1,62 @@
+package service
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	errors "golang.org/x/xerrors"
+
+	cmdutil "github.com/abeja-inc/abeja-platform-model-proxy/cmd/util"
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/proxy"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/version"
+)
+
+var confRedeliver = config.NewConfiguration()
+
+func newCmdRedeliver() *cobra.Command {
+	cmdRedeliver := &cobra.Command{
+		Use:          "redeliver",
+		Short:        "redeliver results of async requests in dead-letter directory to ARMS",
+		PreRunE:      setupRedeliverConfiguration,
+		RunE:         execRedeliver,
+		SilenceUsage: true,
+	}
+
+	// bind options with viper
+	options := []func(*cobra.Command) error{
+		cmdutil.BindAbejaAPIURL,
+		cmdutil.BindPlatformAuthToken,
+		cmdutil.BindAsyncDeadLetterDir,
+		cmdutil.BindARMSMaxRetries,
+		cmdutil.BindCallbackSecret,
+	}
+	if err := cmdutil.BindOptions(cmdRedeliver, options); err != nil {
+		// NOTE: This cobra/viper's error don't occur basically...
+		log.Warningf(procCtx, "unexpected error occurred when binding command line options: "+log.ErrorFormat, err)
+	}
+
+	return cmdRedeliver
+}
+
+func setupRedeliverConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
+	if err := viper.Unmarshal(&confRedeliver); err != nil {
+		return err
+	}
+	return validateRedeliverConfiguration()
+}
+
+func validateRedeliverConfiguration() error {
+	if confRedeliver.AsyncDeadLetterDir == "" {
+		return errors.New("require flag(s) async_dead_letter_dir not set")
+	}
+	return cmdutil.ValidateARMSMaxRetries(confRedeliver.ARMSMaxRetries)
+}
+
+func execRedeliver(cmd *cobra.Command, args []string) error {
+	log.Infof(procCtx, "abeja-runner version: [%s] start redelivering async results.", version.Version)
+	return proxy.RedeliverDeadLetters(procCtx, &confRedeliver, cmd.OutOrStdout())
+}
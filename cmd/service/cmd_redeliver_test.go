@@ -0,0 +1,105 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+
+	cmdutil "github.com/abeja-inc/abeja-platform-model-proxy/cmd/util"
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+)
+
+func TestSetupRedeliverConfiguration(t *testing.T) {
+
+	cases := []struct {
+		name          string
+		optionEnv     cmdutil.AllOptions
+		optionCmdLine cmdutil.AllOptions
+		hasError      bool
+		expects       cmdutil.AllOptions
+	}{
+		{
+			name:          "missing dead-letter directory",
+			optionEnv:     cmdutil.AllOptions{},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      true,
+			expects:       cmdutil.AllOptions{},
+		}, {
+			name: "env",
+			optionEnv: cmdutil.AllOptions{
+				AbejaApiUrl:        "http://localhost:8080",
+				PlatformAuthToken:  "aaaaaaaaaa",
+				AsyncDeadLetterDir: "/tmp/env",
+			},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      false,
+			expects: cmdutil.AllOptions{
+				AbejaApiUrl:        "http://localhost:8080",
+				PlatformAuthToken:  "aaaaaaaaaa",
+				AsyncDeadLetterDir: "/tmp/env",
+				ArmsMaxRetries:     config.DefaultARMSMaxRetries,
+			},
+		}, {
+			name: "cmdline takes precedence",
+			optionEnv: cmdutil.AllOptions{
+				AsyncDeadLetterDir: "/tmp/env",
+				ArmsMaxRetries:     2,
+			},
+			optionCmdLine: cmdutil.AllOptions{
+				AsyncDeadLetterDir: "/tmp/cmdline",
+				ArmsMaxRetries:     3,
+			},
+			hasError: false,
+			expects: cmdutil.AllOptions{
+				AbejaApiUrl:        config.DefaultAbejaAPIURL,
+				AsyncDeadLetterDir: "/tmp/cmdline",
+				ArmsMaxRetries:     3,
+			},
+		}, {
+			name:      "negative retries",
+			optionEnv: cmdutil.AllOptions{},
+			optionCmdLine: cmdutil.AllOptions{
+				AsyncDeadLetterDir: "/tmp/cmdline",
+				ArmsMaxRetries:     -1,
+			},
+			hasError: true,
+			expects:  cmdutil.AllOptions{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cmdutil.CleanUp(t)
+			confRedeliver = config.NewConfiguration()
+			cmdutil.SetOptionsToEnv(c.optionEnv)
+			cmdutil.SetOptionsToCmdline("redeliver", c.optionCmdLine)
+			cmdRedeliver := newCmdRedeliver()
+			cmdRedeliver.RunE = cmdutil.DummyRunEFunc
+			buf := new(bytes.Buffer)
+			cmdRedeliver.SetOutput(buf)
+
+			err := cmdRedeliver.Execute()
+			if err != nil {
+				if c.hasError {
+					return
+				}
+				t.Fatalf("unexpected error occurred: %s", err.Error())
+			}
+			if c.hasError {
+				t.Fatal("error should be occurred")
+			}
+
+			if confRedeliver.APIURL != c.expects.AbejaApiUrl {
+				t.Errorf("AbejaApiUrl should be %s, but %s", c.expects.AbejaApiUrl, confRedeliver.APIURL)
+			}
+			if confRedeliver.PlatformAuthToken != c.expects.PlatformAuthToken {
+				t.Errorf("PlatformAuthToken should be %s, but %s", c.expects.PlatformAuthToken, confRedeliver.PlatformAuthToken)
+			}
+			if confRedeliver.AsyncDeadLetterDir != c.expects.AsyncDeadLetterDir {
+				t.Errorf("AsyncDeadLetterDir should be %s, but %s", c.expects.AsyncDeadLetterDir, confRedeliver.AsyncDeadLetterDir)
+			}
+			if confRedeliver.ARMSMaxRetries != c.expects.ArmsMaxRetries {
+				t.Errorf("ARMSMaxRetries should be %d, but %d", c.expects.ArmsMaxRetries, confRedeliver.ARMSMaxRetries)
+			}
+		})
+	}
+}
@@ -35,7 +35,23 @@ func newCmdRun() *cobra.Command {
 		cmdutil.BindRuntime,
 		cmdutil.BindPort,
 		cmdutil.BindHealthCheckPort,
+		cmdutil.BindWorkers,
+		cmdutil.BindMaxRestarts,
+		cmdutil.BindRequestTimeout,
+		cmdutil.BindStartupTimeout,
+		cmdutil.BindIPCProtocolVersion,
 		cmdutil.BindTrainingResultDir,
+		cmdutil.BindCaptureDir,
+		cmdutil.BindCaptureSampleRate,
+		cmdutil.BindCaptureMaxSize,
+		cmdutil.BindQueueMaxDepth,
+		cmdutil.BindQueueMaxWait,
+		cmdutil.BindDynamicBatchMaxSize,
+		cmdutil.BindDynamicBatchMaxLatency,
+		cmdutil.BindAsyncJournalDir,
+		cmdutil.BindAsyncDeadLetterDir,
+		cmdutil.BindARMSMaxRetries,
+		cmdutil.BindCallbackSecret,
 	}
 	if err := cmdutil.BindOptions(cmdRun, options); err != nil {
 		// NOTE: This cobra/viper's error don't occur basically...
@@ -49,6 +65,9 @@ func newCmdRun() *cobra.Command {
 }
 
 func setupRunConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confRun); err != nil {
 		return err
 	}
@@ -59,6 +78,42 @@ func validateRunConfiguration() error {
 	if err := cmdutil.ValidatePortNumber(confRun.Port); err != nil {
 		return err
 	}
+	if err := cmdutil.ValidateWorkers(confRun.Workers); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateMaxRestarts(confRun.MaxRestarts); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateRequestTimeout(confRun.RequestTimeout); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateStartupTimeout(confRun.StartupTimeout); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateIPCProtocolVersion(confRun.IPCProtocolVersion); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateCaptureSampleRate(confRun.CaptureSampleRate); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateCaptureMaxSize(confRun.CaptureMaxSize); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateQueueMaxDepth(confRun.QueueMaxDepth); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateQueueMaxWait(confRun.QueueMaxWait); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateDynamicBatchMaxSize(confRun.DynamicBatchMaxSize); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateDynamicBatchMaxLatency(confRun.DynamicBatchMaxLatency); err != nil {
+		return err
+	}
+	if err := cmdutil.ValidateARMSMaxRetries(confRun.ARMSMaxRetries); err != nil {
+		return err
+	}
 	if confRun.ServiceID != "" {
 		if confRun.OrganizationID == "" || confRun.DeploymentID == "" {
 			return errors.New(
@@ -73,7 +128,7 @@ func validateRunConfiguration() error {
 
 func execRun(cmd *cobra.Command, args []string) error {
 	log.Infof(procCtx, "abeja-runner version: [%s] start serving.", version.Version)
-	return run(procCtx, &confRun, false)
+	return run(procCtx, &confRun, runOptions{})
 }
 
 func teardownRun(cmd *cobra.Command, args []string) {
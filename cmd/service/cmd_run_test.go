@@ -27,6 +27,8 @@ func TestSetupRunConfiguration(t *testing.T) {
 			expects: cmdutil.AllOptions{
 				AbejaRuntime: config.DefaultRuntime,
 				Port:         config.DefaultHTTPListenPort,
+				Workers:      config.DefaultWorkers,
+				MaxRestarts:  config.DefaultMaxRestarts,
 			},
 			errMsg: "",
 		}, {
@@ -34,12 +36,14 @@ func TestSetupRunConfiguration(t *testing.T) {
 			optionEnv: cmdutil.AllOptions{
 				AbejaRuntime: "golang",
 				Port:         8080,
+				Workers:      2,
 			},
 			optionCmdLine: cmdutil.AllOptions{},
 			hasError:      false,
 			expects: cmdutil.AllOptions{
 				AbejaRuntime: "golang",
 				Port:         8080,
+				Workers:      2,
 			},
 			errMsg: "",
 		}, {
@@ -48,11 +52,13 @@ func TestSetupRunConfiguration(t *testing.T) {
 			optionCmdLine: cmdutil.AllOptions{
 				AbejaRuntime: "golang",
 				Port:         8080,
+				Workers:      3,
 			},
 			hasError: false,
 			expects: cmdutil.AllOptions{
 				AbejaRuntime: "golang",
 				Port:         8080,
+				Workers:      3,
 			},
 			errMsg: "",
 		}, {
@@ -60,15 +66,18 @@ func TestSetupRunConfiguration(t *testing.T) {
 			optionEnv: cmdutil.AllOptions{
 				AbejaRuntime: "golang",
 				Port:         8080,
+				Workers:      2,
 			},
 			optionCmdLine: cmdutil.AllOptions{
 				AbejaRuntime: "python27",
 				Port:         8081,
+				Workers:      4,
 			},
 			hasError: false,
 			expects: cmdutil.AllOptions{
 				AbejaRuntime: "python27",
 				Port:         8081,
+				Workers:      4,
 			},
 			errMsg: "",
 		}, {
@@ -89,6 +98,24 @@ func TestSetupRunConfiguration(t *testing.T) {
 			hasError:      true,
 			expects:       cmdutil.AllOptions{},
 			errMsg:        "Error: port [65536] must be greater than 1023 and less than 65536",
+		}, {
+			name:      "workers too small",
+			optionEnv: cmdutil.AllOptions{},
+			optionCmdLine: cmdutil.AllOptions{
+				Workers: -1,
+			},
+			hasError: true,
+			expects:  cmdutil.AllOptions{},
+			errMsg:   "Error: workers [-1] must be greater than 0",
+		}, {
+			name: "negative max_restarts",
+			optionEnv: cmdutil.AllOptions{
+				MaxRestarts: -1,
+			},
+			optionCmdLine: cmdutil.AllOptions{},
+			hasError:      true,
+			expects:       cmdutil.AllOptions{},
+			errMsg:        "Error: max_restarts [-1] must not be negative",
 		},
 	}
 
@@ -126,6 +153,32 @@ func TestSetupRunConfiguration(t *testing.T) {
 			if confRun.Port != c.expects.Port {
 				t.Errorf("Port should be %d, but %d", c.expects.Port, confRun.Port)
 			}
+			if confRun.Workers != c.expects.Workers {
+				t.Errorf("Workers should be %d, but %d", c.expects.Workers, confRun.Workers)
+			}
+			if c.expects.MaxRestarts != 0 && confRun.MaxRestarts != c.expects.MaxRestarts {
+				t.Errorf("MaxRestarts should be %d, but %d", c.expects.MaxRestarts, confRun.MaxRestarts)
+			}
 		})
 	}
 }
+
+func TestSetupRunConfiguration_SharedKeys(t *testing.T) {
+	cmdutil.CleanUp(t)
+	confRun = config.NewConfiguration()
+	cmdutil.SetOptionsToCmdline("run", cmdutil.AllOptions{RequestTimeout: -1})
+	cmdRun := newCmdRun()
+	cmdRun.RunE = cmdutil.DummyRunEFunc
+	// dev binds the same keys as run after it, as the root command does.
+	newCmdDev()
+	buf := new(bytes.Buffer)
+	cmdRun.SetOutput(buf)
+
+	if err := cmdRun.Execute(); err == nil {
+		t.Fatal("request_timeout of run should be used, but it's ignored")
+	}
+	errMsg := "Error: request_timeout [-1] must be positive"
+	if get := buf.String(); !strings.HasPrefix(get, errMsg) {
+		t.Fatalf("error message should be start with [%s], but [%s]", errMsg, get)
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/watch"
+)
+
+// dumpBodyLimit is the max bytes of body to print.
+const dumpBodyLimit = 2048
+
+// watchInterval is the interval to poll source code in dev mode.
+var watchInterval = 1 * time.Second
+
+// watchSources reloads runtimes each time source code under dir is changed, until stop is closed.
+func watchSources(
+	ctx context.Context,
+	dir string,
+	excludes []string,
+	supervisors []*subprocess.Supervisor,
+	stop <-chan int) {
+
+	watcher, err := watch.NewWatcher(dir, watchInterval, excludes...)
+	if err != nil {
+		log.Warningf(ctx, "failed to watch source code, runtime isn't reloaded on changes: "+log.ErrorFormat, err)
+		return
+	}
+	log.Infof(ctx, "watching source code in %s.", dir)
+	watcher.Run(stop, func(paths []string) {
+		log.Infof(ctx, "%d file(s) changed (%s), reload runtime.", len(paths), strings.Join(paths, ", "))
+		for _, supervisor := range supervisors {
+			supervisor.Reload(ctx)
+		}
+	})
+}
+
+// dumpHandler prints each request and response in readable form.
+type dumpHandler struct {
+	handler http.Handler
+	out     io.Writer
+	mu      sync.Mutex
+}
+
+func newDumpHandler(handler http.Handler, out io.Writer) *dumpHandler {
+	return &dumpHandler{handler: handler, out: out}
+}
+
+func (h *dumpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health_check" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	start := time.Now()
+
+	// read head of body to print, and pass the whole body to the handler.
+	head := make([]byte, dumpBodyLimit+1)
+	n, _ := io.ReadFull(r.Body, head)
+	head = head[:n]
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+	dw := &dumpResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	h.handler.ServeHTTP(dw, r)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, ">>> %s %s\n", r.Method, r.URL.RequestURI())
+	writeHeaders(&buf, r.Header)
+	writeBody(&buf, r.Header.Get("Content-Type"), head, r.ContentLength)
+	fmt.Fprintf(&buf, "<<< %d %s (%s)\n",
+		dw.status, http.StatusText(dw.status), time.Since(start).Round(time.Millisecond))
+	writeHeaders(&buf, w.Header())
+	writeBody(&buf, w.Header().Get("Content-Type"), dw.head.Bytes(), dw.written)
+	buf.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, _ = buf.WriteTo(h.out)
+}
+
+// dumpResponseWriter keeps status code and head of body of response.
+type dumpResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	head    bytes.Buffer
+	written int64
+}
+
+func (w *dumpResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *dumpResponseWriter) Write(b []byte) (int, error) {
+	if rest := dumpBodyLimit + 1 - w.head.Len(); rest > 0 {
+		if rest > len(b) {
+			rest = len(b)
+		}
+		w.head.Write(b[:rest])
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *dumpResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func writeHeaders(buf *bytes.Buffer, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.Join(header[key], ", ")
+		if key == "Authorization" {
+			value = "xxxxxxxxxx"
+		}
+		fmt.Fprintf(buf, "%s: %s\n", key, value)
+	}
+}
+
+// writeBody writes body as text if it is printable, otherwise only its size.
+// size is -1 when it is unknown.
+func writeBody(buf *bytes.Buffer, contentType string, head []byte, size int64) {
+	if len(head) == 0 {
+		return
+	}
+	truncated := len(head) > dumpBodyLimit
+	if truncated {
+		head = head[:dumpBodyLimit]
+	}
+	if !isText(contentType, head) {
+		if size < 0 {
+			fmt.Fprintf(buf, "(binary body of %s)\n", contentType)
+		} else {
+			fmt.Fprintf(buf, "(binary body of %s, %d bytes)\n", contentType, size)
+		}
+		return
+	}
+	buf.Write(head)
+	if truncated {
+		buf.WriteString("... (truncated)")
+	}
+	buf.WriteString("\n")
+}
+
+func isText(contentType string, body []byte) bool {
+	if strings.HasPrefix(contentType, "multipart/") {
+		return false
+	}
+	// the last rune may be cut by the limit.
+	for i := 0; i < utf8.UTFMax-1 && len(body) > 0 && !utf8.Valid(body); i++ {
+		body = body[:len(body)-1]
+	}
+	return utf8.Valid(body) && !bytes.ContainsRune(body, 0)
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDumpHandler(t *testing.T) {
+	var received string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"result": "ok"}`))
+	})
+	var out bytes.Buffer
+	dump := newDumpHandler(handler, &out)
+
+	longBody := `{"text": "` + strings.Repeat("a", dumpBodyLimit) + `"}`
+	req := httptest.NewRequest("POST", "/?q=1", strings.NewReader(longBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	dump.ServeHTTP(rec, req)
+
+	if received != longBody {
+		t.Error("whole body should be passed to the handler")
+	}
+	if rec.Code != http.StatusCreated || rec.Body.String() != `{"result": "ok"}` {
+		t.Errorf("response should be passed to the client, but %d %s", rec.Code, rec.Body.String())
+	}
+	dumped := out.String()
+	for _, expect := range []string{
+		">>> POST /?q=1\n",
+		"Authorization: xxxxxxxxxx\n",
+		"... (truncated)\n",
+		"<<< 201 Created (",
+		"{\"result\": \"ok\"}\n",
+	} {
+		if !strings.Contains(dumped, expect) {
+			t.Errorf("dump should contain [%s], but\n%s", expect, dumped)
+		}
+	}
+	if strings.Contains(dumped, "secret") {
+		t.Errorf("credential should not be printed, but\n%s", dumped)
+	}
+
+	out.Reset()
+	req = httptest.NewRequest("POST", "/", bytes.NewReader([]byte{0x89, 'P', 'N', 'G', 0x00, 0x01}))
+	req.Header.Set("Content-Type", "image/png")
+	dump.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(out.String(), "(binary body of image/png, 6 bytes)\n") {
+		t.Errorf("binary body should be printed as its size, but\n%s", out.String())
+	}
+}
@@ -21,9 +21,19 @@ import (
 	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
 )
 
+// runOptions changes the behavior of run.
+type runOptions struct {
+	download bool // download model and training-result before starting runtime
+	dev      bool // print requests and responses, and reload runtime on changes of source code
+}
+
+// asyncDeliveryWaitMax is the max time to wait for delivering results of async requests on shutdown.
+const asyncDeliveryWaitMax = 25 * time.Second
+
 var (
-	runtime    *subprocess.Runtime
-	httpServer *proxy.HTTPServer
+	runtimes       *subprocess.RuntimePool
+	httpServer     *proxy.HTTPServer
+	errOnBootClose sync.Once
 )
 
 func shutdownHTTPServer(ctx context.Context) {
@@ -35,8 +45,8 @@ func shutdownHTTPServer(ctx context.Context) {
 }
 
 func shutdownRuntime(ctx context.Context) {
-	if runtime != nil {
-		runtime.Shutdown(ctx, 25*time.Second)
+	if runtimes != nil {
+		runtimes.Shutdown(ctx, 25*time.Second)
 	}
 }
 
@@ -62,10 +72,18 @@ func shutdownServices(ctx context.Context, skipRuntime bool) {
 }
 
 func shutdownOnError(ctx context.Context, errOnBoot chan int, err error) {
-	defer close(errOnBoot)
+	defer closeErrOnBoot(errOnBoot)
 	log.Errorf(ctx, "unexpected error occurred: "+log.ErrorFormat, err)
 }
 
+// closeErrOnBoot closes errOnBoot only once,
+// because it may be notified from several workers at the same time.
+func closeErrOnBoot(errOnBoot chan int) {
+	errOnBootClose.Do(func() {
+		close(errOnBoot)
+	})
+}
+
 func download(ctx context.Context, conf *config.Configuration) error {
 	preprocessor, err := preprocess.NewPreprocessor(ctx, conf)
 	if err != nil {
@@ -106,7 +124,7 @@ func handleSignal(
 				return
 			case sig := <-gracefulStop:
 				log.Infof(ctx, "signal[%s] received.", sig.String())
-				close(errOnBoot)
+				closeErrOnBoot(errOnBoot)
 				return
 			case err, received := <-errOnSub:
 				if received {
@@ -115,8 +133,8 @@ func handleSignal(
 				}
 				return
 			default:
-				if runtime != nil {
-					if runtime.IsExited(ctx) {
+				if runtimes != nil {
+					if runtimes.IsExited(ctx) {
 						skipRuntime = true
 						return
 					}
@@ -131,13 +149,18 @@ func handleSignal(
 	close(notifyFromMain)
 	<-notifyToMain
 
+	// results of async requests are delivered from files in dataDir,
+	// so it is removed after the deliveries finished or were moved into dead-letter directory.
+	if !proxy.WaitAsyncDeliveries(asyncDeliveryWaitMax) {
+		log.Warning(ctx, "async results were still being delivered, so they are given up and kept in dead-letter directory if it is set.")
+	}
 	cleanutil.RemoveAll(ctx, dataDir)
 
 	log.Debug(ctx, "runtime finished")
 
 	// exit with subprocess status
-	if status == 0 && runtime != nil {
-		if runtime.Status == subprocess.RuntimeStatusExitedWithSuccess {
+	if status == 0 && runtimes != nil {
+		if runtimes.Status() == subprocess.RuntimeStatusExitedWithSuccess {
 			status = 0
 		} else {
 			status = 1
@@ -147,7 +170,45 @@ func handleSignal(
 	exitStatus <- status
 }
 
-func run(ctx context.Context, conf *config.Configuration, execDownload bool) error {
+// startTransports starts transporting messages between users and each runtime.
+// All transports read requests from the same channel, so that a request is
+// dispatched to an idle runtime. A transport reads requests only while it's connected to
+// its runtime which is ready, so requests aren't dispatched to runtimes starting or restarting.
+// notifyToMain is closed after all transports finished.
+func startTransports(
+	ctx context.Context,
+	conf *config.Configuration,
+	supervisors []*subprocess.Supervisor,
+	request <-chan entity.ContentList,
+	errOnBoot chan int,
+	notifyFromMain chan int,
+	notifyToMain chan int,
+	scopeChans []chan subprocess.LogScope) {
+
+	var wg sync.WaitGroup
+	for i, supervisor := range supervisors {
+		errOnDial := make(chan int)
+		finished := make(chan int)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-errOnDial:
+				closeErrOnBoot(errOnBoot)
+			case <-finished:
+			}
+		}()
+		go proxy.TransportMessages(
+			ctx, conf, supervisor.SocketPath(), supervisor, request,
+			errOnDial, notifyFromMain, finished, scopeChans[i], nil)
+	}
+	go func() {
+		wg.Wait()
+		close(notifyToMain)
+	}()
+}
+
+func run(ctx context.Context, conf *config.Configuration, opts runOptions) error {
 
 	workingDir, err := conf.GetWorkingDir()
 	if err != nil {
@@ -162,26 +223,37 @@ func run(ctx context.Context, conf *config.Configuration, execDownload bool) err
 		return errors.Errorf(": %w", err)
 	}
 
-	udsFilePath, err := cmdutil.MakeUDSFilePath()
-	if err != nil {
-		log.Fatalf(
-			ctx,
-			"failed to build path to socket file for communication to runtime: "+log.ErrorFormat,
-			err)
-		return errors.Errorf(": %w", err)
-	}
-	defer cleanutil.RemoveAll(ctx, filepath.Dir(udsFilePath))
-
 	trainingResultDir, err := conf.GetTrainingResultDir()
 	if err != nil {
 		log.Fatalf(ctx, "failed to get path for training-result: "+log.ErrorFormat, err)
 		return errors.Errorf(": %w", err)
 	}
-	runtime, err = subprocess.CreateServiceRuntime(conf, udsFilePath, trainingResultDir)
-	if err != nil {
-		log.Fatalf(ctx, "failed to CreateServiceRuntime: "+log.ErrorFormat, err)
-		return errors.Errorf(": %w", err)
+
+	// each worker has its own runtime and socket file.
+	// the runtime is restarted by supervisor when it crashed.
+	supervisors := make([]*subprocess.Supervisor, conf.Workers)
+	for i := range supervisors {
+		udsFilePath, err := cmdutil.MakeUDSFilePath()
+		if err != nil {
+			log.Fatalf(
+				ctx,
+				"failed to build path to socket file for communication to runtime: "+log.ErrorFormat,
+				err)
+			return errors.Errorf(": %w", err)
+		}
+		defer cleanutil.RemoveAll(ctx, filepath.Dir(udsFilePath))
+
+		createRuntime := func() (*subprocess.Runtime, error) {
+			return subprocess.CreateServiceRuntime(conf, udsFilePath, trainingResultDir)
+		}
+		supervisors[i], err = subprocess.NewSupervisor(createRuntime, udsFilePath, conf.MaxRestarts)
+		if err != nil {
+			log.Fatalf(ctx, "failed to CreateServiceRuntime: "+log.ErrorFormat, err)
+			return errors.Errorf(": %w", err)
+		}
+		supervisors[i].SetStartupTimeout(conf.GetStartupTimeout())
 	}
+	runtimes = subprocess.NewRuntimePool(supervisors...)
 
 	// trap signals
 	errOnBoot := make(chan int)
@@ -198,19 +270,20 @@ func run(ctx context.Context, conf *config.Configuration, execDownload bool) err
 		ctx, conf.RequestedDataDir, errOnBoot, exitStatus, errOnSub, notifyFromMain, notifyToMain)
 
 	// prepare & start web server
-	request := make(chan entity.ContentList, 10000)
-	response := make(chan entity.Response)
-	// defer close(request) // <- close clearly in shutdown process
-	defer close(response)
+	queue := proxy.NewRequestQueue(conf)
+	// defer queue.Close() // <- close clearly in shutdown process
 
-	httpServer, err = proxy.CreateHTTPServer(runtime, request, response, conf)
+	httpServer, err = proxy.CreateHTTPServer(runtimes, queue, conf)
 	if err != nil {
 		shutdownOnError(ctx, errOnBoot, err)
 		return errors.Errorf(": %w", err)
 	}
+	if opts.dev {
+		httpServer.Server.Handler = newDumpHandler(httpServer.Server.Handler, os.Stdout)
+	}
 	go httpServer.ListenAndServe(ctx, errOnBoot)
 
-	if execDownload {
+	if opts.download {
 		err := download(ctx, conf)
 		if err != nil {
 			shutdownOnError(ctx, errOnBoot, err)
@@ -219,27 +292,28 @@ func run(ctx context.Context, conf *config.Configuration, execDownload bool) err
 	}
 
 	// subprocess logger
-	scopeChan := make(chan context.Context)
-	defer close(scopeChan)
-	runtimeLogger := subprocess.NewRuntimeLogger(ctx, runtime.Cmd, scopeChan)
+	scopeChans := make([]chan subprocess.LogScope, len(supervisors))
+	for i, supervisor := range supervisors {
+		scopeChans[i] = make(chan subprocess.LogScope)
+		defer close(scopeChans[i])
+		runtimeLogger := supervisor.AttachLogger(ctx, scopeChans[i])
+		defer runtimeLogger.Flush(3) // wait 3 seconds for flush all logs.
+	}
 
 	// start runtime
-	if err = runtime.Start(errOnSub); err != nil {
+	if err = runtimes.Start(ctx, errOnSub); err != nil {
 		shutdownOnError(ctx, errOnBoot, err)
 		return errors.Errorf(": %w", err)
 	}
 
-	runtimeLogger.Run()
-	defer runtimeLogger.Flush(3) // wait 3 seconds for flush all logs.
+	// transports connect to runtime once it listens on the socket, and mark it ready.
+	startTransports(ctx, conf, supervisors, queue.Out(), errOnBoot, notifyFromMain, notifyToMain, scopeChans)
 
-	if err = runtime.WaitUntilStarted(ctx, udsFilePath); err != nil {
-		shutdownOnError(ctx, errOnBoot, err)
-		return errors.Errorf(": %w", err)
+	if opts.dev {
+		go watchSources(
+			ctx, workingDir, []string{trainingResultDir, conf.CaptureDir}, supervisors, notifyFromMain)
 	}
 
-	// connect to runtime after runtime started.
-	go proxy.TransportMessages(ctx, conf, udsFilePath, request, response, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
-
 	handledStatus := <-exitStatus
 	if handledStatus > 0 {
 		return errors.New("failed to finalize")
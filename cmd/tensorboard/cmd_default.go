@@ -49,6 +49,9 @@ func newCmdRoot(ctx context.Context) *cobra.Command {
 }
 
 func setupDefaultConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confDefault); err != nil {
 		return err
 	}
@@ -44,6 +44,9 @@ func newCmdDownload() *cobra.Command {
 }
 
 func setupDownloadConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confDownload); err != nil {
 		return errors.Errorf(": %w", err)
 	}
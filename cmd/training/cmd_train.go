@@ -46,6 +46,9 @@ func newCmdTrain() *cobra.Command {
 }
 
 func setupTrainConfiguration(cmd *cobra.Command, args []string) error {
+	if err := cmdutil.RebindOptions(cmd); err != nil {
+		return err
+	}
 	if err := viper.Unmarshal(&confTrain); err != nil {
 		return err
 	}
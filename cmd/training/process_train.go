@@ -133,7 +133,7 @@ func Train(ctx context.Context, conf *config.Configuration) error {
 	}
 
 	// subprocess logger
-	scopeChan := make(chan context.Context)
+	scopeChan := make(chan subprocess.LogScope)
 	runtimeLogger := subprocess.NewRuntimeLogger(ctx, runtime.Cmd, scopeChan)
 
 	if err = runtime.Start(subChan); err != nil {
@@ -2,12 +2,16 @@ package util
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	pathutil "github.com/abeja-inc/abeja-platform-model-proxy/util/path"
 )
 
+// viperKeyAnnotation is the annotation of flag which holds the key of viper bound to it.
+const viperKeyAnnotation = "viper_key"
+
 func bindLocalIntOption(
 	cmd *cobra.Command,
 	flagKey string,
@@ -23,7 +27,7 @@ func bindLocalIntOption(
 	if err := viper.BindPFlag(viperKey, cmd.Flags().Lookup(flagKey)); err != nil {
 		return err
 	}
-	return nil
+	return cmd.Flags().SetAnnotation(flagKey, viperKeyAnnotation, []string{viperKey})
 }
 
 func bindLocalStringOption(
@@ -41,7 +45,7 @@ func bindLocalStringOption(
 	if err := viper.BindPFlag(viperKey, cmd.Flags().Lookup(flagKey)); err != nil {
 		return err
 	}
-	return nil
+	return cmd.Flags().SetAnnotation(flagKey, viperKeyAnnotation, []string{viperKey})
 }
 
 func BindAbejaAPIURL(cmd *cobra.Command) error {
@@ -175,16 +179,205 @@ func BindHealthCheckPort(cmd *cobra.Command) error {
 		"listen port of health check", "HealthCheckPort", "HEALTHCHECK_PORT")
 }
 
+func BindGRPCPort(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "grpc_port", 0,
+		"listen port of gRPC server (0 means disabled)", "GRPCPort", "GRPC_PORT")
+}
+
+func BindWorkers(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "workers", config.DefaultWorkers,
+		"number of runtime processes behind the service port", "Workers", "WORKERS")
+}
+
+func BindMaxRestarts(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "max_restarts", config.DefaultMaxRestarts,
+		"number of times to restart crashed runtime", "MaxRestarts", "MAX_RESTARTS")
+}
+
+func BindRequestTimeout(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "request_timeout", config.DefaultRequestTimeout,
+		"timeout seconds of inference per request, which is also the upper limit of x-abeja-request-timeout",
+		"RequestTimeout", "REQUEST_TIMEOUT")
+}
+
+func BindStartupTimeout(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "startup_timeout", config.DefaultStartupTimeout,
+		"max seconds for runtime to get ready after it started (0 means no limit)",
+		"StartupTimeout", "STARTUP_TIMEOUT")
+}
+
+func BindIPCProtocolVersion(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "ipc_protocol_version", config.DefaultIPCProtocolVersion,
+		"version of IPC protocol which runtime speaks "+
+			"(2 requires runtime which replies HELLO from the proxy)",
+		"IPCProtocolVersion", "IPC_PROTOCOL_VERSION")
+}
+
+func BindCaptureDir(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "capture_dir", "", "directory to capture requests and responses (empty means disabled)",
+		"CaptureDir", "CAPTURE_DIR")
+}
+
+func BindCaptureSampleRate(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "capture_sample_rate", config.DefaultCaptureSampleRate,
+		"percentage of requests to capture", "CaptureSampleRate", "CAPTURE_SAMPLE_RATE")
+}
+
+func BindCaptureMaxSize(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "capture_max_size", config.DefaultCaptureMaxSize,
+		"max size of capture directory in megabytes", "CaptureMaxSize", "CAPTURE_MAX_SIZE")
+}
+
+func BindQueueMaxDepth(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "queue_max_depth", config.DefaultQueueMaxDepth,
+		"max number of requests waiting for runtime", "QueueMaxDepth", "QUEUE_MAX_DEPTH")
+}
+
+func BindQueueMaxWait(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "queue_max_wait", config.DefaultQueueMaxWait,
+		"max seconds of requests waiting for runtime (0 means no limit)",
+		"QueueMaxWait", "QUEUE_MAX_WAIT")
+}
+
+func BindDynamicBatchMaxSize(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "dynamic_batch_max_size", config.DefaultDynamicBatchMaxSize,
+		"max number of requests sent to runtime in a batch (1 means disabled)",
+		"DynamicBatchMaxSize", "DYNAMIC_BATCH_MAX_SIZE")
+}
+
+func BindDynamicBatchMaxLatency(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "dynamic_batch_max_latency", config.DefaultDynamicBatchMaxLatency,
+		"max milliseconds to wait for requests to be batched together",
+		"DynamicBatchMaxLatency", "DYNAMIC_BATCH_MAX_LATENCY")
+}
+
+func BindAsyncJournalDir(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "async_journal_dir", "",
+		"directory to persist async requests across restarts (empty means disabled)",
+		"AsyncJournalDir", "ASYNC_JOURNAL_DIR")
+}
+
+func BindAsyncDeadLetterDir(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "async_dead_letter_dir", "",
+		"directory to keep async results failed to be delivered (empty means disabled)",
+		"AsyncDeadLetterDir", "ASYNC_DEAD_LETTER_DIR")
+}
+
+func BindARMSMaxRetries(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "arms_max_retries", config.DefaultARMSMaxRetries,
+		"number of times to retry delivering async result to ARMS", "ARMSMaxRetries", "ARMS_MAX_RETRIES")
+}
+
+func BindCallbackSecret(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "callback_secret", "",
+		"secret to sign results of async requests sent to callback url (empty means callback is disabled)",
+		"CallbackSecret", "CALLBACK_SECRET")
+}
+
 func BindInput(cmd *cobra.Command) error {
 	return bindLocalStringOption(
 		cmd, "input", "", "input data", "Input", "INPUT")
 }
 
+func BindManifest(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "manifest", "", "JSONL file or directory of inputs of batch, used instead of input",
+		"Manifest", "MANIFEST")
+}
+
+func BindBatchConcurrency(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "batch_concurrency", config.DefaultBatchConcurrency,
+		"number of inputs in manifest processed at the same time", "BatchConcurrency", "BATCH_CONCURRENCY")
+}
+
+func BindBatchCheckpoint(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "batch_checkpoint", "",
+		"file to record progress of manifest, to skip succeeded inputs on resume (empty means disabled)",
+		"BatchCheckpoint", "BATCH_CHECKPOINT")
+}
+
+func BindBatchReport(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "batch_report", "", "file to write summary report of manifest",
+		"BatchReport", "BATCH_REPORT")
+}
+
 func BindOutput(cmd *cobra.Command) error {
 	return bindLocalStringOption(
 		cmd, "output", "", "destination information of output", "Output", "OUTPUT")
 }
 
+func BindOutputFileName(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "output_file_name", config.DefaultOutputFileName,
+		"template of file name of output, which can refer to RunID, Index, Ext, InputName, InputBase and Metadata",
+		"OutputFileName", "OUTPUT_FILE_NAME")
+}
+
+func BindS3Endpoint(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "s3_endpoint", "", "endpoint of S3-compatible storage for output (empty means AWS S3)",
+		"S3Endpoint", "S3_ENDPOINT")
+}
+
+func BindS3Region(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "s3_region", config.DefaultS3Region, "region of S3 for output",
+		"S3Region", "S3_REGION")
+}
+
+func BindS3AccessKeyID(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "s3_access_key_id", "", "access key ID of S3 for output",
+		"S3AccessKeyID", "S3_ACCESS_KEY_ID")
+}
+
+func BindS3SecretAccessKey(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "s3_secret_access_key", "", "secret access key of S3 for output",
+		"S3SecretAccessKey", "S3_SECRET_ACCESS_KEY")
+}
+
+func BindModelCacheDir(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "model_cache_dir", "",
+		"directory to cache downloaded models across restarts, shared by runners on the node (empty means disabled)",
+		"ModelCacheDir", "MODEL_CACHE_DIR")
+}
+
+func BindModelCacheMaxSize(cmd *cobra.Command) error {
+	return bindLocalIntOption(
+		cmd, "model_cache_max_size", config.DefaultModelCacheMaxSize,
+		"max size of model cache in MB, least recently used models are evicted over it",
+		"ModelCacheMaxSize", "MODEL_CACHE_MAX_SIZE")
+}
+
+func BindV2ModelName(cmd *cobra.Command) error {
+	return bindLocalStringOption(
+		cmd, "v2_model_name", "",
+		"model name served on Open Inference Protocol v2 endpoints under /v2 (empty means disabled)",
+		"V2ModelName", "V2_MODEL_NAME")
+}
+
 func BindTrainingResultDir(cmd *cobra.Command) error {
 	return bindLocalStringOption(
 		cmd, "abeja_training_result_dir", pathutil.DefaultTrainingResultDir,
@@ -197,6 +390,24 @@ func BindMountTargetDir(cmd *cobra.Command) error {
 		"directory to mount shared file system", "MountTargetDir", "ABEJA_MOUNT_TARGET_DIR")
 }
 
+// RebindOptions binds the flags of cmd to viper again.
+// viper holds only one flag per key, and the other commands may have bound their flags
+// to the same key after cmd, so the command being executed must bind its flags again.
+// e.g. `replay` binds `request_timeout` after `service run`, and without this
+// `service run --request_timeout=...` was silently ignored.
+// The key of each flag is found by its viper_key annotation, which bindLocal*Option sets.
+func RebindOptions(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		keys, ok := flag.Annotations[viperKeyAnnotation]
+		if !ok || len(keys) == 0 || err != nil {
+			return
+		}
+		err = viper.BindPFlag(keys[0], flag)
+	})
+	return err
+}
+
 func BindOptions(cmd *cobra.Command, options []func(*cobra.Command) error) error {
 	for _, option := range options {
 		if err := option(cmd); err != nil {
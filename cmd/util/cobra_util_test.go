@@ -0,0 +1,50 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+)
+
+func TestRebindOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		rebind  bool
+		expects int
+	}{
+		{name: "flag of executing command is used after rebinding", rebind: true, expects: 10},
+		{name: "flag of the command bound last is used without rebinding", rebind: false, expects: config.DefaultRequestTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			CleanUp(t)
+			viper.Reset()
+			defer viper.Reset()
+
+			// both commands bind the same key, and other binds it after executing.
+			executing := &cobra.Command{Use: "executing", RunE: DummyRunEFunc}
+			if err := BindRequestTimeout(executing); err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			other := &cobra.Command{Use: "other", RunE: DummyRunEFunc}
+			if err := BindRequestTimeout(other); err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+
+			if err := executing.ParseFlags([]string{"--request_timeout=10"}); err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			if c.rebind {
+				if err := RebindOptions(executing); err != nil {
+					t.Fatal("unexpected error occurred:", err)
+				}
+			}
+			if actual := viper.GetInt("RequestTimeout"); actual != c.expects {
+				t.Errorf("RequestTimeout should be %d, but %d", c.expects, actual)
+			}
+		})
+	}
+}
@@ -36,6 +36,35 @@ var confEnvs = [...]string{
 	"input",
 	"output",
 	"port",
+	"grpc_port",
+	"workers",
+	"max_restarts",
+	"request_timeout",
+	"startup_timeout",
+	"ipc_protocol_version",
+	"capture_dir",
+	"capture_sample_rate",
+	"capture_max_size",
+	"queue_max_depth",
+	"queue_max_wait",
+	"dynamic_batch_max_size",
+	"dynamic_batch_max_latency",
+	"async_journal_dir",
+	"async_dead_letter_dir",
+	"arms_max_retries",
+	"callback_secret",
+	"manifest",
+	"batch_concurrency",
+	"batch_checkpoint",
+	"batch_report",
+	"output_file_name",
+	"model_cache_dir",
+	"model_cache_max_size",
+	"v2_model_name",
+	"s3_endpoint",
+	"s3_region",
+	"s3_access_key_id",
+	"s3_secret_access_key",
 }
 
 func CleanUp(t *testing.T) {
@@ -73,6 +102,35 @@ type AllOptions struct {
 	Input                            string
 	Output                           string
 	Port                             int
+	GRPCPort                         int
+	Workers                          int
+	MaxRestarts                      int
+	RequestTimeout                   int
+	StartupTimeout                   int
+	IPCProtocolVersion               int
+	CaptureDir                       string
+	CaptureSampleRate                int
+	CaptureMaxSize                   int
+	QueueMaxDepth                    int
+	QueueMaxWait                     int
+	DynamicBatchMaxSize              int
+	DynamicBatchMaxLatency           int
+	AsyncJournalDir                  string
+	AsyncDeadLetterDir               string
+	ArmsMaxRetries                   int
+	CallbackSecret                   string
+	Manifest                         string
+	BatchConcurrency                 int
+	BatchCheckpoint                  string
+	BatchReport                      string
+	OutputFileName                   string
+	S3Endpoint                       string
+	S3Region                         string
+	S3AccessKeyId                    string
+	S3SecretAccessKey                string
+	ModelCacheDir                    string
+	ModelCacheMaxSize                int
+	V2ModelName                      string
 }
 
 var matchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
@@ -2,6 +2,7 @@ package util
 
 import (
 	"os"
+	"text/template"
 
 	errors "golang.org/x/xerrors"
 )
@@ -13,6 +14,125 @@ func ValidatePortNumber(port int) error {
 	return nil
 }
 
+func ValidateGRPCPort(port int) error {
+	if port == 0 {
+		return nil
+	}
+	return ValidatePortNumber(port)
+}
+
+func ValidateWorkers(workers int) error {
+	if workers < 1 {
+		return errors.Errorf("workers [%d] must be greater than 0", workers)
+	}
+	return nil
+}
+
+func ValidateMaxRestarts(maxRestarts int) error {
+	if maxRestarts < 0 {
+		return errors.Errorf("max_restarts [%d] must not be negative", maxRestarts)
+	}
+	return nil
+}
+
+func ValidateRequestTimeout(requestTimeout int) error {
+	if requestTimeout <= 0 {
+		return errors.Errorf("request_timeout [%d] must be positive", requestTimeout)
+	}
+	return nil
+}
+
+func ValidateStartupTimeout(startupTimeout int) error {
+	if startupTimeout < 0 {
+		return errors.Errorf("startup_timeout [%d] must not be negative", startupTimeout)
+	}
+	return nil
+}
+
+func ValidateIPCProtocolVersion(protocolVersion int) error {
+	if protocolVersion < 1 || protocolVersion > 2 {
+		return errors.Errorf("ipc_protocol_version [%d] must be 1 or 2", protocolVersion)
+	}
+	return nil
+}
+
+func ValidateCaptureSampleRate(sampleRate int) error {
+	if sampleRate < 1 || sampleRate > 100 {
+		return errors.Errorf("capture_sample_rate [%d] must be between 1 and 100", sampleRate)
+	}
+	return nil
+}
+
+func ValidateCaptureMaxSize(maxSize int) error {
+	if maxSize < 1 {
+		return errors.Errorf("capture_max_size [%d] must be greater than 0", maxSize)
+	}
+	return nil
+}
+
+func ValidateQueueMaxDepth(maxDepth int) error {
+	if maxDepth < 1 {
+		return errors.Errorf("queue_max_depth [%d] must be greater than 0", maxDepth)
+	}
+	return nil
+}
+
+func ValidateQueueMaxWait(maxWait int) error {
+	if maxWait < 0 {
+		return errors.Errorf("queue_max_wait [%d] must not be negative", maxWait)
+	}
+	return nil
+}
+
+func ValidateDynamicBatchMaxSize(maxSize int) error {
+	if maxSize < 1 {
+		return errors.Errorf("dynamic_batch_max_size [%d] must be greater than 0", maxSize)
+	}
+	return nil
+}
+
+func ValidateDynamicBatchMaxLatency(maxLatency int) error {
+	if maxLatency < 0 {
+		return errors.Errorf("dynamic_batch_max_latency [%d] must not be negative", maxLatency)
+	}
+	return nil
+}
+
+func ValidateARMSMaxRetries(maxRetries int) error {
+	if maxRetries < 0 {
+		return errors.Errorf("arms_max_retries [%d] must not be negative", maxRetries)
+	}
+	return nil
+}
+
+func ValidateBatchConcurrency(concurrency int) error {
+	if concurrency < 1 {
+		return errors.Errorf("batch_concurrency [%d] must be greater than 0", concurrency)
+	}
+	return nil
+}
+
+func ValidateManifest(manifest string, input string) error {
+	if manifest != "" && input != "" {
+		return errors.New("manifest and input can't be set at the same time")
+	}
+	return nil
+}
+
+func ValidateOutputFileName(fileName string) error {
+	if _, err := template.New("output_file_name").Parse(fileName); err != nil {
+		return errors.Errorf("output_file_name [%s] is invalid template: %w", fileName, err)
+	}
+	return nil
+}
+
+func ValidateModelCacheMaxSize(maxSize int) error {
+	if maxSize < 1 {
+		return errors.Errorf("model_cache_max_size [%d] must be greater than 0", maxSize)
+	}
+	return nil
+}
+
 func ValidateTrainingJobDefinitionVersion(version int) error {
 	if version < 1 {
 		return errors.Errorf("training_job_definition_version [%d] must be greater than 0", version)
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/util/auth"
 	pathutil "github.com/abeja-inc/abeja-platform-model-proxy/util/path"
@@ -16,6 +17,22 @@ const DefaultAbejaAPIURL = "https://api.abeja.io"
 const DefaultHTTPListenPort = 5000
 const DefaultHealthCheckListenPort = 5001
 const DefaultRuntime = "python36"
+const DefaultWorkers = 1
+const DefaultMaxRestarts = 3
+const DefaultRequestTimeout = 60
+const DefaultStartupTimeout = 0
+const DefaultIPCProtocolVersion = 1
+const DefaultCaptureSampleRate = 100
+const DefaultCaptureMaxSize = 1024
+const DefaultQueueMaxDepth = 10000
+const DefaultQueueMaxWait = 0
+const DefaultDynamicBatchMaxSize = 1
+const DefaultDynamicBatchMaxLatency = 10
+const DefaultARMSMaxRetries = 5
+const DefaultBatchConcurrency = 1
+const DefaultOutputFileName = "{{.RunID}}_{{.Index}}{{.Ext}}"
+const DefaultS3Region = "us-east-1"
+const DefaultModelCacheMaxSize = 10240
 
 const DefaultMountTargetDir = "/mnt"
 
@@ -56,14 +73,56 @@ type Configuration struct {
 	RequestedDataDir             string
 	Port                         int
 	HealthCheckPort              int
+	GRPCPort                     int
+	Workers                      int
+	MaxRestarts                  int
+	RequestTimeout               int
+	StartupTimeout               int
+	IPCProtocolVersion           int
 	TrainingResultDir            string
 	Input                        string
 	Output                       string
+	CaptureDir                   string
+	CaptureSampleRate            int
+	CaptureMaxSize               int
+	QueueMaxDepth                int
+	QueueMaxWait                 int
+	DynamicBatchMaxSize          int
+	DynamicBatchMaxLatency       int
+	AsyncJournalDir              string
+	AsyncDeadLetterDir           string
+	ARMSMaxRetries               int
+	CallbackSecret               string
+	Manifest                     string
+	BatchConcurrency             int
+	BatchCheckpoint              string
+	BatchReport                  string
+	OutputFileName               string
+	S3Endpoint                   string
+	S3Region                     string
+	S3AccessKeyID                string
+	S3SecretAccessKey            string
+	ModelCacheDir                string
+	ModelCacheMaxSize            int
+	V2ModelName                  string
 }
 
 func NewConfiguration() Configuration {
 	conf := Configuration{}
 	conf.RequestedDataDir = requestedDataDir
+	conf.Workers = DefaultWorkers
+	conf.MaxRestarts = DefaultMaxRestarts
+	conf.RequestTimeout = DefaultRequestTimeout
+	conf.CaptureSampleRate = DefaultCaptureSampleRate
+	conf.CaptureMaxSize = DefaultCaptureMaxSize
+	conf.QueueMaxDepth = DefaultQueueMaxDepth
+	conf.DynamicBatchMaxSize = DefaultDynamicBatchMaxSize
+	conf.DynamicBatchMaxLatency = DefaultDynamicBatchMaxLatency
+	conf.ARMSMaxRetries = DefaultARMSMaxRetries
+	conf.BatchConcurrency = DefaultBatchConcurrency
+	conf.OutputFileName = DefaultOutputFileName
+	conf.S3Region = DefaultS3Region
+	conf.ModelCacheMaxSize = DefaultModelCacheMaxSize
 	return conf
 }
 
@@ -76,6 +135,37 @@ func (config *Configuration) GetHealthCheckAddress() string {
 	return fmt.Sprintf(":%d", config.HealthCheckPort)
 }
 
+// GetGRPCAddress returns the address and port number on which the gRPC server listens.
+func (config *Configuration) GetGRPCAddress() string {
+	return fmt.Sprintf(":%d", config.GRPCPort)
+}
+
+// GetRequestTimeout returns the timeout of inference per request.
+// It is also the upper limit of the timeout which the request gives.
+func (config *Configuration) GetRequestTimeout() time.Duration {
+	return time.Duration(config.RequestTimeout) * time.Second
+}
+
+// GetStartupTimeout returns the time limit for runtime to get ready after it started. 0 means no limit.
+func (config *Configuration) GetStartupTimeout() time.Duration {
+	return time.Duration(config.StartupTimeout) * time.Second
+}
+
+// GetCaptureMaxBytes returns the limit of size of capture directory in bytes.
+func (config *Configuration) GetCaptureMaxBytes() int64 {
+	return int64(config.CaptureMaxSize) * 1024 * 1024
+}
+
+// GetQueueMaxWait returns the time limit for requests to wait for runtime. 0 means no limit.
+func (config *Configuration) GetQueueMaxWait() time.Duration {
+	return time.Duration(config.QueueMaxWait) * time.Second
+}
+
+// GetDynamicBatchMaxLatency returns the time to wait for requests to be batched together.
+func (config *Configuration) GetDynamicBatchMaxLatency() time.Duration {
+	return time.Duration(config.DynamicBatchMaxLatency) * time.Millisecond
+}
+
 func (config *Configuration) GetWorkingDir() (string, error) {
 	return pathutil.GetWorkingDir(config.UserModelRoot)
 }
@@ -116,7 +206,8 @@ func (config *Configuration) String() string {
 		} else {
 			value = f.String()
 		}
-		if field == "PlatformAuthToken" || field == "PlatformPersonalAccessToken" {
+		if field == "PlatformAuthToken" || field == "PlatformPersonalAccessToken" ||
+			field == "CallbackSecret" || field == "S3SecretAccessKey" {
 			value = "xxxxxxxxxx"
 		}
 		ret.WriteString(fmt.Sprintf("%s: %s", field, value))
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"strings"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
+)
+
+const envKeyOTELSDKDisabled = "OTEL_SDK_DISABLED"
+const envKeyOTELTracesExporter = "OTEL_TRACES_EXPORTER"
+const envKeyOTELExporterOTLPEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+const envKeyOTELExporterOTLPTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+const envKeyOTELExporterOTLPProtocol = "OTEL_EXPORTER_OTLP_PROTOCOL"
+const envKeyOTELExporterOTLPTracesProtocol = "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"
+
+const defaultOTELServiceName = "abeja-platform-model-proxy"
+
+// GetOTLPTraceConfig returns configuration of OTLP exporter by `OTEL_*` environment variables.
+// enabled is true when `OTEL_TRACES_EXPORTER` is `otlp`, or it is not set but
+// the endpoint of OTLP exporter is set.
+// Only `http/protobuf` is supported as the protocol of OTLP exporter.
+// The other variables, like endpoint and sampler, are read by the OpenTelemetry SDK.
+func GetOTLPTraceConfig() (conf tracing.OTLPConfig, enabled bool, err error) {
+	if strings.ToLower(os.Getenv(envKeyOTELSDKDisabled)) == "true" {
+		return conf, false, nil
+	}
+	_, hasEndpoint := lookupEnv(envKeyOTELExporterOTLPTracesEndpoint, envKeyOTELExporterOTLPEndpoint)
+	exporter, ok := lookupEnv(envKeyOTELTracesExporter)
+	if ok && exporter != "otlp" {
+		return conf, false, nil
+	}
+	if !ok && !hasEndpoint {
+		return conf, false, nil
+	}
+
+	if protocol, ok := lookupEnv(envKeyOTELExporterOTLPTracesProtocol, envKeyOTELExporterOTLPProtocol); ok && protocol != "http/protobuf" {
+		return conf, false, errors.Errorf("unsupported protocol of OTLP exporter: %s", protocol)
+	}
+
+	conf.ServiceName = defaultOTELServiceName
+	return conf, true, nil
+}
+
+// lookupEnv returns the value of the first environment variable which is set and not empty.
+func lookupEnv(keys ...string) (string, bool) {
+	for _, key := range keys {
+		if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
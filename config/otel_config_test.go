@@ -0,0 +1,125 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetOTLPTraceConfig(t *testing.T) {
+	keys := []string{
+		envKeyOTELSDKDisabled, envKeyOTELTracesExporter,
+		envKeyOTELExporterOTLPEndpoint, envKeyOTELExporterOTLPTracesEndpoint,
+		envKeyOTELExporterOTLPProtocol, envKeyOTELExporterOTLPTracesProtocol,
+	}
+	orgEnvs := make(map[string]string)
+	for _, key := range keys {
+		if v, ok := os.LookupEnv(key); ok {
+			orgEnvs[key] = v
+		}
+	}
+	defer func() {
+		for _, key := range keys {
+			os.Unsetenv(key)
+			if v, ok := orgEnvs[key]; ok {
+				os.Setenv(key, v)
+			}
+		}
+	}()
+
+	cases := []struct {
+		name    string
+		envs    map[string]string
+		enabled bool
+		isErr   bool
+	}{
+		{
+			name:    "not configured",
+			envs:    map[string]string{},
+			enabled: false,
+		}, {
+			name: "base endpoint",
+			envs: map[string]string{
+				envKeyOTELExporterOTLPEndpoint: "http://collector:4318/",
+			},
+			enabled: true,
+		}, {
+			name: "traces endpoint",
+			envs: map[string]string{
+				envKeyOTELExporterOTLPTracesEndpoint: "http://tempo:4318/custom",
+			},
+			enabled: true,
+		}, {
+			name: "exporter without endpoint",
+			envs: map[string]string{
+				envKeyOTELTracesExporter: "otlp",
+			},
+			enabled: true,
+		}, {
+			name: "other exporter",
+			envs: map[string]string{
+				envKeyOTELTracesExporter:       "none",
+				envKeyOTELExporterOTLPEndpoint: "http://collector:4318",
+			},
+			enabled: false,
+		}, {
+			name: "sdk disabled",
+			envs: map[string]string{
+				envKeyOTELSDKDisabled:          "true",
+				envKeyOTELExporterOTLPEndpoint: "http://collector:4318",
+			},
+			enabled: false,
+		}, {
+			name: "http/protobuf protocol",
+			envs: map[string]string{
+				envKeyOTELExporterOTLPEndpoint:       "http://collector:4318",
+				envKeyOTELExporterOTLPTracesProtocol: "http/protobuf",
+			},
+			enabled: true,
+		}, {
+			name: "grpc protocol",
+			envs: map[string]string{
+				envKeyOTELExporterOTLPEndpoint: "http://collector:4317",
+				envKeyOTELExporterOTLPProtocol: "grpc",
+			},
+			isErr: true,
+		}, {
+			name: "http/json protocol",
+			envs: map[string]string{
+				envKeyOTELExporterOTLPEndpoint:       "http://collector:4318",
+				envKeyOTELExporterOTLPTracesProtocol: "http/json",
+			},
+			isErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, key := range keys {
+				os.Unsetenv(key)
+			}
+			for key, value := range c.envs {
+				os.Setenv(key, value)
+			}
+
+			conf, enabled, err := GetOTLPTraceConfig()
+			if c.isErr {
+				if err == nil {
+					t.Error("error should be occurred")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			if enabled != c.enabled {
+				t.Fatalf("enabled should be %t, but %t", c.enabled, enabled)
+			}
+			if !enabled {
+				return
+			}
+			if conf.ServiceName != defaultOTELServiceName {
+				t.Errorf("service name should be %s, but %s", defaultOTELServiceName, conf.ServiceName)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package convert
 import (
 	"context"
 	"fmt"
+	"mime"
 	"net/http"
 	"os"
 	"sort"
@@ -29,6 +30,9 @@ const KeyContentLength = "Content-Length"
 // KeyConnection is response header key of Connection
 const KeyConnection = "Connection"
 
+// KeyCacheControl is response header key of Cache-Control
+const KeyCacheControl = "Cache-Control"
+
 // ConverterError is custom error struct.
 type ConverterError struct {
 	Msg        string
@@ -106,9 +110,42 @@ func ToContents(
 	}
 	sort.Slice(headers, func(i, j int) bool { return headers[i].Key < headers[j].Key })
 	cl.Headers = headers
+	SetRequestInfo(cl, r)
 	return cl, nil
 }
 
+// SetRequestInfo sets URL path, query, address of the client and request id of Request to ContentList,
+// so that the runtime can serve several endpoints and read options from query.
+func SetRequestInfo(cl *entity.ContentList, r *http.Request) {
+	cl.URLPath = r.URL.Path
+	if query := r.URL.Query(); len(query) > 0 {
+		cl.Query = query
+	}
+	cl.RemoteAddr = r.RemoteAddr
+	cl.RequestID = r.Header.Get("x-abeja-request-id")
+}
+
+// FromStreamingResponse returns status code and headers of http response
+// whose body is sent by chunks afterward.
+func FromStreamingResponse(ctx context.Context, res entity.Response) (int, map[string]string, error) {
+	statusCode, headers, err := responseHeaders(ctx, res)
+	if err != nil {
+		return 0, headers, err
+	}
+	// length of body is unknown until the end of stream.
+	delete(headers, KeyContentLength)
+	if IsEventStream(headers[KeyContentType]) {
+		headers[KeyCacheControl] = "no-cache"
+	}
+	return statusCode, headers, nil
+}
+
+// IsEventStream returns result of `Is contentType text/event-stream ?`.
+func IsEventStream(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "text/event-stream"
+}
+
 // FromResponse returns information of http response from struct of Response.
 func FromResponse(ctx context.Context, res entity.Response) (int, map[string]string, *os.File, error) {
 	var targetConverter converter
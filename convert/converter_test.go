@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -268,3 +269,39 @@ func TestToContentsAsMultipartRequest(t *testing.T) {
 		t.Errorf("Content.Body should be qux, but %s", string(content2Actual))
 	}
 }
+
+func TestToContentsWithRequestInfo(t *testing.T) {
+	conf := config.NewConfiguration()
+	req := httptest.NewRequest("POST", "http://example.com/explain?threshold=0.5&label=cat&label=dog", bytes.NewBufferString("{}"))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("x-abeja-request-id", "123")
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	cl, err := ToContents(context.TODO(), req, &conf)
+	if err != nil {
+		t.Fatal("failed to ToContents: ", err)
+	}
+	if cl.URLPath != "/explain" {
+		t.Errorf("ContentList.URLPath should be /explain, but %s", cl.URLPath)
+	}
+	expectQuery := map[string][]string{"threshold": {"0.5"}, "label": {"cat", "dog"}}
+	if !reflect.DeepEqual(cl.Query, expectQuery) {
+		t.Errorf("ContentList.Query should be %v, but %v", expectQuery, cl.Query)
+	}
+	if cl.RemoteAddr != "192.0.2.1:1234" {
+		t.Errorf("ContentList.RemoteAddr should be 192.0.2.1:1234, but %s", cl.RemoteAddr)
+	}
+	if cl.RequestID != "123" {
+		t.Errorf("ContentList.RequestID should be 123, but %s", cl.RequestID)
+	}
+
+	req = httptest.NewRequest("POST", "http://example.com", bytes.NewBufferString("{}"))
+	req.Header.Add("Content-Type", "application/json")
+	cl, err = ToContents(context.TODO(), req, &conf)
+	if err != nil {
+		t.Fatal("failed to ToContents: ", err)
+	}
+	if cl.Query != nil || cl.RequestID != "" {
+		t.Errorf("empty query and request id should be omitted, but %v and %s", cl.Query, cl.RequestID)
+	}
+}
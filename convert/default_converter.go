@@ -42,6 +42,9 @@ func (conv *defaultConverter) IsTarget(
 	if mt == "multipart/form-data" {
 		return false
 	}
+	if method == DummyMethodForResponse && mt == "multipart/mixed" {
+		return false
+	}
 	return true
 }
 
@@ -97,43 +100,9 @@ func (conv *defaultConverter) ToContent(
 func (conv *defaultConverter) FromResponse(ctx context.Context, res entity.Response) (
 	statusCode int, headers map[string]string, body *os.File, err error) {
 
-	statusCode = http.StatusOK
-	contentType := "application/json"
-	headers = make(map[string]string)
-	headers[KeyContentType] = contentType
-	headers[KeyAbejaProxyVersion] = version.Version
-	headers[KeyContentLength] = "0"
-	// SAMPv2 limits the number of concurrent requests by LimitListener,
-	// but it accepts requests from multiple clients at the same time.
-	// Keepalive is disabled because it can't process requests until
-	// the previous connection is closed, which causes a wait time.
-	headers[KeyConnection] = "close"
-
-	if res.StatusCode != nil {
-		statusCode = *res.StatusCode
-	} else {
-		log.Debug(ctx, "no status_code in response of user-model. set 200")
-	}
-
-	if res.ErrMsg != nil {
-		return 0, headers, nil, &ConverterError{
-			Msg:        *res.ErrMsg,
-			StatusCode: statusCode,
-			Err:        nil,
-			frame:      errors.Caller(0),
-		}
-	}
-
-	if res.ContentType != nil {
-		headers[KeyContentType] = *res.ContentType
-	} else {
-		log.Debug(ctx, "no content-type in response of user-model. use default(application/json).")
-	}
-
-	if res.Metadata != nil {
-		for key, value := range *res.Metadata {
-			headers[key] = value
-		}
+	statusCode, headers, err = responseHeaders(ctx, res)
+	if err != nil {
+		return 0, headers, nil, err
 	}
 
 	if res.Path == nil {
@@ -171,3 +140,44 @@ func (conv *defaultConverter) FromResponse(ctx context.Context, res entity.Respo
 
 	return statusCode, headers, fp, nil
 }
+
+// responseHeaders returns status code and headers of http response from struct of Response.
+func responseHeaders(ctx context.Context, res entity.Response) (int, map[string]string, error) {
+	statusCode := http.StatusOK
+	contentType := "application/json"
+	headers := make(map[string]string)
+	headers[KeyContentType] = contentType
+	headers[KeyAbejaProxyVersion] = version.Version
+	headers[KeyContentLength] = "0"
+	// Keepalive is disabled as it has been since SAMPv2 limited the number of
+	// connections, so that the behavior doesn't change for clients.
+	headers[KeyConnection] = "close"
+
+	if res.StatusCode != nil {
+		statusCode = *res.StatusCode
+	} else {
+		log.Debug(ctx, "no status_code in response of user-model. set 200")
+	}
+
+	if res.ErrMsg != nil {
+		return 0, headers, &ConverterError{
+			Msg:        *res.ErrMsg,
+			StatusCode: statusCode,
+			Err:        nil,
+			frame:      errors.Caller(0),
+		}
+	}
+
+	if res.ContentType != nil {
+		headers[KeyContentType] = *res.ContentType
+	} else {
+		log.Debug(ctx, "no content-type in response of user-model. use default(application/json).")
+	}
+
+	if res.Metadata != nil {
+		for key, value := range *res.Metadata {
+			headers[key] = value
+		}
+	}
+	return statusCode, headers, nil
+}
@@ -35,6 +35,9 @@ func TestIsTarget_Default(t *testing.T) {
 		{name: "POST-image/jpeg", contentType: "image/jpeg", method: "POST", isTarget: true},    // not text data
 		{name: "PATCH-image/jpeg", contentType: "image/jpeg", method: "PATCH", isTarget: false}, // only GET/POST/PUT are allowed
 		{name: "POST-multipart", contentType: "multipart/form-data", method: "POST", isTarget: false},
+		{name: "response-json", contentType: "application/json", method: DummyMethodForResponse, isTarget: true},
+		{name: "response-multipart", contentType: "multipart/form-data", method: DummyMethodForResponse, isTarget: false},
+		{name: "response-multipart/mixed", contentType: "multipart/mixed", method: DummyMethodForResponse, isTarget: false},
 	}
 
 	for _, c := range cases {
@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"strconv"
 
 	errors "golang.org/x/xerrors"
 
@@ -22,7 +26,7 @@ type multipartConverter struct{}
 func (conv *multipartConverter) IsTarget(
 	ctx context.Context, method string, contentType string) bool {
 
-	if method != http.MethodPost && method != http.MethodPut {
+	if method != http.MethodPost && method != http.MethodPut && method != DummyMethodForResponse {
 		return false
 	}
 
@@ -34,6 +38,9 @@ func (conv *multipartConverter) IsTarget(
 	if mt == "multipart/form-data" {
 		return true
 	}
+	if method == DummyMethodForResponse && mt == "multipart/mixed" {
+		return true
+	}
 	return false
 }
 
@@ -96,7 +103,140 @@ func (conv *multipartConverter) ToContent(
 	}, nil
 }
 
+// FromResponse returns multipart body which consists of parts of response.
+// If response has no parts, the file specified by path is used as the body as it is.
 func (conv *multipartConverter) FromResponse(ctx context.Context, res entity.Response) (
 	statusCode int, headers map[string]string, body *os.File, err error) {
-	return 0, nil, nil, errors.New("not implemented error")
+
+	if len(res.Parts) == 0 {
+		return (&defaultConverter{}).FromResponse(ctx, res)
+	}
+
+	statusCode, headers, err = responseHeaders(ctx, res)
+	if err != nil {
+		return 0, headers, nil, err
+	}
+
+	mt, params, err := mime.ParseMediaType(*res.ContentType)
+	if err != nil {
+		return 0, headers, nil, unexpectedConverterError(err)
+	}
+
+	fp, err := ioutil.TempFile("", "")
+	if err != nil {
+		log.Errorf(ctx, "failed to create temporary file: "+log.ErrorFormat, err)
+		return 0, headers, nil, unexpectedConverterError(err)
+	}
+	writer := multipart.NewWriter(fp)
+	if boundary, ok := params["boundary"]; ok {
+		if err := writer.SetBoundary(boundary); err != nil {
+			log.Warningf(ctx, "invalid boundary [%s] in response of user-model: "+log.ErrorFormat, boundary, err)
+			return 0, headers, nil, conv.discard(ctx, fp, err)
+		}
+	}
+
+	for i, part := range res.Parts {
+		if err := writePart(ctx, writer, mt, i, part); err != nil {
+			return 0, headers, nil, conv.discard(ctx, fp, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Errorf(ctx, "failed to write multipart body: "+log.ErrorFormat, err)
+		return 0, headers, nil, conv.discard(ctx, fp, err)
+	}
+	for _, part := range res.Parts {
+		cleanutil.Remove(ctx, *part.Path)
+	}
+
+	size, err := fp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		log.Errorf(ctx, "failed to get size of multipart body: "+log.ErrorFormat, err)
+		return 0, headers, nil, conv.discard(ctx, fp, err)
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		log.Errorf(ctx, "failed to seek multipart body: "+log.ErrorFormat, err)
+		return 0, headers, nil, conv.discard(ctx, fp, err)
+	}
+	params["boundary"] = writer.Boundary()
+	headers[KeyContentType] = mime.FormatMediaType(mt, params)
+	headers[KeyContentLength] = strconv.FormatInt(size, 10)
+	return statusCode, headers, fp, nil
+}
+
+// discard removes multipart body which is being written, and returns error for response.
+func (conv *multipartConverter) discard(ctx context.Context, fp *os.File, err error) error {
+	cleanutil.Close(ctx, fp, fp.Name())
+	cleanutil.Remove(ctx, fp.Name())
+	return unexpectedConverterError(err)
+}
+
+// writePart writes content of part to multipart body.
+func writePart(
+	ctx context.Context,
+	writer *multipart.Writer,
+	mediaType string,
+	index int,
+	part *entity.Content) error {
+
+	if part.Path == nil {
+		log.Warningf(ctx, "no path in part[%d] of response of user-model.", index)
+		return errors.Errorf("no path in part[%d]", index)
+	}
+
+	header := make(textproto.MIMEHeader)
+	dispositionParams := make(map[string]string)
+	if part.FileName != nil {
+		dispositionParams["filename"] = *part.FileName
+	}
+	if mediaType == "multipart/form-data" {
+		name := fmt.Sprintf("part%d", index)
+		if part.FormName != nil {
+			name = *part.FormName
+		} else if part.FileName != nil {
+			name = *part.FileName
+		}
+		dispositionParams["name"] = name
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", dispositionParams))
+	} else if part.FileName != nil {
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", dispositionParams))
+	}
+	contentType := "application/octet-stream"
+	if part.ContentType != nil {
+		contentType = *part.ContentType
+	}
+	header.Set("Content-Type", contentType)
+	for key, value := range part.Metadata {
+		header.Set(key, fmt.Sprint(value))
+	}
+
+	src, err := os.Open(*part.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Warningf(ctx, "file [%s] that specified in response of user-model not exist.", *part.Path)
+		} else {
+			log.Errorf(ctx, "failed to load file: "+log.ErrorFormat, err)
+		}
+		return errors.Errorf(": %w", err)
+	}
+	defer cleanutil.Close(ctx, src, *part.Path)
+
+	dst, err := writer.CreatePart(header)
+	if err != nil {
+		log.Errorf(ctx, "failed to create part: "+log.ErrorFormat, err)
+		return errors.Errorf(": %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		log.Errorf(ctx, "failed to write part: "+log.ErrorFormat, err)
+		return errors.Errorf(": %w", err)
+	}
+	return nil
+}
+
+func unexpectedConverterError(err error) error {
+	return &ConverterError{
+		Msg:        "unexpected error",
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        err,
+		frame:      errors.Caller(1),
+	}
 }
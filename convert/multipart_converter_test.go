@@ -3,14 +3,21 @@ package convert
 import (
 	"bytes"
 	"context"
+	"io"
 	"io/ioutil"
+	"mime"
 	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/convert/testutils"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
 )
 
 func TestIsTarget_Multipart(t *testing.T) {
@@ -41,6 +48,26 @@ func TestIsTarget_Multipart(t *testing.T) {
 			contentType: "multipart/form-data",
 			method:      "POST",
 			isTarget:    true,
+		}, {
+			name:        "multipart/mixed",
+			contentType: "multipart/mixed",
+			method:      "POST",
+			isTarget:    false,
+		}, {
+			name:        "response-application/json",
+			contentType: "application/json",
+			method:      DummyMethodForResponse,
+			isTarget:    false,
+		}, {
+			name:        "response-multipart/form-data",
+			contentType: "multipart/form-data",
+			method:      DummyMethodForResponse,
+			isTarget:    true,
+		}, {
+			name:        "response-multipart/mixed",
+			contentType: "multipart/mixed; boundary=foo",
+			method:      DummyMethodForResponse,
+			isTarget:    true,
 		},
 	}
 
@@ -142,3 +169,163 @@ func TestToContent_Multipart(t *testing.T) {
 		t.Errorf("Content.Body should be qux, but %s", string(content2Actual))
 	}
 }
+
+func TestFromResponse_Multipart(t *testing.T) {
+	conv := multipartConverter{}
+
+	type part struct {
+		contentType *string
+		fileName    *string
+		formName    *string
+		body        string
+	}
+	strPtr := func(s string) *string { return &s }
+	cases := []struct {
+		name              string
+		contentType       string
+		parts             []part
+		expectBoundary    string
+		expectDisposition []string
+		expectContentType []string
+	}{
+		{
+			name:        "form-data",
+			contentType: "multipart/form-data",
+			parts: []part{
+				{contentType: strPtr("image/png"), fileName: strPtr("mask.png"), formName: strPtr("mask"), body: "png-data"},
+				{contentType: strPtr("application/json"), fileName: strPtr("summary.json"), body: "{\"foo\":\"bar\"}"},
+				{body: "plain"},
+			},
+			expectDisposition: []string{
+				`form-data; filename=mask.png; name=mask`,
+				`form-data; filename=summary.json; name=summary.json`,
+				`form-data; name=part2`,
+			},
+			expectContentType: []string{"image/png", "application/json", "application/octet-stream"},
+		},
+		{
+			name:        "mixed with boundary",
+			contentType: "multipart/mixed; boundary=foobarbaz",
+			parts: []part{
+				{contentType: strPtr("image/png"), fileName: strPtr("mask.png"), body: "png-data"},
+				{contentType: strPtr("application/json"), body: "{\"foo\":\"bar\"}"},
+			},
+			expectBoundary: "foobarbaz",
+			expectDisposition: []string{
+				`attachment; filename=mask.png`,
+				``,
+			},
+			expectContentType: []string{"image/png", "application/json"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var contents []*entity.Content
+			for _, p := range c.parts {
+				fp, err := ioutil.TempFile("", "")
+				if err != nil {
+					t.Fatal("failed to create temp file", err)
+				}
+				fpath := fp.Name()
+				cleanutil.Close(context.TODO(), fp, fpath)
+				if err := ioutil.WriteFile(fpath, []byte(p.body), 0644); err != nil {
+					t.Fatal("Error when writing to file:", err)
+				}
+				contents = append(contents, &entity.Content{
+					ContentType: p.contentType,
+					Path:        &fpath,
+					FileName:    p.fileName,
+					FormName:    p.formName,
+				})
+			}
+			statusCode := http.StatusOK
+			res := entity.Response{
+				ContentType: &c.contentType,
+				Parts:       contents,
+				StatusCode:  &statusCode,
+			}
+
+			status, headers, body, err := conv.FromResponse(context.TODO(), res)
+			if err != nil {
+				t.Fatalf("err should be nil, but %s", err.Error())
+			}
+			defer os.Remove(body.Name())
+			if status != statusCode {
+				t.Errorf("status_code should be %d, but %d", statusCode, status)
+			}
+			for _, content := range contents {
+				if _, err := os.Stat(*content.Path); !os.IsNotExist(err) {
+					t.Errorf("file of part [%s] should be removed", *content.Path)
+				}
+			}
+
+			buf, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal("failed to read response file: ", err)
+			}
+			if headers[KeyContentLength] != strconv.Itoa(len(buf)) {
+				t.Errorf("content-length should be %d, but %s", len(buf), headers[KeyContentLength])
+			}
+			mt, params, err := mime.ParseMediaType(headers[KeyContentType])
+			if err != nil {
+				t.Fatal("failed to parse content-type: ", err)
+			}
+			expectMediaType, _, _ := mime.ParseMediaType(c.contentType)
+			if mt != expectMediaType {
+				t.Errorf("content-type should be %s, but %s", expectMediaType, mt)
+			}
+			if c.expectBoundary != "" && params["boundary"] != c.expectBoundary {
+				t.Errorf("boundary should be %s, but %s", c.expectBoundary, params["boundary"])
+			}
+
+			reader := multipart.NewReader(bytes.NewReader(buf), params["boundary"])
+			for i, p := range c.parts {
+				actual, err := reader.NextPart()
+				if err != nil {
+					t.Fatalf("failed to read part[%d]: %s", i, err)
+				}
+				if actual.Header.Get("Content-Disposition") != c.expectDisposition[i] {
+					t.Errorf("Content-Disposition of part[%d] should be [%s], but [%s]",
+						i, c.expectDisposition[i], actual.Header.Get("Content-Disposition"))
+				}
+				if actual.Header.Get("Content-Type") != c.expectContentType[i] {
+					t.Errorf("Content-Type of part[%d] should be %s, but %s",
+						i, c.expectContentType[i], actual.Header.Get("Content-Type"))
+				}
+				partBody, err := ioutil.ReadAll(actual)
+				if err != nil {
+					t.Fatalf("failed to read body of part[%d]: %s", i, err)
+				}
+				if string(partBody) != p.body {
+					t.Errorf("body of part[%d] should be [%s], but [%s]", i, p.body, string(partBody))
+				}
+			}
+			if _, err := reader.NextPart(); err != io.EOF {
+				t.Errorf("multipart body should have %d parts", len(c.parts))
+			}
+		})
+	}
+}
+
+func TestFromResponseWithNotExistPart_Multipart(t *testing.T) {
+	conv := multipartConverter{}
+	contentType := "multipart/mixed"
+	path := "/not/exist/file"
+	res := entity.Response{
+		ContentType: &contentType,
+		Parts:       []*entity.Content{{Path: &path}},
+	}
+
+	_, _, _, err := conv.FromResponse(context.TODO(), res)
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+	convErr, ok := err.(*ConverterError)
+	if !ok {
+		t.Fatalf("err should be ConverterError, but %T", err)
+	}
+	if convErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status code should be %d, but %d", http.StatusServiceUnavailable, convErr.StatusCode)
+	}
+}
@@ -0,0 +1,141 @@
+// Package deadletter keeps results of async requests which could not be delivered
+// to ARMS or callback url, so that they can be redelivered later.
+//
+// Layout of the directory is:
+//
+//	<dir>/<id>/letter.json  Letter
+//	<dir>/<id>/body         body of request to ARMS or callback url
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/util"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+)
+
+const letterFileName = "letter.json"
+const bodyFileName = "body"
+
+// Letter is a request to ARMS or callback url which failed.
+// The token of ARMS isn't kept, so it is redelivered with the platform credentials.
+type Letter struct {
+	ID             string    `json:"id"`
+	Path           string    `json:"path,omitempty"`         // endpoint of ARMS
+	CallbackURL    string    `json:"callback_url,omitempty"` // set instead of Path when the result is sent to callback url
+	AsyncRequestID string    `json:"async_request_id,omitempty"`
+	ContentType    string    `json:"content_type"`
+	Kind           string    `json:"kind"` // `response` for result of inference, `error` for error
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error"`
+	FailedAt       time.Time `json:"failed_at"`
+	BodyPath       string    `json:"-"`
+}
+
+// Store is the directory of Letters.
+type Store struct {
+	dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// Open returns Store of dir.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Errorf("failed to create dead-letter directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put moves the body into the store, and writes the letter.
+// ID and BodyPath of the letter are set.
+func (s *Store) Put(letter *Letter, bodyPath string) error {
+	s.mu.Lock()
+	s.seq++
+	letter.ID = fmt.Sprintf("%d-%d", time.Now().UnixNano(), s.seq)
+	s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, letter.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Errorf("failed to create dead-letter: %w", err)
+	}
+	letter.BodyPath = filepath.Join(dir, bodyFileName)
+	if err := util.MoveFile(bodyPath, letter.BodyPath); err != nil {
+		cleanutil.RemoveAll(context.Background(), dir)
+		return errors.Errorf("failed to move body into dead-letter: %w", err)
+	}
+	if err := s.Update(letter); err != nil {
+		cleanutil.RemoveAll(context.Background(), dir)
+		return err
+	}
+	return nil
+}
+
+// Update rewrites the letter, e.g. after redelivery failed again.
+func (s *Store) Update(letter *Letter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return errors.Errorf("failed to marshal dead-letter: %w", err)
+	}
+	path := filepath.Join(s.dir, letter.ID, letterFileName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Errorf("failed to write dead-letter: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Errorf("failed to write dead-letter: %w", err)
+	}
+	return nil
+}
+
+// List returns letters in the store in order of failure.
+// Directories without letter, e.g. left by a crash while putting, are skipped.
+func (s *Store) List() ([]*Letter, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Errorf("failed to read dead-letter directory: %w", err)
+	}
+	var letters []*Letter
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, entry.Name(), letterFileName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Errorf("failed to read dead-letter: %w", err)
+		}
+		var letter Letter
+		if err := json.Unmarshal(data, &letter); err != nil {
+			return nil, errors.Errorf("failed to unmarshal dead-letter %s: %w", entry.Name(), err)
+		}
+		letter.ID = entry.Name()
+		letter.BodyPath = filepath.Join(s.dir, entry.Name(), bodyFileName)
+		letters = append(letters, &letter)
+	}
+	sort.Slice(letters, func(i, k int) bool {
+		return letters[i].FailedAt.Before(letters[k].FailedAt)
+	})
+	return letters, nil
+}
+
+// Remove removes the letter after it is redelivered.
+func (s *Store) Remove(letter *Letter) error {
+	if err := os.RemoveAll(filepath.Join(s.dir, letter.ID)); err != nil {
+		return errors.Errorf("failed to remove dead-letter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package deadletter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(filepath.Join(dir, "letters"))
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	now := time.Now()
+	for i, path := range []string{"/results/req-2", "/results/req-1"} {
+		body := filepath.Join(dir, "body")
+		if err := ioutil.WriteFile(body, []byte(path), 0600); err != nil {
+			t.Fatal(err)
+		}
+		letter := &Letter{Path: path, Kind: "response", Attempts: 1, FailedAt: now.Add(-time.Duration(i) * time.Minute)}
+		if err := store.Put(letter, body); err != nil {
+			t.Fatal("unexpected error occurred:", err)
+		}
+		if _, err := os.Stat(body); !os.IsNotExist(err) {
+			t.Error("body should be moved into store")
+		}
+	}
+	// left by a crash while putting.
+	if err := os.Mkdir(filepath.Join(dir, "letters", "broken"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := store.List()
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(letters) != 2 || letters[0].Path != "/results/req-1" || letters[1].Path != "/results/req-2" {
+		t.Fatalf("letters should be listed in order of failure, but %+v", letters)
+	}
+	body, err := ioutil.ReadFile(letters[0].BodyPath)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if string(body) != "/results/req-1" {
+		t.Errorf("body should be kept, but [%s]", string(body))
+	}
+
+	letters[0].Attempts = 2
+	letters[0].LastError = "failed again"
+	if err := store.Update(letters[0]); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if err := store.Remove(letters[1]); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	letters, err = store.List()
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(letters) != 1 || letters[0].Attempts != 2 || letters[0].LastError != "failed again" {
+		t.Errorf("letter should be updated, but %+v", letters)
+	}
+}
@@ -1,14 +1,18 @@
 package entity
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
-// Content is struct of part of HTTP-Request.
+// Content is struct of part of HTTP-Request (or multipart HTTP-Response).
 type Content struct {
 	ContentType *string                `json:"content_type,omitempty"`
 	Path        *string                `json:"path,omitempty"`
 	FileName    *string                `json:"file_name,omitempty"`
 	FormName    *string                `json:"form_name,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"` // metadata of the content
+	Keep        bool                   `json:"-"`                  // the file isn't temporary, so it must not be removed
 }
 
 // Header is struct of part of headers of HTTP-Request
@@ -19,20 +23,49 @@ type Header struct {
 
 // ContentList is struct of HTTP-Request.
 type ContentList struct {
-	Method         string          `json:"method"`
-	ContentType    string          `json:"content_type"`
-	Headers        []*Header       `json:"headers"`
-	Contents       []*Content      `json:"contents"`
-	AsyncRequestID string          `json:"-"`
-	AsyncARMSToken string          `json:"-"`
-	Ctx            context.Context `json:"-"`
+	Method         string              `json:"method"`
+	ContentType    string              `json:"content_type"`
+	Headers        []*Header           `json:"headers"`
+	Contents       []*Content          `json:"contents"`
+	URLPath        string              `json:"url_path,omitempty"`    // path of request URL, like `/predict`
+	Query          map[string][]string `json:"query,omitempty"`       // parsed query string of request URL
+	RemoteAddr     string              `json:"remote_addr,omitempty"` // network address of the client
+	RequestID      string              `json:"request_id,omitempty"`  // value of `x-abeja-request-id` header
+	AsyncRequestID string              `json:"-"`
+	AsyncARMSToken string              `json:"-"`
+	CallbackURL    string              `json:"-"` // url to send the result of async request to, instead of ARMS
+	Ctx            context.Context     `json:"-"`
+	ResponseChan   chan Response       `json:"-"`                     // receives the response of sync request
+	Timeout        time.Duration       `json:"-"`                     // timeout of inference. 0 means no timeout
+	TraceParent    string              `json:"traceparent,omitempty"` // W3C traceparent of IPC round trip
+	Ledger         Ledger              `json:"-"`                     // records delivery of async request. nil when it isn't journaled
+}
+
+// Ledger records delivery of the results of async requests,
+// so that each of them is delivered to ARMS or callback url only once.
+type Ledger interface {
+	// Begin returns false when the result of the request is being delivered or has been delivered.
+	Begin(asyncRequestID string) bool
+	// Done records that the result or error of the request was delivered.
+	Done(asyncRequestID string)
 }
 
 // Response is struct of HTTP-Response.
+// When ContentType is multipart, Parts are used as the parts of body instead of Path.
+// When Streaming is true, body is not in Path but in chunks which runtime sends afterward.
 type Response struct {
 	ContentType *string            `json:"content_type,omitempty"`
 	Metadata    *map[string]string `json:"metadata,omitempty"`
 	Path        *string            `json:"path,omitempty"`
+	Parts       []*Content         `json:"parts,omitempty"`
 	ErrMsg      *string            `json:"error_message,omitempty"`
 	StatusCode  *int               `json:"status_code,omitempty"`
+	Streaming   bool               `json:"streaming,omitempty"`
+	Chunks      <-chan Chunk       `json:"-"` // receives chunks of streaming response of sync request
+}
+
+// Chunk is a part of body of streaming response.
+type Chunk struct {
+	Data []byte
+	Err  error // set to the last chunk when the stream is broken
 }
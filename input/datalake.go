@@ -0,0 +1,85 @@
+package input
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
+)
+
+// datalakeFile is part of response of `GET file info`
+type datalakeFile struct {
+	DownloadURL string                 `json:"download_url"`
+	ContentType string                 `json:"content_type"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+}
+
+func (d *datalakeFile) GetDownloadURL() string {
+	return d.DownloadURL
+}
+
+func (d *datalakeFile) GetContentType() string {
+	return d.ContentType
+}
+
+// datalakeResolver downloads files of Datalake.
+type datalakeResolver struct {
+	conf   *config.Configuration
+	option *http.Client
+}
+
+func newDatalakeResolver(conf *config.Configuration, option *http.Client) *datalakeResolver {
+	return &datalakeResolver{conf: conf, option: option}
+}
+
+// Resolve downloads the file of `<channel_id>/<file_id>`.
+// Metadata of the file is passed as it is, and the file ID is used as the name
+// when the file has no name.
+func (r *datalakeResolver) Resolve(ctx context.Context, value string, dir string) ([]*File, error) {
+	ctx, span := tracing.StartSpan(ctx, "datalake.download", tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("datalake.path", value)
+
+	downloader, err := util.NewDownloader(r.conf.APIURL, r.conf.GetAuthInfo(), r.option)
+	if err != nil {
+		return nil, errors.Errorf("failed to parse ABEJA_API_URL: %w", err)
+	}
+
+	fp, err := ioutil.TempFile(dir, "input_")
+	if err != nil {
+		return nil, errors.Errorf("failed to create temporary file: %w", err)
+	}
+	filePath := fp.Name()
+	cleanutil.Close(ctx, fp, filePath)
+
+	var file datalakeFile
+	contentType, err := downloader.Download(fmt.Sprintf("/channels/%s", value), filePath, &file)
+	if err != nil {
+		span.SetError(err)
+		cleanutil.Remove(ctx, filePath)
+		return nil, errors.Errorf("failed to download file from datalake: %w", err)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	name, _ := file.Metadata[metaFileName].(string)
+	if name == "" {
+		name = path.Base(value)
+	}
+	return []*File{{
+		Path:        filePath,
+		ContentType: contentType,
+		Name:        name,
+		Metadata:    file.Metadata,
+		Temporary:   true,
+	}}, nil
+}
@@ -0,0 +1,41 @@
+package input
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	errors "golang.org/x/xerrors"
+)
+
+// fileResolver resolves local files, which are passed to runtime as they are.
+type fileResolver struct{}
+
+func (r *fileResolver) Resolve(ctx context.Context, value string, dir string) ([]*File, error) {
+	info, err := os.Stat(value)
+	if err != nil {
+		return nil, errors.Errorf("failed to open %s: %w", value, err)
+	}
+	if !info.IsDir() {
+		name := filepath.Base(value)
+		return []*File{newFile(value, typeByName(name), name, false)}, nil
+	}
+
+	// ioutil.ReadDir returns entries sorted by name.
+	entries, err := ioutil.ReadDir(value)
+	if err != nil {
+		return nil, errors.Errorf("failed to read directory %s: %w", value, err)
+	}
+	var files []*File
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			name := entry.Name()
+			files = append(files, newFile(filepath.Join(value, name), typeByName(name), name, false))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("no file in directory %s", value)
+	}
+	return files, nil
+}
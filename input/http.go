@@ -0,0 +1,131 @@
+package input
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	errors "golang.org/x/xerrors"
+
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// these are variables to be shortened in tests.
+var (
+	downloadTimeout       = 10 * time.Minute
+	downloadRetryInterval = 1 * time.Second
+	downloadMaxRetries    = 3
+)
+
+// httpResolver downloads files from plain or signed urls.
+type httpResolver struct {
+	client *http.Client
+}
+
+func newHTTPResolver(option *http.Client) *httpResolver {
+	client := option
+	if client == nil {
+		client = &http.Client{Timeout: downloadTimeout}
+	}
+	return &httpResolver{client: client}
+}
+
+func (r *httpResolver) Resolve(ctx context.Context, value string, dir string) ([]*File, error) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid url, it must be http(s): %s", redact(value))
+	}
+	// query of signed url is a credential, so it is not logged.
+	display := redact(value)
+
+	resp, err := getWithRetry(ctx, display, func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", value, nil)
+		if err != nil {
+			return nil, backoff.Permanent(errors.Errorf(": %w", err))
+		}
+		res, err := r.client.Do(req.WithContext(ctx))
+		if uerr, ok := err.(*url.Error); ok {
+			uerr.URL = display
+		}
+		return res, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	name := path.Base(u.Path)
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil &&
+		params["filename"] != "" {
+		name = path.Base(params["filename"])
+	}
+	if name == "/" || name == "." {
+		name = ""
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = typeByName(name)
+	}
+	filePath, err := saveTemp(ctx, dir, name, resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("failed to download %s: %w", display, err)
+	}
+	return []*File{newFile(filePath, contentType, name, true)}, nil
+}
+
+// getWithRetry sends the request built by do, and retries on errors of server and network.
+// It returns the response only when it succeeded.
+func getWithRetry(ctx context.Context, display string, do func() (*http.Response, error)) (*http.Response, error) {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = downloadRetryInterval
+	b.MaxElapsedTime = 0
+
+	var resp *http.Response
+	err := backoff.RetryNotify(
+		func() error {
+			res, err := do()
+			if err != nil {
+				return err
+			}
+			if res.StatusCode >= 300 {
+				msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+				res.Body.Close()
+				err := errors.Errorf(
+					"failed to download %s with status %d, body = [%s]", display, res.StatusCode, msg)
+				if res.StatusCode < 500 &&
+					res.StatusCode != http.StatusRequestTimeout &&
+					res.StatusCode != http.StatusTooManyRequests {
+					return backoff.Permanent(err)
+				}
+				return err
+			}
+			resp = res
+			return nil
+		},
+		backoff.WithMaxRetries(b, uint64(downloadMaxRetries)),
+		func(err error, wait time.Duration) {
+			log.Warningf(ctx, "failed to download %s, retry after %s: "+log.ErrorFormat, display, wait, err)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// redact removes query and user info from the url.
+func redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid url)"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,201 @@
+// Package input resolves the files referred by INPUT (or a line of manifest)
+// into local files, which are passed to runtime.
+//
+// A reference is a JSON object which has one or more of the keys below.
+// Each value is a string or an array of strings, and each file becomes a content of the request.
+//
+//	{"$datalake:1": "<channel_id>/<file_id>"}  file of Datalake.
+//	{"$file": "<path>"}                         local file, or regular files directly under the directory.
+//	{"$http": "<url>"}                          file of plain or signed url of http(s).
+//	{"$s3": "s3://<bucket>/<key>"}              object of S3 or S3-compatible storage like MinIO.
+//
+// Files are ordered by the keys above, then by the order in the array.
+package input
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+)
+
+const (
+	KeyDatalake = "$datalake:1"
+	KeyFile     = "$file"
+	KeyHTTP     = "$http"
+	KeyS3       = "$s3"
+)
+
+// keys are the keys of reference in the order of files.
+var keys = []string{KeyDatalake, KeyFile, KeyHTTP, KeyS3}
+
+// metaFileName is the key of metadata which has the original file name, the same as Datalake.
+const metaFileName = "x-abeja-meta-filename"
+
+// Reference refers a file (or files) to be resolved.
+type Reference struct {
+	Key   string // one of KeyDatalake, KeyFile, KeyHTTP and KeyS3
+	Value string
+}
+
+// String returns the source and the uri of the reference for messages.
+// Credentials and query of url are omitted, because signed url has its signature in query.
+func (r Reference) String() string {
+	uri := r.Value
+	if r.Key == KeyHTTP {
+		if u, err := url.Parse(uri); err == nil {
+			u.User = nil
+			u.RawQuery = ""
+			u.Fragment = ""
+			uri = u.String()
+		}
+	}
+	return fmt.Sprintf("%s %s", r.Key, uri)
+}
+
+// File is a local file resolved from a reference.
+type File struct {
+	Path        string
+	ContentType string
+	Name        string // original file name, empty when unknown
+	Metadata    map[string]interface{}
+	Temporary   bool // the file was downloaded, and is removed after use
+}
+
+// Resolver makes the files of a reference available as local files.
+type Resolver interface {
+	// Resolve returns the files of value. Downloaded files are created in dir.
+	Resolve(ctx context.Context, value string, dir string) ([]*File, error)
+}
+
+// ParseReferences returns the references in obj.
+// It returns no reference if obj has none of the keys, which means obj is sent as JSON.
+func ParseReferences(obj map[string]interface{}) ([]Reference, error) {
+	var refs []Reference
+	for _, key := range keys {
+		v, ok := obj[key]
+		if !ok {
+			continue
+		}
+		switch val := v.(type) {
+		case string:
+			if val == "" {
+				return nil, errors.Errorf("invalid %s: %v", key, v)
+			}
+			refs = append(refs, Reference{Key: key, Value: val})
+		case []interface{}:
+			if len(val) == 0 {
+				return nil, errors.Errorf("invalid %s: %v", key, v)
+			}
+			for _, e := range val {
+				s, ok := e.(string)
+				if !ok || s == "" {
+					return nil, errors.Errorf("invalid %s: %v", key, v)
+				}
+				refs = append(refs, Reference{Key: key, Value: s})
+			}
+		default:
+			return nil, errors.Errorf("invalid %s: %v", key, v)
+		}
+	}
+	return refs, nil
+}
+
+// Resolve resolves all references into files in conf.RequestedDataDir.
+// When any of them failed, files already downloaded are removed.
+func Resolve(
+	ctx context.Context,
+	conf *config.Configuration,
+	refs []Reference,
+	option *http.Client) ([]*File, error) {
+
+	resolvers := make(map[string]Resolver)
+	var files []*File
+	for _, ref := range refs {
+		resolver, ok := resolvers[ref.Key]
+		if !ok {
+			var err error
+			if resolver, err = newResolver(ref.Key, conf, option); err != nil {
+				Remove(ctx, files)
+				return nil, errors.Errorf("failed to resolve %s: %w", ref, err)
+			}
+			resolvers[ref.Key] = resolver
+		}
+		resolved, err := resolver.Resolve(ctx, ref.Value, conf.RequestedDataDir)
+		if err != nil {
+			Remove(ctx, files)
+			return nil, errors.Errorf("failed to resolve %s: %w", ref, err)
+		}
+		files = append(files, resolved...)
+	}
+	return files, nil
+}
+
+func newResolver(key string, conf *config.Configuration, option *http.Client) (Resolver, error) {
+	switch key {
+	case KeyDatalake:
+		return newDatalakeResolver(conf, option), nil
+	case KeyFile:
+		return &fileResolver{}, nil
+	case KeyHTTP:
+		return newHTTPResolver(option), nil
+	case KeyS3:
+		return newS3Resolver(conf, option)
+	default:
+		return nil, errors.Errorf("unknown input source: %s", key)
+	}
+}
+
+// Remove removes temporary files.
+func Remove(ctx context.Context, files []*File) {
+	for _, f := range files {
+		if f.Temporary {
+			cleanutil.Remove(ctx, f.Path)
+		}
+	}
+}
+
+// typeByName returns the content-type guessed from the extension of name.
+func typeByName(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// newFile returns the file whose metadata has the name.
+func newFile(filePath, contentType, name string, temporary bool) *File {
+	f := &File{Path: filePath, ContentType: contentType, Name: name, Temporary: temporary}
+	if name != "" {
+		f.Metadata = map[string]interface{}{metaFileName: name}
+	}
+	return f
+}
+
+// saveTemp writes body to a temporary file in dir, which has the same extension as name.
+func saveTemp(ctx context.Context, dir, name string, body io.Reader) (string, error) {
+	fp, err := ioutil.TempFile(dir, "input_*"+filepath.Ext(name))
+	if err != nil {
+		return "", errors.Errorf("failed to create temporary file: %w", err)
+	}
+	filePath := fp.Name()
+	_, err = io.Copy(fp, body)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanutil.Remove(ctx, filePath)
+		return "", errors.Errorf("failed to write temporary file: %w", err)
+	}
+	return filePath, nil
+}
@@ -0,0 +1,67 @@
+package input
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	s3util "github.com/abeja-inc/abeja-platform-model-proxy/util/s3"
+)
+
+// s3Resolver downloads objects of S3 or S3-compatible storage.
+type s3Resolver struct {
+	client *s3util.Client
+}
+
+func newS3Resolver(conf *config.Configuration, option *http.Client) (*s3Resolver, error) {
+	client, err := s3util.NewClient(conf, option)
+	if err != nil {
+		return nil, errors.Errorf("failed to set up %s: %w", KeyS3, err)
+	}
+	return &s3Resolver{client: client}, nil
+}
+
+func (r *s3Resolver) Resolve(ctx context.Context, value string, dir string) ([]*File, error) {
+	bucket, key, err := s3util.ParseURL(value)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" || strings.HasSuffix(value, "/") {
+		return nil, errors.Errorf("key of object must be specified, prefix is not supported: %s", value)
+	}
+
+	resp, err := getWithRetry(ctx, value, func() (*http.Response, error) {
+		req, err := r.client.NewRequest(ctx, "GET", bucket, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		return r.client.Do(req, s3util.EmptyPayloadHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	name := path.Base(key)
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || contentType == "binary/octet-stream" {
+		// S3 returns `binary/octet-stream` for objects put without content-type.
+		contentType = typeByName(name)
+	}
+	filePath, err := saveTemp(ctx, dir, name, resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("failed to download %s: %w", value, err)
+	}
+	f := newFile(filePath, contentType, name, true)
+	// user-defined metadata of the object is passed as it is.
+	for k, v := range resp.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-meta-") && len(v) > 0 {
+			f.Metadata[lk] = v[0]
+		}
+	}
+	return []*File{f}, nil
+}
@@ -0,0 +1,362 @@
+// Package journal persists accepted async requests of ARMS on local disk,
+// so that they are processed after the runner restarts, and records their
+// delivery so that each of them ends in a result or error.
+//
+// The result is delivered at least once, not exactly once. When the runner
+// crashes after the result is sent but before Done is recorded, the request
+// is processed and its result is sent again after restart.
+//
+// Layout of the directory is:
+//
+//	<dir>/journal.jsonl           one record per line
+//	<dir>/payloads/<payload>/...  files of request contents
+//
+// Content files are moved from RequestedDataDir into the journal directory,
+// because RequestedDataDir is a temporary directory removed on exit.
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+const journalFileName = "journal.jsonl"
+const payloadsDirName = "payloads"
+
+const (
+	opAccept  = "accept"
+	opDeliver = "deliver"
+)
+
+// ErrAlreadyAccepted is returned when the async request is accepted but not yet delivered.
+var ErrAlreadyAccepted = errors.New("async request is already accepted")
+
+type state int
+
+const (
+	statePending state = iota
+	stateDelivering
+)
+
+// record is a line of the journal.
+// The token of ARMS isn't kept, so the result of restored request is sent with the platform credentials.
+type record struct {
+	Op        string              `json:"op"`
+	ID        string              `json:"id"`
+	At        time.Time           `json:"at"`
+	Payload   string              `json:"payload,omitempty"`
+	Callback  string              `json:"callback,omitempty"`
+	RequestID string              `json:"request_id,omitempty"`
+	Timeout   time.Duration       `json:"timeout,omitempty"`
+	Request   *entity.ContentList `json:"request,omitempty"`
+}
+
+// Journal records async requests from acceptance to delivery of their results.
+// It implements entity.Ledger.
+type Journal struct {
+	dir string
+
+	mu      sync.Mutex
+	pending map[string]*record
+	states  map[string]state
+	seq     int
+}
+
+// Open opens the journal in dir, and drops records of delivered requests from it.
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Join(dir, payloadsDirName), 0700); err != nil {
+		return nil, errors.Errorf("failed to create journal directory: %w", err)
+	}
+	pending, err := readPending(filepath.Join(dir, journalFileName))
+	if err != nil {
+		return nil, errors.Errorf("failed to read journal: %w", err)
+	}
+	j := &Journal{
+		dir:     dir,
+		pending: pending,
+		states:  make(map[string]state),
+	}
+	for id := range pending {
+		j.states[id] = statePending
+	}
+	if err := j.compact(); err != nil {
+		return nil, errors.Errorf("failed to compact journal: %w", err)
+	}
+	return j, nil
+}
+
+// Pending returns async requests which were accepted but not delivered, in order of acceptance.
+func (j *Journal) Pending() []entity.ContentList {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	records := make([]*record, 0, len(j.pending))
+	for _, rec := range j.pending {
+		records = append(records, rec)
+	}
+	sortByTime(records)
+
+	list := make([]entity.ContentList, 0, len(records))
+	for _, rec := range records {
+		cl := *rec.Request
+		cl.Contents = make([]*entity.Content, len(rec.Request.Contents))
+		for i, c := range rec.Request.Contents {
+			content := *c
+			path := filepath.Join(j.dir, *c.Path)
+			content.Path = &path
+			cl.Contents[i] = &content
+		}
+		ctx := context.Background()
+		if rec.RequestID != "" {
+			ctx = context.WithValue(ctx, log.KeyRequestID, rec.RequestID) //nolint // SA1029: should not use built-in type string as key for value; define your own type to avoid collisions
+		}
+		cl.Ctx = ctx
+		cl.AsyncRequestID = rec.ID
+		cl.CallbackURL = rec.Callback
+		cl.Timeout = rec.Timeout
+		cl.Ledger = j
+		list = append(list, cl)
+	}
+	return list
+}
+
+// Accept moves content files of the async request into the journal, and records it.
+// Paths of contents in cl are changed to the moved ones, and cl.Ledger is set to j.
+// It returns ErrAlreadyAccepted when the request of the same id is waiting for delivery.
+func (j *Journal) Accept(cl *entity.ContentList, requestID string) error {
+	j.mu.Lock()
+	if _, ok := j.states[cl.AsyncRequestID]; ok {
+		j.mu.Unlock()
+		return ErrAlreadyAccepted
+	}
+	// reserve the id, not to accept the same request at the same time.
+	j.states[cl.AsyncRequestID] = statePending
+	j.seq++
+	payload := fmt.Sprintf("%d-%d", time.Now().UnixNano(), j.seq)
+	j.mu.Unlock()
+
+	payloadDir := filepath.Join(j.dir, payloadsDirName, payload)
+	if err := os.MkdirAll(payloadDir, 0700); err != nil {
+		j.release(cl.AsyncRequestID)
+		return errors.Errorf("failed to create payload directory: %w", err)
+	}
+	request := *cl
+	request.Contents = make([]*entity.Content, len(cl.Contents))
+	paths := make([]string, len(cl.Contents))
+	for i, c := range cl.Contents {
+		rel := filepath.Join(payloadsDirName, payload, fmt.Sprintf("content-%d", i))
+		if err := util.MoveFile(*c.Path, filepath.Join(j.dir, rel)); err != nil {
+			cleanutil.RemoveAll(context.Background(), payloadDir)
+			j.release(cl.AsyncRequestID)
+			return errors.Errorf("failed to move content into journal: %w", err)
+		}
+		relPath := rel
+		content := *c
+		content.Path = &relPath
+		request.Contents[i] = &content
+		paths[i] = filepath.Join(j.dir, rel)
+	}
+
+	rec := &record{
+		Op:        opAccept,
+		ID:        cl.AsyncRequestID,
+		At:        time.Now(),
+		Payload:   payload,
+		Callback:  cl.CallbackURL,
+		RequestID: requestID,
+		Timeout:   cl.Timeout,
+		Request:   &request,
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.append(rec); err != nil {
+		cleanutil.RemoveAll(context.Background(), payloadDir)
+		delete(j.states, rec.ID)
+		return err
+	}
+	j.pending[rec.ID] = rec
+	for i, c := range cl.Contents {
+		path := paths[i]
+		c.Path = &path
+	}
+	cl.Ledger = j
+	return nil
+}
+
+func (j *Journal) release(id string) {
+	j.mu.Lock()
+	delete(j.states, id)
+	j.mu.Unlock()
+}
+
+// Begin returns true when the result of the async request can be delivered,
+// and false when it is being delivered by another or has been delivered.
+func (j *Journal) Begin(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st, ok := j.states[id]
+	if !ok || st != statePending {
+		return false
+	}
+	j.states[id] = stateDelivering
+	return true
+}
+
+// Done records that the result or error of the async request was delivered,
+// and removes its content files.
+func (j *Journal) Done(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec, ok := j.pending[id]
+	if !ok {
+		return
+	}
+	if err := j.append(&record{Op: opDeliver, ID: id, At: time.Now()}); err != nil {
+		// the request may be delivered again after restart.
+		log.Warningf(context.Background(), "failed to record delivery of async request %s: "+log.ErrorFormat, id, err)
+	}
+	delete(j.pending, id)
+	delete(j.states, id)
+	cleanutil.RemoveAll(context.Background(), filepath.Join(j.dir, payloadsDirName, rec.Payload))
+}
+
+// Discard records the async request as finished without delivery,
+// because the request is rejected before it is queued.
+func (j *Journal) Discard(id string) {
+	j.Done(id)
+}
+
+// Len returns the number of async requests waiting for delivery.
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.pending)
+}
+
+// append writes the record to the journal and syncs it, so that it survives a crash.
+func (j *Journal) append(rec *record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Errorf("failed to marshal journal record: %w", err)
+	}
+	path := filepath.Join(j.dir, journalFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Errorf("failed to open journal: %w", err)
+	}
+	defer cleanutil.Close(context.Background(), f, path)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return errors.Errorf("failed to write journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the journal with pending records only, and removes payloads of the others.
+func (j *Journal) compact() error {
+	records := make([]*record, 0, len(j.pending))
+	payloads := make(map[string]bool)
+	for _, rec := range j.pending {
+		records = append(records, rec)
+		payloads[rec.Payload] = true
+	}
+	sortByTime(records)
+
+	path := filepath.Join(j.dir, journalFileName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			cleanutil.Close(context.Background(), f, tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		cleanutil.Close(context.Background(), f, tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		cleanutil.Close(context.Background(), f, tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(j.dir, payloadsDirName))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !payloads[entry.Name()] {
+			cleanutil.RemoveAll(context.Background(), filepath.Join(j.dir, payloadsDirName, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// readPending returns accepted records without delivery by id.
+func readPending(path string) (map[string]*record, error) {
+	pending := make(map[string]*record)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pending, nil
+		}
+		return nil, err
+	}
+	defer cleanutil.Close(context.Background(), f, path)
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec record
+			if jsonErr := json.Unmarshal(line, &rec); jsonErr != nil {
+				// the last line may be broken by a crash while writing.
+				log.Warningf(context.Background(), "skip broken line of journal: "+log.ErrorFormat, jsonErr)
+			} else if rec.Op == opAccept && rec.Request != nil {
+				pending[rec.ID] = &rec
+			} else if rec.Op == opDeliver {
+				delete(pending, rec.ID)
+			}
+		}
+		if err == io.EOF {
+			return pending, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func sortByTime(records []*record) {
+	sort.Slice(records, func(i, k int) bool {
+		return records[i].At.Before(records[k].At)
+	})
+}
@@ -0,0 +1,182 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+)
+
+func newContentList(t *testing.T, dataDir string, asyncRequestID string, body string) *entity.ContentList {
+	t.Helper()
+	f, err := ioutil.TempFile(dataDir, "")
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if _, err := f.WriteString(body); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	path := f.Name()
+	return &entity.ContentList{
+		Method:         "POST",
+		ContentType:    "application/json",
+		Headers:        []*entity.Header{{Key: "content-type", Values: []string{"application/json"}}},
+		Contents:       []*entity.Content{{Path: &path}},
+		AsyncRequestID: asyncRequestID,
+		AsyncARMSToken: "token-" + asyncRequestID,
+		Timeout:        3 * time.Second,
+	}
+}
+
+func TestJournal_AcceptAndRestore(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	for _, id := range []string{"req-1", "req-2"} {
+		cl := newContentList(t, dataDir, id, `{"id": "`+id+`"}`)
+		src := *cl.Contents[0].Path
+		if err := j.Accept(cl, "x-"+id); err != nil {
+			t.Fatal("unexpected error occurred:", err)
+		}
+		if cl.Ledger != j {
+			t.Error("Ledger should be set to journal")
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Errorf("content should be moved from %s", src)
+		}
+		if !strings.HasPrefix(*cl.Contents[0].Path, dir) {
+			t.Errorf("content should be moved into journal, but %s", *cl.Contents[0].Path)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if strings.Contains(string(data), "token-") {
+		t.Error("token of ARMS should not be written to journal")
+	}
+	if err := j.Accept(newContentList(t, dataDir, "req-1", "{}"), ""); err != ErrAlreadyAccepted {
+		t.Errorf("pending request should not be accepted again, but %v", err)
+	}
+
+	// req-1 is delivered, and req-2 is lost by restart.
+	if !j.Begin("req-1") {
+		t.Fatal("pending request should be deliverable")
+	}
+	if j.Begin("req-1") {
+		t.Error("request being delivered should not be delivered again")
+	}
+	j.Done("req-1")
+	if j.Begin("req-1") {
+		t.Error("delivered request should not be delivered again")
+	}
+
+	restored, err := Open(dir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	pending := restored.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("1 request should be restored, but %d", len(pending))
+	}
+	cl := pending[0]
+	if cl.AsyncRequestID != "req-2" || cl.AsyncARMSToken != "" || cl.Timeout != 3*time.Second {
+		t.Errorf("async request should be restored, but %+v", cl)
+	}
+	if cl.Method != "POST" || cl.ContentType != "application/json" || len(cl.Headers) != 1 {
+		t.Errorf("request should be restored, but %+v", cl)
+	}
+	if cl.Ledger != restored || cl.Ctx == nil {
+		t.Error("Ledger and Ctx should be set to restored request")
+	}
+	body, err := ioutil.ReadFile(*cl.Contents[0].Path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if string(body) != `{"id": "req-2"}` {
+		t.Errorf("content should be restored, but %s", string(body))
+	}
+
+	if !restored.Begin("req-2") {
+		t.Fatal("restored request should be deliverable")
+	}
+	restored.Done("req-2")
+	if restored.Len() != 0 {
+		t.Errorf("no request should be pending, but %d", restored.Len())
+	}
+
+	restored, err = Open(dir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(restored.Pending()) != 0 {
+		t.Error("delivered requests should not be restored")
+	}
+	payloads, err := ioutil.ReadDir(filepath.Join(dir, payloadsDirName))
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(payloads) != 0 {
+		t.Errorf("payloads of delivered requests should be removed, but %d remain", len(payloads))
+	}
+}
+
+func TestJournal_BrokenLine(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if err := j.Accept(newContentList(t, dataDir, "req-1", "{}"), ""); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	// crashed while writing the next record.
+	f, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"op":"accept","id":"req-2","payl`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Open(dir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	pending := restored.Pending()
+	if len(pending) != 1 || pending[0].AsyncRequestID != "req-1" {
+		t.Errorf("only req-1 should be restored, but %+v", pending)
+	}
+}
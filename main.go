@@ -3,12 +3,12 @@ package main
 import (
 	"context"
 	"os"
-
-	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"time"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/cmd"
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
 	"github.com/abeja-inc/abeja-platform-model-proxy/version"
 )
 
@@ -21,20 +21,42 @@ func main() {
 }
 
 func execute(procCtx context.Context) int {
-	if setupDD(procCtx) {
-		defer tracer.Stop()
+	if tracer := setupTracer(procCtx); tracer != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(procCtx, 5*time.Second)
+			defer cancel()
+			if err := tracer.Shutdown(ctx); err != nil {
+				log.Warningf(procCtx, "failed to shutdown tracer: "+log.ErrorFormat, err)
+			}
+		}()
 	}
 	return cmd.Execute(procCtx)
 }
 
-func setupDD(procCtx context.Context) bool {
+// setupTracer sets up OTLP exporter if `OTEL_*` is set, otherwise datadog if its agent is set.
+func setupTracer(procCtx context.Context) tracing.Tracer {
+	otlpConf, enabled, err := config.GetOTLPTraceConfig()
+	if err != nil {
+		log.Warningf(procCtx, "OTLP exporter is not set up: "+log.ErrorFormat, err)
+	} else if enabled {
+		tracer, err := tracing.NewOTLPTracer(procCtx, otlpConf)
+		if err != nil {
+			log.Warningf(procCtx, "OTLP exporter is not set up: "+log.ErrorFormat, err)
+			return nil
+		}
+		tracing.SetTracer(tracer)
+		log.Debug(procCtx, "OTLP exporter is set up.")
+		return tracer
+	}
+
 	options := config.GetTraceOptions()
 	if len(options) == 0 {
 		// datadog is not set because the datadog-agent host is not set
 		log.Debug(procCtx, "datadog is not set up.")
-		return false
+		return nil
 	}
-	tracer.Start(options...)
+	tracer := tracing.NewDatadogTracer(options, config.GetHTTPTraceOptions())
+	tracing.SetTracer(tracer)
 	log.Debug(procCtx, "datadog is set up.")
-	return true
+	return tracer
 }
@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+const (
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+)
+
+// checkpointRecord is a line of checkpoint.
+type checkpointRecord struct {
+	Key    string    `json:"key"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Checkpoint records the outcome of each item, so that succeeded items are
+// skipped when the batch is resumed. Failed items are processed again.
+type Checkpoint struct {
+	path string
+
+	mu        sync.Mutex
+	file      *os.File
+	succeeded map[string]bool
+}
+
+// OpenCheckpoint reads the checkpoint at path if exists, and opens it to append records.
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	succeeded, err := readCheckpoint(path)
+	if err != nil {
+		return nil, errors.Errorf("failed to read checkpoint: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Errorf("failed to open checkpoint: %w", err)
+	}
+	return &Checkpoint{path: path, file: f, succeeded: succeeded}, nil
+}
+
+// Succeeded returns true when the item had succeeded before.
+func (c *Checkpoint) Succeeded(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.succeeded[key]
+}
+
+// Record records the outcome of the item. err is nil when the item succeeded.
+func (c *Checkpoint) Record(key string, err error) error {
+	rec := checkpointRecord{Key: key, Status: statusSucceeded, At: time.Now()}
+	if err != nil {
+		rec.Status = statusFailed
+		rec.Error = err.Error()
+	}
+	line, merr := json.Marshal(rec)
+	if merr != nil {
+		return errors.Errorf("failed to marshal checkpoint record: %w", merr)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return errors.Errorf("failed to write checkpoint: %w", err)
+	}
+	if rec.Status == statusSucceeded {
+		c.succeeded[key] = true
+	}
+	return nil
+}
+
+// Close syncs and closes the checkpoint.
+func (c *Checkpoint) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.file.Sync(); err != nil {
+		cleanutil.Close(context.Background(), c.file, c.path)
+		return errors.Errorf("failed to sync checkpoint: %w", err)
+	}
+	return c.file.Close()
+}
+
+func readCheckpoint(path string) (map[string]bool, error) {
+	succeeded := make(map[string]bool)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return succeeded, nil
+		}
+		return nil, err
+	}
+	defer cleanutil.Close(context.Background(), f, path)
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec checkpointRecord
+			if jsonErr := json.Unmarshal(line, &rec); jsonErr != nil {
+				// the last line may be broken by a crash while writing.
+				log.Warningf(context.Background(), "skip broken line of checkpoint: "+log.ErrorFormat, jsonErr)
+			} else if rec.Status == statusSucceeded {
+				succeeded[rec.Key] = true
+			}
+		}
+		if err == io.EOF {
+			return succeeded, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package manifest reads the list of inputs of batch, and keeps track of
+// the progress of them so that an interrupted batch can be resumed.
+//
+// A manifest is one of:
+//
+//	JSONL file  each line is an input. A line which refers files like
+//	            `{"$datalake:1": "<channel_id>/<file_id>"}` (see package input) is
+//	            the files, and the other JSON values are sent as they are.
+//	directory   each regular file directly under it is an input.
+//
+// Items are identified by line number or file name, so the manifest must not
+// be changed before the batch is resumed.
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/input"
+)
+
+// Item is an input of batch.
+// One of JSON, References and FilePath is set, unless Err is set.
+type Item struct {
+	Index      int               // position in manifest, starting with 0
+	Key        string            // identifies the item in checkpoint
+	JSON       []byte            // JSON value sent to runtime
+	References []input.Reference // files referred by the line
+	FilePath   string            // path of local file
+	Err        error             // the item is broken, which fails only the item
+}
+
+// Manifest reads items one by one, not to keep all of them in memory.
+type Manifest struct {
+	file   *os.File
+	reader *bufio.Reader
+	line   int
+
+	dir   string
+	files []os.FileInfo
+
+	index int
+}
+
+// Open opens the manifest at path, which is a JSONL file or a directory.
+func Open(path string) (*Manifest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Errorf("failed to open manifest: %w", err)
+	}
+	if info.IsDir() {
+		// ioutil.ReadDir returns entries sorted by name.
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, errors.Errorf("failed to read manifest directory: %w", err)
+		}
+		files := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() {
+				files = append(files, entry)
+			}
+		}
+		return &Manifest{dir: path, files: files}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Errorf("failed to open manifest: %w", err)
+	}
+	return &Manifest{file: f, reader: bufio.NewReader(f)}, nil
+}
+
+// Next returns the next item, or io.EOF when all items are read.
+func (m *Manifest) Next() (*Item, error) {
+	if m.file == nil {
+		if m.index >= len(m.files) {
+			return nil, io.EOF
+		}
+		name := m.files[m.index].Name()
+		item := &Item{Index: m.index, Key: name, FilePath: filepath.Join(m.dir, name)}
+		m.index++
+		return item, nil
+	}
+
+	for {
+		line, err := m.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Errorf("failed to read manifest: %w", err)
+		}
+		if len(line) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		m.line++
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		item := parseLine(line)
+		item.Index = m.index
+		item.Key = fmt.Sprintf("line:%d", m.line)
+		m.index++
+		return item, nil
+	}
+}
+
+func parseLine(line []byte) *Item {
+	var value interface{}
+	if err := json.Unmarshal(line, &value); err != nil {
+		return &Item{Err: errors.Errorf("invalid JSON: %w", err)}
+	}
+	if obj, ok := value.(map[string]interface{}); ok {
+		refs, err := input.ParseReferences(obj)
+		if err != nil {
+			return &Item{Err: err}
+		}
+		if len(refs) > 0 {
+			return &Item{References: refs}
+		}
+	}
+	return &Item{JSON: line}
+}
+
+// Close closes the manifest.
+func (m *Manifest) Close() error {
+	if m.file == nil {
+		return nil
+	}
+	return m.file.Close()
+}
@@ -0,0 +1,163 @@
+package manifest
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/input"
+)
+
+func readAll(t *testing.T, m *Manifest) []*Item {
+	t.Helper()
+	var items []*Item
+	for {
+		item, err := m.Next()
+		if err == io.EOF {
+			return items
+		}
+		if err != nil {
+			t.Fatal("unexpected error occurred:", err)
+		}
+		items = append(items, item)
+	}
+}
+
+func TestManifest_JSONL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "manifest.jsonl")
+	lines := "{\"foo\": 1}\n\n{\"$datalake:1\": \"1234/20200101T000000-abcd\"}\n{broken\n[1, 2]"
+	if err := ioutil.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer m.Close()
+	items := readAll(t, m)
+	if len(items) != 4 {
+		t.Fatalf("4 items should be read, but %d", len(items))
+	}
+	if items[0].Key != "line:1" || string(items[0].JSON) != `{"foo": 1}` {
+		t.Errorf("JSON should be read, but %+v", items[0])
+	}
+	expectRefs := []input.Reference{{Key: input.KeyDatalake, Value: "1234/20200101T000000-abcd"}}
+	if items[1].Index != 1 || items[1].Key != "line:3" || !reflect.DeepEqual(items[1].References, expectRefs) {
+		t.Errorf("file of Datalake should be read, but %+v", items[1])
+	}
+	if items[2].Key != "line:4" || items[2].Err == nil {
+		t.Errorf("broken line should be an item with error, but %+v", items[2])
+	}
+	if items[3].Index != 3 || string(items[3].JSON) != "[1, 2]" {
+		t.Errorf("last line without newline should be read, but %+v", items[3])
+	}
+}
+
+func TestManifest_Directory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b.jpg", "a.png"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Open(dir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer m.Close()
+	items := readAll(t, m)
+	if len(items) != 2 {
+		t.Fatalf("2 files should be read, but %d", len(items))
+	}
+	if items[0].Key != "a.png" || items[0].FilePath != filepath.Join(dir, "a.png") || items[1].Key != "b.jpg" {
+		t.Errorf("files should be read in order of name, but %+v, %+v", items[0], items[1])
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.jsonl")
+
+	c, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if err := c.Record("line:1", nil); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if err := c.Record("line:2", errors.New("runtime returned error status 500.")); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if !c.Succeeded("line:1") || c.Succeeded("line:2") {
+		t.Error("only succeeded item should be skipped")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	resumed, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer resumed.Close()
+	if !resumed.Succeeded("line:1") || resumed.Succeeded("line:2") || resumed.Succeeded("line:3") {
+		t.Error("only succeeded item should be skipped after resume")
+	}
+}
+
+func TestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+
+	report := NewReport("manifest.jsonl")
+	report.Skip()
+	report.Add("line:2", nil)
+	report.Add("line:3", errors.New("failed"))
+	report.Finish(false)
+	if err := report.Write(path); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := &Report{}
+	if err := json.Unmarshal(data, written); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if written.Total != 3 || written.Succeeded != 1 || written.Failed != 1 || written.Skipped != 1 {
+		t.Errorf("counts should be written, but %+v", written)
+	}
+	if len(written.Failures) != 1 || written.Failures[0].Key != "line:3" || written.Failures[0].Error != "failed" {
+		t.Errorf("failures should be written, but %+v", written.Failures)
+	}
+}
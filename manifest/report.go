@@ -0,0 +1,88 @@
+package manifest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+// Failure is an item which failed.
+type Failure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// Report is the summary of batch.
+type Report struct {
+	Manifest    string    `json:"manifest"`
+	Total       int       `json:"total"`
+	Succeeded   int       `json:"succeeded"`
+	Failed      int       `json:"failed"`
+	Skipped     int       `json:"skipped"` // succeeded before resume
+	Interrupted bool      `json:"interrupted"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Failures    []Failure `json:"failures"`
+
+	mu sync.Mutex
+}
+
+// NewReport returns the report of batch over manifest, which starts now.
+func NewReport(manifest string) *Report {
+	return &Report{
+		Manifest:  manifest,
+		StartedAt: time.Now(),
+		Failures:  []Failure{},
+	}
+}
+
+// Skip counts the item which had succeeded before.
+func (r *Report) Skip() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Total++
+	r.Skipped++
+}
+
+// Add counts the outcome of the item. err is nil when the item succeeded.
+func (r *Report) Add(key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Total++
+	if err == nil {
+		r.Succeeded++
+		return
+	}
+	r.Failed++
+	r.Failures = append(r.Failures, Failure{Key: key, Error: err.Error()})
+}
+
+// Finish marks the end of batch.
+func (r *Report) Finish(interrupted bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Interrupted = interrupted
+	r.FinishedAt = time.Now()
+}
+
+// Write writes the report to path as JSON.
+func (r *Report) Write(path string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return errors.Errorf("failed to marshal report: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Errorf("failed to write report: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
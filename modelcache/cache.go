@@ -0,0 +1,355 @@
+// Package modelcache keeps archives of models downloaded from ABEJA Platform on local disk,
+// so that a runner restarted on the same node skips downloading them again.
+//
+// Archives are content-addressed, i.e. stored by their SHA256, and each entry maps a key,
+// which identifies a model version or a training job, to its archive:
+//
+//	<dir>/lock                  lock of the whole cache, held while entries are changed
+//	<dir>/entries/<hash>.json   entry of key, whose name is SHA256 of the key
+//	<dir>/entries/<hash>.lock   lock of key, held while the archive is downloaded or used
+//	<dir>/blobs/<sha256>        archive
+//	<dir>/tmp/<hash>            archive of key being downloaded
+//
+// Several runners on a node can share the cache. Runners of the same key wait for
+// the first one to download the archive, and archives in use are never evicted.
+// The integrity of archive is checked every time it is used.
+package modelcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	errors "golang.org/x/xerrors"
+
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// staleTmpAge is the age of temporary files regarded as left by crashed runners.
+const staleTmpAge = 24 * time.Hour
+
+var lookups = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "abeja_proxy_model_cache_lookups_total",
+		Help: "Number of lookups of model cache by result (hit, miss, broken).",
+	},
+	[]string{"result"})
+
+// entry is the record of key.
+type entry struct {
+	Key      string    `json:"key"`
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+
+	name string // name of entry file without extension
+}
+
+// Cache is the cache of archives in a directory.
+type Cache struct {
+	dir     string
+	maxSize int64
+}
+
+// Open opens the cache in dir, whose archives are kept within maxSize bytes in total.
+func Open(dir string, maxSize int64) (*Cache, error) {
+	if maxSize <= 0 {
+		return nil, errors.Errorf("max size of model cache must be greater than 0, but %d", maxSize)
+	}
+	c := &Cache{dir: dir, maxSize: maxSize}
+	for _, d := range []string{c.entriesDir(), c.blobsDir(), c.tmpDir()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, errors.Errorf("failed to create directory of model cache: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Cache) entriesDir() string {
+	return filepath.Join(c.dir, "entries")
+}
+
+func (c *Cache) blobsDir() string {
+	return filepath.Join(c.dir, "blobs")
+}
+
+func (c *Cache) tmpDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+func (c *Cache) entryPath(name string) string {
+	return filepath.Join(c.entriesDir(), name+".json")
+}
+
+func (c *Cache) keyLockPath(name string) string {
+	return filepath.Join(c.entriesDir(), name+".lock")
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.blobsDir(), digest)
+}
+
+// Fetch returns the path of the archive of key.
+// When the archive isn't cached or is broken, fetch is called to download it to the given path,
+// where the partial download of previous fetch may be left.
+// The archive must not be modified, and release must be called after it is used.
+func (c *Cache) Fetch(
+	ctx context.Context,
+	key string,
+	fetch func(path string) error) (string, func(), error) {
+
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	keyLock, err := lockFile(c.keyLockPath(name))
+	if err != nil {
+		return "", nil, err
+	}
+	release := keyLock.unlock
+
+	blob, err := c.lookup(ctx, name)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	if blob != "" {
+		lookups.WithLabelValues("hit").Inc()
+		log.Infof(ctx, "model cache hit: %s", key)
+		return blob, release, nil
+	}
+
+	lookups.WithLabelValues("miss").Inc()
+	log.Infof(ctx, "model cache miss: %s", key)
+	blob, err = c.store(ctx, key, name, fetch)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	return blob, release, nil
+}
+
+// lookup returns the path of the archive of the entry, or empty if it isn't cached.
+func (c *Cache) lookup(ctx context.Context, name string) (string, error) {
+	lock, err := lockFile(filepath.Join(c.dir, "lock"))
+	if err != nil {
+		return "", err
+	}
+	e, err := readEntry(c.entryPath(name))
+	if err != nil || e == nil {
+		lock.unlock()
+		return "", err
+	}
+	e.LastUsed = time.Now()
+	err = writeEntry(c.entryPath(name), e)
+	lock.unlock()
+	if err != nil {
+		return "", err
+	}
+
+	// the archive isn't evicted while the lock of key is held, so it can be checked without the lock of cache.
+	blob := c.blobPath(e.Digest)
+	digest, _, err := digestOf(blob)
+	if err == nil && digest == e.Digest {
+		return blob, nil
+	}
+	lookups.WithLabelValues("broken").Inc()
+	log.Warningf(ctx, "archive of model cache is broken, so download it again: %s", e.Key)
+
+	lock, err = lockFile(filepath.Join(c.dir, "lock"))
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+	cleanutil.Remove(ctx, c.entryPath(name))
+	if _, err := os.Stat(blob); err == nil {
+		cleanutil.Remove(ctx, blob)
+	}
+	return "", nil
+}
+
+// store downloads the archive of key by fetch, and adds it to the cache.
+func (c *Cache) store(
+	ctx context.Context,
+	key string,
+	name string,
+	fetch func(path string) error) (string, error) {
+
+	// the path is fixed by key, so fetch can resume the download interrupted before.
+	// it's left on failure for the same reason, and removed when it gets stale.
+	tmp := filepath.Join(c.tmpDir(), name)
+	if err := fetch(tmp); err != nil {
+		return "", err
+	}
+	digest, size, err := digestOf(tmp)
+	if err != nil {
+		cleanutil.Remove(ctx, tmp)
+		return "", err
+	}
+
+	lock, err := lockFile(filepath.Join(c.dir, "lock"))
+	if err != nil {
+		cleanutil.Remove(ctx, tmp)
+		return "", err
+	}
+	defer lock.unlock()
+
+	blob := c.blobPath(digest)
+	if _, err := os.Stat(blob); err == nil {
+		// the same archive is cached by another key.
+		cleanutil.Remove(ctx, tmp)
+	} else if err := os.Rename(tmp, blob); err != nil {
+		cleanutil.Remove(ctx, tmp)
+		return "", errors.Errorf("failed to move archive to model cache: %w", err)
+	}
+	e := &entry{Key: key, Digest: digest, Size: size, LastUsed: time.Now()}
+	if err := writeEntry(c.entryPath(name), e); err != nil {
+		return "", err
+	}
+	c.evict(ctx, name)
+	return blob, nil
+}
+
+// evict removes entries least recently used until archives fit in max size,
+// except the entry of current and entries in use. The lock of cache must be held.
+func (c *Cache) evict(ctx context.Context, current string) {
+	c.removeStaleTmp(ctx)
+
+	entries, err := c.entries()
+	if err != nil {
+		log.Warningf(ctx, "failed to read entries of model cache: "+log.ErrorFormat, err)
+		return
+	}
+	refs := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, e := range entries {
+		refs[e.Digest]++
+		sizes[e.Digest] = e.Size
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	for _, e := range entries {
+		if total <= c.maxSize {
+			return
+		}
+		if e.name == current {
+			continue
+		}
+		keyLock, err := tryLockFile(c.keyLockPath(e.name))
+		if err != nil {
+			log.Warningf(ctx, "failed to lock entry of model cache: "+log.ErrorFormat, err)
+			continue
+		}
+		if keyLock == nil {
+			// the archive is in use.
+			continue
+		}
+		cleanutil.Remove(ctx, c.entryPath(e.name))
+		refs[e.Digest]--
+		if refs[e.Digest] == 0 {
+			cleanutil.Remove(ctx, c.blobPath(e.Digest))
+			total -= e.Size
+		}
+		keyLock.unlock()
+		log.Infof(ctx, "evicted from model cache: %s", e.Key)
+	}
+	if total > c.maxSize {
+		log.Warningf(ctx, "model cache exceeds max size %d bytes, because archives are in use", c.maxSize)
+	}
+}
+
+func (c *Cache) entries() ([]*entry, error) {
+	files, err := ioutil.ReadDir(c.entriesDir())
+	if err != nil {
+		return nil, err
+	}
+	var entries []*entry
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		e, err := readEntry(filepath.Join(c.entriesDir(), f.Name()))
+		if err != nil {
+			log.Warningf(context.TODO(), "skip broken entry of model cache: "+log.ErrorFormat, err)
+			continue
+		}
+		if e != nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (c *Cache) removeStaleTmp(ctx context.Context) {
+	files, err := ioutil.ReadDir(c.tmpDir())
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) > staleTmpAge {
+			cleanutil.Remove(ctx, filepath.Join(c.tmpDir(), f.Name()))
+		}
+	}
+}
+
+// readEntry returns the entry at path, or nil if not exists.
+func readEntry(path string) (*entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Errorf("failed to read entry of model cache: %w", err)
+	}
+	e := &entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, errors.Errorf("failed to parse entry of model cache %s: %w", path, err)
+	}
+	e.name = strings.TrimSuffix(filepath.Base(path), ".json")
+	return e, nil
+}
+
+func writeEntry(path string, e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Errorf("failed to marshal entry of model cache: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Errorf("failed to write entry of model cache: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Errorf("failed to write entry of model cache: %w", err)
+	}
+	return nil
+}
+
+// digestOf returns SHA256 and size of the file.
+func digestOf(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, errors.Errorf("failed to open archive: %w", err)
+	}
+	defer cleanutil.Close(context.TODO(), f, path)
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, errors.Errorf("failed to read archive: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,209 @@
+package modelcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, maxSize int64) (*Cache, func()) {
+	dir, err := ioutil.TempDir("", "modelcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(dir, maxSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("Unexpected Error occurred: ", err)
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+// fetchOf returns the function to fetch which writes content, and the counter of calls.
+func fetchOf(content string) (func(string) error, *int32) {
+	var calls int32
+	return func(path string) error {
+		atomic.AddInt32(&calls, 1)
+		return ioutil.WriteFile(path, []byte(content), 0644)
+	}, &calls
+}
+
+func fetchAndRead(t *testing.T, c *Cache, key string, fetch func(string) error) string {
+	path, release, err := c.Fetch(context.TODO(), key, fetch)
+	if err != nil {
+		t.Fatal("Unexpected Error occurred: ", err)
+	}
+	defer release()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFetch(t *testing.T) {
+	c, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	fetch, calls := fetchOf("model")
+	for i := 0; i < 2; i++ {
+		if content := fetchAndRead(t, c, "models/1/versions/1", fetch); content != "model" {
+			t.Errorf("content should be [model], but [%s]", content)
+		}
+	}
+	if *calls != 1 {
+		t.Errorf("archive should be downloaded once, but %d times", *calls)
+	}
+
+	// the same archive of another key is stored once.
+	fetchAndRead(t, c, "models/1/versions/2", fetch)
+	blobs, _ := ioutil.ReadDir(c.blobsDir())
+	if len(blobs) != 1 {
+		t.Errorf("the same archive should be stored once, but %d", len(blobs))
+	}
+}
+
+func TestFetch_Broken(t *testing.T) {
+	c, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	fetch, calls := fetchOf("model")
+	path, release, err := c.Fetch(context.TODO(), "key", fetch)
+	if err != nil {
+		t.Fatal("Unexpected Error occurred: ", err)
+	}
+	release()
+	if err := ioutil.WriteFile(path, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := fetchAndRead(t, c, "key", fetch); content != "model" {
+		t.Errorf("broken archive should be downloaded again, but [%s]", content)
+	}
+	if *calls != 2 {
+		t.Errorf("archive should be downloaded twice, but %d times", *calls)
+	}
+}
+
+func TestFetch_Error(t *testing.T) {
+	c, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	_, _, err := c.Fetch(context.TODO(), "key", func(path string) error {
+		if err := ioutil.WriteFile(path, []byte("mod"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return os.ErrNotExist
+	})
+	if err == nil {
+		t.Fatal("Error should be raised")
+	}
+
+	// the lock of key is released on failure, and the partial download is left to be resumed.
+	content := fetchAndRead(t, c, "key", func(path string) error {
+		partial, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, append(partial, []byte("el")...), 0644)
+	})
+	if content != "model" {
+		t.Errorf("content should be [model], but [%s]", content)
+	}
+	tmps, _ := ioutil.ReadDir(c.tmpDir())
+	if len(tmps) != 0 {
+		t.Errorf("downloaded file should be moved, but %d files left", len(tmps))
+	}
+}
+
+func TestFetch_Evict(t *testing.T) {
+	c, cleanup := newTestCache(t, 10)
+	defer cleanup()
+
+	fetchA, callsA := fetchOf("aaaa")
+	fetchB, _ := fetchOf("bbbb")
+	fetchC, _ := fetchOf("cccc")
+	fetchAndRead(t, c, "a", fetchA)
+	time.Sleep(10 * time.Millisecond)
+	fetchAndRead(t, c, "b", fetchB)
+	time.Sleep(10 * time.Millisecond)
+	// a is used more recently than b.
+	fetchAndRead(t, c, "a", fetchA)
+	time.Sleep(10 * time.Millisecond)
+
+	// b is in use, so it isn't evicted.
+	_, releaseB, err := c.Fetch(context.TODO(), "b", fetchB)
+	if err != nil {
+		t.Fatal("Unexpected Error occurred: ", err)
+	}
+	fetchAndRead(t, c, "c", fetchC)
+	releaseB()
+
+	entries, err := c.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]bool)
+	for _, e := range entries {
+		keys[e.Key] = true
+	}
+	if len(keys) != 2 || !keys["b"] || !keys["c"] {
+		t.Errorf("entries should be b and c, but %v", keys)
+	}
+	fetchAndRead(t, c, "a", fetchA)
+	if *callsA != 2 {
+		t.Errorf("evicted archive should be downloaded again, but %d times", *callsA)
+	}
+}
+
+func TestFetch_Concurrent(t *testing.T) {
+	c, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	var calls int32
+	fetch := func(path string) error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return ioutil.WriteFile(path, []byte("model"), 0644)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// each runner opens the cache by itself.
+			c, err := Open(c.dir, c.maxSize)
+			if err != nil {
+				t.Error("Unexpected Error occurred: ", err)
+				return
+			}
+			path, release, err := c.Fetch(context.TODO(), "key", fetch)
+			if err != nil {
+				t.Error("Unexpected Error occurred: ", err)
+				return
+			}
+			defer release()
+			if data, _ := ioutil.ReadFile(path); string(data) != "model" {
+				t.Errorf("content should be [model], but [%s]", string(data))
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("archive should be downloaded once, but %d times", calls)
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "lock")); err != nil {
+		t.Errorf("lock file should exist: %v", err)
+	}
+}
+
+func TestOpen_Error(t *testing.T) {
+	if _, err := Open(os.TempDir(), 0); err == nil {
+		t.Error("Error should be raised")
+	}
+}
@@ -0,0 +1,80 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	httpclient "github.com/abeja-inc/abeja-platform-model-proxy/util/http"
+)
+
+// datalakeSink uploads results to a channel of Datalake.
+type datalakeSink struct {
+	conf      *config.Configuration
+	channelID string
+	option    *http.Client
+}
+
+func newDatalakeSink(conf *config.Configuration, channelID string, option *http.Client) *datalakeSink {
+	return &datalakeSink{conf: conf, channelID: channelID, option: option}
+}
+
+func (s *datalakeSink) String() string {
+	return "datalake:" + s.channelID
+}
+
+func (s *datalakeSink) Write(ctx context.Context, name string, result *Result) error {
+	httpClient, err :=
+		httpclient.NewRetryHTTPClient(s.conf.APIURL, 30, 3, s.conf.GetAuthInfo(), s.option)
+	if err != nil {
+		return err
+	}
+
+	reqUrl := httpClient.BuildURL(
+		fmt.Sprintf("/channels/%s/upload", s.channelID),
+		map[string]interface{}{"conflict_target": "filename"})
+
+	// the body is wrapped not to be closed by client, because it is written to the other sinks.
+	req, err := http.NewRequest("POST", reqUrl, ioutil.NopCloser(result.Body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range result.Headers {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-abeja-meta-") {
+			req.Header.Set(k, v)
+		}
+	}
+
+	req.Header.Set("x-abeja-meta-filename", name)
+	fileinfo, err := result.Body.Stat()
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fileinfo.Size()
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var errMsg string
+		msgBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			errMsg = err.Error()
+		} else {
+			errMsg = string(msgBytes)
+		}
+		return fmt.Errorf(
+			"response from Datalake was error with StatusCode: %d, body: %s",
+			resp.StatusCode,
+			errMsg,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package output
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	errors "golang.org/x/xerrors"
+
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+)
+
+// localSink writes results to a directory, which may be shared storage mounted.
+type localSink struct {
+	dir string
+}
+
+func newLocalSink(dir string) *localSink {
+	return &localSink{dir: dir}
+}
+
+func (s *localSink) String() string {
+	return "local:" + s.dir
+}
+
+// Write writes the result to a temporary file and renames it,
+// so that readers of the directory never see a partially written file.
+func (s *localSink) Write(ctx context.Context, name string, result *Result) error {
+	dst := filepath.Join(s.dir, filepath.FromSlash(name))
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Errorf("failed to create directory: %w", err)
+	}
+
+	fp, err := ioutil.TempFile(dir, ".tmp_")
+	if err != nil {
+		return errors.Errorf("failed to create temporary file: %w", err)
+	}
+	tmp := fp.Name()
+	_, err = io.Copy(fp, result.Body)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		cleanutil.Remove(ctx, tmp)
+		return errors.Errorf("failed to write %s: %w", dst, err)
+	}
+	return nil
+}
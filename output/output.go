@@ -0,0 +1,297 @@
+// Package output writes results of runtime to the destinations specified by OUTPUT.
+//
+// OUTPUT is a JSON object or an array of them. Each object has one of the keys below,
+// and optionally `file_name`, the template of file name used instead of output_file_name.
+//
+//	{"$datalake:1": "<channel_id>"}     Datalake channel. An array of channel IDs is also accepted.
+//	{"$local": "<directory>"}           directory of local (or mounted shared) file system.
+//	{"$s3": "s3://<bucket>/<prefix>"}   bucket of S3 or S3-compatible storage like MinIO.
+//	{"$stdout": true}                   standard output, each result followed by a newline.
+//
+// A file name template is a text/template, which can refer to the fields of NameData.
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+const (
+	keyDatalake = "$datalake:1"
+	keyLocal    = "$local"
+	keyS3       = "$s3"
+	keyStdout   = "$stdout"
+	keyFileName = "file_name"
+)
+
+// Sink is a destination of results.
+type Sink interface {
+	// Write writes the result as the file of name.
+	Write(ctx context.Context, name string, result *Result) error
+	// String returns the destination for logs.
+	String() string
+}
+
+// Result is a result of runtime to be written.
+type Result struct {
+	Body        *os.File
+	ContentType string
+	Headers     map[string]string // headers of runtime response, e.g. `x-abeja-meta-*`
+}
+
+// Input describes the input of the result, which is used to build file names.
+type Input struct {
+	Index    int    // position of input in the batch, 0 for oneshot
+	Name     string // file name of input, empty when unknown (e.g. JSON input)
+	Metadata map[string]interface{}
+}
+
+// NameData is the data passed to file name templates.
+type NameData struct {
+	RunID     string
+	Index     int
+	Ext       string // extension for content-type of result, e.g. `.json`
+	InputName string // file name of input, e.g. `cat.jpg`
+	InputBase string // file name of input without extension, e.g. `cat`
+	Metadata  map[string]string
+}
+
+type destination struct {
+	sink     Sink
+	fileName *template.Template
+}
+
+// Output is the set of destinations in OUTPUT.
+type Output struct {
+	runID        string
+	destinations []destination
+}
+
+// Parse parses OUTPUT of conf. It returns Output without destination when OUTPUT is empty.
+func Parse(ctx context.Context, conf *config.Configuration, option *http.Client) (*Output, error) {
+	out := &Output{runID: conf.RunID}
+	if conf.Output == "" {
+		return out, nil
+	}
+
+	fileName := conf.OutputFileName
+	if fileName == "" {
+		fileName = config.DefaultOutputFileName
+	}
+	defaultName, err := ParseFileName(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []map[string]interface{}
+	trimmed := bytes.TrimSpace([]byte(conf.Output))
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &objs)
+	} else {
+		var obj map[string]interface{}
+		err = json.Unmarshal(trimmed, &obj)
+		objs = append(objs, obj)
+	}
+	if err != nil {
+		return nil, errors.Errorf("failed to parse OUTPUT: %w", err)
+	}
+
+	for _, obj := range objs {
+		name := defaultName
+		if v, ok := obj[keyFileName]; ok {
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.Errorf("%s of OUTPUT must be string, but %v", keyFileName, v)
+			}
+			if name, err = ParseFileName(s); err != nil {
+				return nil, err
+			}
+		}
+		sinks, err := parseSinks(ctx, conf, obj, option)
+		if err != nil {
+			return nil, err
+		}
+		for _, sink := range sinks {
+			out.destinations = append(out.destinations, destination{sink: sink, fileName: name})
+		}
+	}
+	return out, nil
+}
+
+func parseSinks(
+	ctx context.Context,
+	conf *config.Configuration,
+	obj map[string]interface{},
+	option *http.Client) ([]Sink, error) {
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sinks []Sink
+	for _, key := range keys {
+		v := obj[key]
+		switch key {
+		case keyDatalake:
+			channelIDs, err := toStrings(key, v)
+			if err != nil {
+				return nil, err
+			}
+			for _, channelID := range channelIDs {
+				sinks = append(sinks, newDatalakeSink(conf, channelID, option))
+			}
+		case keyLocal:
+			dir, ok := v.(string)
+			if !ok || dir == "" {
+				return nil, errors.Errorf("invalid %s of OUTPUT: %v", key, v)
+			}
+			sinks = append(sinks, newLocalSink(dir))
+		case keyS3:
+			target, ok := v.(string)
+			if !ok {
+				return nil, errors.Errorf("invalid %s of OUTPUT: %v", key, v)
+			}
+			sink, err := newS3Sink(conf, target, option)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case keyStdout:
+			if enabled, ok := v.(bool); !ok {
+				return nil, errors.Errorf("invalid %s of OUTPUT: %v", key, v)
+			} else if enabled {
+				sinks = append(sinks, newStdoutSink())
+			}
+		case keyFileName:
+		default:
+			log.Warningf(ctx, "unknown key of OUTPUT is ignored: %s", key)
+		}
+	}
+	return sinks, nil
+}
+
+func toStrings(key string, v interface{}) ([]string, error) {
+	switch val := v.(type) {
+	case string:
+		if val != "" {
+			return []string{val}, nil
+		}
+	case []interface{}:
+		res := make([]string, 0, len(val))
+		for _, e := range val {
+			s, ok := e.(string)
+			if !ok || s == "" {
+				return nil, errors.Errorf("invalid %s of OUTPUT: %v", key, v)
+			}
+			res = append(res, s)
+		}
+		return res, nil
+	}
+	return nil, errors.Errorf("invalid %s of OUTPUT: %v", key, v)
+}
+
+// ParseFileName parses the template of file name.
+func ParseFileName(text string) (*template.Template, error) {
+	tmpl, err := template.New("file_name").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, errors.Errorf("invalid template of file name [%s]: %w", text, err)
+	}
+	return tmpl, nil
+}
+
+// Len returns the number of destinations.
+func (o *Output) Len() int {
+	return len(o.destinations)
+}
+
+// Destinations returns the destinations for logs.
+func (o *Output) Destinations() []string {
+	res := make([]string, 0, len(o.destinations))
+	for _, d := range o.destinations {
+		res = append(res, d.sink.String())
+	}
+	return res
+}
+
+// Write writes the result of input to all destinations.
+// It tries every destination even if some of them failed, and returns error if any failed.
+func (o *Output) Write(ctx context.Context, input Input, result *Result) error {
+	data := o.nameData(ctx, input, result.ContentType)
+	var failed []string
+	for _, d := range o.destinations {
+		if err := write(ctx, d, data, result); err != nil {
+			log.Warningf(ctx, "failed to write result to %s: "+log.ErrorFormat, d.sink, err)
+			failed = append(failed, d.sink.String())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to write result to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func write(ctx context.Context, d destination, data *NameData, result *Result) error {
+	var buf bytes.Buffer
+	if err := d.fileName.Execute(&buf, data); err != nil {
+		return errors.Errorf("failed to build file name: %w", err)
+	}
+	name := buf.String()
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if _, err := result.Body.Seek(0, io.SeekStart); err != nil {
+		return errors.Errorf("failed to rewind result: %w", err)
+	}
+	return d.sink.Write(ctx, name, result)
+}
+
+func (o *Output) nameData(ctx context.Context, input Input, contentType string) *NameData {
+	data := &NameData{
+		RunID:     o.runID,
+		Index:     input.Index,
+		InputName: input.Name,
+		InputBase: strings.TrimSuffix(input.Name, path.Ext(input.Name)),
+		Metadata:  make(map[string]string, len(input.Metadata)),
+	}
+	if contentType != "" {
+		data.Ext = util.GetExtension(ctx, contentType)
+	}
+	for k, v := range input.Metadata {
+		data.Metadata[k] = fmt.Sprint(v)
+	}
+	return data
+}
+
+// validateName rejects names which are empty or escape from the destination.
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("file name is empty")
+	}
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return errors.Errorf("file name [%s] must be relative", name)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return errors.Errorf("file name [%s] must not contain `..`", name)
+		}
+	}
+	return nil
+}
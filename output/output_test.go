@@ -0,0 +1,137 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+)
+
+func writeTemp(t *testing.T, content string) *os.File {
+	t.Helper()
+	f, err := ioutil.TempFile("", "output_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestOutput_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	defer setStdout(&buf)()
+
+	conf := &config.Configuration{
+		RunID: "run",
+		Output: `[
+			{"$local": "` + filepath.Join(dir, "default") + `"},
+			{"$local": "` + filepath.Join(dir, "named") + `",
+			 "file_name": "{{.InputBase}}/{{.Index}}_{{index .Metadata \"x-abeja-meta-label\"}}{{.Ext}}"},
+			{"$stdout": true}
+		]`,
+	}
+	out, err := Parse(context.TODO(), conf, nil)
+	if err != nil {
+		t.Fatal("Unexpected Error occurred: ", err)
+	}
+	if out.Len() != 3 {
+		t.Fatalf("Output should have 3 destinations, but %v", out.Destinations())
+	}
+
+	body := writeTemp(t, `{"foo": "bar"}`)
+	defer body.Close()
+	input := Input{Index: 3, Name: "cat.jpg", Metadata: map[string]interface{}{"x-abeja-meta-label": "cat"}}
+	if err := out.Write(context.TODO(), input, &Result{Body: body, ContentType: "application/json"}); err != nil {
+		t.Fatal("Unexpected Error occurred: ", err)
+	}
+
+	for _, name := range []string{"default/run_3.json", "named/cat/3_cat.json"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s should be written: %v", name, err)
+		}
+		if string(data) != `{"foo": "bar"}` {
+			t.Errorf("content of %s should be the result, but [%s]", name, string(data))
+		}
+	}
+	if buf.String() != "{\"foo\": \"bar\"}\n" {
+		t.Errorf("result should be written to stdout with newline, but [%s]", buf.String())
+	}
+}
+
+func TestOutput_Write_InvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name     string
+		fileName string
+	}{
+		{name: "empty", fileName: "{{.InputName}}"},
+		{name: "parent", fileName: "../{{.RunID}}"},
+		{name: "absolute", fileName: "/tmp/{{.RunID}}"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := &config.Configuration{
+				RunID:          "run",
+				Output:         `{"$local": "` + dir + `"}`,
+				OutputFileName: c.fileName,
+			}
+			out, err := Parse(context.TODO(), conf, nil)
+			if err != nil {
+				t.Fatal("Unexpected Error occurred: ", err)
+			}
+			body := writeTemp(t, "result")
+			defer body.Close()
+			if err := out.Write(context.TODO(), Input{}, &Result{Body: body}); err == nil {
+				t.Error("Error should be raised")
+			}
+		})
+	}
+}
+
+func TestParse_Error(t *testing.T) {
+	cases := []struct {
+		name string
+		conf *config.Configuration
+	}{
+		{name: "invalid JSON", conf: &config.Configuration{Output: "{"}},
+		{name: "invalid local", conf: &config.Configuration{Output: `{"$local": ""}`}},
+		{name: "invalid stdout", conf: &config.Configuration{Output: `{"$stdout": "yes"}`}},
+		{name: "invalid template", conf: &config.Configuration{Output: `{"$stdout": true, "file_name": "{{"}`}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := Parse(context.TODO(), c.conf, nil); err == nil {
+				t.Error("Error should be raised")
+			}
+		})
+	}
+}
+
+// setStdout replaces the writer of stdoutSink, and returns the function to restore it.
+func setStdout(w *bytes.Buffer) func() {
+	org := stdout
+	stdout = w
+	return func() {
+		stdout = org
+	}
+}
@@ -0,0 +1,111 @@
+package output
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	s3util "github.com/abeja-inc/abeja-platform-model-proxy/util/s3"
+)
+
+// these are variables to be shortened in tests.
+var (
+	s3RetryInterval = 1 * time.Second
+	s3MaxRetries    = 3
+)
+
+// s3Sink puts results to a bucket of S3 or S3-compatible storage.
+type s3Sink struct {
+	client *s3util.Client
+	bucket string
+	prefix string
+}
+
+func newS3Sink(conf *config.Configuration, target string, option *http.Client) (*s3Sink, error) {
+	bucket, prefix, err := s3util.ParseURL(target)
+	if err != nil {
+		return nil, errors.Errorf("invalid %s of OUTPUT: %w", keyS3, err)
+	}
+	client, err := s3util.NewClient(conf, option)
+	if err != nil {
+		return nil, errors.Errorf("failed to set up %s of OUTPUT: %w", keyS3, err)
+	}
+	return &s3Sink{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3Sink) String() string {
+	if s.prefix == "" {
+		return "s3://" + s.bucket
+	}
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+func (s *s3Sink) Write(ctx context.Context, name string, result *Result) error {
+	if _, err := result.Body.Seek(0, io.SeekStart); err != nil {
+		return errors.Errorf("failed to rewind result: %w", err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, result.Body)
+	if err != nil {
+		return errors.Errorf("failed to read result: %w", err)
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = s3RetryInterval
+	b.MaxElapsedTime = 0
+	return backoff.RetryNotify(
+		func() error {
+			if _, err := result.Body.Seek(0, io.SeekStart); err != nil {
+				return backoff.Permanent(errors.Errorf("failed to rewind result: %w", err))
+			}
+			return s.put(ctx, name, result, size, payloadHash)
+		},
+		backoff.WithMaxRetries(b, uint64(s3MaxRetries)),
+		func(err error, wait time.Duration) {
+			log.Warningf(ctx, "failed to put %s to %s, retry after %s: "+log.ErrorFormat, name, s, wait, err)
+		})
+}
+
+func (s *s3Sink) put(ctx context.Context, name string, result *Result, size int64, payloadHash string) error {
+	key := name
+	if s.prefix != "" {
+		key = s.prefix + "/" + name
+	}
+	// the body is wrapped not to be closed by client, because it is written to the other sinks.
+	req, err := s.client.NewRequest(ctx, "PUT", s.bucket, key, ioutil.NopCloser(result.Body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.ContentLength = size
+	if result.ContentType != "" {
+		req.Header.Set("Content-Type", result.ContentType)
+	}
+
+	resp, err := s.client.Do(req, payloadHash)
+	if err != nil {
+		return errors.Errorf(": %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		err := errors.Errorf(
+			"response from %s was error with StatusCode: %d, body: %s", s, resp.StatusCode, string(msg))
+		if resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout &&
+			resp.StatusCode != http.StatusTooManyRequests {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package output
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+)
+
+// s3Stub is a stand-in of S3-compatible storage like MinIO, which keeps objects in memory.
+type s3Stub struct {
+	mu          sync.Mutex
+	objects     map[string]string
+	contentType map[string]string
+	failures    int // number of requests to fail with 503 at first
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != "PUT" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.objects[r.URL.Path] = string(body)
+	s.contentType[r.URL.Path] = r.Header.Get("Content-Type")
+}
+
+func newS3Stub(failures int) *s3Stub {
+	return &s3Stub{objects: map[string]string{}, contentType: map[string]string{}, failures: failures}
+}
+
+func TestS3Sink(t *testing.T) {
+	defer setFastS3Retry()()
+
+	cases := []struct {
+		name       string
+		target     string
+		fileName   string
+		failures   int
+		expectPath string
+		expectErr  bool
+	}{
+		{
+			name:       "with prefix",
+			target:     "s3://bucket/results/run1",
+			fileName:   "cat.json",
+			expectPath: "/bucket/results/run1/cat.json",
+		}, {
+			name:       "without prefix",
+			target:     "s3://bucket",
+			fileName:   "a b.json",
+			expectPath: "/bucket/a b.json",
+		}, {
+			name:       "retry",
+			target:     "s3://bucket",
+			fileName:   "retry.json",
+			failures:   2,
+			expectPath: "/bucket/retry.json",
+		}, {
+			name:      "give up",
+			target:    "s3://bucket",
+			fileName:  "fail.json",
+			failures:  s3MaxRetries + 1,
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := newS3Stub(c.failures)
+			ts := httptest.NewServer(stub)
+			defer ts.Close()
+
+			conf := &config.Configuration{
+				S3Endpoint:        ts.URL,
+				S3AccessKeyID:     "AKID",
+				S3SecretAccessKey: "secret",
+			}
+			sink, err := newS3Sink(conf, c.target, nil)
+			if err != nil {
+				t.Fatal("Unexpected Error occurred: ", err)
+			}
+			body := writeTemp(t, `{"foo": "bar"}`)
+			defer body.Close()
+
+			err = sink.Write(context.TODO(), c.fileName, &Result{Body: body, ContentType: "application/json"})
+			if c.expectErr {
+				if err == nil {
+					t.Fatal("Error should be raised")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Unexpected Error occurred: ", err)
+			}
+			if actual := stub.objects[c.expectPath]; actual != `{"foo": "bar"}` {
+				t.Errorf("object %s should be put, but objects are %v", c.expectPath, stub.objects)
+			}
+			if actual := stub.contentType[c.expectPath]; actual != "application/json" {
+				t.Errorf("Content-Type should be application/json, but %s", actual)
+			}
+		})
+	}
+}
+
+func TestNewS3Sink_Error(t *testing.T) {
+	cases := []struct {
+		name   string
+		conf   *config.Configuration
+		target string
+	}{
+		{
+			name:   "not s3 scheme",
+			conf:   &config.Configuration{S3AccessKeyID: "AKID", S3SecretAccessKey: "secret"},
+			target: "https://bucket/prefix",
+		}, {
+			name:   "no credentials",
+			conf:   &config.Configuration{},
+			target: "s3://bucket/prefix",
+		}, {
+			name:   "invalid endpoint",
+			conf:   &config.Configuration{S3Endpoint: "ftp://minio", S3AccessKeyID: "AKID", S3SecretAccessKey: "secret"},
+			target: "s3://bucket/prefix",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := newS3Sink(c.conf, c.target, nil); err == nil {
+				t.Error("Error should be raised")
+			}
+		})
+	}
+}
+
+// setFastS3Retry shortens the interval of retry, and returns the function to restore it.
+func setFastS3Retry() func() {
+	interval := s3RetryInterval
+	s3RetryInterval = time.Millisecond
+	return func() {
+		s3RetryInterval = interval
+	}
+}
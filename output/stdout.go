@@ -0,0 +1,63 @@
+package output
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+)
+
+// stdout is the writer of stdoutSink, which is replaced in tests.
+var stdout io.Writer = os.Stdout
+
+// stdoutMutex keeps results from being interleaved by parallel inputs.
+var stdoutMutex sync.Mutex
+
+// stdoutSink writes results to standard output, each followed by a newline.
+// Note that logs are also written to standard output.
+type stdoutSink struct{}
+
+func newStdoutSink() *stdoutSink {
+	return &stdoutSink{}
+}
+
+func (s *stdoutSink) String() string {
+	return "stdout"
+}
+
+func (s *stdoutSink) Write(ctx context.Context, name string, result *Result) error {
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+
+	w := bufio.NewWriter(stdout)
+	last := &lastByteWriter{w: w}
+	if _, err := io.Copy(last, result.Body); err != nil {
+		return errors.Errorf("failed to write result: %w", err)
+	}
+	if last.b != '\n' {
+		if err := w.WriteByte('\n'); err != nil {
+			return errors.Errorf("failed to write result: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Errorf("failed to write result: %w", err)
+	}
+	return nil
+}
+
+// lastByteWriter remembers the last byte written.
+type lastByteWriter struct {
+	w io.Writer
+	b byte
+}
+
+func (l *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if n > 0 {
+		l.b = p[n-1]
+	}
+	return n, err
+}
@@ -2,20 +2,31 @@ package preprocess
 
 import (
 	"context"
-	"io/ioutil"
+	"io"
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	errors "golang.org/x/xerrors"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/modelcache"
 	"github.com/abeja-inc/abeja-platform-model-proxy/util"
 	"github.com/abeja-inc/abeja-platform-model-proxy/util/auth"
-	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
 	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
 )
 
+var durations = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "abeja_proxy_preprocess_duration_seconds",
+		Help:    "Duration of preparing user-model in seconds by phase (download, unarchive, download_unarchive).",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200},
+	},
+	[]string{"phase"})
+
 // Preprocessor is struct for preprocess.
 type Preprocessor struct {
 	BaseURL                   string
@@ -29,6 +40,7 @@ type Preprocessor struct {
 	TrainingJobID             *string
 	TrainingJobDefinitionName *string
 	TrainingResultDir         string
+	Cache                     *modelcache.Cache
 }
 
 // SourceResJSON is struct for extract `download_uri` from ABEJA-Platform API.
@@ -106,6 +118,16 @@ func NewPreprocessor(ctx context.Context, conf *config.Configuration) (*Preproce
 		TrainingResultDir:         trainingResultDir,
 	}
 
+	if conf.ModelCacheDir != "" {
+		c, err := modelcache.Open(conf.ModelCacheDir, int64(conf.ModelCacheMaxSize)<<20)
+		if err != nil {
+			// models can be prepared without cache, so it doesn't stop runner.
+			log.Warningf(ctx, "model cache is disabled: "+log.ErrorFormat, err)
+		} else {
+			preprocessor.Cache = c
+		}
+	}
+
 	if deploymentCodeDownload != "" {
 		preprocessor.DeploymentCodeDownload = &deploymentCodeDownload
 	}
@@ -146,13 +168,13 @@ func (p *Preprocessor) Prepare(ctx context.Context) error {
 
 	if p.DeploymentCodeDownload != nil {
 		if err := prepareDeploymentCode(
-			ctx, *p.DeploymentCodeDownload, p.ModelRootDir, downloader); err != nil {
+			ctx, *p.DeploymentCodeDownload, p.ModelRootDir, downloader, p.Cache); err != nil {
 			return errors.Errorf(": %w", err)
 		}
 	} else {
 		if err := prepareModel(
 			ctx, p.OrganizationID, p.ModelID, p.ModelVersionID,
-			p.ModelRootDir, downloader); err != nil {
+			p.ModelRootDir, downloader, p.Cache); err != nil {
 			return errors.Errorf(": %w", err)
 		}
 	}
@@ -161,7 +183,7 @@ func (p *Preprocessor) Prepare(ctx context.Context) error {
 		if err := prepareTrainingModel(
 			ctx, *p.TrainingModelDownload,
 			p.TrainingResultDir,
-			downloader); err != nil {
+			downloader, p.Cache); err != nil {
 			return errors.Errorf(": %w", err)
 		}
 	} else if p.TrainingJobID != nil {
@@ -170,7 +192,7 @@ func (p *Preprocessor) Prepare(ctx context.Context) error {
 			*p.TrainingJobDefinitionName,
 			*p.TrainingJobID,
 			p.TrainingResultDir,
-			downloader); err != nil {
+			downloader, p.Cache); err != nil {
 			return errors.Errorf(": %w", err)
 		}
 	}
@@ -181,25 +203,16 @@ func prepareDeploymentCode(
 	ctx context.Context,
 	reqPath string,
 	destPath string,
-	downloader *util.Downloader) error {
-
-	tempFilePath, err := download(ctx, reqPath, downloader, new(SourceResJSON))
-	if err != nil {
-		return errors.Errorf(": %w", err)
-	}
-	defer cleanutil.Remove(ctx, tempFilePath)
+	downloader *util.Downloader,
+	c *modelcache.Cache) error {
 
-	if _, err = os.Stat(destPath); err != nil {
+	if _, err := os.Stat(destPath); err != nil {
 		if err = os.Mkdir(destPath, os.ModeDir); err != nil {
 			return errors.Errorf(
 				"failed to make directory for user-model: %s, error: %w", destPath, err)
 		}
 	}
-
-	if err = util.Unarchive(tempFilePath, destPath); err != nil {
-		return errors.Errorf("failed to unarchive deployment code: %w", err)
-	}
-	return nil
+	return prepareArchive(ctx, reqPath, destPath, downloader, new(SourceResJSON), c, "deployment code")
 }
 
 func prepareModel(
@@ -208,53 +221,35 @@ func prepareModel(
 	modelID string,
 	versionID string,
 	destPath string,
-	downloader *util.Downloader) error {
-
-	reqPath :=
-		path.Join("organizations", orgID, "models", modelID, "versions", versionID, "source")
-	tempFilePath, err := download(ctx, reqPath, downloader, new(SourceResJSON))
-	if err != nil {
-		return errors.Errorf(": %w", err)
-	}
-	defer cleanutil.Remove(ctx, tempFilePath)
+	downloader *util.Downloader,
+	c *modelcache.Cache) error {
 
-	if _, err = os.Stat(destPath); err != nil {
+	if _, err := os.Stat(destPath); err != nil {
 		if err = os.Mkdir(destPath, os.ModeDir); err != nil {
 			return errors.Errorf(
 				"failed to make directory for user-model: %s, error: %w", destPath, err)
 		}
 	}
-
-	if err = util.Unarchive(tempFilePath, destPath); err != nil {
-		return errors.Errorf("failed to unarchive model version: %w", err)
-	}
-	return nil
+	reqPath :=
+		path.Join("organizations", orgID, "models", modelID, "versions", versionID, "source")
+	return prepareArchive(ctx, reqPath, destPath, downloader, new(SourceResJSON), c, "model version")
 }
 
 func prepareTrainingModel(
 	ctx context.Context,
 	reqPath string,
 	destPath string,
-	downloader *util.Downloader) error {
-
-	tempFilePath, err := download(ctx, reqPath, downloader, new(SourceResJSON))
-	if err != nil {
-		return errors.Errorf(": %w", err)
-	}
-	defer cleanutil.Remove(ctx, tempFilePath)
+	downloader *util.Downloader,
+	c *modelcache.Cache) error {
 
-	if _, err = os.Stat(destPath); err != nil {
+	if _, err := os.Stat(destPath); err != nil {
 		if err = os.Mkdir(destPath, os.ModeDir); err != nil {
 			return errors.Errorf(
 				"failed to make directory for training-result: %s, error: %w",
 				destPath, err)
 		}
 	}
-
-	if err = util.Unarchive(tempFilePath, destPath); err != nil {
-		return errors.Errorf("failed to unarchive model: %w", err)
-	}
-	return nil
+	return prepareArchive(ctx, reqPath, destPath, downloader, new(SourceResJSON), c, "model")
 }
 
 func prepareTrainingJobResult(
@@ -263,45 +258,98 @@ func prepareTrainingJobResult(
 	jobDefName string,
 	jobID string,
 	destPath string,
-	downloader *util.Downloader) error {
-
-	reqPath :=
-		path.Join("organizations", orgID, "training/definitions", jobDefName, "jobs", jobID, "result")
-	tempFilePath, err := download(ctx, reqPath, downloader, new(TrainingJobResJSON))
-	if err != nil {
-		return errors.Errorf(": %w", err)
-	}
-	defer cleanutil.Remove(ctx, tempFilePath)
+	downloader *util.Downloader,
+	c *modelcache.Cache) error {
 
-	if _, err = os.Stat(destPath); err != nil {
+	if _, err := os.Stat(destPath); err != nil {
 		if err = os.Mkdir(destPath, os.ModeDir); err != nil {
 			return errors.Errorf(
 				"failed to make directory for training-result: %s, error: %w",
 				destPath, err)
 		}
 	}
+	reqPath :=
+		path.Join("organizations", orgID, "training/definitions", jobDefName, "jobs", jobID, "result")
+	return prepareArchive(ctx, reqPath, destPath, downloader, new(TrainingJobResJSON), c, "training job result")
+}
 
-	if err = util.Unarchive(tempFilePath, destPath); err != nil {
-		return errors.Errorf("failed to unarchive training job result: %w", err)
+// prepareArchive downloads the archive of reqPath and unarchives it to destPath.
+// Without the cache, the archive is unarchived while it's downloaded, not to be stored on disk.
+// With the cache, the archive is stored in the cache, and unarchived from there.
+func prepareArchive(
+	ctx context.Context,
+	reqPath string,
+	destPath string,
+	downloader *util.Downloader,
+	decoderRes util.DecoderRes,
+	c *modelcache.Cache,
+	name string) error {
+
+	if c == nil {
+		return downloadAndUnarchive(reqPath, destPath, downloader, decoderRes, name)
+	}
+
+	// archives of a model version and a training job are never changed, so the path identifies them.
+	archivePath, release, err := c.Fetch(ctx, reqPath, func(filePath string) error {
+		return download(reqPath, filePath, downloader, decoderRes)
+	})
+	if err != nil {
+		return errors.Errorf(": %w", err)
+	}
+	defer release()
+
+	if err = unarchive(archivePath, destPath); err != nil {
+		return errors.Errorf("failed to unarchive %s: %w", name, err)
 	}
 	return nil
 }
 
 func download(
-	ctx context.Context,
 	reqPath string,
+	filePath string,
 	downloader *util.Downloader,
-	decoderRes util.DecoderRes) (string, error) {
-	fp, err := ioutil.TempFile("", "model")
-	if err != nil {
-		return "", errors.Errorf("failed to create temporary file for downloading: %w", err)
+	decoderRes util.DecoderRes) error {
+	defer observeDuration("download", time.Now())
+	if _, err := downloader.Download(reqPath, filePath, decoderRes); err != nil {
+		return errors.Errorf("failed to download model: %w", err)
 	}
-	filePath := fp.Name()
-	cleanutil.Close(ctx, fp, filePath)
+	return nil
+}
+
+func unarchive(src string, dest string) error {
+	defer observeDuration("unarchive", time.Now())
+	return util.Unarchive(src, dest)
+}
 
-	if _, err = downloader.Download(reqPath, filePath, decoderRes); err != nil {
-		cleanutil.Remove(ctx, filePath)
-		return "", errors.Errorf("failed to download model: %w", err)
+// downloadAndUnarchive streams the archive downloaded to the unarchiver.
+func downloadAndUnarchive(
+	reqPath string,
+	destPath string,
+	downloader *util.Downloader,
+	decoderRes util.DecoderRes,
+	name string) error {
+	defer observeDuration("download_unarchive", time.Now())
+
+	pr, pw := io.Pipe()
+	unarchived := make(chan error, 1)
+	go func() {
+		err := util.UnarchiveStream(pr, destPath)
+		// download stops writing if unarchive fails.
+		pr.CloseWithError(err)
+		unarchived <- err
+	}()
+	_, err := downloader.DownloadTo(reqPath, pw, decoderRes)
+	pw.CloseWithError(err)
+	unarchiveErr := <-unarchived
+	if err != nil && (unarchiveErr == nil || !errors.Is(err, unarchiveErr)) {
+		return errors.Errorf("failed to download model: %w", err)
 	}
-	return filePath, nil
+	if unarchiveErr != nil {
+		return errors.Errorf("failed to unarchive %s: %w", name, unarchiveErr)
+	}
+	return nil
+}
+
+func observeDuration(phase string, start time.Time) {
+	durations.WithLabelValues(phase).Observe(time.Since(start).Seconds())
 }
@@ -7,17 +7,15 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"path/filepath"
 
 	errors "golang.org/x/xerrors"
 
-	simplejson "github.com/bitly/go-simplejson"
-
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/convert"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/input"
+	"github.com/abeja-inc/abeja-platform-model-proxy/output"
 	"github.com/abeja-inc/abeja-platform-model-proxy/util"
-	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
 )
 
 // === Protocol
@@ -29,10 +27,87 @@ import (
 // |--------------------|----------------|------------------------|---------------|
 // | 0xAB | 0xE9 | 0xA0 | 0x01           | (4 bytes)              | ...           |
 // |--------------------|----------------|------------------------|---------------|
+//
+// === Protocol (version 2)
+//
+// |-------------------------------------------------------------------------------------------------------------|---------------|
+// | Header                                                                                                      | Body          |
+// |-------------------------------------------------------------------------------------------------------------|---------------|
+// | MAGIC              | VERSION (byte) | TYPE (byte) | RESERVED (3 bytes) | REQUEST ID (uint32) | LENGTH (uint32) | JSON (string) |
+// |--------------------|----------------|-------------|--------------------|---------------------|-----------------|---------------|
+// | 0xAB | 0xE9 | 0xA0 | 0x02           | (1 byte)    | 0x00 0x00 0x00     | (4 bytes)           | (4 bytes)       | ...           |
+// |--------------------|----------------|-------------|--------------------|---------------------|-----------------|---------------|
+//
+// Version 2 carries a frame type and a request ID, so that several requests can be in flight
+// on one connection and the runtime can answer them out of order.
+// The runtime answers REQUEST frame with RESPONSE frame which has the same REQUEST ID.
+// When the request timed out, the proxy sends CANCEL frame with the same REQUEST ID and
+// empty body. The runtime should stop processing the request, and its response is discarded.
+//
+// === Streaming (version 2)
+//
+// The runtime can stream the body of response. It sends RESPONSE frame which has
+// `"streaming": true` and no `path` first, then CHUNK frames with the same REQUEST ID.
+// Body of CHUNK frame is raw bytes of the response body (not JSON),
+// and CHUNK frame with empty body means the end of stream.
+// The proxy forwards each chunk to the client with `Transfer-Encoding: chunked`,
+// or as one event when `content_type` is `text/event-stream`.
+// The timeout of request is applied until RESPONSE frame arrives.
+//
+// === Dynamic batching (version 2)
+//
+// When `dynamic_batch_max_size` is greater than 1 and the runtime declares `max_batch_size`
+// in HELLO frame, the proxy collects compatible requests (the same method and media type)
+// which arrive within `dynamic_batch_max_latency`, and sends them in one BATCH frame.
+// Body of BATCH frame is JSON array of requests, and the runtime answers it with RESPONSE frame
+// which has the same REQUEST ID and JSON array of responses in the same order.
+// Responses in a batch can't be streamed. When the batch timed out, the proxy sends CANCEL frame
+// with its REQUEST ID, and all requests in it are answered with 504.
+//
+// === Request info
+//
+// JSON of request has `url_path` and `query` of the request URL (e.g. `/explain` and
+// `{"threshold": ["0.5"]}`), `remote_addr` of the client and `request_id` from
+// `x-abeja-request-id` header, so that the runtime can serve several endpoints and read options.
+// They are omitted when they are empty, like for the request from INPUT.
+//
+// === Tracing
+//
+// When tracing by OTLP is enabled, JSON of request has `traceparent` in W3C Trace Context format,
+// which identifies the span of IPC round trip. The runtime can start its spans as children of it.
+//
+// === Negotiation
+//
+// The proxy speaks version 2 only when `ipc_protocol_version` is configured as 2,
+// so that runtimes which only speak version 1 keep working without configuration.
+// The proxy passes the version with the environment variable `ABEJA_IPC_PROTOCOL_VERSION`.
+// On version 2, the proxy sends HELLO frame like `{"version": 2}` as soon as it connects,
+// and the runtime replies HELLO frame with body like
+// `{"versions": [1, 2], "max_concurrency": 4, "max_batch_size": 8}`.
+// `max_concurrency` is the number of requests which the runtime can process at the same time
+// (1 if omitted), and `max_batch_size` is the number of requests which the runtime accepts
+// in a BATCH frame (1 if omitted, which means BATCH frame isn't sent).
+// The proxy waits for the reply up to `startup_timeout`, and the connection fails
+// when the runtime doesn't reply HELLO frame or `versions` doesn't have 2.
+//
+// === Logging (version 2)
+//
+// The runtime processes several requests at the same time, so the proxy tags a log of the runtime
+// with the request only when the log is JSON which has `ipc_request_id`, the REQUEST ID of the frame.
+//
+// === Readiness (version 2)
+//
+// A runtime which takes time to load its model can declare `"sends_ready": true` in HELLO frame,
+// and send READY frame with REQUEST ID 0 when it gets ready, with body like
+// `{"model": {"name": "resnet50", "version": "1.0"}}` (body may be empty).
+// The proxy sends no request and the health check reports the phase of startup until READY frame arrives,
+// which must be within `startup_timeout` after connecting as well as HELLO frame.
+// Other runtimes are regarded as ready as soon as the proxy connects to them.
 const magic0 = 0xAB
 const magic1 = 0xE9
 const magic2 = 0xA0
 const version = 0x01
+const version2 = 0x02
 
 // Header is header of protocol for communicate to runtime.
 type Header struct {
@@ -41,19 +116,66 @@ type Header struct {
 	Length  uint32
 }
 
-// DatalakeSourceResJSON is part of response of `GET file info`
-type DatalakeSourceResJSON struct {
-	DownloadURL string                 `json:"download_url"`
-	ContentType string                 `json:"content_type"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+// FrameType represents type of frame in protocol version 2.
+type FrameType byte
+
+// FrameTypes for protocol version 2.
+const (
+	FrameTypeRequest FrameType = iota + 1
+	FrameTypeResponse
+	FrameTypeHello
+	FrameTypeCancel
+	FrameTypeChunk
+	FrameTypeBatch
+	FrameTypeReady
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameTypeRequest:
+		return "REQUEST"
+	case FrameTypeResponse:
+		return "RESPONSE"
+	case FrameTypeHello:
+		return "HELLO"
+	case FrameTypeCancel:
+		return "CANCEL"
+	case FrameTypeChunk:
+		return "CHUNK"
+	case FrameTypeBatch:
+		return "BATCH"
+	case FrameTypeReady:
+		return "READY"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// HeaderV2 is header of protocol version 2 for communicate to runtime.
+type HeaderV2 struct {
+	Magic     [3]byte
+	Version   byte
+	Type      FrameType
+	Reserved  [3]byte
+	RequestID uint32
+	Length    uint32
+}
+
+// HelloFromRuntime is body of HELLO frame which runtime replies.
+type HelloFromRuntime struct {
+	Versions       []int `json:"versions"`
+	MaxConcurrency int   `json:"max_concurrency,omitempty"`
+	MaxBatchSize   int   `json:"max_batch_size,omitempty"`
+	SendsReady     bool  `json:"sends_ready,omitempty"`
 }
 
-func (d *DatalakeSourceResJSON) GetDownloadURL() string {
-	return d.DownloadURL
+// ReadyFromRuntime is body of READY frame which runtime sends.
+type ReadyFromRuntime struct {
+	Model map[string]interface{} `json:"model,omitempty"`
 }
 
-func (d *DatalakeSourceResJSON) GetContentType() string {
-	return d.ContentType
+// HelloToRuntime is body of HELLO frame which proxy sends.
+type HelloToRuntime struct {
+	Version int `json:"version"`
 }
 
 func FromRequest(request *entity.ContentList) (Header, []byte, error) {
@@ -70,6 +192,35 @@ func FromRequest(request *entity.ContentList) (Header, []byte, error) {
 	return header, b, nil
 }
 
+// FromRequestV2 returns REQUEST frame of protocol version 2.
+func FromRequestV2(requestID uint32, request *entity.ContentList) (HeaderV2, []byte, error) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return HeaderV2{}, []byte{}, errors.Errorf("json encode error: %w", err)
+	}
+	return NewHeaderV2(FrameTypeRequest, requestID, len(b)), b, nil
+}
+
+// FromBatchRequestV2 returns BATCH frame of protocol version 2.
+func FromBatchRequestV2(requestID uint32, requests []*entity.ContentList) (HeaderV2, []byte, error) {
+	b, err := json.Marshal(requests)
+	if err != nil {
+		return HeaderV2{}, []byte{}, errors.Errorf("json encode error: %w", err)
+	}
+	return NewHeaderV2(FrameTypeBatch, requestID, len(b)), b, nil
+}
+
+// NewHeaderV2 returns header of protocol version 2.
+func NewHeaderV2(frameType FrameType, requestID uint32, length int) HeaderV2 {
+	return HeaderV2{
+		Magic:     [3]byte{magic0, magic1, magic2},
+		Version:   version2,
+		Type:      frameType,
+		RequestID: requestID,
+		Length:    uint32(length),
+	}
+}
+
 func ToResponse(bodyBuff []byte, conf *config.Configuration) (entity.Response, error) {
 	if bytes.Equal(bodyBuff, []byte{}) {
 		return entity.Response{}, errors.Errorf("communication with runtime")
@@ -101,34 +252,63 @@ func ToResponse(bodyBuff []byte, conf *config.Configuration) (entity.Response, e
 	return body, nil
 }
 
+// ToBatchResponses returns the responses of BATCH frame, which must be as many as the requests.
+func ToBatchResponses(bodyBuff []byte, size int, conf *config.Configuration) ([]entity.Response, error) {
+	if bytes.Equal(bodyBuff, []byte{}) {
+		return nil, errors.Errorf("communication with runtime")
+	}
+	var bodies []json.RawMessage
+	if err := json.Unmarshal(bodyBuff, &bodies); err != nil {
+		return nil, errors.Errorf("Read IPC batch response body error: %w", err)
+	}
+	if len(bodies) != size {
+		return nil, errors.Errorf("batch response has %d responses for %d requests", len(bodies), size)
+	}
+	responses := make([]entity.Response, 0, size)
+	for _, body := range bodies {
+		res, err := ToResponse(body, conf)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, res)
+	}
+	return responses, nil
+}
+
 func FromInput(
 	ctx context.Context,
 	conf *config.Configuration,
 	option *http.Client) (*entity.ContentList, error) {
 
-	input := conf.Input
-	if input == "" {
+	inputJSON := conf.Input
+	if inputJSON == "" {
 		return &entity.ContentList{
 			AsyncRequestID: conf.RunID,             // TODO temporary
 			AsyncARMSToken: conf.PlatformAuthToken, // TODO temporary
 		}, nil
 	}
 
-	json, err := simplejson.NewJson([]byte(input))
+	var value interface{}
+	if err := json.Unmarshal([]byte(inputJSON), &value); err != nil {
+		return nil, errors.Errorf("failed to parse INPUT: %w", err)
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return convertToJsonContents(ctx, inputJSON, conf)
+	}
+	refs, err := input.ParseReferences(obj)
 	if err != nil {
 		return nil, errors.Errorf("failed to parse INPUT: %w", err)
 	}
-
-	if _, err := json.Array(); err == nil {
-		return convertToJsonContents(ctx, input, conf)
+	if len(refs) == 0 {
+		return convertToJsonContents(ctx, inputJSON, conf)
 	}
 
-	datalakePath, err := json.Get("$datalake:1").String()
+	files, err := input.Resolve(ctx, conf, refs, option)
 	if err != nil {
-		return convertToJsonContents(ctx, input, conf)
+		return nil, errors.Errorf("failed to read INPUT: %w", err)
 	}
-
-	return convertToFileContents(ctx, conf, datalakePath, option)
+	return buildFileContents(conf, files), nil
 }
 
 func convertToJsonContents(
@@ -146,47 +326,38 @@ func convertToJsonContents(
 	return buildContents(contentType, conf.RunID, conf.PlatformAuthToken, filePath, nil), nil
 }
 
-func convertToFileContents(
-	ctx context.Context,
-	conf *config.Configuration,
-	datalakePath string,
-	option *http.Client) (*entity.ContentList, error) {
-
-	contentType, filePath, metadata, err := getFileFromDatalake(ctx, conf, datalakePath, option)
-	if err != nil {
-		return nil, errors.Errorf("failed to create temporary file: %w", err)
-	}
-
-	return buildContents(contentType, conf.RunID, conf.PlatformAuthToken, filePath, metadata), nil
-}
-
-func getFileFromDatalake(
-	ctx context.Context,
-	conf *config.Configuration,
-	datalakePath string,
-	option *http.Client) (string, string, map[string]interface{}, error) {
-
-	filePath := filepath.Join(conf.RequestedDataDir, "uploaded_file")
-	reqPath := fmt.Sprintf("/channels/%s", datalakePath)
-
-	downloader, err := util.NewDownloader(conf.APIURL, conf.GetAuthInfo(), option)
-	if err != nil {
-		return "", "", nil, errors.Errorf("failed to parse ABEJA_API_URL: %w", err)
+// buildFileContents returns the request of files resolved from INPUT.
+// A file is sent as the body, and multiple files are sent as parts of multipart/form-data,
+// whose form names are `file0`, `file1`, ... in order.
+func buildFileContents(conf *config.Configuration, files []*input.File) *entity.ContentList {
+	contents := make([]*entity.Content, 0, len(files))
+	for i, f := range files {
+		content := &entity.Content{
+			ContentType: &f.ContentType,
+			Path:        &f.Path,
+			Metadata:    f.Metadata,
+			Keep:        !f.Temporary,
+		}
+		if f.Name != "" {
+			content.FileName = &f.Name
+		}
+		if len(files) > 1 {
+			formName := fmt.Sprintf("file%d", i)
+			content.FormName = &formName
+		}
+		contents = append(contents, content)
 	}
-
-	var contentType string
-	var datalakeSourceResJSON DatalakeSourceResJSON
-	contentType, err =
-		downloader.Download(reqPath, filePath, &datalakeSourceResJSON)
-	if err != nil {
-		cleanutil.Remove(ctx, filePath)
-		return "", "", nil, errors.Errorf("failed to download file from datalake: %w", err)
+	contentType := "multipart/form-data"
+	if len(files) == 1 {
+		contentType = files[0].ContentType
 	}
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	return &entity.ContentList{
+		Method:         "POST",
+		ContentType:    contentType,
+		Contents:       contents,
+		AsyncRequestID: conf.RunID,             // TODO temporary
+		AsyncARMSToken: conf.PlatformAuthToken, // TODO temporary
 	}
-
-	return contentType, filePath, datalakeSourceResJSON.Metadata, nil
 }
 
 func buildContents(
@@ -207,20 +378,7 @@ func buildContents(
 	return cl
 }
 
-func FromOutput(conf *config.Configuration) (string, error) {
-	output := conf.Output
-	if output == "" {
-		return "", nil
-	}
-
-	json, err := simplejson.NewJson([]byte(output))
-	if err != nil {
-		return "", errors.Errorf("failed to parse OUTPUT: %w", err)
-	}
-
-	val, exist := json.CheckGet("$datalake:1")
-	if !exist {
-		return "", nil
-	}
-	return val.String()
+// FromOutput returns the destinations of results specified by OUTPUT.
+func FromOutput(ctx context.Context, conf *config.Configuration, option *http.Client) (*output.Output, error) {
+	return output.Parse(ctx, conf, option)
 }
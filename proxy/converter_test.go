@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
@@ -13,6 +16,16 @@ import (
 )
 
 func TestFromInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "converter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.json", "b.png"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
 
 	cases := []struct {
 		name                string
@@ -113,6 +126,26 @@ func TestFromInput(t *testing.T) {
 				},
 			},
 			expectBody: "{\"foo\": \"bar\"}",
+		}, {
+			name: "multiple files input",
+			conf: &config.Configuration{
+				Input: "{\"$file\": [\"" + filepath.Join(dir, "a.json") + "\", \"" + filepath.Join(dir, "b.png") + "\"]}",
+			},
+			httpClient:          nil,
+			expectHasError:      false,
+			errMsg:              "",
+			expectContentLength: 2,
+			expectContentType:   "multipart/form-data",
+			expectMetadata:      map[string]interface{}{"x-abeja-meta-filename": "a.json"},
+			expectBody:          "a.json",
+		}, {
+			name: "invalid file input",
+			conf: &config.Configuration{
+				Input: "{\"$file\": 1}",
+			},
+			httpClient:     nil,
+			expectHasError: true,
+			errMsg:         "failed to parse INPUT: invalid $file: 1",
 		}, {
 			name: "normal json input",
 			conf: &config.Configuration{
@@ -201,32 +234,55 @@ func TestFromInput(t *testing.T) {
 
 func TestFromOutput(t *testing.T) {
 	cases := []struct {
-		name            string
-		conf            *config.Configuration
-		expectHasError  bool
-		errMsg          string
-		expectChannelID string
+		name               string
+		conf               *config.Configuration
+		expectHasError     bool
+		errMsg             string
+		expectDestinations []string
 	}{
 		{
 			name: "normal datalake channel",
 			conf: &config.Configuration{
 				Output: "{\"$datalake:1\": \"1111111111111\"}",
 			},
-			expectHasError:  false,
-			errMsg:          "",
-			expectChannelID: "1111111111111",
+			expectHasError:     false,
+			errMsg:             "",
+			expectDestinations: []string{"datalake:1111111111111"},
+		}, {
+			name: "multiple datalake channels",
+			conf: &config.Configuration{
+				Output: "{\"$datalake:1\": [\"1111111111111\", \"2222222222222\"]}",
+			},
+			expectHasError:     false,
+			errMsg:             "",
+			expectDestinations: []string{"datalake:1111111111111", "datalake:2222222222222"},
+		}, {
+			name: "multiple destinations",
+			conf: &config.Configuration{
+				Output: "[{\"$local\": \"/mnt/results\"}, {\"$stdout\": true, \"file_name\": \"{{.InputBase}}\"}]",
+			},
+			expectHasError:     false,
+			errMsg:             "",
+			expectDestinations: []string{"local:/mnt/results", "stdout"},
+		}, {
+			name: "invalid datalake channel",
+			conf: &config.Configuration{
+				Output: "{\"$datalake:1\": 1}",
+			},
+			expectHasError: true,
+			errMsg:         "invalid $datalake:1 of OUTPUT: 1",
 		}, {
-			name:            "no output",
-			conf:            &config.Configuration{},
-			expectHasError:  false,
-			errMsg:          "",
-			expectChannelID: "",
+			name:               "no output",
+			conf:               &config.Configuration{},
+			expectHasError:     false,
+			errMsg:             "",
+			expectDestinations: []string{},
 		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			actual, err := FromOutput(c.conf)
+			actual, err := FromOutput(context.TODO(), c.conf, nil)
 			if err != nil {
 				if c.expectHasError {
 					if err.Error() != c.errMsg {
@@ -241,8 +297,8 @@ func TestFromOutput(t *testing.T) {
 				t.Fatal("Error should be raised")
 			}
 
-			if actual != c.expectChannelID {
-				t.Errorf("channelID should be %s, but %s", c.expectChannelID, actual)
+			if !reflect.DeepEqual(actual.Destinations(), c.expectDestinations) {
+				t.Errorf("destinations should be %v, but %v", c.expectDestinations, actual.Destinations())
 			}
 		})
 	}
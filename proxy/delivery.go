@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/deadletter"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
+)
+
+const (
+	deliveryKindResponse = "response" // result of inference
+	deliveryKindError    = "error"    // error instead of result
+)
+
+// keyIdempotencyKey is the header which identifies the result among its duplicated deliveries.
+const keyIdempotencyKey = "Idempotency-Key"
+
+// deliveryTimeout is the time limit of each request to ARMS or callback url.
+var deliveryTimeout = 30 * time.Second
+
+// deliveryRetryInterval is the first interval to retry the delivery, which grows exponentially.
+var deliveryRetryInterval = 1 * time.Second
+
+// deliveryMaxRetryInterval is the max interval to retry the delivery.
+var deliveryMaxRetryInterval = 30 * time.Second
+
+// asyncDelivery is a request to send the result of async request, whose body is in a file.
+// It is PUT to ARMS, or POSTed to callbackURL when it is set.
+type asyncDelivery struct {
+	kind           string
+	path           string
+	token          string
+	callbackURL    string
+	asyncRequestID string
+	contentType    string
+	bodyPath       string
+	aborted        <-chan struct{} // closed to give up the delivery, nil when never given up
+}
+
+func newAsyncDelivery(
+	ctx context.Context,
+	conf *config.Configuration,
+	cl entity.ContentList,
+	kind string,
+	contentType string,
+	bodyPath string) *asyncDelivery {
+
+	delivery := &asyncDelivery{
+		kind:           kind,
+		asyncRequestID: cl.AsyncRequestID,
+		contentType:    contentType,
+		bodyPath:       bodyPath,
+	}
+	if cl.CallbackURL != "" {
+		delivery.callbackURL = cl.CallbackURL
+	} else {
+		delivery.path = buildARMSEndPoint(ctx, conf, cl.AsyncRequestID)
+		delivery.token = cl.AsyncARMSToken
+		if delivery.token == "" {
+			// the token of request restored from journal isn't kept.
+			delivery.token = conf.PlatformAuthToken
+		}
+	}
+	return delivery
+}
+
+func (d *asyncDelivery) destination() string {
+	if d.callbackURL != "" {
+		return d.callbackURL
+	}
+	return d.path
+}
+
+// deliverAsyncResult sends the result of async request to ARMS or callback url with retries.
+// When all of them failed, the result is moved into dead-letter directory if it is set,
+// so that it can be redelivered later. Otherwise the result is lost.
+//
+// The delivery is at-least-once: the same result is sent again when the runner crashed
+// after sending it but before recording it in the journal, or when it's redelivered from
+// dead-letter directory after the receiver actually got it. Each delivery carries the async
+// request id in `Idempotency-Key`, so that receivers can ignore duplicates.
+func deliverAsyncResult(
+	ctx context.Context,
+	conf *config.Configuration,
+	delivery *asyncDelivery,
+	option *http.Client) {
+
+	spanName := "arms.upload"
+	if delivery.callbackURL != "" {
+		spanName = "callback.post"
+	}
+	ctx, span := tracing.StartSpan(ctx, spanName, tracing.SpanKindClient)
+	defer span.End()
+	if delivery.kind == deliveryKindError {
+		span.SetAttribute("arms.error_response", true)
+	}
+
+	attempts, err := sendWithRetry(ctx, conf, delivery, option)
+	span.SetAttribute("arms.attempts", attempts)
+	if err == nil {
+		cleanutil.Remove(ctx, delivery.bodyPath)
+		return
+	}
+	span.SetError(err)
+	asyncSendFailures.WithLabelValues(delivery.kind).Inc()
+	log.Errorf(
+		ctx, "failed to send async %s to %s after %d attempt(s): "+log.ErrorFormat,
+		delivery.kind, delivery.destination(), attempts, err)
+
+	if conf.AsyncDeadLetterDir == "" {
+		cleanutil.Remove(ctx, delivery.bodyPath)
+		return
+	}
+	if err := putDeadLetter(conf.AsyncDeadLetterDir, delivery, attempts, err); err != nil {
+		log.Errorf(ctx, "failed to keep async %s as dead-letter: "+log.ErrorFormat, delivery.kind, err)
+		cleanutil.Remove(ctx, delivery.bodyPath)
+		return
+	}
+	log.Warningf(ctx, "async %s is kept in dead-letter directory %s.", delivery.kind, conf.AsyncDeadLetterDir)
+}
+
+func putDeadLetter(dir string, delivery *asyncDelivery, attempts int, lastErr error) error {
+	store, err := deadletter.Open(dir)
+	if err != nil {
+		return err
+	}
+	letter := &deadletter.Letter{
+		Path:           delivery.path,
+		CallbackURL:    delivery.callbackURL,
+		AsyncRequestID: delivery.asyncRequestID,
+		ContentType:    delivery.contentType,
+		Kind:           delivery.kind,
+		Attempts:       attempts,
+		LastError:      lastErr.Error(),
+		FailedAt:       time.Now(),
+	}
+	return store.Put(letter, delivery.bodyPath)
+}
+
+// sendWithRetry sends the request until it succeeds, up to conf.ARMSMaxRetries times of retry,
+// and returns the number of attempts. 4xx errors other than 408 and 429 are not retried,
+// because the same request fails again. The request being sent is canceled when the delivery is given up.
+func sendWithRetry(
+	ctx context.Context,
+	conf *config.Configuration,
+	delivery *asyncDelivery,
+	option *http.Client) (int, error) {
+
+	// NOTE: ctx isn't used for cancellation, because async request outlives its HTTP request.
+	sendCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-delivery.aborted:
+			cancel()
+		case <-sendCtx.Done():
+		}
+	}()
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = deliveryRetryInterval
+	b.MaxInterval = deliveryMaxRetryInterval
+	b.MaxElapsedTime = 0
+
+	attempts := 0
+	err := backoff.RetryNotify(
+		func() error {
+			attempts++
+			return send(ctx, sendCtx, conf, delivery, option)
+		},
+		backoff.WithContext(backoff.WithMaxRetries(b, uint64(conf.ARMSMaxRetries)), sendCtx),
+		func(err error, wait time.Duration) {
+			log.Warningf(
+				ctx, "failed to send async %s to %s, retry after %s: "+log.ErrorFormat,
+				delivery.kind, delivery.destination(), wait, err)
+		})
+	if err != nil && sendCtx.Err() != nil {
+		err = errors.Errorf("delivery is given up on shutdown: %w", err)
+	}
+	return attempts, err
+}
+
+func send(
+	ctx context.Context,
+	sendCtx context.Context,
+	conf *config.Configuration,
+	delivery *asyncDelivery,
+	option *http.Client) error {
+
+	f, err := os.Open(delivery.bodyPath)
+	if err != nil {
+		return backoff.Permanent(errors.Errorf("failed to open body: %w", err))
+	}
+	info, err := f.Stat()
+	if err != nil {
+		cleanutil.Close(ctx, f, delivery.bodyPath)
+		return backoff.Permanent(errors.Errorf("failed to stat body: %w", err))
+	}
+
+	var req *http.Request
+	if delivery.callbackURL != "" {
+		req, err = newCallbackRequest(conf.CallbackSecret, delivery, f)
+	} else {
+		req, err = newARMSRequest(conf.APIURL, delivery, f)
+	}
+	if err != nil {
+		cleanutil.Close(ctx, f, delivery.bodyPath)
+		return backoff.Permanent(err)
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", delivery.contentType)
+	req.Header.Set(keyIdempotencyKey, delivery.asyncRequestID)
+
+	client := option
+	if client == nil {
+		client = &http.Client{Timeout: deliveryTimeout}
+	}
+	// the body is closed by client, even on errors.
+	resp, err := client.Do(req.WithContext(sendCtx))
+	if err != nil {
+		return errors.Errorf(": %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		err := errors.Errorf("response error from %s with StatusCode: %d", delivery.destination(), resp.StatusCode)
+		if resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout &&
+			resp.StatusCode != http.StatusTooManyRequests {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// newARMSRequest returns the request to PUT the result to ARMS.
+// NOTE: context of request isn't used, because async request outlives its HTTP request.
+func newARMSRequest(apiURL string, delivery *asyncDelivery, body io.Reader) (*http.Request, error) {
+	reqURL, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, errors.Errorf(": %w", err)
+	}
+	reqURL.Path = path.Join(reqURL.Path, delivery.path)
+	req, err := http.NewRequest("PUT", reqURL.String(), body)
+	if err != nil {
+		return nil, errors.Errorf(": %w", err)
+	}
+	if delivery.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", delivery.token))
+	}
+	return req, nil
+}
+
+// newCallbackRequest returns the request to POST the result to callback url, signed with secret.
+// Receivers can verify it by comparing HMAC-SHA256 of "<timestamp>.<body>"
+// with x-abeja-callback-signature, and reject old ones by x-abeja-callback-timestamp.
+func newCallbackRequest(secret string, delivery *asyncDelivery, body io.ReadSeeker) (*http.Request, error) {
+	if secret == "" {
+		return nil, errors.New("callback_secret is not set")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := signCallback(secret, timestamp, body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Errorf("failed to rewind body: %w", err)
+	}
+	req, err := http.NewRequest("POST", delivery.callbackURL, body)
+	if err != nil {
+		return nil, errors.Errorf(": %w", err)
+	}
+	req.Header.Set("x-abeja-callback-request-id", delivery.asyncRequestID)
+	req.Header.Set("x-abeja-callback-timestamp", timestamp)
+	req.Header.Set("x-abeja-callback-signature", "sha256="+signature)
+	return req, nil
+}
+
+// signCallback returns hex of HMAC-SHA256 of "<timestamp>.<body>" with secret.
+func signCallback(secret string, timestamp string, body io.Reader) (string, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	if _, err := io.Copy(mac, body); err != nil {
+		return "", errors.Errorf("failed to sign body: %w", err)
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// RedeliverDeadLetters sends results in dead-letter directory to ARMS or callback url again, and writes the outcome
+// of each of them to out. Delivered ones are removed, and the others are kept with their last error.
+// Results are sent to ARMS with the platform credentials of conf, because the token of each request isn't kept.
+func RedeliverDeadLetters(ctx context.Context, conf *config.Configuration, out io.Writer) error {
+	store, err := deadletter.Open(conf.AsyncDeadLetterDir)
+	if err != nil {
+		return errors.Errorf(": %w", err)
+	}
+	letters, err := store.List()
+	if err != nil {
+		return errors.Errorf(": %w", err)
+	}
+
+	failed := 0
+	for _, letter := range letters {
+		delivery := &asyncDelivery{
+			kind:           letter.Kind,
+			path:           letter.Path,
+			token:          conf.PlatformAuthToken,
+			callbackURL:    letter.CallbackURL,
+			asyncRequestID: letter.AsyncRequestID,
+			contentType:    letter.ContentType,
+			bodyPath:       letter.BodyPath,
+		}
+		attempts, err := sendWithRetry(ctx, conf, delivery, nil)
+		if err != nil {
+			failed++
+			letter.Attempts += attempts
+			letter.LastError = err.Error()
+			letter.FailedAt = time.Now()
+			if err := store.Update(letter); err != nil {
+				return errors.Errorf(": %w", err)
+			}
+			fmt.Fprintf(out, "[FAILED] %s %s: %s\n", letter.Kind, delivery.destination(), letter.LastError)
+			continue
+		}
+		if err := store.Remove(letter); err != nil {
+			return errors.Errorf(": %w", err)
+		}
+		fmt.Fprintf(out, "[OK] %s %s\n", letter.Kind, delivery.destination())
+	}
+
+	fmt.Fprintf(out, "%d redelivered, %d failed\n", len(letters)-failed, failed)
+	if failed > 0 {
+		return errors.Errorf("%d result(s) failed to be redelivered", failed)
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/deadletter"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+)
+
+// armsStub fails requests with status until failures runs out.
+type armsStub struct {
+	mu       sync.Mutex
+	status   int
+	failures int
+	bodies   []string
+	tokens   []string
+	keys     []string
+}
+
+func (s *armsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = append(s.bodies, string(body))
+	s.tokens = append(s.tokens, r.Header.Get("Authorization"))
+	s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+	if s.failures != 0 {
+		s.failures--
+		w.WriteHeader(s.status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func setFastRetry() func() {
+	orgInterval, orgMaxInterval := deliveryRetryInterval, deliveryMaxRetryInterval
+	deliveryRetryInterval, deliveryMaxRetryInterval = time.Millisecond, 5*time.Millisecond
+	return func() {
+		deliveryRetryInterval, deliveryMaxRetryInterval = orgInterval, orgMaxInterval
+	}
+}
+
+func writeBody(t *testing.T, dir string, body string) string {
+	t.Helper()
+	f, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestDeliverToARMS_Retry(t *testing.T) {
+	defer setFastRetry()()
+	stub := &armsStub{status: http.StatusServiceUnavailable, failures: 2}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	conf := &config.Configuration{APIURL: server.URL, ARMSMaxRetries: 3}
+	bodyPath := writeBody(t, dataDir, `{"result": 1}`)
+	deliverAsyncResult(context.TODO(), conf, &asyncDelivery{
+		kind:           deliveryKindResponse,
+		path:           "/results/req-1",
+		token:          "token",
+		asyncRequestID: "req-1",
+		contentType:    "application/json",
+		bodyPath:       bodyPath,
+	}, nil)
+
+	if len(stub.bodies) != 3 {
+		t.Fatalf("result should be sent 3 times, but %d times", len(stub.bodies))
+	}
+	for i, body := range stub.bodies {
+		if body != `{"result": 1}` {
+			t.Errorf("whole body should be sent at attempt %d, but [%s]", i+1, body)
+		}
+		if stub.tokens[i] != "Bearer token" {
+			t.Errorf("token should be sent at attempt %d, but [%s]", i+1, stub.tokens[i])
+		}
+		if stub.keys[i] != "req-1" {
+			t.Errorf("Idempotency-Key should be req-1 at attempt %d, but [%s]", i+1, stub.keys[i])
+		}
+	}
+	if _, err := os.Stat(bodyPath); !os.IsNotExist(err) {
+		t.Error("delivered body should be removed")
+	}
+}
+
+func TestNewAsyncDelivery_Token(t *testing.T) {
+	conf := &config.Configuration{PlatformAuthToken: "platform-token"}
+	cases := []struct {
+		name   string
+		token  string
+		expect string
+	}{
+		{name: "token of request", token: "token", expect: "token"},
+		{name: "restored from journal", token: "", expect: "platform-token"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cl := entity.ContentList{AsyncRequestID: "req-1", AsyncARMSToken: c.token}
+			delivery := newAsyncDelivery(context.TODO(), conf, cl, deliveryKindResponse, "application/json", "")
+			if delivery.token != c.expect {
+				t.Errorf("token should be %s, but [%s]", c.expect, delivery.token)
+			}
+		})
+	}
+}
+
+func TestDeliverToARMS_DeadLetter(t *testing.T) {
+	defer setFastRetry()()
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	deadLetterDir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(deadLetterDir)
+
+	cases := []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{name: "server error is retried", status: http.StatusBadGateway, attempts: 3},
+		{name: "client error is not retried", status: http.StatusBadRequest, attempts: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := &armsStub{status: c.status, failures: -1}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			conf := &config.Configuration{APIURL: server.URL, ARMSMaxRetries: 2, AsyncDeadLetterDir: deadLetterDir}
+			deliverAsyncResult(context.TODO(), conf, &asyncDelivery{
+				kind:        deliveryKindError,
+				path:        "/results/" + c.name,
+				token:       "token",
+				contentType: "application/json",
+				bodyPath:    writeBody(t, dataDir, c.name),
+			}, nil)
+			if len(stub.bodies) != c.attempts {
+				t.Errorf("error should be sent %d times, but %d times", c.attempts, len(stub.bodies))
+			}
+		})
+	}
+
+	store, err := deadletter.Open(deadLetterDir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	letters, err := store.List()
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(letters) != len(cases) {
+		t.Fatalf("%d dead-letters should be kept, but %d", len(cases), len(letters))
+	}
+	for i, letter := range letters {
+		if letter.Kind != deliveryKindError || letter.Attempts != cases[i].attempts {
+			t.Errorf("dead-letter should keep the delivery, but %+v", letter)
+		}
+	}
+
+	// ARMS recovered.
+	stub := &armsStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	conf := &config.Configuration{
+		APIURL:             server.URL,
+		ARMSMaxRetries:     0,
+		AsyncDeadLetterDir: deadLetterDir,
+		PlatformAuthToken:  "platform-token",
+	}
+	out := new(bytes.Buffer)
+	if err := RedeliverDeadLetters(context.TODO(), conf, out); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(stub.bodies) != 2 || stub.bodies[0] != cases[0].name || stub.bodies[1] != cases[1].name {
+		t.Errorf("dead-letters should be redelivered in order, but %v", stub.bodies)
+	}
+	for i, token := range stub.tokens {
+		if token != "Bearer platform-token" {
+			t.Errorf("platform token should be sent at redelivery %d, but [%s]", i+1, token)
+		}
+	}
+	if !strings.HasSuffix(out.String(), "2 redelivered, 0 failed\n") {
+		t.Errorf("summary should be written, but [%s]", out.String())
+	}
+	if letters, _ := store.List(); len(letters) != 0 {
+		t.Errorf("redelivered dead-letters should be removed, but %d remain", len(letters))
+	}
+}
+
+func TestWaitAsyncDeliveries_Abort(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ARMS doesn't respond until the delivery is given up.
+		_, _ = ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	deadLetterDir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(deadLetterDir)
+
+	conf := &config.Configuration{APIURL: server.URL, ARMSMaxRetries: 3, AsyncDeadLetterDir: deadLetterDir}
+	cl := entity.ContentList{AsyncRequestID: "req-1", AsyncARMSToken: "token"}
+	bodyPath := writeBody(t, dataDir, "result")
+	delivery := newAsyncDelivery(context.TODO(), conf, cl, deliveryKindResponse, "application/json", bodyPath)
+	deliverInBackground(context.TODO(), conf, cl, delivery, nil)
+
+	if WaitAsyncDeliveries(100 * time.Millisecond) {
+		t.Fatal("delivery should not be finished")
+	}
+	if _, err := os.Stat(bodyPath); !os.IsNotExist(err) {
+		t.Error("body should be moved from data directory")
+	}
+	store, err := deadletter.Open(deadLetterDir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	letters, err := store.List()
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(letters) != 1 || !strings.HasPrefix(letters[0].LastError, "delivery is given up on shutdown") {
+		t.Fatalf("given up delivery should be kept as dead-letter, but %+v", letters)
+	}
+	select {
+	case <-deliveries.wait():
+	default:
+		t.Error("no delivery should remain")
+	}
+}
+
+func TestRedeliverDeadLetters_Failed(t *testing.T) {
+	deadLetterDir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(deadLetterDir)
+	store, err := deadletter.Open(deadLetterDir)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	letter := &deadletter.Letter{Path: "/results/req-1", Kind: deliveryKindResponse, Attempts: 4, FailedAt: time.Now()}
+	if err := store.Put(letter, writeBody(t, deadLetterDir, "body")); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	stub := &armsStub{status: http.StatusForbidden, failures: -1}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	conf := &config.Configuration{APIURL: server.URL, AsyncDeadLetterDir: deadLetterDir}
+	out := new(bytes.Buffer)
+	if err := RedeliverDeadLetters(context.TODO(), conf, out); err == nil {
+		t.Fatal("error should be occurred")
+	}
+	if !strings.HasPrefix(out.String(), "[FAILED] response /results/req-1:") {
+		t.Errorf("failure should be written, but [%s]", out.String())
+	}
+
+	letters, err := store.List()
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if len(letters) != 1 || letters[0].Attempts != 5 || !strings.Contains(letters[0].LastError, "403") {
+		t.Errorf("failed dead-letter should be kept with the last error, but %+v", letters)
+	}
+}
+
+func TestDeliverAsyncResult_Callback(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	conf := &config.Configuration{CallbackSecret: "secret"}
+	cl := entity.ContentList{AsyncRequestID: "job-1", CallbackURL: server.URL + "/done"}
+	delivery := newAsyncDelivery(context.TODO(), conf, cl, deliveryKindResponse, "multipart/form-data", writeBody(t, dataDir, "result"))
+	deliverAsyncResult(context.TODO(), conf, delivery, nil)
+
+	r := <-received
+	body := <-bodies
+	if r.Method != "POST" || r.URL.Path != "/done" {
+		t.Errorf("result should be POSTed to callback url, but %s %s", r.Method, r.URL.Path)
+	}
+	if r.Header.Get("Authorization") != "" {
+		t.Error("token of ARMS should not be sent to callback url")
+	}
+	if v := r.Header.Get("x-abeja-callback-request-id"); v != "job-1" {
+		t.Errorf("request id should be job-1, but [%s]", v)
+	}
+	if v := r.Header.Get("Idempotency-Key"); v != "job-1" {
+		t.Errorf("Idempotency-Key should be job-1, but [%s]", v)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(r.Header.Get("x-abeja-callback-timestamp") + "."))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if v := r.Header.Get("x-abeja-callback-signature"); v != expected {
+		t.Errorf("signature should be %s, but %s", expected, v)
+	}
+	if string(body) != "result" {
+		t.Errorf("whole body should be sent, but [%s]", string(body))
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
+)
+
+// dynamicBatchSize returns the max number of requests sent to runtime in a batch.
+// 1 means requests are sent one by one.
+func dynamicBatchSize(conf *config.Configuration, conn *runtimeConn) int {
+	size := conf.DynamicBatchMaxSize
+	if conn.MaxBatchSize() < size {
+		size = conn.MaxBatchSize()
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// collectBatch collects requests compatible with first, until the batch is full or maxLatency elapses.
+// It returns the batch, and the request which arrived but can't join the batch if any.
+func collectBatch(
+	first entity.ContentList,
+	request <-chan entity.ContentList,
+	maxSize int,
+	maxLatency time.Duration,
+	notifyFromMain chan int,
+	done <-chan struct{}) ([]entity.ContentList, *entity.ContentList) {
+
+	batch := []entity.ContentList{first}
+	timer := time.NewTimer(maxLatency)
+	defer timer.Stop()
+	for len(batch) < maxSize {
+		select {
+		case cl, ok := <-request:
+			if !ok {
+				return batch, nil
+			}
+			if !batchable(first, cl) {
+				return batch, &cl
+			}
+			batch = append(batch, cl)
+		case <-timer.C:
+			return batch, nil
+		case <-notifyFromMain:
+			return batch, nil
+		case <-done:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// batchable returns true if the runtime can process both requests in a batch,
+// i.e. they have the same method and media type.
+func batchable(a, b entity.ContentList) bool {
+	return a.Method == b.Method && mediaType(a.ContentType) == mediaType(b.ContentType)
+}
+
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mt
+}
+
+// transportBatch sends the requests to runtime in a batch, and splits the response into each of them.
+// The batch times out by the shortest timeout of the requests in it.
+func transportBatch(
+	conf *config.Configuration,
+	conn *runtimeConn,
+	batch []entity.ContentList,
+	notifyFromMain chan int,
+	scopeChan chan subprocess.LogScope,
+	option *http.Client) {
+
+	ctx, span := tracing.StartSpan(batch[0].Ctx, "ipc.round_trip", tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("ipc.protocol_version", int(conn.version))
+	span.SetAttribute("ipc.batch_size", len(batch))
+	batchSizes.Observe(float64(len(batch)))
+
+	var timeout time.Duration
+	cls := make([]*entity.ContentList, len(batch))
+	for i := range batch {
+		batch[i].TraceParent = span.TraceParent()
+		cls[i] = &batch[i]
+		if t := batch[i].Timeout; t > 0 && (timeout == 0 || t < timeout) {
+			timeout = t
+		}
+	}
+
+	// respondAll answers each request in its own context concurrently,
+	// so that a slow delivery of async result doesn't delay the others.
+	respondAll := func(respond func(i int, contents entity.ContentList)) {
+		var wg sync.WaitGroup
+		for i, contents := range batch {
+			wg.Add(1)
+			go func(i int, contents entity.ContentList) {
+				defer wg.Done()
+				respond(i, contents)
+			}(i, contents)
+		}
+		wg.Wait()
+	}
+
+	req, err := conn.encodeBatch(cls)
+	if err != nil {
+		log.Errorf(ctx, "json encode error: "+log.ErrorFormat, err)
+		respondAll(func(_ int, contents entity.ContentList) {
+			responseInternalServerError(contents.Ctx, conf, contents, "encoding from request", option)
+		})
+		return
+	}
+	defer scopeLogs(ctx, scopeChan, req)()
+
+	respReceiver, err := conn.send(ctx, req)
+	if err != nil {
+		log.Errorf(ctx, "Write IPC request error: "+log.ErrorFormat, err)
+		respondAll(func(_ int, contents entity.ContentList) {
+			responseInternalServerError(contents.Ctx, conf, contents, "communication with runtime", option)
+		})
+		return
+	}
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case bodyBuff := <-respReceiver:
+		if len(bodyBuff) == 0 && conn.Err() != nil {
+			// runtime crashed while processing the batch.
+			span.SetError(conn.Err())
+			respondAll(func(_ int, contents entity.ContentList) {
+				responseRuntimeError(
+					contents.Ctx, conf, contents, http.StatusServiceUnavailable,
+					"runtime exited unexpectedly", option)
+			})
+			return
+		}
+		responses, err := ToBatchResponses(bodyBuff, len(batch), conf)
+		if err != nil {
+			log.Errorf(ctx, "invalid batch response: "+log.ErrorFormat, err)
+			respondAll(func(_ int, contents entity.ContentList) {
+				responseInternalServerError(contents.Ctx, conf, contents, err.Error(), option)
+			})
+			return
+		}
+		respondAll(func(i int, contents entity.ContentList) {
+			if responses[i].Streaming && responses[i].ErrMsg == nil {
+				responseInternalServerError(contents.Ctx, conf, contents, "streaming response in batch", option)
+				return
+			}
+			sendResponse(contents.Ctx, responses[i], conf, contents, option)
+		})
+	case <-timer:
+		log.Warningf(ctx, "runtime didn't respond to batch of %d requests within %s.", len(batch), timeout)
+		span.SetError(errors.Errorf("runtime didn't respond within %s", timeout))
+		conn.cancel(ctx, req)
+		respondAll(func(_ int, contents entity.ContentList) {
+			responseRuntimeError(
+				contents.Ctx, conf, contents, http.StatusGatewayTimeout,
+				"runtime didn't respond in time", option)
+		})
+	case <-notifyFromMain:
+		conn.cancel(ctx, req)
+		respondAll(func(_ int, contents entity.ContentList) {
+			abortRequest(contents.Ctx, conf, contents, option)
+		})
+	}
+}
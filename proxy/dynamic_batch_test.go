@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+)
+
+func TestTransportMessage_DynamicBatch(t *testing.T) {
+	errOnBoot := make(chan int)
+	request := make(chan entity.ContentList, 4)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	scopeChan := make(chan subprocess.LogScope, 10)
+	defer close(errOnBoot)
+	defer close(notifyFromMain)
+
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// mock for runtime, which accepts batches.
+	go func() {
+		fd, _ := listener.Accept()
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2],"max_batch_size":8}`))
+
+		header, body := readFrameV2(t, fd)
+		if header.Type != FrameTypeBatch {
+			t.Errorf("frame type should be BATCH, but %d", header.Type)
+		}
+		var cls []entity.ContentList
+		if err := json.Unmarshal(body, &cls); err != nil {
+			t.Error("Error when decoding batch:", err)
+		}
+		responses := make([]map[string]interface{}, len(cls))
+		for i, cl := range cls {
+			responses[i] = map[string]interface{}{"status_code": 200 + i, "content_type": cl.ContentType}
+		}
+		b, _ := json.Marshal(responses)
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, b)
+
+		// the request which isn't compatible with the batch is sent alone.
+		header, _ = readFrameV2(t, fd)
+		if header.Type != FrameTypeRequest {
+			t.Errorf("frame type should be REQUEST, but %d", header.Type)
+		}
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, []byte(`{"status_code":200}`))
+		// wait until proxy closes the connection.
+		_, _ = io.Copy(ioutil.Discard, fd)
+	}()
+
+	// the batch is limited by dynamic_batch_max_size, not by max_batch_size of runtime.
+	conf := &config.Configuration{IPCProtocolVersion: 2, DynamicBatchMaxSize: 3, DynamicBatchMaxLatency: 100}
+	responses := make([]chan entity.Response, 4)
+	contentTypes := []string{
+		"application/json", "application/json; charset=utf-8", "application/json", "image/jpeg"}
+	for i := range responses {
+		responses[i] = make(chan entity.Response, 1)
+		request <- entity.ContentList{
+			Method:       "POST",
+			ContentType:  contentTypes[i],
+			ResponseChan: responses[i],
+			Ctx:          context.TODO(),
+		}
+	}
+	go TransportMessages(
+		context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+
+	for i, response := range responses[:3] {
+		select {
+		case r := <-response:
+			if r.StatusCode == nil || *r.StatusCode != 200+i {
+				t.Errorf("StatusCode of request[%d] should be %d, but %v", i, 200+i, r.StatusCode)
+			}
+			if r.ContentType == nil || *r.ContentType != contentTypes[i] {
+				t.Errorf("response of request[%d] should be split in order, but %v", i, r.ContentType)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout on receiving response of request[%d]", i)
+		}
+	}
+	select {
+	case r := <-responses[3]:
+		if r.StatusCode == nil || *r.StatusCode != http.StatusOK {
+			t.Errorf("StatusCode should be %d, but %v", http.StatusOK, r.StatusCode)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on receiving response of request not batched")
+	}
+	close(request)
+	<-notifyToMain
+}
+
+func TestTransportMessage_DynamicBatchError(t *testing.T) {
+	cases := []struct {
+		name       string
+		response   string
+		statusCode int
+	}{
+		{name: "mismatched responses", response: `[{"status_code":200}]`, statusCode: http.StatusInternalServerError},
+		{name: "timeout", response: "", statusCode: http.StatusGatewayTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errOnBoot := make(chan int)
+			request := make(chan entity.ContentList, 2)
+			notifyFromMain := make(chan int)
+			notifyToMain := make(chan int)
+			scopeChan := make(chan subprocess.LogScope, 10)
+			defer close(errOnBoot)
+
+			path, listener := listenTestSocket(t)
+			defer cleanutil.Close(context.TODO(), listener, path)
+
+			finished := make(chan struct{})
+			go func() {
+				defer close(finished)
+				fd, _ := listener.Accept()
+				defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+				replyHelloV2(t, fd, []byte(`{"versions":[1,2],"max_batch_size":2}`))
+				header, _ := readFrameV2(t, fd)
+				if c.response != "" {
+					writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, []byte(c.response))
+					return
+				}
+				cancelHeader, _ := readFrameV2(t, fd)
+				if cancelHeader.Type != FrameTypeCancel || cancelHeader.RequestID != header.RequestID {
+					t.Errorf("batch should be canceled, but frame type %d of request[%d]",
+						cancelHeader.Type, cancelHeader.RequestID)
+				}
+			}()
+
+			conf := &config.Configuration{IPCProtocolVersion: 2, DynamicBatchMaxSize: 2, DynamicBatchMaxLatency: 100}
+			responses := []chan entity.Response{make(chan entity.Response, 1), make(chan entity.Response, 1)}
+			timeouts := []time.Duration{0, 100 * time.Millisecond}
+			for i := range responses {
+				request <- entity.ContentList{
+					Method:       "POST",
+					ResponseChan: responses[i],
+					Timeout:      timeouts[i],
+					Ctx:          context.TODO(),
+				}
+			}
+			go TransportMessages(
+				context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+
+			for i, response := range responses {
+				select {
+				case r := <-response:
+					if r.StatusCode == nil || *r.StatusCode != c.statusCode {
+						t.Errorf("StatusCode of request[%d] should be %d, but %v", i, c.statusCode, r.StatusCode)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timeout on receiving response of request[%d]", i)
+				}
+			}
+			select {
+			case <-finished:
+			case <-time.After(2 * time.Second):
+				t.Error("runtime should finish")
+			}
+			close(notifyFromMain)
+			<-notifyToMain
+		})
+	}
+}
+
+func TestBatchable(t *testing.T) {
+	cases := []struct {
+		name     string
+		a        entity.ContentList
+		b        entity.ContentList
+		expected bool
+	}{
+		{
+			name:     "same media type",
+			a:        entity.ContentList{Method: "POST", ContentType: "application/json"},
+			b:        entity.ContentList{Method: "POST", ContentType: "application/json; charset=utf-8"},
+			expected: true,
+		},
+		{
+			name:     "different media type",
+			a:        entity.ContentList{Method: "POST", ContentType: "application/json"},
+			b:        entity.ContentList{Method: "POST", ContentType: "image/png"},
+			expected: false,
+		},
+		{
+			name:     "different method",
+			a:        entity.ContentList{Method: "GET"},
+			b:        entity.ContentList{Method: "POST"},
+			expected: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := batchable(c.a, c.b); actual != c.expected {
+				t.Errorf("batchable should be %v, but %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestListenAndServe_DynamicBatch(t *testing.T) {
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// mock for runtime, which accepts batches.
+	batched := make(chan int, 1)
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2],"max_batch_size":2}`))
+
+		header, body := readFrameV2(t, fd)
+		var cls []entity.ContentList
+		if header.Type == FrameTypeBatch {
+			if err := json.Unmarshal(body, &cls); err != nil {
+				t.Error("Error when decoding batch:", err)
+			}
+		}
+		batched <- len(cls)
+		responses := make([]map[string]interface{}, len(cls))
+		for i := range cls {
+			resPath := writeBody(t, "", `{"result":"ok"}`)
+			responses[i] = map[string]interface{}{
+				"status_code": 200, "content_type": "application/json", "path": resPath}
+		}
+		b, _ := json.Marshal(responses)
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, b)
+	}()
+
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	conf := config.NewConfiguration()
+	conf.Port = freePort(t)
+	conf.HealthCheckPort = freePort(t)
+	conf.IPCProtocolVersion = 2
+	conf.DynamicBatchMaxSize = 2
+	conf.DynamicBatchMaxLatency = 1000
+	queue := NewRequestQueue(&conf)
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	url := serveForTest(t, server, &conf)
+
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	go TransportMessages(
+		context.TODO(), &conf, path, nil, queue.Out(), make(chan int), notifyFromMain, notifyToMain,
+		make(chan subprocess.LogScope, 10), nil)
+	defer func() {
+		if err := server.Shutdown(context.TODO(), time.Second); err != nil {
+			t.Error("unexpected error occurred", err)
+		}
+		stopTransport(t, notifyFromMain, notifyToMain)
+	}()
+
+	// two clients at the same time are served by one BATCH frame.
+	client := &http.Client{Timeout: 5 * time.Second}
+	statusCodes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := client.Post(url, "application/json", strings.NewReader(`{"foo":"bar"}`))
+			if err != nil {
+				t.Error("unexpected error occurred", err)
+				statusCodes <- 0
+				return
+			}
+			defer res.Body.Close()
+			statusCodes <- res.StatusCode
+		}()
+	}
+	select {
+	case size := <-batched:
+		if size != 2 {
+			t.Errorf("requests should be sent in a batch of 2, but %d", size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout on receiving batch")
+	}
+	for i := 0; i < 2; i++ {
+		if statusCode := <-statusCodes; statusCode != http.StatusOK {
+			t.Errorf("http status should be %d, but %d", http.StatusOK, statusCode)
+		}
+	}
+}
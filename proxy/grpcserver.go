@@ -0,0 +1,429 @@
+package proxy
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative inferencepb/inference.proto
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	errors "golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/convert"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/proxy/inferencepb"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// === gRPC
+//
+// When `grpc_port` is set, the service `abeja.proxy.v1.Inference` defined in inferencepb/inference.proto
+// is served on it. PredictRequest is handled like POST request to the service port,
+// i.e. it's converted into ContentList and dispatched to runtimes through the same queue.
+// Metadata of the call is passed to the runtime as headers, and the deadline of the call
+// limits the timeout of inference. Async requests aren't supported.
+// The runtime is reported as SERVING by the standard health service when it's ready.
+// Its stubs in package inferencepb are generated from inference.proto by `go generate`.
+
+// grpcChunkSize is the max size of body in each message of PredictStream.
+const grpcChunkSize = 64 * 1024
+
+// grpcMaxMessageSize is the max size of message received.
+const grpcMaxMessageSize = 64 << 20
+
+// grpcHealthInterval is the interval to reflect readiness of runtimes in health service. It's shortened in tests.
+var grpcHealthInterval = time.Second
+
+// GRPCServer represents the server of inference service and health service.
+type GRPCServer struct {
+	Addr   string
+	server *grpc.Server
+	health *runtimeHealth
+}
+
+// createGRPCServer returns the server of inference service and health service,
+// which shares runtimes and queue with the HTTP server.
+func createGRPCServer(
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue,
+	conf *config.Configuration) *GRPCServer {
+
+	s := grpc.NewServer(grpc.MaxRecvMsgSize(grpcMaxMessageSize))
+	inferencepb.RegisterInferenceServer(s, &inferenceServer{
+		runtimes: runtimes,
+		queue:    queue,
+		conf:     conf,
+	})
+	h := &runtimeHealth{Server: health.NewServer(), runtimes: runtimes}
+	h.update()
+	healthpb.RegisterHealthServer(s, h)
+
+	return &GRPCServer{
+		Addr:   conf.GetGRPCAddress(),
+		server: s,
+		health: h,
+	}
+}
+
+// ListenAndServe listens on Addr, and serves calls until Shutdown is called.
+func (gs *GRPCServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", gs.Addr)
+	if err != nil {
+		return errors.Errorf(": %w", err)
+	}
+	return gs.Serve(listener)
+}
+
+// Serve serves calls on listener until Shutdown is called. It returns nil after Shutdown.
+func (gs *GRPCServer) Serve(listener net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go gs.health.watch(done)
+	if err := gs.server.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+		return errors.Errorf(": %w", err)
+	}
+	return nil
+}
+
+// Shutdown reports NOT_SERVING, and waits for calls in flight until ctx is done.
+// The calls still in flight are canceled after that.
+func (gs *GRPCServer) Shutdown(ctx context.Context) error {
+	gs.health.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		gs.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		gs.server.Stop()
+		return errors.Errorf(": %w", ctx.Err())
+	}
+}
+
+// runtimeHealth reports the server itself by empty name and inference service
+// as SERVING when runtimes are ready, otherwise NOT_SERVING.
+type runtimeHealth struct {
+	*health.Server
+	runtimes *subprocess.RuntimePool
+}
+
+func (h *runtimeHealth) update() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if h.runtimes.IsReady() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	h.SetServingStatus("", status)
+	h.SetServingStatus(inferencepb.Inference_ServiceDesc.ServiceName, status)
+}
+
+// watch reflects readiness of runtimes until done is closed.
+func (h *runtimeHealth) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(grpcHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			h.update()
+		}
+	}
+}
+
+// inferenceServer implements InferenceServer.
+type inferenceServer struct {
+	inferencepb.UnimplementedInferenceServer
+	runtimes *subprocess.RuntimePool
+	queue    *RequestQueue
+	conf     *config.Configuration
+}
+
+// Predict implements InferenceServer.
+func (s *inferenceServer) Predict(ctx context.Context, req *inferencepb.PredictRequest) (*inferencepb.PredictResponse, error) {
+	ctx = grpcContext(ctx)
+	accessLog := AccessLog{
+		start: time.Now(),
+	}
+	defer func() {
+		accessLog.log(ctx, grpcAccessRequest(inferencepb.Inference_Predict_FullMethodName))
+	}()
+
+	res, cl, httpStatus, err := grpcPredict(ctx, s.runtimes, s.queue, s.conf, req)
+	if err != nil {
+		accessLog.status = httpStatus
+		return nil, err
+	}
+	defer deleteTempFiles(ctx, cl, nil)
+	statusCode, headers, body, err := readWholeResponse(ctx, res)
+	if err != nil {
+		accessLog.status = converterStatus(err)
+		return nil, grpcError(accessLog.status, err.Error())
+	}
+	accessLog.status = statusCode
+	return newPredictResponse(statusCode, headers, body), nil
+}
+
+// PredictStream implements InferenceServer.
+func (s *inferenceServer) PredictStream(req *inferencepb.PredictRequest, stream inferencepb.Inference_PredictStreamServer) error {
+	ctx := grpcContext(stream.Context())
+	accessLog := AccessLog{
+		start: time.Now(),
+	}
+	defer func() {
+		accessLog.log(ctx, grpcAccessRequest(inferencepb.Inference_PredictStream_FullMethodName))
+	}()
+
+	res, cl, httpStatus, err := grpcPredict(ctx, s.runtimes, s.queue, s.conf, req)
+	if err != nil {
+		accessLog.status = httpStatus
+		return err
+	}
+	defer deleteTempFiles(ctx, cl, nil)
+
+	if res.Chunks != nil {
+		statusCode, headers, err := convert.FromStreamingResponse(ctx, res)
+		if err != nil {
+			accessLog.status = converterStatus(err)
+			return grpcError(accessLog.status, err.Error())
+		}
+		accessLog.status = statusCode
+		if err := stream.Send(newPredictResponse(statusCode, headers, nil)); err != nil {
+			return err
+		}
+		for chunk := range res.Chunks {
+			if chunk.Err != nil {
+				log.Warningf(ctx, "streaming response is broken: "+log.ErrorFormat, chunk.Err)
+				return status.Errorf(codes.Internal, "streaming response is broken: %s", chunk.Err.Error())
+			}
+			if err := sendBody(chunk.Data, stream); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	statusCode, headers, body, err := convert.FromResponse(ctx, res)
+	if err != nil {
+		accessLog.status = converterStatus(err)
+		return grpcError(accessLog.status, err.Error())
+	}
+	defer deleteTempFiles(ctx, nil, body)
+	accessLog.status = statusCode
+	if err := stream.Send(newPredictResponse(statusCode, headers, nil)); err != nil {
+		return err
+	}
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if err := sendBody(buf[:n], stream); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read response of model: %s", err.Error())
+		}
+	}
+}
+
+// grpcPredict converts PredictRequest into ContentList, and dispatches it to runtimes like HTTP request.
+// When it fails, it returns HTTP status code for access log with the error of gRPC.
+func grpcPredict(
+	ctx context.Context,
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue,
+	conf *config.Configuration,
+	req *inferencepb.PredictRequest) (entity.Response, *entity.ContentList, int, error) {
+
+	path := req.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	r, err := http.NewRequest(http.MethodPost, path, bytes.NewReader(req.Body))
+	if err != nil {
+		return entity.Response{}, nil, http.StatusBadRequest, grpcError(http.StatusBadRequest, err.Error())
+	}
+	r = r.WithContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	r.Header = grpcHeader(ctx)
+	for _, h := range req.Headers {
+		for _, v := range h.Values {
+			r.Header.Add(h.Key, v)
+		}
+	}
+	r.Header.Set("Content-Type", req.ContentType)
+
+	timeout, err := getRequestTimeout(r, conf)
+	if err != nil {
+		return entity.Response{}, nil, http.StatusBadRequest, grpcError(http.StatusBadRequest, err.Error())
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if !runtimes.IsReady() {
+		return entity.Response{}, nil, http.StatusServiceUnavailable,
+			grpcError(http.StatusServiceUnavailable, "service unavailable")
+	}
+	// admit the request before its body is written to disk.
+	room, err := queue.reserve()
+	if err != nil {
+		status, gerr := grpcRejection(ctx, err)
+		return entity.Response{}, nil, status, gerr
+	}
+	defer room.cancel()
+
+	cl, err := convert.ToContents(ctx, r, conf)
+	if err != nil {
+		status := converterStatus(err)
+		return entity.Response{}, nil, status, grpcError(status, err.Error())
+	}
+	cl.Timeout = timeout
+
+	res, err := dispatch(room, cl)
+	if err != nil {
+		deleteTempFiles(ctx, cl, nil)
+		status, gerr := grpcRejection(ctx, err)
+		return entity.Response{}, nil, status, gerr
+	}
+	return res, cl, 0, nil
+}
+
+// grpcRejection returns status code and error of the request which isn't accepted by the queue.
+func grpcRejection(ctx context.Context, err error) (int, error) {
+	if err == ErrQueueClosed {
+		return http.StatusServiceUnavailable, grpcError(http.StatusServiceUnavailable, "service unavailable")
+	}
+	log.Warningf(ctx, "request is rejected: "+log.ErrorFormat, err)
+	return http.StatusTooManyRequests, grpcError(http.StatusTooManyRequests, "too many requests")
+}
+
+// grpcContext returns the context with the request id and requester id in metadata.
+func grpcContext(ctx context.Context) context.Context {
+	header := grpcHeader(ctx)
+	if v := header.Get("x-abeja-request-id"); v != "" {
+		ctx = context.WithValue(ctx, log.KeyRequestID, v) //nolint // SA1029: should not use built-in type string as key for value; define your own type to avoid collisions
+	}
+	if v := header.Get("x-abeja-requester-id"); v != "" {
+		ctx = context.WithValue(ctx, log.KeyRequesterID, v) //nolint // SA1029: should not use built-in type string as key for value; define your own type to avoid collisions
+	}
+	return ctx
+}
+
+// grpcHeader returns metadata of the call as headers of HTTP.
+func grpcHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if isGRPCReservedHeader(key) {
+			continue
+		}
+		for _, v := range values {
+			header.Add(key, v)
+		}
+	}
+	return header
+}
+
+// grpcAccessRequest returns the request which represents the call in access log.
+func grpcAccessRequest(method string) *http.Request {
+	return &http.Request{Method: http.MethodPost, RequestURI: method, Header: http.Header{}}
+}
+
+// isGRPCReservedHeader returns true if the header is used by gRPC itself, not metadata.
+func isGRPCReservedHeader(key string) bool {
+	if strings.HasPrefix(key, ":") {
+		return true
+	}
+	key = http.CanonicalHeaderKey(key)
+	return strings.HasPrefix(key, "Grpc-") ||
+		key == "Te" || key == "Content-Type" || key == "Content-Length"
+}
+
+// converterStatus returns HTTP status code of the error of converter.
+func converterStatus(err error) int {
+	if convertError, ok := err.(*convert.ConverterError); ok {
+		return convertError.StatusCode
+	}
+	return http.StatusServiceUnavailable
+}
+
+// grpcError returns the error of gRPC corresponding to HTTP status code.
+func grpcError(httpStatus int, message string) error {
+	code := codes.Internal
+	switch httpStatus {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		code = codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, message)
+}
+
+// newPredictResponse returns PredictResponse. Headers only for HTTP, like Content-Length, are omitted.
+func newPredictResponse(statusCode int, headers map[string]string, body []byte) *inferencepb.PredictResponse {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		if key == convert.KeyContentType || key == convert.KeyContentLength || key == convert.KeyConnection {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := &inferencepb.PredictResponse{
+		StatusCode:  int32(statusCode),
+		ContentType: headers[convert.KeyContentType],
+		Body:        body,
+	}
+	for _, key := range keys {
+		res.Headers = append(res.Headers, &inferencepb.Header{Key: key, Values: []string{headers[key]}})
+	}
+	return res
+}
+
+// sendBody sends data as body of PredictResponse in chunks.
+func sendBody(data []byte, stream inferencepb.Inference_PredictStreamServer) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > grpcChunkSize {
+			n = grpcChunkSize
+		}
+		if err := stream.Send(&inferencepb.PredictResponse{Body: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
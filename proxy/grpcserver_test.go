@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/convert"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/proxy/inferencepb"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+)
+
+// responseHeaders returns headers of PredictResponse as map.
+func responseHeaders(res *inferencepb.PredictResponse) map[string]string {
+	headers := make(map[string]string)
+	for _, h := range res.Headers {
+		headers[h.Key] = h.Values[0]
+	}
+	return headers
+}
+
+func TestGRPCPredict(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	conf := config.NewConfiguration()
+	conf.GRPCPort = 5002
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	if server.GRPCServer.Addr != ":5002" {
+		t.Errorf("address of gRPC should be :5002, but %s", server.GRPCServer.Addr)
+	}
+	defer setGRPCHealthInterval(10 * time.Millisecond)()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	go func() {
+		if err := server.GRPCServer.Serve(listener); err != nil {
+			t.Error("unexpected error occurred", err)
+		}
+	}()
+	defer func() {
+		if err := server.GRPCServer.Shutdown(context.Background()); err != nil {
+			t.Error("unexpected error occurred", err)
+		}
+	}()
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	defer conn.Close()
+	client := inferencepb.NewInferenceClient(conn)
+
+	req := &inferencepb.PredictRequest{
+		ContentType: "application/json",
+		Body:        []byte("{\"foo\":\"bar\"}"),
+		Headers:     []*inferencepb.Header{{Key: "x-foo", Values: []string{"bar"}}},
+		Path:        "explain?threshold=0.5",
+	}
+
+	// the response larger than a chunk is sent in messages by PredictStream.
+	resBody := bytes.Repeat([]byte("a"), grpcChunkSize+1)
+	respond := func(reqChan <-chan entity.ContentList) {
+		cl := <-reqChan
+		if cl.Method != http.MethodPost || cl.ContentType != "application/json" {
+			t.Errorf("request should be POST of application/json, but %s of %s", cl.Method, cl.ContentType)
+		}
+		headers := make(map[string]string)
+		for _, h := range cl.Headers {
+			headers[h.Key] = h.Values[0]
+		}
+		if headers["x-foo"] != "bar" || headers["x-abeja-request-id"] != "123" {
+			t.Errorf("headers and metadata should be passed, but %v", headers)
+		}
+		if _, ok := headers["grpc-timeout"]; ok {
+			t.Error("grpc-timeout should not be passed")
+		}
+		if cl.URLPath != "/explain" || cl.Query["threshold"][0] != "0.5" || cl.RemoteAddr == "" {
+			t.Errorf("path, query and address of client should be passed, but %s, %v and [%s]",
+				cl.URLPath, cl.Query, cl.RemoteAddr)
+		}
+		if cl.Timeout <= 0 {
+			t.Errorf("timeout should be limited by deadline, but %s", cl.Timeout)
+		}
+		body, err := ioutil.ReadFile(*cl.Contents[0].Path)
+		if err != nil || string(body) != "{\"foo\":\"bar\"}" {
+			t.Errorf("request body should be passed, but [%s]", string(body))
+		}
+
+		f, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Error("unexpected error occurred", err)
+			return
+		}
+		if _, err := f.Write(resBody); err != nil {
+			t.Error("unexpected error occurred", err)
+		}
+		f.Close()
+		filePath := f.Name()
+		contentType := "text/plain"
+		statusCode := http.StatusCreated
+		metadata := map[string]string{"X-Abeja-Model-Id": "1300000000000"}
+		cl.ResponseChan <- entity.Response{
+			ContentType: &contentType,
+			Metadata:    &metadata,
+			Path:        &filePath,
+			StatusCode:  &statusCode,
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-abeja-request-id", "123")
+
+	go respond(queue.Out())
+	res, err := client.Predict(ctx, req)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	if res.StatusCode != http.StatusCreated || res.ContentType != "text/plain" || !bytes.Equal(res.Body, resBody) {
+		t.Errorf("response should be 201 of text/plain with body, but %d of %s", res.StatusCode, res.ContentType)
+	}
+	headers := responseHeaders(res)
+	if headers["X-Abeja-Model-Id"] != "1300000000000" {
+		t.Errorf("metadata of response should be in headers, but %v", headers)
+	}
+	if _, ok := headers[convert.KeyContentLength]; ok {
+		t.Error("Content-Length should not be in headers")
+	}
+
+	go respond(queue.Out())
+	stream, err := client.PredictStream(ctx, req)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	var messages []*inferencepb.PredictResponse
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("unexpected error occurred", err)
+		}
+		messages = append(messages, msg)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("PredictStream should respond 3 messages, but %d", len(messages))
+	}
+	first := messages[0]
+	if first.StatusCode != http.StatusCreated || first.ContentType != "text/plain" || len(first.Body) != 0 {
+		t.Errorf("first message should be 201 of text/plain without body, but %d of %s", first.StatusCode, first.ContentType)
+	}
+	var streamed []byte
+	for _, msg := range messages[1:] {
+		streamed = append(streamed, msg.Body...)
+	}
+	if !bytes.Equal(streamed, resBody) {
+		t.Errorf("body should be streamed, but %d bytes", len(streamed))
+	}
+
+	// health of runtime
+	healthClient := healthpb.NewHealthClient(conn)
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal("unexpected error occurred", err)
+		}
+		return res.Status
+	}
+	if st := check(inferencepb.Inference_ServiceDesc.ServiceName); st != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("health should be SERVING, but %s", st)
+	}
+	runtime.Status = subprocess.RuntimeStatusPreparing
+	deadline := time.Now().Add(5 * time.Second)
+	for check("") != healthpb.HealthCheckResponse_NOT_SERVING {
+		if time.Now().After(deadline) {
+			t.Fatal("health should be NOT_SERVING when runtime isn't ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := client.Predict(ctx, req); status.Code(err) != codes.Unavailable {
+		t.Errorf("status should be Unavailable when runtime isn't ready, but %v", err)
+	}
+}
+
+func setGRPCHealthInterval(interval time.Duration) func() {
+	org := grpcHealthInterval
+	grpcHealthInterval = interval
+	return func() {
+		grpcHealthInterval = org
+	}
+}
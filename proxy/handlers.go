@@ -1,52 +1,98 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/capture"
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/convert"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/journal"
 	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
 	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
 )
 
-func getHealthCheckHandleFunc(runtime *subprocess.Runtime) func(w http.ResponseWriter, r *http.Request) {
+// keyStreamError is the trailer key which tells the reason why the streaming response is broken.
+const keyStreamError = "X-Abeja-Stream-Error"
+
+// keyCallbackURL is the header of url to send the result of async request to, instead of ARMS.
+const keyCallbackURL = "x-abeja-callback-url"
+
+// keyCallbackRequestID is the header of id of async request with callback url,
+// which is generated when the client doesn't give it.
+const keyCallbackRequestID = "x-abeja-callback-request-id"
+
+// getHealthCheckHandleFunc returns HandlerFunc for health-check,
+// which also tells the state of each runtime and the depth of request queue.
+// It is ok while any runtime is ready, and tells the model which runtime told when it got ready.
+// It tells the phase of startup while all runtimes are preparing.
+func getHealthCheckHandleFunc(
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
 		w.Header().Set("Content-Type", "application/json")
-		if runtime.IsReady() {
+		var status, extra string
+		if runtimes.IsReady() {
 			w.WriteHeader(http.StatusOK)
-			status := []byte("{\"status\":\"ok\"}")
-			if _, err := w.Write(status); err != nil {
-				log.Warningf(ctx, "Error when writing response body: "+log.ErrorFormat, err)
+			status = "ok"
+			if model := runtimes.Model(); model != nil {
+				if b, err := json.Marshal(model); err == nil {
+					extra = fmt.Sprintf(",\"model\":%s", string(b))
+				} else {
+					log.Warningf(ctx, "Error when encoding model: "+log.ErrorFormat, err)
+				}
 			}
+		} else if runtimes.Status() == subprocess.RuntimeStatusExitedWithSuccess {
+			w.WriteHeader(http.StatusNotFound)
+			status = "service not found"
 		} else {
-			var status string
-			if runtime.Status == subprocess.RuntimeStatusExitedWithSuccess {
-				w.WriteHeader(http.StatusNotFound)
-				status = "{\"status\":\"service not found\"}"
-			} else {
-				w.WriteHeader(http.StatusServiceUnavailable)
-				status = "{\"status\":\"service unavailable\"}"
-			}
-			if _, err := w.Write([]byte(status)); err != nil {
-				log.Warningf(ctx, "Error when writing response body: "+log.ErrorFormat, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			status = "service unavailable"
+			if runtimes.Status() == subprocess.RuntimeStatusPreparing {
+				extra = fmt.Sprintf(",\"phase\":\"%s\"", runtimes.Phase())
 			}
 		}
+		if b, err := json.Marshal(runtimes.Workers()); err == nil {
+			extra += fmt.Sprintf(",\"workers\":%s", string(b))
+		} else {
+			log.Warningf(ctx, "Error when encoding state of workers: "+log.ErrorFormat, err)
+		}
+		stats := queue.Stats()
+		body := fmt.Sprintf(
+			"{\"status\":\"%s\"%s,\"queue\":{\"depth\":%d,\"max_depth\":%d,\"sync\":%d,\"async\":%d}}",
+			status, extra, stats.Depth(), queue.MaxDepth(), stats.Sync, stats.Async)
+		if _, err := w.Write([]byte(body)); err != nil {
+			log.Warningf(ctx, "Error when writing response body: "+log.ErrorFormat, err)
+		}
 	}
 }
 
+// getRequestHandleFunc returns HandlerFunc for user request.
+// recorder captures requests and responses if it is not nil,
+// and asyncJournal persists async requests if it is not nil.
 func getRequestHandleFunc(
-	runtime *subprocess.Runtime,
-	request chan entity.ContentList,
-	response chan entity.Response,
-	conf *config.Configuration) func(w http.ResponseWriter, r *http.Request) {
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue,
+	conf *config.Configuration,
+	recorder *capture.Store,
+	asyncJournal *journal.Journal) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -63,14 +109,37 @@ func getRequestHandleFunc(
 			ctx = context.WithValue(ctx, log.KeyRequesterID, v) //nolint // SA1029: should not use built-in type string as key for value; define your own type to avoid collisions
 		}
 
-		if !runtime.IsReady() {
+		timeout, err := getRequestTimeout(r, conf)
+		if err != nil {
+			outputErrorResponse(ctx, w, http.StatusBadRequest, err.Error())
+			accessLog.status = http.StatusBadRequest
+			return
+		}
+		callbackURL, err := getCallbackURL(r, conf)
+		if err != nil {
+			outputErrorResponse(ctx, w, http.StatusBadRequest, err.Error())
+			accessLog.status = http.StatusBadRequest
+			return
+		}
+
+		if !runtimes.IsReady() {
 			// not ready
 			outputErrorResponse(ctx, w, http.StatusServiceUnavailable, "service unavailable")
 			accessLog.status = http.StatusServiceUnavailable
 			return
 		}
+		// admit the request before its body is written to disk.
+		room, err := queue.reserve()
+		if err != nil {
+			accessLog.status = rejectRequest(ctx, w, queue, err)
+			return
+		}
+		defer room.cancel()
 
+		_, span := tracing.StartSpan(ctx, "convert.to_contents", tracing.SpanKindInternal)
 		cl, err := convert.ToContents(ctx, r, conf)
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			// failed to parse request
 			var statusCode = http.StatusServiceUnavailable
@@ -82,19 +151,49 @@ func getRequestHandleFunc(
 			return
 		}
 
+		cl.Timeout = timeout
+
 		asyncRequestID := r.Header.Get("x-abeja-arms-async-request-id")
+		if callbackURL != "" {
+			// async request whose result is sent to callback url instead of ARMS
+			asyncRequestID = r.Header.Get(keyCallbackRequestID)
+			if asyncRequestID == "" {
+				asyncRequestID = newCallbackRequestID()
+			}
+			cl.CallbackURL = callbackURL
+			w.Header().Set(keyCallbackRequestID, asyncRequestID)
+		}
 		if asyncRequestID != "" {
 			// async request
-			asyncToken := r.Header.Get("x-abeja-arms-async-request-token")
 			cl.AsyncRequestID = asyncRequestID
-			cl.AsyncARMSToken = asyncToken
-			request <- *cl
+			if callbackURL == "" {
+				cl.AsyncARMSToken = r.Header.Get("x-abeja-arms-async-request-token")
+			}
+			queued := true
+			if asyncJournal != nil {
+				err := asyncJournal.Accept(cl, r.Header.Get("x-abeja-request-id"))
+				if err == journal.ErrAlreadyAccepted {
+					log.Infof(ctx, "async request %s is already accepted.", asyncRequestID)
+					deleteTempFiles(ctx, cl, nil)
+					queued = false
+				} else if err != nil {
+					log.Warningf(ctx, "failed to journal async request: "+log.ErrorFormat, err)
+				}
+			}
+			if queued {
+				if _, err := room.push(*cl); err != nil {
+					accessLog.status = rejectRequest(ctx, w, queue, err)
+					deleteTempFiles(ctx, cl, nil)
+					if cl.Ledger != nil {
+						asyncJournal.Discard(asyncRequestID)
+					}
+					return
+				}
+			}
 
 			w.Header().Set(convert.KeyContentType, "application/json")
-			// SAMPv2 limits the number of concurrent requests by LimitListener,
-			// but it accepts requests from multiple clients at the same time.
-			// Keepalive is disabled because it can't process requests
-			// until the previous connection is closed, which causes a wait time.
+			// Keepalive is disabled as well as the response of synchronous requests.
+			// (see convert.responseHeaders)
 			w.Header().Set(convert.KeyConnection, "close")
 			w.WriteHeader(http.StatusAccepted)
 			if _, err := w.Write([]byte("")); err != nil {
@@ -105,10 +204,27 @@ func getRequestHandleFunc(
 			return
 		}
 
-		request <- *cl
-
-		res := <-response
+		res, err := dispatch(room, cl)
+		if err != nil {
+			accessLog.status = rejectRequest(ctx, w, queue, err)
+			deleteTempFiles(ctx, cl, nil)
+			return
+		}
+		if recorder != nil && res.Chunks == nil && recorder.Sample() {
+			// capture before converting, because the converter removes parts of response.
+			if err := recorder.Capture(ctx, r.Header.Get("x-abeja-request-id"), cl, &res); err != nil {
+				log.Warningf(ctx, "failed to capture request: "+log.ErrorFormat, err)
+			}
+		}
+		if res.Chunks != nil {
+			accessLog.status = writeStreamingResponse(ctx, w, res)
+			deleteTempFiles(ctx, cl, nil)
+			return
+		}
+		_, span = tracing.StartSpan(ctx, "convert.from_response", tracing.SpanKindInternal)
 		status, headers, body, err := convert.FromResponse(ctx, res)
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			var statusCode = http.StatusServiceUnavailable
 			if convertError, ok := err.(*convert.ConverterError); ok {
@@ -130,11 +246,215 @@ func getRequestHandleFunc(
 		// record the response code to be returned
 		accessLog.status = status
 
-		// TODO record request/response
 		deleteTempFiles(ctx, cl, body)
 	}
 }
 
+// dispatch queues the sync request to runtimes in the room reserved, and waits for its response.
+// It returns error when the request isn't accepted by the queue or waited too long in it.
+func dispatch(room *reservation, cl *entity.ContentList) (entity.Response, error) {
+	response := make(chan entity.Response, 1)
+	cl.ResponseChan = response
+	entry, err := room.push(*cl)
+	if err != nil {
+		return entity.Response{}, err
+	}
+	res, ok := waitResponse(room.queue, entry, response)
+	if !ok {
+		queueRejections.WithLabelValues("timeout").Inc()
+		return entity.Response{}, errors.New("waited too long in request queue")
+	}
+	return res, nil
+}
+
+// waitResponse waits for the response of the request in the queue.
+// It returns false when the request waited longer than max wait of the queue before runtime took it.
+func waitResponse(
+	queue *RequestQueue,
+	entry *queueEntry,
+	response chan entity.Response) (entity.Response, bool) {
+
+	if queue.maxWait <= 0 {
+		return <-response, true
+	}
+	timer := time.NewTimer(queue.maxWait)
+	defer timer.Stop()
+	select {
+	case res := <-response:
+		return res, true
+	case <-timer.C:
+		if queue.remove(entry) {
+			return entity.Response{}, false
+		}
+		// runtime already took the request.
+		return <-response, true
+	}
+}
+
+// readWholeResponse returns status code, headers and the whole body of response.
+// The body of streaming response is read to the end.
+func readWholeResponse(ctx context.Context, res entity.Response) (int, map[string]string, []byte, error) {
+	if res.Chunks != nil {
+		statusCode, headers, err := convert.FromStreamingResponse(ctx, res)
+		if err != nil {
+			for range res.Chunks {
+			}
+			return 0, headers, nil, err
+		}
+		var body bytes.Buffer
+		for chunk := range res.Chunks {
+			if chunk.Err != nil {
+				log.Warningf(ctx, "streaming response is broken: "+log.ErrorFormat, chunk.Err)
+				for range res.Chunks {
+				}
+				return 0, headers, nil, chunk.Err
+			}
+			body.Write(chunk.Data)
+		}
+		return statusCode, headers, body.Bytes(), nil
+	}
+
+	statusCode, headers, fp, err := convert.FromResponse(ctx, res)
+	if err != nil {
+		return 0, headers, nil, err
+	}
+	defer deleteTempFiles(ctx, nil, fp)
+	body, err := ioutil.ReadAll(fp)
+	if err != nil {
+		return 0, headers, nil, errors.Errorf("failed to read response of model: %w", err)
+	}
+	return statusCode, headers, body, nil
+}
+
+// rejectRequest responds that the request isn't accepted, and returns status code.
+func rejectRequest(ctx context.Context, w http.ResponseWriter, queue *RequestQueue, err error) int {
+	statusCode, message := rejection(ctx, w, queue, err)
+	outputErrorResponse(ctx, w, statusCode, message)
+	return statusCode
+}
+
+// rejection returns status code and message of the request which isn't accepted.
+// When the queue is full, the client is told when to retry by `Retry-After`.
+func rejection(ctx context.Context, w http.ResponseWriter, queue *RequestQueue, err error) (int, string) {
+	if err == ErrQueueClosed {
+		return http.StatusServiceUnavailable, "service unavailable"
+	}
+	log.Warningf(ctx, "request is rejected: "+log.ErrorFormat, err)
+	w.Header().Set("Retry-After", strconv.Itoa(queue.RetryAfter()))
+	return http.StatusTooManyRequests, "too many requests"
+}
+
+// writeStreamingResponse writes chunks of response as soon as they arrive, and returns status code.
+// Each chunk is written as one event when Content-Type is text/event-stream.
+// When the stream is broken, its reason is set to the trailer `X-Abeja-Stream-Error`.
+func writeStreamingResponse(ctx context.Context, w http.ResponseWriter, res entity.Response) int {
+	status, headers, err := convert.FromStreamingResponse(ctx, res)
+	if err != nil {
+		var statusCode = http.StatusServiceUnavailable
+		if convertError, ok := err.(*convert.ConverterError); ok {
+			statusCode = convertError.StatusCode
+		}
+		outputErrorResponse(ctx, w, statusCode, err.Error())
+		return statusCode
+	}
+
+	for key, value := range headers {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set("Trailer", keyStreamError)
+	w.WriteHeader(status)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	eventStream := convert.IsEventStream(headers[convert.KeyContentType])
+	for chunk := range res.Chunks {
+		data := chunk.Data
+		if chunk.Err != nil {
+			log.Warningf(ctx, "streaming response is broken: "+log.ErrorFormat, chunk.Err)
+			w.Header().Set(keyStreamError, chunk.Err.Error())
+			if !eventStream {
+				break
+			}
+			data = toEvent("error", []byte(chunk.Err.Error()))
+		} else if eventStream {
+			data = toEvent("", data)
+		}
+		if _, err := w.Write(data); err != nil {
+			log.Warningf(ctx, "Error when writing response body: "+log.ErrorFormat, err)
+			break
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return status
+}
+
+// toEvent formats data as an event of text/event-stream.
+func toEvent(event string, data []byte) []byte {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimRight(line, "\r"))
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// getRequestTimeout returns the timeout of inference, which can be shortened by
+// the header `x-abeja-request-timeout` in seconds.
+// The header can't disable or extend the configured timeout, so the value longer than it is clamped.
+func getRequestTimeout(r *http.Request, conf *config.Configuration) (time.Duration, error) {
+	limit := conf.GetRequestTimeout()
+	v := r.Header.Get("x-abeja-request-timeout")
+	if v == "" {
+		return limit, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return 0, errors.Errorf("invalid x-abeja-request-timeout: %s", v)
+	}
+	if timeout := time.Duration(seconds * float64(time.Second)); timeout < limit {
+		return timeout, nil
+	}
+	return limit, nil
+}
+
+// getCallbackURL returns the callback url of async request given by the header `x-abeja-callback-url`,
+// or empty when it isn't given.
+func getCallbackURL(r *http.Request, conf *config.Configuration) (string, error) {
+	v := r.Header.Get(keyCallbackURL)
+	if v == "" {
+		return "", nil
+	}
+	if conf.CallbackSecret == "" {
+		return "", errors.Errorf("%s is not enabled", keyCallbackURL)
+	}
+	if r.Header.Get("x-abeja-arms-async-request-id") != "" {
+		return "", errors.Errorf("%s can't be used with async request of ARMS", keyCallbackURL)
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.Errorf("invalid %s: %s", keyCallbackURL, v)
+	}
+	return v, nil
+}
+
+func newCallbackRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// never happens on supported platforms.
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return hex.EncodeToString(b)
+}
+
 func outputErrorResponse(ctx context.Context, w http.ResponseWriter, statusCode int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -151,4 +471,6 @@ type AccessLog struct {
 
 func (a AccessLog) log(ctx context.Context, r *http.Request) {
 	log.AccessLog(ctx, a.status, a.start, r)
+	requestsTotal.WithLabelValues(r.Method, strconv.Itoa(a.status)).Inc()
+	requestDuration.Observe(time.Since(a.start).Seconds())
 }
@@ -7,28 +7,40 @@ import (
 	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/netutil"
-	httptrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
+	errors "golang.org/x/xerrors"
 
+	"github.com/abeja-inc/abeja-platform-model-proxy/capture"
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/journal"
 	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
 	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
 	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
 )
 
 // HTTPServer represents the wrapper of net/http/Server.
 type HTTPServer struct {
 	Server            *http.Server
 	HealthCheckServer *http.Server
-	req               chan entity.ContentList
+	GRPCServer        *GRPCServer // nil when gRPC is disabled
+	queue             *RequestQueue
+	maxConnections    int
 }
 
+// connectionHeadroom is the number of connections allowed beyond max depth of the queue,
+// for requests being processed by runtimes and requests being rejected by the queue.
+const connectionHeadroom = 1024
+
 func deleteTempFiles(ctx context.Context, cl *entity.ContentList, resBody *os.File) {
 	if cl != nil {
 		contents := cl.Contents
 		for _, c := range contents {
-			cleanutil.Remove(ctx, *c.Path)
+			if !c.Keep {
+				cleanutil.Remove(ctx, *c.Path)
+			}
 		}
 	}
 	if resBody != nil {
@@ -37,30 +49,83 @@ func deleteTempFiles(ctx context.Context, cl *entity.ContentList, resBody *os.Fi
 	}
 }
 
+// writeTimeout is the time limit of each write to the client.
+var writeTimeout = 30 * time.Second
+
+// writeDeadlineListener accepts connections which limit the time of each write.
+type writeDeadlineListener struct {
+	net.Listener
+}
+
+func (l *writeDeadlineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writeDeadlineConn{conn}, nil
+}
+
+// writeDeadlineConn extends the write deadline on each write,
+// so that streaming response can last as long as chunks keep arriving.
+type writeDeadlineConn struct {
+	net.Conn
+}
+
+func (c *writeDeadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
 // CreateHTTPServer return HTTPServer.
 func CreateHTTPServer(
-	runtime *subprocess.Runtime,
-	request chan entity.ContentList,
-	response chan entity.Response,
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue,
 	conf *config.Configuration) (*HTTPServer, error) {
 
-	muxOptions := config.GetHTTPTraceOptions()
-	serviceHandler := httptrace.NewServeMux(muxOptions...)
-	healthCheckHandler := httptrace.NewServeMux(muxOptions...)
+	serviceHandler := tracing.NewServeMux()
+	healthCheckHandler := tracing.NewServeMux()
 
 	// add HandlerFunc for health-check
-	healthCheckHandler.HandleFunc("/health_check", getHealthCheckHandleFunc(runtime))
-	serviceHandler.HandleFunc("/health_check", getHealthCheckHandleFunc(runtime))
+	healthCheckHandler.HandleFunc("/health_check", getHealthCheckHandleFunc(runtimes, queue))
+	serviceHandler.HandleFunc("/health_check", getHealthCheckHandleFunc(runtimes, queue))
+	// add Handler for metrics, which is exposed only on health-check port
+	healthCheckHandler.Handle("/metrics", promhttp.Handler())
+	registerServiceMetrics(runtimes, queue)
 	// add HandlerFunc for user request
+	var recorder *capture.Store
+	if conf.CaptureDir != "" {
+		var err error
+		recorder, err = capture.NewStore(conf.CaptureDir, conf.CaptureSampleRate, conf.GetCaptureMaxBytes())
+		if err != nil {
+			return nil, errors.Errorf(": %w", err)
+		}
+	}
+	var asyncJournal *journal.Journal
+	if conf.AsyncJournalDir != "" {
+		var err error
+		asyncJournal, err = restoreAsyncRequests(conf.AsyncJournalDir, queue)
+		if err != nil {
+			return nil, errors.Errorf(": %w", err)
+		}
+	}
 	serviceHandler.HandleFunc(
 		"/",
-		getRequestHandleFunc(runtime, request, response, conf))
+		getRequestHandleFunc(runtimes, queue, conf, recorder, asyncJournal))
+	// add HandlerFuncs for Open Inference Protocol v2, which are optional
+	if conf.V2ModelName != "" {
+		registerV2Handlers(serviceHandler, runtimes, queue, conf)
+	}
 
+	// NOTE: WriteTimeout is not set, because it limits the whole time of
+	// inference and streaming response. Instead, inference is limited by
+	// request timeout, and each write to the client is limited by writeTimeout.
+	// (see writeDeadlineConn)
 	serviceServer := &http.Server{
 		Addr:           conf.GetListenAddress(),
 		Handler:        serviceHandler,
 		ReadTimeout:    30 * time.Second,
-		WriteTimeout:   30 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
@@ -75,14 +140,40 @@ func CreateHTTPServer(
 	httpServer := &HTTPServer{
 		Server:            serviceServer,
 		HealthCheckServer: healthCheckServer,
-		req:               request,
+		queue:             queue,
+		maxConnections:    queue.MaxDepth() + connectionHeadroom,
+	}
+	if conf.GRPCPort != 0 {
+		httpServer.GRPCServer = createGRPCServer(runtimes, queue, conf)
 	}
 	return httpServer, nil
 }
 
+// restoreAsyncRequests opens the journal of async requests,
+// and queues the requests which were accepted before restart.
+func restoreAsyncRequests(dir string, queue *RequestQueue) (*journal.Journal, error) {
+	asyncJournal, err := journal.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	pending := asyncJournal.Pending()
+	for _, cl := range pending {
+		if err := queue.restore(cl); err != nil {
+			return nil, err
+		}
+	}
+	if len(pending) > 0 {
+		log.Infof(context.Background(), "%d async request(s) are restored from journal.", len(pending))
+	}
+	return asyncJournal, nil
+}
+
 // ListenAndServe start serving http-request/response.
-// Because the DL framework(s) are often incompatible with multithreading,
-// This server has only one thread for waiting request.
+// Requests wait in the queue, which rejects them with 429 when it is full, and each runtime
+// receives only as many requests as it can process at a time. (the DL framework(s) are often
+// incompatible with multithreading) The number of connections is limited generously beyond
+// the queue, so that the queue can reject requests but too many connections can't exhaust
+// file descriptors.
 func (hs *HTTPServer) ListenAndServe(ctx context.Context, errOnBoot chan int) {
 	go func() {
 		log.Debugf(ctx, "start listen health check with address: %s.", hs.HealthCheckServer.Addr)
@@ -98,8 +189,18 @@ func (hs *HTTPServer) ListenAndServe(ctx context.Context, errOnBoot chan int) {
 		}
 	}()
 
-	// Since the DL framework often does not support multithreading,
-	// limit the number of simultaneous connections
+	if hs.GRPCServer != nil {
+		go func() {
+			log.Debugf(ctx, "start listen gRPC with address: %s.", hs.GRPCServer.Addr)
+			if err := hs.GRPCServer.ListenAndServe(); err != nil {
+				log.Errorf(ctx, "error occurred when gRPC request listening: "+log.ErrorFormat, err)
+				close(errOnBoot)
+				return
+			}
+			log.Debug(ctx, "finish to listen gRPC.")
+		}()
+	}
+
 	log.Debugf(ctx, "start listen with address: %s.", hs.Server.Addr)
 	listener, err := net.Listen("tcp", hs.Server.Addr)
 	if err != nil {
@@ -107,8 +208,7 @@ func (hs *HTTPServer) ListenAndServe(ctx context.Context, errOnBoot chan int) {
 		close(errOnBoot)
 		return
 	}
-	limitedListener := netutil.LimitListener(listener, 1)
-
+	limitedListener := netutil.LimitListener(&writeDeadlineListener{listener}, hs.maxConnections)
 	if err := hs.Server.Serve(limitedListener); err != nil {
 		if err != http.ErrServerClosed {
 			close(errOnBoot)
@@ -120,7 +220,7 @@ func (hs *HTTPServer) ListenAndServe(ctx context.Context, errOnBoot chan int) {
 
 // Shutdown does graceful-shutdown.
 func (hs *HTTPServer) Shutdown(procCtx context.Context, timeout time.Duration) error {
-	close(hs.req)
+	hs.queue.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	go func() {
@@ -128,5 +228,12 @@ func (hs *HTTPServer) Shutdown(procCtx context.Context, timeout time.Duration) e
 			log.Warningf(procCtx, "healthcheck server shutdown error: "+log.ErrorFormat, err)
 		}
 	}()
+	if hs.GRPCServer != nil {
+		go func() {
+			if err := hs.GRPCServer.Shutdown(ctx); err != nil {
+				log.Warningf(procCtx, "gRPC server shutdown error: "+log.ErrorFormat, err)
+			}
+		}()
+	}
 	return hs.Server.Shutdown(ctx)
 }
@@ -2,32 +2,46 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
 	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
 )
 
+func newRuntimePool(t *testing.T, runtime *subprocess.Runtime) *subprocess.RuntimePool {
+	t.Helper()
+	supervisor, err := subprocess.NewSupervisor(
+		func() (*subprocess.Runtime, error) { return runtime, nil }, "", 0)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	return subprocess.NewRuntimePool(supervisor)
+}
+
 func TestHealthCheck(t *testing.T) {
 	runtime := &subprocess.Runtime{
 		Cmd:    nil,
 		Status: subprocess.RuntimeStatusPreparing,
 	}
-	reqChan := make(chan entity.ContentList)
-	resChan := make(chan entity.Response)
-	defer close(reqChan)
-	defer close(resChan)
 	conf := config.NewConfiguration()
 	conf.Port = config.DefaultHTTPListenPort
 	conf.HealthCheckPort = config.DefaultHealthCheckListenPort
-	server, err := CreateHTTPServer(runtime, reqChan, resChan, &conf)
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
 	if err != nil {
 		t.Fatal("unexpected error occurred", err)
 	}
@@ -42,22 +56,22 @@ func TestHealthCheck(t *testing.T) {
 			name:          "preparing",
 			runtimeStatus: subprocess.RuntimeStatusPreparing,
 			httpStatus:    http.StatusServiceUnavailable,
-			resBody:       "{\"status\":\"service unavailable\"}",
+			resBody:       "{\"status\":\"service unavailable\",\"phase\":\"starting\",\"workers\":[{\"state\":\"starting\",\"restarts\":0}],\"queue\":{\"depth\":0,\"max_depth\":10000,\"sync\":0,\"async\":0}}",
 		}, {
 			name:          "running",
 			runtimeStatus: subprocess.RuntimeStatusRunning,
 			httpStatus:    http.StatusOK,
-			resBody:       "{\"status\":\"ok\"}",
+			resBody:       "{\"status\":\"ok\",\"workers\":[{\"state\":\"ready\",\"restarts\":0}],\"queue\":{\"depth\":0,\"max_depth\":10000,\"sync\":0,\"async\":0}}",
 		}, {
 			name:          "already-exited-with-success",
 			runtimeStatus: subprocess.RuntimeStatusExitedWithSuccess,
 			httpStatus:    http.StatusNotFound,
-			resBody:       "{\"status\":\"service not found\"}",
+			resBody:       "{\"status\":\"service not found\",\"workers\":[{\"state\":\"exited\",\"restarts\":0}],\"queue\":{\"depth\":0,\"max_depth\":10000,\"sync\":0,\"async\":0}}",
 		}, {
 			name:          "already-exited-with-failure",
 			runtimeStatus: subprocess.RuntimeStatusExitedWithFailure,
 			httpStatus:    http.StatusServiceUnavailable,
-			resBody:       "{\"status\":\"service unavailable\"}",
+			resBody:       "{\"status\":\"service unavailable\",\"workers\":[{\"state\":\"failed\",\"restarts\":0}],\"queue\":{\"depth\":0,\"max_depth\":10000,\"sync\":0,\"async\":0}}",
 		},
 	}
 	for _, c := range cases {
@@ -75,6 +89,92 @@ func TestHealthCheck(t *testing.T) {
 			}
 		})
 	}
+
+	// the model which runtime told in READY frame is reported.
+	runtime.Status = subprocess.RuntimeStatusPreparing
+	runtime.MarkReady(map[string]interface{}{"name": "resnet50"})
+	req := httptest.NewRequest("GET", "/health_check", nil)
+	rec := httptest.NewRecorder()
+	server.HealthCheckServer.Handler.ServeHTTP(rec, req)
+	expected := "{\"status\":\"ok\",\"model\":{\"name\":\"resnet50\"},\"workers\":[{\"state\":\"ready\",\"restarts\":0}],\"queue\":{\"depth\":0,\"max_depth\":10000,\"sync\":0,\"async\":0}}"
+	if rec.Body.String() != expected {
+		t.Errorf("response body should be [%s], but [%s]", expected, rec.Body.String())
+	}
+}
+
+func TestHealthCheck_PartiallyReady(t *testing.T) {
+	var supervisors []*subprocess.Supervisor
+	for _, status := range []subprocess.RuntimeStatus{
+		subprocess.RuntimeStatusRunning, subprocess.RuntimeStatusPreparing} {
+		runtime := &subprocess.Runtime{Status: status}
+		supervisor, err := subprocess.NewSupervisor(
+			func() (*subprocess.Runtime, error) { return runtime, nil }, "", 0)
+		if err != nil {
+			t.Fatal("unexpected error occurred", err)
+		}
+		supervisors = append(supervisors, supervisor)
+	}
+	conf := config.NewConfiguration()
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	server, err := CreateHTTPServer(subprocess.NewRuntimePool(supervisors...), queue, &conf)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+
+	// the service is available while the other worker is restarting.
+	req := httptest.NewRequest("GET", "/health_check", nil)
+	rec := httptest.NewRecorder()
+	server.HealthCheckServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("http status should be %d, but %d", http.StatusOK, rec.Code)
+	}
+	expected := "{\"status\":\"ok\",\"workers\":[{\"state\":\"ready\",\"restarts\":0},{\"state\":\"starting\",\"restarts\":0}]," +
+		"\"queue\":{\"depth\":0,\"max_depth\":10000,\"sync\":0,\"async\":0}}"
+	if rec.Body.String() != expected {
+		t.Errorf("response body should be [%s], but [%s]", expected, rec.Body.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	conf := config.NewConfiguration()
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	if _, err := queue.push(entity.ContentList{}); err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+
+	// request to service port is counted.
+	req := httptest.NewRequest("GET", "/health_check", nil)
+	AccessLog{start: time.Now(), status: http.StatusOK}.log(context.TODO(), req)
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	server.HealthCheckServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("http status should be %d, but %d", http.StatusOK, rec.Code)
+	}
+	body := rec.Body.String()
+	for _, expect := range []string{
+		"abeja_proxy_queue_depth 1\n",
+		"abeja_proxy_runtime_restarts_total{worker=\"0\"} 0\n",
+		"abeja_proxy_runtime_status{worker=\"0\"} 1\n",
+		"abeja_proxy_requests_total{code=\"200\",method=\"GET\"} ",
+		"abeja_proxy_request_duration_seconds_count ",
+		"# TYPE abeja_proxy_request_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("metrics should contain [%s], but\n%s", expect, body)
+		}
+	}
 }
 
 func TestRequest(t *testing.T) {
@@ -82,13 +182,11 @@ func TestRequest(t *testing.T) {
 		Cmd:    nil,
 		Status: subprocess.RuntimeStatusRunning,
 	}
-	reqChan := make(chan entity.ContentList)
-	resChan := make(chan entity.Response)
-	defer close(reqChan)
-	defer close(resChan)
 	conf := config.NewConfiguration()
 	conf.Port = config.DefaultHTTPListenPort
-	server, err := CreateHTTPServer(runtime, reqChan, resChan, &conf)
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
 	if err != nil {
 		t.Fatal("unexpected error occurred", err)
 	}
@@ -212,7 +310,7 @@ func TestRequest(t *testing.T) {
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			f := func(reqChan chan entity.ContentList, resChan chan entity.Response) {
+			f := func(reqChan <-chan entity.ContentList) {
 				cl := <-reqChan
 				if c.reqMethod != cl.Method {
 					t.Errorf("request method should be %s, but %s", c.reqMethod, cl.Method)
@@ -311,9 +409,9 @@ func TestRequest(t *testing.T) {
 					ErrMsg:      nil,
 					StatusCode:  &resStatusCode,
 				}
-				resChan <- res
+				cl.ResponseChan <- res
 			}
-			go f(reqChan, resChan)
+			go f(queue.Out())
 
 			var body io.Reader
 			path := "/"
@@ -376,3 +474,384 @@ func TestRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRequestTimeout(t *testing.T) {
+	cases := []struct {
+		name           string
+		requestTimeout int
+		header         string
+		hasError       bool
+		expect         time.Duration
+	}{
+		{
+			name:           "configured timeout",
+			requestTimeout: 10,
+			header:         "",
+			hasError:       false,
+			expect:         10 * time.Second,
+		}, {
+			name:           "overridden by header",
+			requestTimeout: 10,
+			header:         "2.5",
+			hasError:       false,
+			expect:         2500 * time.Millisecond,
+		}, {
+			name:           "invalid header",
+			requestTimeout: 10,
+			header:         "ten",
+			hasError:       true,
+		}, {
+			name:           "negative header",
+			requestTimeout: 10,
+			header:         "-1",
+			hasError:       true,
+		}, {
+			name:           "zero header",
+			requestTimeout: 10,
+			header:         "0",
+			hasError:       true,
+		}, {
+			name:           "header longer than configured timeout",
+			requestTimeout: 10,
+			header:         "3600",
+			hasError:       false,
+			expect:         10 * time.Second,
+		}, {
+			name:           "default timeout",
+			requestTimeout: config.DefaultRequestTimeout,
+			header:         "",
+			hasError:       false,
+			expect:         60 * time.Second,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := config.NewConfiguration()
+			conf.RequestTimeout = c.requestTimeout
+			req := httptest.NewRequest("POST", "/", nil)
+			if c.header != "" {
+				req.Header.Set("x-abeja-request-timeout", c.header)
+			}
+			timeout, err := getRequestTimeout(req, &conf)
+			if c.hasError {
+				if err == nil {
+					t.Error("error should be occurred")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			if timeout != c.expect {
+				t.Errorf("timeout should be %s, but %s", c.expect, timeout)
+			}
+		})
+	}
+}
+
+func TestWriteStreamingResponse(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		chunks      []entity.Chunk
+		body        string
+		streamError string
+	}{
+		{
+			name:        "chunked",
+			contentType: "application/x-ndjson",
+			chunks:      []entity.Chunk{{Data: []byte("{\"n\":1}\n")}, {Data: []byte("{\"n\":2}\n")}},
+			body:        "{\"n\":1}\n{\"n\":2}\n",
+		}, {
+			name:        "event-stream",
+			contentType: "text/event-stream",
+			chunks:      []entity.Chunk{{Data: []byte("foo")}, {Data: []byte("bar\nbaz\n")}},
+			body:        "data: foo\n\ndata: bar\ndata: baz\n\n",
+		}, {
+			name:        "broken chunked",
+			contentType: "application/octet-stream",
+			chunks:      []entity.Chunk{{Data: []byte("foo")}, {Err: errors.New("runtime exited")}},
+			body:        "foo",
+			streamError: "runtime exited",
+		}, {
+			name:        "broken event-stream",
+			contentType: "text/event-stream",
+			chunks:      []entity.Chunk{{Data: []byte("foo")}, {Err: errors.New("runtime exited")}},
+			body:        "data: foo\n\nevent: error\ndata: runtime exited\n\n",
+			streamError: "runtime exited",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			chunks := make(chan entity.Chunk, len(c.chunks))
+			for _, chunk := range c.chunks {
+				chunks <- chunk
+			}
+			close(chunks)
+			statusCode := http.StatusOK
+			res := entity.Response{
+				ContentType: &c.contentType,
+				StatusCode:  &statusCode,
+				Chunks:      chunks,
+			}
+
+			rec := httptest.NewRecorder()
+			status := writeStreamingResponse(context.TODO(), rec, res)
+			resp := rec.Result()
+			defer resp.Body.Close()
+
+			if status != http.StatusOK || resp.StatusCode != http.StatusOK {
+				t.Errorf("status code should be %d, but %d/%d", http.StatusOK, status, resp.StatusCode)
+			}
+			if resp.Header.Get("Content-Type") != c.contentType {
+				t.Errorf("Content-Type should be %s, but %s", c.contentType, resp.Header.Get("Content-Type"))
+			}
+			if resp.Header.Get("Content-Length") != "" {
+				t.Errorf("Content-Length should not be set, but %s", resp.Header.Get("Content-Length"))
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal("failed to read body:", err)
+			}
+			if string(body) != c.body {
+				t.Errorf("body should be [%s], but [%s]", c.body, string(body))
+			}
+			if resp.Trailer.Get(keyStreamError) != c.streamError {
+				t.Errorf("trailer %s should be [%s], but [%s]",
+					keyStreamError, c.streamError, resp.Trailer.Get(keyStreamError))
+			}
+		})
+	}
+}
+
+func TestAsyncJournal(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := config.NewConfiguration()
+	conf.AsyncJournalDir = dir
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("{\"foo\":\"bar\"}"))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("x-abeja-arms-async-request-id", "req-1")
+		rec := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusAccepted {
+			t.Errorf("http status should be %d, but %d", http.StatusAccepted, rec.Code)
+		}
+	}
+	// the same request is queued only once.
+	cl := <-queue.Out()
+	if cl.Ledger == nil || !strings.HasPrefix(*cl.Contents[0].Path, dir) {
+		t.Errorf("async request should be journaled, but %+v", cl)
+	}
+	if stats := queue.Stats(); stats.Depth() != 0 {
+		t.Errorf("queue should be empty, but %+v", stats)
+	}
+
+	// restart before delivery.
+	restoredQueue := NewRequestQueue(&conf)
+	defer restoredQueue.Close()
+	if _, err := CreateHTTPServer(newRuntimePool(t, runtime), restoredQueue, &conf); err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	restored := <-restoredQueue.Out()
+	if restored.AsyncRequestID != "req-1" {
+		t.Errorf("async request should be restored, but %+v", restored)
+	}
+	body, err := ioutil.ReadFile(*restored.Contents[0].Path)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	if string(body) != "{\"foo\":\"bar\"}" {
+		t.Errorf("content should be restored, but %s", string(body))
+	}
+}
+
+func TestCallback(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	cases := []struct {
+		name       string
+		secret     string
+		headers    map[string]string
+		statusCode int
+		requestID  string
+	}{
+		{
+			name:       "callback with request id",
+			secret:     "secret",
+			headers:    map[string]string{"x-abeja-callback-url": "https://example.com/done", "x-abeja-callback-request-id": "job-1"},
+			statusCode: http.StatusAccepted,
+			requestID:  "job-1",
+		}, {
+			name:       "callback without request id",
+			secret:     "secret",
+			headers:    map[string]string{"x-abeja-callback-url": "http://example.com/done"},
+			statusCode: http.StatusAccepted,
+		}, {
+			name:       "callback is disabled",
+			secret:     "",
+			headers:    map[string]string{"x-abeja-callback-url": "https://example.com/done"},
+			statusCode: http.StatusBadRequest,
+		}, {
+			name:       "invalid callback url",
+			secret:     "secret",
+			headers:    map[string]string{"x-abeja-callback-url": "file:///etc/passwd"},
+			statusCode: http.StatusBadRequest,
+		}, {
+			name:   "callback with async request of ARMS",
+			secret: "secret",
+			headers: map[string]string{
+				"x-abeja-callback-url":          "https://example.com/done",
+				"x-abeja-arms-async-request-id": "req-1",
+			},
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := config.NewConfiguration()
+			conf.CallbackSecret = c.secret
+			queue := NewRequestQueue(&conf)
+			defer queue.Close()
+			handler := getRequestHandleFunc(newRuntimePool(t, runtime), queue, &conf, nil, nil)
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != c.statusCode {
+				t.Fatalf("http status should be %d, but %d", c.statusCode, rec.Code)
+			}
+			if c.statusCode != http.StatusAccepted {
+				return
+			}
+
+			requestID := rec.Header().Get("x-abeja-callback-request-id")
+			if requestID == "" || (c.requestID != "" && requestID != c.requestID) {
+				t.Errorf("request id should be responded, but [%s]", requestID)
+			}
+			cl := <-queue.Out()
+			if cl.AsyncRequestID != requestID || cl.CallbackURL != c.headers["x-abeja-callback-url"] {
+				t.Errorf("request should be queued as async request with callback, but %+v", cl)
+			}
+			deleteTempFiles(context.TODO(), &cl, nil)
+		})
+	}
+}
+
+// freePort returns the port number which nobody listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// serveForTest starts listening of server, and returns the url of it.
+func serveForTest(t *testing.T, server *HTTPServer, conf *config.Configuration) string {
+	t.Helper()
+	go server.ListenAndServe(context.TODO(), make(chan int))
+	address := fmt.Sprintf("127.0.0.1:%d", conf.Port)
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return "http://" + address + "/"
+		}
+	}
+	t.Fatal("timeout on waiting for server to listen")
+	return ""
+}
+
+func TestListenAndServe_QueueFull(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	conf := config.NewConfiguration()
+	conf.Port = freePort(t)
+	conf.HealthCheckPort = freePort(t)
+	conf.QueueMaxDepth = 2
+	queue := NewRequestQueue(&conf)
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+	defer server.Shutdown(context.TODO(), time.Second)
+	url := serveForTest(t, server, &conf)
+
+	type result struct {
+		statusCode int
+		retryAfter string
+	}
+	// more clients than the queue holds connect at the same time with only one runtime.
+	results := make(chan result, conf.QueueMaxDepth+1)
+	for i := 0; i < conf.QueueMaxDepth+1; i++ {
+		go func() {
+			res, err := http.Post(url, "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Error("unexpected error occurred", err)
+				results <- result{}
+				return
+			}
+			defer res.Body.Close()
+			results <- result{statusCode: res.StatusCode, retryAfter: res.Header.Get("Retry-After")}
+		}()
+	}
+
+	// runtime doesn't take requests yet, so the request over depth of the queue is rejected.
+	select {
+	case r := <-results:
+		if r.statusCode != http.StatusTooManyRequests {
+			t.Errorf("http status should be %d, but %d", http.StatusTooManyRequests, r.statusCode)
+		}
+		if r.retryAfter == "" {
+			t.Error("Retry-After should be set")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request over depth of the queue should be rejected")
+	}
+
+	for i := 0; i < conf.QueueMaxDepth; i++ {
+		cl := <-queue.Out()
+		deleteTempFiles(context.TODO(), &cl, nil)
+		f, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal("unexpected error occurred", err)
+		}
+		if _, err := f.WriteString("{}"); err != nil {
+			t.Error("unexpected error occurred", err)
+		}
+		f.Close()
+		resPath := f.Name()
+		statusCode := http.StatusOK
+		cl.ResponseChan <- entity.Response{Path: &resPath, StatusCode: &statusCode}
+	}
+	for i := 0; i < conf.QueueMaxDepth; i++ {
+		if r := <-results; r.statusCode != http.StatusOK {
+			t.Errorf("http status should be %d, but %d", http.StatusOK, r.statusCode)
+		}
+	}
+}
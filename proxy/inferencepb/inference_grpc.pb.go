@@ -0,0 +1,185 @@
+// Inference service served on `grpc_port` (see proxy/grpcserver.go).
+// The standard health service `grpc.health.v1.Health` is served on the same port.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: inferencepb/inference.proto
+
+package inferencepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Inference_Predict_FullMethodName       = "/abeja.proxy.v1.Inference/Predict"
+	Inference_PredictStream_FullMethodName = "/abeja.proxy.v1.Inference/PredictStream"
+)
+
+// InferenceClient is the client API for Inference service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type InferenceClient interface {
+	// Predict requests inference, and returns the whole response.
+	Predict(ctx context.Context, in *PredictRequest, opts ...grpc.CallOption) (*PredictResponse, error)
+	// PredictStream requests inference, and streams the response.
+	// The first message has status_code, content_type and headers,
+	// and the following messages have body in chunks as the runtime sends them.
+	PredictStream(ctx context.Context, in *PredictRequest, opts ...grpc.CallOption) (Inference_PredictStreamClient, error)
+}
+
+type inferenceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewInferenceClient(cc grpc.ClientConnInterface) InferenceClient {
+	return &inferenceClient{cc}
+}
+
+func (c *inferenceClient) Predict(ctx context.Context, in *PredictRequest, opts ...grpc.CallOption) (*PredictResponse, error) {
+	out := new(PredictResponse)
+	err := c.cc.Invoke(ctx, Inference_Predict_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *inferenceClient) PredictStream(ctx context.Context, in *PredictRequest, opts ...grpc.CallOption) (Inference_PredictStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Inference_ServiceDesc.Streams[0], Inference_PredictStream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &inferencePredictStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Inference_PredictStreamClient interface {
+	Recv() (*PredictResponse, error)
+	grpc.ClientStream
+}
+
+type inferencePredictStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *inferencePredictStreamClient) Recv() (*PredictResponse, error) {
+	m := new(PredictResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// InferenceServer is the server API for Inference service.
+// All implementations must embed UnimplementedInferenceServer
+// for forward compatibility
+type InferenceServer interface {
+	// Predict requests inference, and returns the whole response.
+	Predict(context.Context, *PredictRequest) (*PredictResponse, error)
+	// PredictStream requests inference, and streams the response.
+	// The first message has status_code, content_type and headers,
+	// and the following messages have body in chunks as the runtime sends them.
+	PredictStream(*PredictRequest, Inference_PredictStreamServer) error
+	mustEmbedUnimplementedInferenceServer()
+}
+
+// UnimplementedInferenceServer must be embedded to have forward compatible implementations.
+type UnimplementedInferenceServer struct {
+}
+
+func (UnimplementedInferenceServer) Predict(context.Context, *PredictRequest) (*PredictResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Predict not implemented")
+}
+func (UnimplementedInferenceServer) PredictStream(*PredictRequest, Inference_PredictStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method PredictStream not implemented")
+}
+func (UnimplementedInferenceServer) mustEmbedUnimplementedInferenceServer() {}
+
+// UnsafeInferenceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to InferenceServer will
+// result in compilation errors.
+type UnsafeInferenceServer interface {
+	mustEmbedUnimplementedInferenceServer()
+}
+
+func RegisterInferenceServer(s grpc.ServiceRegistrar, srv InferenceServer) {
+	s.RegisterService(&Inference_ServiceDesc, srv)
+}
+
+func _Inference_Predict_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PredictRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(InferenceServer).Predict(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Inference_Predict_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(InferenceServer).Predict(ctx, req.(*PredictRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Inference_PredictStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PredictRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(InferenceServer).PredictStream(m, &inferencePredictStreamServer{stream})
+}
+
+type Inference_PredictStreamServer interface {
+	Send(*PredictResponse) error
+	grpc.ServerStream
+}
+
+type inferencePredictStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *inferencePredictStreamServer) Send(m *PredictResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Inference_ServiceDesc is the grpc.ServiceDesc for Inference service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Inference_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "abeja.proxy.v1.Inference",
+	HandlerType: (*InferenceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Predict",
+			Handler:    _Inference_Predict_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PredictStream",
+			Handler:       _Inference_PredictStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "inferencepb/inference.proto",
+}
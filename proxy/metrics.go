@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "abeja_proxy_requests_total",
+			Help: "Number of HTTP requests by method and status code.",
+		},
+		[]string{"method", "code"})
+	requestDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "abeja_proxy_request_duration_seconds",
+			Help:    "Latency of HTTP requests in seconds.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		})
+	asyncSendFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "abeja_proxy_async_send_failures_total",
+			Help: "Number of failures in sending async response to ARMS. " +
+				"type is `response` for result of inference, `error` for error.",
+		},
+		[]string{"type"})
+	queueRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "abeja_proxy_queue_rejections_total",
+			Help: "Number of requests rejected with 429 by request queue. " +
+				"reason is `full` for the queue at max depth, `timeout` for exceeding max wait.",
+		},
+		[]string{"reason"})
+	batchSizes = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "abeja_proxy_dynamic_batch_size",
+			Help:    "Number of requests sent to runtime in a batch.",
+			Buckets: []float64{1, 2, 4, 8, 16, 32, 64},
+		})
+)
+
+var (
+	queueDepthDesc = prometheus.NewDesc(
+		"abeja_proxy_queue_depth",
+		"Number of requests waiting for runtime.",
+		nil, nil)
+	runtimeRestartsDesc = prometheus.NewDesc(
+		"abeja_proxy_runtime_restarts_total",
+		"Number of restarts of runtime by worker.",
+		[]string{"worker"}, nil)
+	runtimeStatusDesc = prometheus.NewDesc(
+		"abeja_proxy_runtime_status",
+		"Status of runtime by worker. "+
+			"0: preparing, 1: running, 2: exited with success, 3: exited with failure.",
+		[]string{"worker"}, nil)
+)
+
+// serviceCollector collects metrics from runtimes and queue of requests on each exposition.
+type serviceCollector struct {
+	runtimes *subprocess.RuntimePool
+	queue    *RequestQueue
+}
+
+// Describe implements prometheus.Collector.
+func (c *serviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- runtimeRestartsDesc
+	ch <- runtimeStatusDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *serviceCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(c.queue.Stats().Depth()))
+	for i, s := range c.runtimes.Supervisors() {
+		worker := strconv.Itoa(i)
+		ch <- prometheus.MustNewConstMetric(
+			runtimeRestartsDesc, prometheus.CounterValue, float64(s.Restarts()), worker)
+		ch <- prometheus.MustNewConstMetric(
+			runtimeStatusDesc, prometheus.GaugeValue, float64(s.Status()), worker)
+	}
+}
+
+var (
+	serviceMetricsMu sync.Mutex
+	serviceMetrics   *serviceCollector
+)
+
+// registerServiceMetrics registers metrics which are collected from runtimes and queue of requests.
+// It replaces the ones of the server created before.
+func registerServiceMetrics(runtimes *subprocess.RuntimePool, queue *RequestQueue) {
+	serviceMetricsMu.Lock()
+	defer serviceMetricsMu.Unlock()
+	if serviceMetrics != nil {
+		prometheus.Unregister(serviceMetrics)
+	}
+	serviceMetrics = &serviceCollector{runtimes: runtimes, queue: queue}
+	prometheus.MustRegister(serviceMetrics)
+}
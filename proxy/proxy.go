@@ -1,29 +1,30 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
-	"net"
 	"net/http"
 	"net/textproto"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	errors "golang.org/x/xerrors"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/convert"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
 	"github.com/abeja-inc/abeja-platform-model-proxy/util"
-	"github.com/abeja-inc/abeja-platform-model-proxy/util/auth"
 	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
-	httpclient "github.com/abeja-inc/abeja-platform-model-proxy/util/http"
 	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
 )
 
 const errorMessageForAsync = `{
@@ -37,6 +38,24 @@ const errorMessageForAsync = `{
   }
 }`
 
+const runtimeErrorMessageForAsync = `{
+  "status": %d,
+  "headers": {
+    "content-type": "application/json"
+  },
+  "body": {
+    "error": "%s",
+    "error_description": "%s"
+  }
+}`
+
+// redialInterval is the max interval to reconnect to runtime, while it is starting or restarting.
+const redialInterval = 1 * time.Second
+
+// firstRedialInterval is the first interval to reconnect to runtime, which is doubled up to redialInterval,
+// so that runtime is connected soon after it started listening on the socket.
+const firstRedialInterval = 50 * time.Millisecond
+
 func responseSyncUnexpectedError(code int, msg string, sendto chan entity.Response) {
 
 	ct := "application/json"
@@ -50,49 +69,142 @@ func responseSyncUnexpectedError(code int, msg string, sendto chan entity.Respon
 	sendto <- res
 }
 
-func sendAsyncErrorToARMS(
+func sendAsyncUnexpectedError(
 	ctx context.Context,
 	conf *config.Configuration,
-	path string,
-	token string,
+	cl entity.ContentList,
 	message string,
 	option *http.Client) {
 
-	authInfo := auth.AuthInfo{AuthToken: token}
-	httpClient, err :=
-		httpclient.NewRetryHTTPClient(conf.APIURL, 30, 3, authInfo, option)
-	if err != nil {
-		log.Error(ctx, "unexpected error occurred in sending error async response: ", err)
-		return
-	}
-	reqUrl := httpClient.BuildURL(path, nil)
 	body := fmt.Sprintf(errorMessageForAsync, message)
+	sendAsyncError(ctx, conf, cl, body, option)
+}
 
-	req, err := http.NewRequest(
-		"PUT", reqUrl, strings.NewReader(body))
+// sendAsyncError sends the error of async request to ARMS or callback url instead of its result.
+// It ends the delivery begun by beginDelivery.
+func sendAsyncError(
+	ctx context.Context,
+	conf *config.Configuration,
+	cl entity.ContentList,
+	body string,
+	option *http.Client) {
+
+	fp, err := ioutil.TempFile(conf.RequestedDataDir, "")
 	if err != nil {
 		log.Error(ctx, "unexpected error occurred in sending error async response: ", err)
+		asyncSendFailures.WithLabelValues(deliveryKindError).Inc()
+		endDelivery(cl)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := httpClient.Do(req)
+	bodyPath := fp.Name()
+	_, err = fp.WriteString(body)
+	cleanutil.Close(ctx, fp, bodyPath)
 	if err != nil {
 		log.Error(ctx, "unexpected error occurred in sending error async response: ", err)
+		asyncSendFailures.WithLabelValues(deliveryKindError).Inc()
+		cleanutil.Remove(ctx, bodyPath)
+		endDelivery(cl)
 		return
 	}
-	resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		log.Warningf(ctx, "response error from GW with StatusCode: %d", resp.StatusCode)
+	delivery := newAsyncDelivery(ctx, conf, cl, deliveryKindError, "application/json", bodyPath)
+	deliverInBackground(ctx, conf, cl, delivery, option)
+}
+
+// deliveryTracker counts async results being delivered in background.
+// sync.WaitGroup isn't used, because deliveries may begin while waiting for them on shutdown.
+type deliveryTracker struct {
+	mu      sync.Mutex
+	count   int
+	idle    chan struct{} // closed when count gets 0
+	aborted chan struct{} // closed to give up deliveries on shutdown
+}
+
+// add returns the channel which is closed when the delivery must be given up.
+func (d *deliveryTracker) add() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.count == 0 {
+		d.idle = make(chan struct{})
+		d.aborted = make(chan struct{})
+	}
+	d.count++
+	return d.aborted
+}
+
+func (d *deliveryTracker) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.count--
+	if d.count == 0 {
+		close(d.idle)
+	}
+}
+
+// abort gives up results being delivered.
+func (d *deliveryTracker) abort() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.count == 0 {
 		return
 	}
+	select {
+	case <-d.aborted:
+	default:
+		close(d.aborted)
+	}
+}
+
+// wait returns the channel which is closed when no result is being delivered.
+func (d *deliveryTracker) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.count == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	return d.idle
+}
+
+var deliveries = &deliveryTracker{}
+
+// deliverInBackground delivers the result of async request in another goroutine,
+// so that runtime can take the next request without waiting for ARMS or callback url,
+// which may take long with retries. The delivery is ended after it finished.
+func deliverInBackground(
+	ctx context.Context,
+	conf *config.Configuration,
+	cl entity.ContentList,
+	delivery *asyncDelivery,
+	option *http.Client) {
+
+	delivery.aborted = deliveries.add()
+	go func() {
+		defer deliveries.done()
+		defer endDelivery(cl)
+		deliverAsyncResult(ctx, conf, delivery, option)
+	}()
+}
+
+// WaitAsyncDeliveries waits until async results being delivered in background are finished,
+// up to timeout. It must be called before the results are removed with RequestedDataDir.
+// On timeout, the deliveries are given up and their results are moved into dead-letter
+// directory if it is set, then it returns false after they finished.
+func WaitAsyncDeliveries(timeout time.Duration) bool {
+	select {
+	case <-deliveries.wait():
+		return true
+	case <-time.After(timeout):
+	}
+	deliveries.abort()
+	<-deliveries.wait()
+	return false
 }
 
 func responseInternalServerError(
 	ctx context.Context,
 	conf *config.Configuration,
 	cl entity.ContentList,
-	sendto chan entity.Response,
 	message string,
 	option *http.Client) {
 
@@ -100,10 +212,54 @@ func responseInternalServerError(
 		responseSyncUnexpectedError(
 			http.StatusInternalServerError,
 			"Internal Server Error: unexpected error of "+message,
-			sendto)
+			cl.ResponseChan)
 	} else {
-		path := buildARMSEndPoint(ctx, conf, cl.AsyncRequestID)
-		sendAsyncErrorToARMS(ctx, conf, path, cl.AsyncARMSToken, message, option)
+		if !beginDelivery(ctx, cl) {
+			return
+		}
+		sendAsyncUnexpectedError(ctx, conf, cl, message, option)
+	}
+}
+
+// responseRuntimeError responds the error caused by runtime(e.g. crash, timeout).
+func responseRuntimeError(
+	ctx context.Context,
+	conf *config.Configuration,
+	cl entity.ContentList,
+	statusCode int,
+	message string,
+	option *http.Client) {
+
+	statusText := http.StatusText(statusCode)
+	if cl.AsyncRequestID == "" {
+		responseSyncUnexpectedError(statusCode, statusText+": "+message, cl.ResponseChan)
+	} else {
+		if !beginDelivery(ctx, cl) {
+			return
+		}
+		errorCode := strings.ReplaceAll(strings.ToLower(statusText), " ", "_")
+		body := fmt.Sprintf(runtimeErrorMessageForAsync, statusCode, errorCode, statusText+": "+message)
+		sendAsyncError(ctx, conf, cl, body, option)
+	}
+}
+
+// beginDelivery returns false when the result of async request must not be sent,
+// because it is being sent or has been sent. endDelivery must be called after sending,
+// which is done by sendAsyncError or deliverInBackground.
+func beginDelivery(ctx context.Context, cl entity.ContentList) bool {
+	if cl.Ledger == nil {
+		return true
+	}
+	if !cl.Ledger.Begin(cl.AsyncRequestID) {
+		log.Warningf(ctx, "result of async request %s is already delivered, skip it.", cl.AsyncRequestID)
+		return false
+	}
+	return true
+}
+
+func endDelivery(cl entity.ContentList) {
+	if cl.Ledger != nil {
+		cl.Ledger.Done(cl.AsyncRequestID)
 	}
 }
 
@@ -116,260 +272,572 @@ func buildARMSEndPoint(ctx context.Context, conf *config.Configuration, requestI
 }
 
 // TransportMessages transports request from user to runtime and response from runtime to user.
+// When the runtime speaks protocol version 2, requests are sent without waiting for
+// responses of previous ones, up to the max concurrency which the runtime declared.
+// When dynamic batching is enabled and the runtime accepts batches, compatible requests
+// arriving close together are sent in a batch.
+// When the connection is broken(e.g. runtime crashed), it reconnects to the runtime
+// restarted by supervisor. The runtime is marked as ready by supervisor each time it's connected.
+// It fails to connect at first in the same way when runtime died before it got ready,
+// and errOnBoot is closed only when there is no supervisor to restart runtime.
 func TransportMessages(
 	procCtx context.Context,
 	conf *config.Configuration,
 	socketFilePath string,
-	request chan entity.ContentList,
-	response chan entity.Response,
+	supervisor *subprocess.Supervisor,
+	request <-chan entity.ContentList,
 	errOnBoot chan int,
 	notifyFromMain chan int,
 	notifyToMain chan int,
-	scopeChan chan context.Context,
+	scopeChan chan subprocess.LogScope,
 	option *http.Client) {
 
-	conn, err := net.Dial("unix", socketFilePath)
-	if err != nil {
+	transportMessages(
+		procCtx, conf, socketFilePath, supervisor, request,
+		errOnBoot, notifyFromMain, notifyToMain, scopeChan, option, redialInterval)
+}
+
+// transportMessages is TransportMessages which reconnects to runtime at interval.
+func transportMessages(
+	procCtx context.Context,
+	conf *config.Configuration,
+	socketFilePath string,
+	supervisor *subprocess.Supervisor,
+	request <-chan entity.ContentList,
+	errOnBoot chan int,
+	notifyFromMain chan int,
+	notifyToMain chan int,
+	scopeChan chan subprocess.LogScope,
+	option *http.Client,
+	interval time.Duration) {
+
+	// dialCtx is canceled when main notifies to finish, so as not to keep waiting for runtime to get ready.
+	dialCtx, cancelDial := context.WithCancel(procCtx)
+	defer cancelDial()
+	go func() {
+		select {
+		case <-notifyFromMain:
+			cancelDial()
+		case <-dialCtx.Done():
+		}
+	}()
+
+	conn, err := dialSupervisedRuntime(dialCtx, conf, socketFilePath, supervisor)
+	switch {
+	case err != nil && dialCtx.Err() != nil:
+		log.Info(procCtx, "stop waiting for runtime to get ready.")
+	case err != nil && supervisor == nil:
 		log.Errorf(procCtx, "Failed to dial to runtime: "+log.ErrorFormat, err)
 		close(errOnBoot)
 		return
+	case err != nil:
+		// runtime may not listen on the socket yet, or it may die or time out before it gets ready,
+		// and then it's restarted by supervisor. (main finishes when supervisor gives up restarting)
+		log.Debugf(procCtx, "failed to dial to runtime, wait for runtime to start: "+log.ErrorFormat, err)
+		conn = redialRuntime(dialCtx, conf, socketFilePath, supervisor, notifyFromMain, interval)
 	}
-	defer cleanutil.Close(procCtx, conn, socketFilePath)
-
-	respReceiver := make(chan []byte, 1)
-	defer close(respReceiver)
 
-FINISHED:
-	for {
-		contents, ok := <-request
-		if !ok {
-			close(notifyToMain)
+	// carried is the request received but not yet sent, which is sent after reconnecting.
+	var carried *entity.ContentList
+	for conn != nil {
+		var finished bool
+		finished, carried = transportOnConn(
+			procCtx, conf, conn, supervisor, request, carried, notifyFromMain, scopeChan, option)
+		cleanutil.Close(procCtx, conn, socketFilePath)
+		if finished {
 			break
 		}
-		ctx := contents.Ctx
-		scopeChan <- ctx
+		log.Warning(procCtx, "connection to runtime is lost, wait for runtime to restart.")
+		conn = redialRuntime(dialCtx, conf, socketFilePath, supervisor, notifyFromMain, interval)
+	}
+	if carried != nil {
+		abortRequest(carried.Ctx, conf, *carried, option)
+	}
+	close(notifyToMain)
+	log.Debug(procCtx, "finish transporting")
+}
 
-		header, body, err := FromRequest(&contents)
-		if err != nil {
-			log.Errorf(ctx, "json encode error: "+log.ErrorFormat, err)
-			responseInternalServerError(ctx, conf, contents, response, "encoding from request", option)
-			continue
-		}
+// transportOnConn transports messages until the connection is broken.
+// It returns true when transporting is finished by main or by closing request,
+// with the request which was received but couldn't be sent if any.
+func transportOnConn(
+	procCtx context.Context,
+	conf *config.Configuration,
+	conn *runtimeConn,
+	supervisor *subprocess.Supervisor,
+	request <-chan entity.ContentList,
+	carried *entity.ContentList,
+	notifyFromMain chan int,
+	scopeChan chan subprocess.LogScope,
+	option *http.Client) (bool, *entity.ContentList) {
 
-		if err = binary.Write(conn, binary.BigEndian, header); err != nil {
-			log.Errorf(ctx, "Write IPC request header error: "+log.ErrorFormat, err)
-			responseInternalServerError(ctx, conf, contents, response, "communication with runtime", option)
-			continue
-		}
+	slots := make(chan struct{}, conn.MaxConcurrency())
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	batchSize := dynamicBatchSize(conf, conn)
 
-		if _, err = conn.Write(body); err != nil {
-			log.Errorf(ctx, "Write IPC request body error: "+log.ErrorFormat, err)
-			responseInternalServerError(ctx, conf, contents, response, "communication with runtime", option)
-			continue
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-notifyFromMain:
+			return true, carried
+		case <-conn.Done():
+			return false, carried
 		}
-
-		go func() {
-			headBuff := make([]byte, 8)
-			if _, err = io.ReadFull(conn, headBuff); err != nil {
-				log.Errorf(ctx, "Read IPC response header error: "+log.ErrorFormat, err)
-				respReceiver <- []byte{}
-				return
+		var contents entity.ContentList
+		if carried != nil {
+			contents = *carried
+			carried = nil
+		} else {
+			select {
+			case cl, ok := <-request:
+				if !ok {
+					return true, nil
+				}
+				contents = cl
+			case <-notifyFromMain:
+				return true, nil
+			case <-conn.Done():
+				return false, nil
 			}
+		}
 
-			if err := binary.Read(bytes.NewReader(headBuff), binary.BigEndian, &header); err != nil {
-				log.Errorf(ctx, "Read IPC response header error: "+log.ErrorFormat, err)
-				respReceiver <- []byte{}
-				return
-			}
+		var batch []entity.ContentList
+		if batchSize > 1 {
+			batch, carried = collectBatch(
+				contents, request, batchSize, conf.GetDynamicBatchMaxLatency(), notifyFromMain, conn.Done())
+		}
 
-			log.Debug(ctx, "response body length = "+fmt.Sprint(header.Length))
-			bodyBuff := make([]byte, header.Length)
-			if _, err = io.ReadFull(conn, bodyBuff); err != nil {
-				log.Errorf(ctx, "Read IPC response body error: "+log.ErrorFormat, err)
-				respReceiver <- []byte{}
+		inFlight.Add(1)
+		go func(contents entity.ContentList, batch []entity.ContentList) {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			if len(batch) > 1 {
+				transportBatch(conf, conn, batch, notifyFromMain, scopeChan, option)
 				return
 			}
-			log.Debugf(ctx, "response body = %s", string(bodyBuff))
+			transportMessage(conf, conn, supervisor, contents, notifyFromMain, scopeChan, option)
+		}(contents, batch)
+	}
+}
 
-			respReceiver <- bodyBuff
-		}()
+// redialRuntime reconnects to runtime until it succeeds, ctx is done or main notifies to finish.
+// The interval of reconnecting starts from firstRedialInterval, and is doubled up to interval.
+func redialRuntime(
+	ctx context.Context,
+	conf *config.Configuration,
+	socketFilePath string,
+	supervisor *subprocess.Supervisor,
+	notifyFromMain chan int,
+	interval time.Duration) *runtimeConn {
 
+	wait := firstRedialInterval
+	for {
+		if wait > interval {
+			wait = interval
+		}
 		select {
-		case bodyBuff := <-respReceiver:
-			res, err := ToResponse(bodyBuff, conf)
-			if err != nil {
-				responseInternalServerError(ctx, conf, contents, response, err.Error(), option)
-			} else {
-				sendResponse(ctx, res, response, conf, contents, option)
-			}
-			scopeChan <- procCtx
 		case <-notifyFromMain:
-			responseInternalServerError(ctx, conf, contents, response, "received signal", option)
-			close(notifyToMain)
-			scopeChan <- procCtx
-			break FINISHED
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
 		}
+		conn, err := dialSupervisedRuntime(ctx, conf, socketFilePath, supervisor)
+		if err == nil {
+			log.Info(ctx, "reconnected to runtime.")
+			return conn
+		}
+		log.Debugf(ctx, "failed to reconnect to runtime: "+log.ErrorFormat, err)
+		wait *= 2
+	}
+}
+
+// dialStartingRuntime connects to runtime which has just started, and may not listen on the socket yet.
+// It gives up when main notifies to finish, or runtime doesn't get ready within startup timeout.
+func dialStartingRuntime(
+	ctx context.Context,
+	conf *config.Configuration,
+	socketFilePath string,
+	notifyFromMain chan int) (*runtimeConn, error) {
+
+	dialCtx := ctx
+	if timeout := conf.GetStartupTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := dialRuntime(dialCtx, conf, socketFilePath)
+	if err == nil {
+		return conn, nil
+	}
+	log.Debugf(ctx, "failed to dial to runtime, wait for runtime to start: "+log.ErrorFormat, err)
+	if conn = redialRuntime(dialCtx, conf, socketFilePath, nil, notifyFromMain, redialInterval); conn != nil {
+		return conn, nil
+	}
+	if dialCtx.Err() != nil {
+		return nil, errors.Errorf("runtime didn't get ready within %s: %w", conf.GetStartupTimeout(), err)
+	}
+	return nil, errors.Errorf("stopped waiting for runtime to get ready: %w", err)
+}
+
+func transportMessage(
+	conf *config.Configuration,
+	conn *runtimeConn,
+	supervisor *subprocess.Supervisor,
+	contents entity.ContentList,
+	notifyFromMain chan int,
+	scopeChan chan subprocess.LogScope,
+	option *http.Client) {
+
+	ctx, span := tracing.StartSpan(contents.Ctx, "ipc.round_trip", tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("ipc.protocol_version", int(conn.version))
+	contents.TraceParent = span.TraceParent()
+
+	req, err := conn.encode(&contents)
+	if err != nil {
+		log.Errorf(ctx, "json encode error: "+log.ErrorFormat, err)
+		responseInternalServerError(ctx, conf, contents, "encoding from request", option)
+		return
+	}
+	defer scopeLogs(ctx, scopeChan, req)()
+
+	respReceiver, err := conn.send(ctx, req)
+	if err != nil {
+		log.Errorf(ctx, "Write IPC request error: "+log.ErrorFormat, err)
+		responseInternalServerError(ctx, conf, contents, "communication with runtime", option)
+		return
+	}
+
+	var timeout <-chan time.Time
+	if contents.Timeout > 0 {
+		timer := time.NewTimer(contents.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case bodyBuff := <-respReceiver:
+		if len(bodyBuff) == 0 && conn.Err() != nil {
+			// runtime crashed while processing the request.
+			span.SetError(conn.Err())
+			responseRuntimeError(
+				ctx, conf, contents, http.StatusServiceUnavailable, "runtime exited unexpectedly", option)
+			return
+		}
+		res, err := ToResponse(bodyBuff, conf)
+		if err != nil {
+			responseInternalServerError(ctx, conf, contents, err.Error(), option)
+		} else if res.Streaming && res.ErrMsg == nil {
+			streamResponse(ctx, conf, conn, req, res, contents, notifyFromMain, timeout, option)
+		} else {
+			sendResponse(ctx, res, conf, contents, option)
+		}
+	case <-timeout:
+		log.Warningf(ctx, "runtime didn't respond within %s.", contents.Timeout)
+		span.SetError(errors.Errorf("runtime didn't respond within %s", contents.Timeout))
+		responseRuntimeError(
+			ctx, conf, contents, http.StatusGatewayTimeout, "runtime didn't respond in time", option)
+		if !conn.cancel(ctx, req) {
+			// runtime of protocol version 1 can't cancel the request,
+			// so restart it not to keep subsequent requests waiting.
+			conn.fail(ctx, errors.Errorf("request timed out after %s", contents.Timeout))
+			if supervisor != nil {
+				supervisor.Restart(ctx)
+			}
+		}
+	case <-notifyFromMain:
+		abortRequest(ctx, conf, contents, option)
+	}
+}
+
+// abortRequest answers the request which won't be processed because transporting finished.
+func abortRequest(
+	ctx context.Context,
+	conf *config.Configuration,
+	contents entity.ContentList,
+	option *http.Client) {
+
+	if contents.Ledger != nil {
+		// journaled async request is processed again after restart.
+		log.Infof(ctx, "async request %s is left in journal.", contents.AsyncRequestID)
+		return
+	}
+	responseInternalServerError(ctx, conf, contents, "received signal", option)
+}
+
+// scopeLogs tells the logger of runtime that runtime began processing the request,
+// and returns the function to tell that runtime finished it.
+// On protocol version 2, logs of runtime are scoped by REQUEST ID of the frame,
+// because runtime processes several requests at the same time.
+func scopeLogs(ctx context.Context, scopeChan chan subprocess.LogScope, req *ipcRequest) func() {
+	scopeChan <- subprocess.LogScope{Ctx: ctx, RequestID: req.id}
+	return func() {
+		scopeChan <- subprocess.LogScope{RequestID: req.id}
 	}
-	log.Debug(procCtx, "finish transporting")
 }
 
 func sendResponse(
 	ctx context.Context,
 	res entity.Response,
-	response chan entity.Response,
 	conf *config.Configuration,
 	contents entity.ContentList,
 	option *http.Client) {
 
 	if contents.AsyncRequestID != "" {
-		// async. send response to ARMS
-		log.Debug(ctx, "send async response to GW...")
+		// async. send response to ARMS or callback url
+		log.Debug(ctx, "send async response...")
 		sendAsyncResponse(ctx, conf, res, contents, option)
 	} else {
 		// sync
 		log.Debug(ctx, "send sync response to client...")
-		response <- res
+		contents.ResponseChan <- res
 	}
 }
 
-func sendAsyncResponse(
+// streamResponse forwards chunks of streaming response to the client.
+// For async request, chunks are gathered into a file and sent to ARMS or callback url at once.
+// Gathering them is limited by timeout of the request, because nobody waits them and goes away.
+func streamResponse(
 	ctx context.Context,
 	conf *config.Configuration,
+	conn *runtimeConn,
+	req *ipcRequest,
 	res entity.Response,
 	contents entity.ContentList,
+	notifyFromMain chan int,
+	timeout <-chan time.Time,
 	option *http.Client) {
 
-	pr, pw := io.Pipe()
-	mw := multipart.NewWriter(pw)
-
-	done := make(chan error)
-	defer close(done)
-
-	path := buildARMSEndPoint(ctx, conf, contents.AsyncRequestID)
-
-	statusCode, headers, body, err := convert.FromResponse(ctx, res)
-	if err != nil {
-		log.Errorf(ctx, "unexpected error occurred in sending async response: "+log.ErrorFormat, err)
-		sendAsyncErrorToARMS(ctx, conf, path, contents.AsyncARMSToken, "response from runtime", option)
+	if conn.version != version2 {
+		// runtime of protocol version 1 can't send chunks.
+		responseInternalServerError(ctx, conf, contents, "streaming response on protocol version 1", option)
 		return
 	}
-	defer deleteTempFiles(ctx, &contents, body)
-
-	go func() {
-		defer cleanutil.Close(ctx, pr, "pipeReader")
-		authInfo := auth.AuthInfo{AuthToken: contents.AsyncARMSToken}
-		httpClient, err :=
-			httpclient.NewRetryHTTPClient(conf.APIURL, 30, 3, authInfo, option)
-		if err != nil {
-			done <- err
-			return
-		}
-
-		reqUrl := httpClient.BuildURL(path, nil)
-
-		req, err := http.NewRequest("PUT", reqUrl, pr)
-		if err != nil {
-			done <- err
-			return
-		}
-		req.Header.Set("Content-Type", mw.FormDataContentType())
+	res.Streaming = false
 
-		resp, err := httpClient.Do(req)
+	if contents.AsyncRequestID != "" {
+		fp, err := ioutil.TempFile(conf.RequestedDataDir, "")
 		if err != nil {
-			done <- err
+			log.Errorf(ctx, "failed to create temporary file: "+log.ErrorFormat, err)
+			conn.cancel(ctx, req)
+			responseInternalServerError(ctx, conf, contents, "receiving streaming response", option)
 			return
 		}
-		resp.Body.Close()
-		if resp.StatusCode >= 400 {
-			log.Errorf(ctx, "response from GW was error with StatusCode: %d", resp.StatusCode)
-		}
-		done <- nil
-	}()
-
-	go func() {
-		defer cleanutil.Close(ctx, pw, "pipeWriter")
-		defer cleanutil.Close(ctx, mw, "multiWriter")
-
-		// part: status
-		statusHeader := createPartHeader("status", "text/plain")
-		statusPart, err := mw.CreatePart(statusHeader)
-		if err != nil {
-			xerr := errors.Errorf("unexpected error occurred in creating statusPart: %w", err)
-			done <- xerr
-			return
+		path := fp.Name()
+		discard := func() {
+			cleanutil.Close(ctx, fp, path)
+			cleanutil.Remove(ctx, path)
+			conn.cancel(ctx, req)
 		}
-		_, err = statusPart.Write([]byte(strconv.Itoa(statusCode)))
-		if err != nil {
-			xerr := errors.Errorf("unexpected error occurred in writing status to statusPart: %w", err)
-			done <- xerr
-			return
+	gather:
+		for {
+			select {
+			case data, ok := <-req.chunks:
+				if !ok {
+					break gather
+				}
+				if _, err = fp.Write(data); err != nil {
+					break gather
+				}
+			case <-timeout:
+				log.Warningf(ctx, "runtime didn't finish streaming response within %s.", contents.Timeout)
+				discard()
+				responseRuntimeError(
+					ctx, conf, contents, http.StatusGatewayTimeout, "runtime didn't respond in time", option)
+				return
+			case <-notifyFromMain:
+				discard()
+				abortRequest(ctx, conf, contents, option)
+				return
+			}
 		}
-
-		// part: headers
-		// NOTE: remove Content-Length because it's incorrect in this case.
-		delete(headers, convert.KeyContentLength)
-		headersHeader := createPartHeader("headers", "application/json")
-		headersPart, err := mw.CreatePart(headersHeader)
+		cleanutil.Close(ctx, fp, path)
 		if err != nil {
-			xerr := errors.Errorf("unexpected error occurred in creating headersPart: %w", err)
-			done <- xerr
+			log.Errorf(ctx, "failed to write streaming response: "+log.ErrorFormat, err)
+			conn.cancel(ctx, req)
+			cleanutil.Remove(ctx, path)
+			responseInternalServerError(ctx, conf, contents, "receiving streaming response", option)
 			return
 		}
-		headerBytes, err := json.Marshal(headers)
-		if err != nil {
-			xerr := errors.Errorf(
-				"unexpected error occurred in marshaling headers from res.Metadata: %w", err)
-			done <- xerr
+		if errors.Is(req.streamErr, errStreamOverflow) {
+			cleanutil.Remove(ctx, path)
+			responseInternalServerError(ctx, conf, contents, "receiving streaming response", option)
 			return
 		}
-		if _, err := headersPart.Write(headerBytes); err != nil {
-			xerr := errors.Errorf(
-				"unexpected error occurred in writing headers to headersPart: %w", err)
-			done <- xerr
+		if req.streamErr != nil {
+			cleanutil.Remove(ctx, path)
+			responseRuntimeError(
+				ctx, conf, contents, http.StatusServiceUnavailable, "runtime exited unexpectedly", option)
 			return
 		}
+		res.Path = &path
+		sendResponse(ctx, res, conf, contents, option)
+		return
+	}
 
-		// part: body
-		bodyHeader := createPartHeader("body", util.ToStringValue(res.ContentType, "text/plain"))
-		bodyPart, err := mw.CreatePart(bodyHeader)
-		if err != nil {
-			xerr := errors.Errorf("unexpected error occurred in creating bodyPart: %w", err)
-			done <- xerr
-			return
+	chunks := make(chan entity.Chunk)
+	defer close(chunks)
+	res.Chunks = chunks
+	contents.ResponseChan <- res
+
+	// forward returns false when the client went away.
+	forward := func(chunk entity.Chunk) bool {
+		select {
+		case chunks <- chunk:
+			return true
+		case <-ctx.Done():
+			log.Warning(ctx, "client went away while streaming response.")
+			return false
 		}
-		if body != nil {
-			if _, err = io.Copy(bodyPart, body); err != nil {
-				xerr := errors.Errorf(
-					"unexpected error occurred in writing body to bodyPart: %w", err)
-				done <- xerr
+	}
+	for {
+		select {
+		case data, ok := <-req.chunks:
+			if !ok {
+				if errors.Is(req.streamErr, errStreamOverflow) {
+					forward(entity.Chunk{Err: req.streamErr})
+				} else if req.streamErr != nil {
+					forward(entity.Chunk{Err: errors.Errorf("runtime exited unexpectedly: %w", req.streamErr)})
+				}
 				return
 			}
-		} else {
-			if _, err := bodyPart.Write([]byte("")); err != nil {
-				xerr := errors.Errorf(
-					"unexpected error occurred in writing body to bodyPart: %w", err)
-				done <- xerr
+			if !forward(entity.Chunk{Data: data}) {
+				conn.cancel(ctx, req)
 				return
 			}
+		case <-ctx.Done():
+			log.Warning(ctx, "client went away while streaming response.")
+			conn.cancel(ctx, req)
+			return
+		case <-notifyFromMain:
+			conn.cancel(ctx, req)
+			forward(entity.Chunk{Err: errors.New("received signal")})
+			return
 		}
-	}()
-
-	checkAsync(ctx, conf, path, contents.AsyncARMSToken, done, option)
+	}
 }
 
-func checkAsync(
+// sendAsyncResponse builds the result of async request into a file, and delivers it to ARMS or callback url.
+// The result is built into a file, so that it can be sent again when the delivery failed,
+// and so that it is delivered in background after files of the request are removed.
+func sendAsyncResponse(
 	ctx context.Context,
 	conf *config.Configuration,
-	path string,
-	token string,
-	sendErr chan error,
+	res entity.Response,
+	contents entity.ContentList,
 	option *http.Client) {
 
-	sendError := <-sendErr
-	if sendError != nil {
-		log.Error(ctx, "unexpected error occurred in sending async response: ", sendError)
-		sendAsyncErrorToARMS(ctx, conf, path, token, "build response of runtime", option)
+	if !beginDelivery(ctx, contents) {
+		return
+	}
+
+	statusCode, headers, body, err := convert.FromResponse(ctx, res)
+	if err != nil {
+		log.Errorf(ctx, "unexpected error occurred in sending async response: "+log.ErrorFormat, err)
+		sendAsyncUnexpectedError(ctx, conf, contents, "response from runtime", option)
+		return
+	}
+	defer deleteTempFiles(ctx, &contents, body)
+
+	bodyPath, contentType, err := buildAsyncResult(conf.RequestedDataDir, statusCode, headers, res, body)
+	if err != nil {
+		log.Error(ctx, "unexpected error occurred in sending async response: ", err)
+		asyncSendFailures.WithLabelValues(deliveryKindResponse).Inc()
+		sendAsyncUnexpectedError(ctx, conf, contents, "build response of runtime", option)
+		return
+	}
+	delivery := newAsyncDelivery(ctx, conf, contents, deliveryKindResponse, contentType, bodyPath)
+	deliverInBackground(ctx, conf, contents, delivery, option)
+}
+
+// buildAsyncResult writes the result of async request as multipart of status, headers and body
+// into a file in dir, and returns the path and Content-Type of it.
+func buildAsyncResult(
+	dir string,
+	statusCode int,
+	headers map[string]string,
+	res entity.Response,
+	body *os.File) (string, string, error) {
+
+	fp, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return "", "", errors.Errorf("unexpected error occurred in creating result file: %w", err)
+	}
+	path := fp.Name()
+	mw := multipart.NewWriter(fp)
+	if err := writeAsyncResult(mw, statusCode, headers, res, body); err != nil {
+		cleanutil.Close(context.Background(), fp, path)
+		cleanutil.Remove(context.Background(), path)
+		return "", "", err
+	}
+	if err := mw.Close(); err != nil {
+		cleanutil.Close(context.Background(), fp, path)
+		cleanutil.Remove(context.Background(), path)
+		return "", "", errors.Errorf("unexpected error occurred in closing multiWriter: %w", err)
+	}
+	if err := fp.Close(); err != nil {
+		cleanutil.Remove(context.Background(), path)
+		return "", "", errors.Errorf("unexpected error occurred in closing result file: %w", err)
+	}
+	return path, mw.FormDataContentType(), nil
+}
+
+func writeAsyncResult(
+	mw *multipart.Writer,
+	statusCode int,
+	headers map[string]string,
+	res entity.Response,
+	body *os.File) error {
+
+	// part: status
+	statusHeader := createPartHeader("status", "text/plain")
+	statusPart, err := mw.CreatePart(statusHeader)
+	if err != nil {
+		return errors.Errorf("unexpected error occurred in creating statusPart: %w", err)
+	}
+	_, err = statusPart.Write([]byte(strconv.Itoa(statusCode)))
+	if err != nil {
+		return errors.Errorf("unexpected error occurred in writing status to statusPart: %w", err)
+	}
+
+	// part: headers
+	// NOTE: remove Content-Length because it's incorrect in this case.
+	delete(headers, convert.KeyContentLength)
+	headersHeader := createPartHeader("headers", "application/json")
+	headersPart, err := mw.CreatePart(headersHeader)
+	if err != nil {
+		return errors.Errorf("unexpected error occurred in creating headersPart: %w", err)
+	}
+	headerBytes, err := json.Marshal(headers)
+	if err != nil {
+		return errors.Errorf(
+			"unexpected error occurred in marshaling headers from res.Metadata: %w", err)
+	}
+	if _, err := headersPart.Write(headerBytes); err != nil {
+		return errors.Errorf(
+			"unexpected error occurred in writing headers to headersPart: %w", err)
+	}
+
+	// part: body
+	bodyContentType := util.ToStringValue(res.ContentType, "text/plain")
+	if len(res.Parts) > 0 {
+		// boundary of multipart body is decided by converter.
+		bodyContentType = headers[convert.KeyContentType]
+	}
+	bodyHeader := createPartHeader("body", bodyContentType)
+	bodyPart, err := mw.CreatePart(bodyHeader)
+	if err != nil {
+		return errors.Errorf("unexpected error occurred in creating bodyPart: %w", err)
+	}
+	if body != nil {
+		if _, err = io.Copy(bodyPart, body); err != nil {
+			return errors.Errorf(
+				"unexpected error occurred in writing body to bodyPart: %w", err)
+		}
 	}
+	return nil
 }
 
 func createPartHeader(name string, contentType string) textproto.MIMEHeader {
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/input"
+	"github.com/abeja-inc/abeja-platform-model-proxy/manifest"
+	"github.com/abeja-inc/abeja-platform-model-proxy/output"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// errInterrupted is the error of item which is stopped by signal.
+var errInterrupted = errors.New("interrupted by signal")
+
+// TransportBatchMessages sends each input in the manifest to runtime, instead of single INPUT.
+// Inputs are sent in parallel up to conf.BatchConcurrency and the max concurrency of runtime.
+// Failure of an input doesn't stop the batch, but the exit status becomes error.
+func TransportBatchMessages(
+	ctx context.Context,
+	conf *config.Configuration,
+	socketFilePath string,
+	errOnBoot chan int,
+	notifyFromMain chan int,
+	notifyToMain chan int,
+	option *http.Client) {
+
+	defer close(notifyToMain)
+
+	// open unix domain socket to runtime
+	conn, err := dialStartingRuntime(ctx, conf, socketFilePath, notifyFromMain)
+	if err != nil {
+		log.Errorf(ctx, "Failed to dial to runtime: "+log.ErrorFormat, err)
+		notifyToMain <- 1
+		close(errOnBoot)
+		return
+	}
+	defer cleanutil.Close(ctx, conn, socketFilePath)
+
+	// check OUTPUT
+	out, err := FromOutput(ctx, conf, option)
+	if err != nil {
+		log.Errorf(ctx, "OUTPUT parse error:"+log.ErrorFormat, err)
+		notifyToMain <- 1
+		close(errOnBoot)
+		return
+	}
+	if out.Len() == 0 {
+		log.Info(ctx, "Output destination not specified.")
+	}
+
+	report, err := runBatch(ctx, conf, conn, out, notifyFromMain, option)
+	if err != nil {
+		log.Errorf(ctx, "failed to run batch: "+log.ErrorFormat, err)
+		notifyToMain <- 1
+		close(errOnBoot)
+		return
+	}
+	log.Infof(
+		ctx, "batch finished: total %d, succeeded %d, failed %d, skipped %d",
+		report.Total, report.Succeeded, report.Failed, report.Skipped)
+	if conf.BatchReport != "" {
+		if err := report.Write(conf.BatchReport); err != nil {
+			log.Errorf(ctx, "failed to write batch report: "+log.ErrorFormat, err)
+			if !report.Interrupted {
+				notifyToMain <- 1
+			}
+			return
+		}
+	}
+	if report.Failed > 0 && !report.Interrupted {
+		notifyToMain <- 1
+	}
+}
+
+func runBatch(
+	ctx context.Context,
+	conf *config.Configuration,
+	conn *runtimeConn,
+	out *output.Output,
+	notifyFromMain chan int,
+	option *http.Client) (*manifest.Report, error) {
+
+	items, err := manifest.Open(conf.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanutil.Close(ctx, items, conf.Manifest)
+
+	var checkpoint *manifest.Checkpoint
+	if conf.BatchCheckpoint != "" {
+		checkpoint, err = manifest.OpenCheckpoint(conf.BatchCheckpoint)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanutil.Close(ctx, checkpoint, conf.BatchCheckpoint)
+	}
+
+	workers := conf.BatchConcurrency
+	if workers > conn.MaxConcurrency() {
+		log.Infof(
+			ctx, "batch_concurrency %d is limited to max concurrency of runtime %d.",
+			workers, conn.MaxConcurrency())
+		workers = conn.MaxConcurrency()
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	report := manifest.NewReport(conf.Manifest)
+	queue := make(chan *manifest.Item)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				err := processBatchItem(ctx, conf, conn, item, out, notifyFromMain, option)
+				if err == errInterrupted {
+					continue
+				}
+				if err != nil {
+					log.Warningf(ctx, "input [%s] failed: "+log.ErrorFormat, item.Key, err)
+				}
+				report.Add(item.Key, err)
+				if checkpoint != nil {
+					if err := checkpoint.Record(item.Key, err); err != nil {
+						log.Warningf(ctx, "failed to record checkpoint: "+log.ErrorFormat, err)
+					}
+				}
+			}
+		}()
+	}
+
+	interrupted := false
+	var readErr error
+feed:
+	for {
+		item, err := items.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+		if checkpoint != nil && checkpoint.Succeeded(item.Key) {
+			report.Skip()
+			continue
+		}
+		select {
+		case queue <- item:
+		case <-notifyFromMain:
+			interrupted = true
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if readErr != nil {
+		return nil, readErr
+	}
+	report.Finish(interrupted)
+	return report, nil
+}
+
+// processBatchItem sends the item to runtime, and processes the result of it.
+func processBatchItem(
+	ctx context.Context,
+	conf *config.Configuration,
+	conn *runtimeConn,
+	item *manifest.Item,
+	out *output.Output,
+	notifyFromMain chan int,
+	option *http.Client) error {
+
+	if item.Err != nil {
+		return item.Err
+	}
+	cl, err := toBatchContents(ctx, conf, item, option)
+	if err != nil {
+		return err
+	}
+	defer deleteTempFiles(ctx, cl, nil)
+
+	req, err := conn.encode(cl)
+	if err != nil {
+		return errors.Errorf("json marshaling error: %w", err)
+	}
+	receiver, err := conn.send(ctx, req)
+	if err != nil {
+		return errors.Errorf("Write IPC request error: %w", err)
+	}
+
+	select {
+	case bodyBuff := <-receiver:
+		res, err := ToResponse(bodyBuff, conf)
+		if err != nil {
+			return err
+		}
+		if res.Path != nil {
+			defer cleanutil.Remove(ctx, *res.Path)
+		}
+		if res.Streaming {
+			conn.cancel(ctx, req)
+			return errors.New("streaming response is not supported in batch")
+		}
+		return processResult(ctx, res, out, inputOf(item.Index, cl, ""))
+	case <-notifyFromMain:
+		conn.cancel(ctx, req)
+		return errInterrupted
+	}
+}
+
+// toBatchContents returns the request of the item.
+// Files of the request are temporary unless they are local files.
+func toBatchContents(
+	ctx context.Context,
+	conf *config.Configuration,
+	item *manifest.Item,
+	option *http.Client) (*entity.ContentList, error) {
+
+	refs := item.References
+	if item.FilePath != "" {
+		refs = []input.Reference{{Key: input.KeyFile, Value: item.FilePath}}
+	}
+	if len(refs) > 0 {
+		files, err := input.Resolve(ctx, conf, refs, option)
+		if err != nil {
+			return nil, err
+		}
+		return buildFileContents(conf, files), nil
+	}
+	filePath, err := createBatchTempFile(conf.RequestedDataDir, item.JSON)
+	if err != nil {
+		return nil, err
+	}
+	return buildContents("application/json", conf.RunID, conf.PlatformAuthToken, filePath, nil), nil
+}
+
+// createBatchTempFile creates a file of data, whose name is unique among inputs in parallel.
+func createBatchTempFile(dir string, data []byte) (string, error) {
+	fp, err := ioutil.TempFile(dir, "batch_")
+	if err != nil {
+		return "", errors.Errorf("failed to create temporary file: %w", err)
+	}
+	path := fp.Name()
+	_, err = fp.Write(data)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanutil.Remove(context.Background(), path)
+		return "", errors.Errorf("failed to write temporary file: %w", err)
+	}
+	return path, nil
+}
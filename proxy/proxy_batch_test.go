@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/manifest"
+)
+
+// serveBatchRuntime is the runtime which fails requests whose content contains `fail`.
+// It returns the content of request as the body of response.
+func serveBatchRuntime(t *testing.T, listener net.Listener) {
+	fd, err := listener.Accept()
+	if err != nil {
+		t.Error("Error when accepting:", err)
+		return
+	}
+	defer fd.Close()
+
+	replyHelloV2(t, fd, []byte(`{"versions":[1,2],"max_concurrency":2}`))
+	for {
+		headBuf := make([]byte, headerV2Size)
+		if _, err := io.ReadFull(fd, headBuf); err != nil {
+			return
+		}
+		header, err := decodeHeaderV2(headBuf)
+		if err != nil {
+			t.Error("Error when decoding header:", err)
+			return
+		}
+		bodyBuf := make([]byte, header.Length)
+		if _, err := io.ReadFull(fd, bodyBuf); err != nil {
+			t.Error("Error when reading body:", err)
+			return
+		}
+		var cl entity.ContentList
+		if err := json.Unmarshal(bodyBuf, &cl); err != nil {
+			t.Error("Error when unmarshaling body:", err)
+			return
+		}
+		content, err := ioutil.ReadFile(*cl.Contents[0].Path)
+		if err != nil {
+			t.Error("Error when reading content:", err)
+			return
+		}
+		status := 200
+		if strings.Contains(string(content), "fail") {
+			status = 500
+		}
+		resPath := *cl.Contents[0].Path + ".res"
+		if err := ioutil.WriteFile(resPath, content, 0600); err != nil {
+			t.Error("Error when writing response:", err)
+			return
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"status_code": status, "content_type": "application/json", "path": resPath})
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, body)
+	}
+}
+
+func runTestBatch(t *testing.T, conf *config.Configuration) int {
+	t.Helper()
+	path, listener := listenTestSocket(t)
+	defer listener.Close()
+	go serveBatchRuntime(t, listener)
+
+	errOnBoot := make(chan int)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int, 1)
+	go TransportBatchMessages(context.TODO(), conf, path, errOnBoot, notifyFromMain, notifyToMain, nil)
+
+	status := 0
+	select {
+	case v, ok := <-notifyToMain:
+		if ok {
+			status = v
+			<-notifyToMain
+		}
+	case <-errOnBoot:
+		t.Fatal("batch should not fail on boot")
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch should finish")
+	}
+	return status
+}
+
+func readReport(t *testing.T, path string) *manifest.Report {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	report := &manifest.Report{}
+	if err := json.Unmarshal(data, report); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	return report
+}
+
+func TestTransportBatchMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manifestPath := filepath.Join(dir, "manifest.jsonl")
+	lines := "{\"id\": 1}\n{\"id\": 2, \"fail\": true}\n{broken\n{\"id\": 4}\n"
+	if err := ioutil.WriteFile(manifestPath, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Configuration{
+		IPCProtocolVersion: 2,
+		RequestedDataDir:   dir,
+		Manifest:           manifestPath,
+		BatchConcurrency:   4,
+		BatchCheckpoint:    filepath.Join(dir, "checkpoint.jsonl"),
+		BatchReport:        filepath.Join(dir, "report.json"),
+	}
+
+	if status := runTestBatch(t, conf); status != 1 {
+		t.Errorf("batch with failed inputs should exit with 1, but %d", status)
+	}
+	report := readReport(t, conf.BatchReport)
+	if report.Total != 4 || report.Succeeded != 2 || report.Failed != 2 || report.Skipped != 0 {
+		t.Errorf("report should count 2 succeeded and 2 failed, but %+v", report)
+	}
+	failed := map[string]bool{}
+	for _, f := range report.Failures {
+		failed[f.Key] = true
+	}
+	if !failed["line:2"] || !failed["line:3"] {
+		t.Errorf("line 2 and 3 should fail, but %+v", report.Failures)
+	}
+
+	// resume after fixing the manifest.
+	lines = "{\"id\": 1}\n{\"id\": 2}\n{\"id\": 3}\n{\"id\": 4}\n"
+	if err := ioutil.WriteFile(manifestPath, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := runTestBatch(t, conf); status != 0 {
+		t.Errorf("batch should exit with 0, but %d", status)
+	}
+	report = readReport(t, conf.BatchReport)
+	if report.Total != 4 || report.Succeeded != 2 || report.Failed != 0 || report.Skipped != 2 {
+		t.Errorf("succeeded inputs should be skipped on resume, but %+v", report)
+	}
+
+	// only the manifest and outputs of batch remain.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("temporary files of inputs should be removed, but %d files", len(entries))
+	}
+}
+
+func TestTransportBatchMessages_Output(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inputDir := filepath.Join(dir, "inputs")
+	if err := os.Mkdir(inputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cat.json", "dog.json"} {
+		if err := ioutil.WriteFile(filepath.Join(inputDir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outputDir := filepath.Join(dir, "outputs")
+	conf := &config.Configuration{
+		IPCProtocolVersion: 2,
+		RunID:              "run",
+		RequestedDataDir:   dir,
+		Manifest:           inputDir,
+		BatchConcurrency:   2,
+		Output: `[{"$local": "` + outputDir + `"},
+			{"$local": "` + outputDir + `", "file_name": "{{.InputBase}}_{{.Index}}{{.Ext}}"}]`,
+	}
+
+	if status := runTestBatch(t, conf); status != 0 {
+		t.Errorf("batch should exit with 0, but %d", status)
+	}
+	expects := map[string]string{
+		"run_0.json": "cat.json", "run_1.json": "dog.json",
+		"cat_0.json": "cat.json", "dog_1.json": "dog.json",
+	}
+	for name, expect := range expects {
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Errorf("%s should be written: %v", name, err)
+			continue
+		}
+		if string(data) != expect {
+			t.Errorf("%s should be the result of %s, but [%s]", name, expect, string(data))
+		}
+	}
+	// inputs in directory manifest must not be removed.
+	entries, err := ioutil.ReadDir(inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("only inputs should remain in the manifest directory, but %d files", len(entries))
+	}
+}
@@ -1,23 +1,17 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"net"
 	"net/http"
-	"os"
-	"strings"
+
+	errors "golang.org/x/xerrors"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/convert"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/output"
 	"github.com/abeja-inc/abeja-platform-model-proxy/util"
 	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
-	httpclient "github.com/abeja-inc/abeja-platform-model-proxy/util/http"
 	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
 )
 
@@ -33,7 +27,7 @@ func TransportOneshotMessage(
 	defer close(notifyToMain)
 
 	// open unix domain socket to runtime
-	conn, err := net.Dial("unix", socketFilePath)
+	conn, err := dialStartingRuntime(ctx, conf, socketFilePath, notifyFromMain)
 	if err != nil {
 		log.Errorf(ctx, "Failed to dial to runtime: "+log.ErrorFormat, err)
 		notifyToMain <- 1
@@ -42,9 +36,6 @@ func TransportOneshotMessage(
 	}
 	defer cleanutil.Close(ctx, conn, socketFilePath)
 
-	respReceiver := make(chan []byte, 1)
-	defer close(respReceiver)
-
 	// parse INPUT and get content of input from datalake
 	cl, err := FromInput(ctx, conf, option)
 	if err != nil {
@@ -67,18 +58,18 @@ func TransportOneshotMessage(
 	defer deleteTempFiles(ctx, cl, nil)
 
 	// check OUTPUT
-	datalakeChannelID, err := FromOutput(conf)
+	out, err := FromOutput(ctx, conf, option)
 	if err != nil {
 		log.Errorf(ctx, "OUTPUT parse error:"+log.ErrorFormat, err)
 		notifyToMain <- 1
 		close(errOnBoot)
 		return
 	}
-	if datalakeChannelID == "" {
-		log.Info(ctx, "Output datalake channel not specified.")
+	if out.Len() == 0 {
+		log.Info(ctx, "Output destination not specified.")
 	}
 
-	header, body, err := FromRequest(cl)
+	req, err := conn.encode(cl)
 	if err != nil {
 		log.Errorf(ctx, "json marshaling error: "+log.ErrorFormat, err)
 		notifyToMain <- 1
@@ -87,47 +78,14 @@ func TransportOneshotMessage(
 	}
 
 	// send request to runtime
-	if err = binary.Write(conn, binary.BigEndian, header); err != nil {
-		log.Errorf(ctx, "Write IPC request header error: "+log.ErrorFormat, err)
-		notifyToMain <- 1
-		close(errOnBoot)
-		return
-	}
-
-	if _, err = conn.Write(body); err != nil {
-		log.Errorf(ctx, "Write IPC request body error: "+log.ErrorFormat, err)
+	respReceiver, err := conn.send(ctx, req)
+	if err != nil {
+		log.Errorf(ctx, "Write IPC request error: "+log.ErrorFormat, err)
 		notifyToMain <- 1
 		close(errOnBoot)
 		return
 	}
 
-	// receive response from runtime
-	go func() {
-		headBuff := make([]byte, 8)
-		if _, err = io.ReadFull(conn, headBuff); err != nil {
-			log.Errorf(ctx, "Read IPC response header error: "+log.ErrorFormat, err)
-			respReceiver <- []byte{}
-			return
-		}
-
-		if err := binary.Read(bytes.NewReader(headBuff), binary.BigEndian, &header); err != nil {
-			log.Errorf(ctx, "Read IPC response header error: "+log.ErrorFormat, err)
-			respReceiver <- []byte{}
-			return
-		}
-
-		log.Debug(ctx, "response body length = "+fmt.Sprint(header.Length))
-		bodyBuff := make([]byte, header.Length)
-		if _, err = io.ReadFull(conn, bodyBuff); err != nil {
-			log.Errorf(ctx, "Read IPC response body error: "+log.ErrorFormat, err)
-			respReceiver <- []byte{}
-			return
-		}
-		log.Debugf(ctx, "response body = %s", string(bodyBuff))
-
-		respReceiver <- bodyBuff
-	}()
-
 	// wait response or signal
 	select {
 	case bodyBuff := <-respReceiver:
@@ -139,7 +97,7 @@ func TransportOneshotMessage(
 			if res.Path != nil {
 				defer cleanutil.Remove(ctx, *res.Path)
 			}
-			handleResult(ctx, conf, res, datalakeChannelID, notifyToMain, option)
+			handleResult(ctx, conf, res, out, inputOf(0, cl, ""), notifyToMain)
 		}
 	case <-notifyFromMain:
 		log.Debug(ctx, "signal received")
@@ -150,109 +108,71 @@ func handleResult(
 	ctx context.Context,
 	conf *config.Configuration,
 	res entity.Response,
-	datalakeChannelID string,
-	notifyToMain chan int,
-	option *http.Client) {
+	out *output.Output,
+	input output.Input,
+	notifyToMain chan int) {
 
-	status, headers, body, err := convert.FromResponse(ctx, res)
-	if err != nil {
-		if convertError, ok := err.(*convert.ConverterError); ok {
-			log.Warning(ctx, convertError.Msg)
-		} else {
-			log.Warningf(ctx, log.ErrorFormat, err)
-		}
-		notifyToMain <- 1
-		return
-	}
-
-	if datalakeChannelID != "" {
-		if res.Path == nil {
-			// if OUTPUT is specified but there is nothing to upload, it logs a warning.
-			log.Warning(ctx, "runtime didn't return body.")
-		} else {
-			err := uploadResult(
-				ctx, conf, datalakeChannelID, headers, body, res.ContentType, option)
-			if err != nil {
-				log.Errorf(ctx, log.ErrorFormat, err)
-				notifyToMain <- 1
-				return
-			}
-		}
-	}
-
-	if status > 299 {
-		log.Warningf(ctx, "runtime returned error status %d.", status)
+	if err := processResult(ctx, res, out, input); err != nil {
+		log.Warningf(ctx, log.ErrorFormat, err)
 		notifyToMain <- 1
 	}
 }
 
-func uploadResult(
+// processResult writes the result of input to the destinations of OUTPUT,
+// and returns error when it failed or runtime returned error status.
+func processResult(
 	ctx context.Context,
-	conf *config.Configuration,
-	datalakeChannelID string,
-	headers map[string]string,
-	body *os.File,
-	contentType *string,
-	option *http.Client) error {
+	res entity.Response,
+	out *output.Output,
+	input output.Input) error {
 
-	httpClient, err :=
-		httpclient.NewRetryHTTPClient(conf.APIURL, 30, 3, conf.GetAuthInfo(), option)
+	status, headers, body, err := convert.FromResponse(ctx, res)
 	if err != nil {
 		return err
 	}
-
-	reqUrl := httpClient.BuildURL(
-		fmt.Sprintf("/channels/%s/upload", datalakeChannelID),
-		map[string]interface{}{"conflict_target": "filename"})
-
-	req, err := http.NewRequest("POST", reqUrl, body)
-	if err != nil {
-		return err
+	if len(res.Parts) > 0 {
+		// body is built from parts by converter.
+		defer deleteTempFiles(ctx, nil, body)
 	}
 
-	for k, v := range headers {
-		lk := strings.ToLower(k)
-		if lk == "content-type" || strings.HasPrefix(lk, "x-abeja-meta-") {
-			req.Header.Set(k, v)
+	if out.Len() > 0 {
+		if res.Path == nil && len(res.Parts) == 0 {
+			// if OUTPUT is specified but there is nothing to upload, it logs a warning.
+			log.Warning(ctx, "runtime didn't return body.")
+		} else {
+			result := &output.Result{
+				Body:        body,
+				ContentType: util.ToStringValue(res.ContentType, ""),
+				Headers:     headers,
+			}
+			if err := out.Write(ctx, input, result); err != nil {
+				return err
+			}
 		}
 	}
 
-	fileName := buildFileName(ctx, conf.RunID, contentType)
-	req.Header.Set("x-abeja-meta-filename", fileName)
-	fileinfo, err := body.Stat()
-	if err != nil {
-		return err
-	}
-	req.ContentLength = fileinfo.Size()
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		var errMsg string
-		msgBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			errMsg = err.Error()
-		} else {
-			errMsg = string(msgBytes)
-		}
-		return fmt.Errorf(
-			"response from Datalake was error with StatusCode: %d, body: %s",
-			resp.StatusCode,
-			string(errMsg),
-		)
+	if status > 299 {
+		return errors.Errorf("runtime returned error status %d.", status)
 	}
 	return nil
 }
 
-func buildFileName(ctx context.Context, runID string, contentType *string) string {
-	var ext string
-	if contentType == nil || *contentType == "" {
-		ext = ""
-	} else {
-		ext = util.GetExtension(ctx, *contentType)
+// inputOf returns the input of cl for file names of output.
+// name is the file name of input if known, otherwise it is taken from the first content.
+func inputOf(index int, cl *entity.ContentList, name string) output.Input {
+	in := output.Input{Index: index, Name: name}
+	if len(cl.Contents) == 0 {
+		return in
+	}
+	content := cl.Contents[0]
+	in.Metadata = content.Metadata
+	if in.Name == "" && content.FileName != nil {
+		in.Name = *content.FileName
+	}
+	if in.Name == "" {
+		if fileName, ok := in.Metadata["x-abeja-meta-filename"].(string); ok {
+			in.Name = fileName
+		}
 	}
-	return fmt.Sprintf("%s_0%s", runID, ext)
+	return in
 }
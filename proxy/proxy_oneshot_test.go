@@ -7,6 +7,7 @@ import (
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/output"
 )
 
 func TestTransportOneshotMessage_DialError(t *testing.T) {
@@ -15,8 +16,9 @@ func TestTransportOneshotMessage_DialError(t *testing.T) {
 	notifyToMain := make(chan int)
 	defer close(notifyFromMain)
 
-	ticker := *time.NewTicker(2 * time.Second)
-	conf := &config.Configuration{}
+	ticker := time.NewTicker(2 * time.Second)
+	// runtime which doesn't listen on the socket is given up after startup timeout.
+	conf := &config.Configuration{StartupTimeout: 1}
 	scopeChan := make(chan context.Context, 10)
 	defer close(scopeChan)
 	go TransportOneshotMessage(
@@ -46,8 +48,12 @@ func TestHandleResult_NoBody(t *testing.T) {
 	conf := &config.Configuration{
 		APIURL: "http://localhost",
 		RunID:  "dummy",
+		Output: "{\"$datalake:1\": \"dummy\"}",
+	}
+	out, err := FromOutput(context.TODO(), conf, nil)
+	if err != nil {
+		t.Fatal("Unexpected Error occurred: ", err)
 	}
-	datalakeChannelID := "dummy"
 
 	cases := []struct {
 		name         string
@@ -78,9 +84,9 @@ func TestHandleResult_NoBody(t *testing.T) {
 				context.TODO(),
 				conf,
 				res,
-				datalakeChannelID,
+				out,
+				output.Input{},
 				notifyToMain,
-				nil,
 			)
 
 			var actual int
@@ -6,8 +6,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -18,6 +20,7 @@ import (
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
 	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
 )
 
@@ -31,18 +34,30 @@ func RemoveUDSFile(path string, t *testing.T) {
 	}
 }
 
+// stopTransport notifies TransportMessages to finish, and waits for it,
+// so that channels used by it can be closed after that.
+func stopTransport(t *testing.T, notifyFromMain chan int, notifyToMain chan int) {
+	t.Helper()
+	close(notifyFromMain)
+	select {
+	case <-notifyToMain:
+	case <-time.After(2 * time.Second):
+		t.Error("timeout on waiting for transporting to finish")
+	}
+}
+
 func TestTransportMessage_OK(t *testing.T) {
 	errOnBoot := make(chan int)
 	request := make(chan entity.ContentList)
 	response := make(chan entity.Response)
 	notifyFromMain := make(chan int)
 	notifyToMain := make(chan int)
-	scopeChan := make(chan context.Context, 10)
+	scopeChan := make(chan subprocess.LogScope, 10)
 	defer close(errOnBoot)
 	defer close(request)
 	defer close(response)
 	defer close(scopeChan)
-	defer close(notifyFromMain)
+	defer stopTransport(t, notifyFromMain, notifyToMain)
 
 	path := filepath.Join(os.TempDir(), "test_unixdomainsocket")
 	RemoveUDSFile(path, t)
@@ -178,10 +193,11 @@ func TestTransportMessage_OK(t *testing.T) {
 		DeploymentID: "dummy-deployment-id",
 		ServiceID:    "dummy-service-id",
 	}
-	go TransportMessages(context.TODO(), conf, path, request, response, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+	go TransportMessages(context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
 
 	var resp *entity.Response
-	ticker := *time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(2 * time.Second)
+	reqCL.ResponseChan = response
 	request <- reqCL
 
 B:
@@ -248,16 +264,16 @@ func TestTransportMessage_DialError(t *testing.T) {
 	defer close(response)
 	defer close(notifyFromMain)
 
-	ticker := *time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(2 * time.Second)
 	conf := &config.Configuration{}
-	scopeChan := make(chan context.Context, 10)
+	scopeChan := make(chan subprocess.LogScope, 10)
 	defer close(scopeChan)
 	go TransportMessages(
 		context.TODO(),
 		conf,
 		"invalid_socket_file",
+		nil,
 		request,
-		response,
 		errOnBoot,
 		notifyFromMain,
 		notifyToMain,
@@ -286,17 +302,16 @@ func TestTransportMessage_WriteToSocketError(t *testing.T) {
 	defer close(errOnBoot)
 	defer close(request)
 	defer close(response)
-	defer close(notifyFromMain)
+	defer stopTransport(t, notifyFromMain, notifyToMain)
 
 	path := filepath.Join(os.TempDir(), "test_unixdomainsocket")
 	RemoveUDSFile(path, t)
 	listener, _ := net.Listen("unix", path)
 
-	ticker := *time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(2 * time.Second)
 	conf := &config.Configuration{}
-	scopeChan := make(chan context.Context, 10)
-	defer close(scopeChan)
-	go TransportMessages(context.TODO(), conf, path, request, response, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+	scopeChan := make(chan subprocess.LogScope, 10)
+	go TransportMessages(context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
 	time.Sleep(100 * time.Millisecond)
 
 	// close socket for occurring write error
@@ -304,9 +319,10 @@ func TestTransportMessage_WriteToSocketError(t *testing.T) {
 		t.Fatal("Error when closing listener:", err)
 	}
 	request <- entity.ContentList{
-		Method:      "GET",
-		ContentType: "",
-		Contents:    nil,
+		Method:       "GET",
+		ContentType:  "",
+		Contents:     nil,
+		ResponseChan: response,
 	}
 	var resp *entity.Response
 B:
@@ -334,7 +350,7 @@ func TestTransportMessage_ReadFromSocketError(t *testing.T) {
 	defer close(errOnBoot)
 	defer close(request)
 	defer close(response)
-	defer close(notifyFromMain)
+	defer stopTransport(t, notifyFromMain, notifyToMain)
 
 	path := filepath.Join(os.TempDir(), "test_unixdomainsocket")
 	RemoveUDSFile(path, t)
@@ -414,13 +430,13 @@ func TestTransportMessage_ReadFromSocketError(t *testing.T) {
 	}()
 
 	conf := &config.Configuration{}
-	scopeChan := make(chan context.Context, 10)
-	defer close(scopeChan)
+	scopeChan := make(chan subprocess.LogScope, 10)
 	go TransportMessages(
-		context.TODO(), conf, path, request, response, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+		context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
 
 	var resp *entity.Response
-	ticker := *time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(2 * time.Second)
+	reqCL.ResponseChan = response
 	request <- reqCL
 
 B:
@@ -436,11 +452,22 @@ B:
 			break B
 		}
 	}
-	assertInternalServerErrorResponse(t, resp)
+	// runtime closed connection while processing the request.
+	assertServiceUnavailableResponse(t, resp)
 }
 
 func assertInternalServerErrorResponse(t *testing.T, resp *entity.Response) {
 	t.Helper()
+	assertErrorResponse(t, resp, http.StatusInternalServerError, "Internal Server Error")
+}
+
+func assertServiceUnavailableResponse(t *testing.T, resp *entity.Response) {
+	t.Helper()
+	assertErrorResponse(t, resp, http.StatusServiceUnavailable, "Service Unavailable")
+}
+
+func assertErrorResponse(t *testing.T, resp *entity.Response, statusCode int, errMsgPrefix string) {
+	t.Helper()
 
 	if resp == nil {
 		t.Fatal("resp should not be nil")
@@ -462,17 +489,503 @@ func assertInternalServerErrorResponse(t *testing.T, resp *entity.Response) {
 	if resp.ErrMsg == nil {
 		t.Error("ErrMsg should not be nil")
 	} else {
-		if !strings.HasPrefix(*resp.ErrMsg, "Internal Server Error") {
-			t.Errorf("ErrMsg should start with `Internal Server Error`, but `%s`", *resp.ErrMsg)
+		if !strings.HasPrefix(*resp.ErrMsg, errMsgPrefix) {
+			t.Errorf("ErrMsg should start with `%s`, but `%s`", errMsgPrefix, *resp.ErrMsg)
 		}
 	}
 	if resp.StatusCode == nil {
 		t.Error("StatusCode should be not nil")
 	} else {
-		if http.StatusInternalServerError != *resp.StatusCode {
-			t.Errorf(
-				"StatusCode should be %d, but %d",
-				http.StatusInternalServerError, *resp.StatusCode)
+		if statusCode != *resp.StatusCode {
+			t.Errorf("StatusCode should be %d, but %d", statusCode, *resp.StatusCode)
+		}
+	}
+}
+
+func TestTransportMessage_Reconnect(t *testing.T) {
+	errOnBoot := make(chan int)
+	request := make(chan entity.ContentList)
+	response := make(chan entity.Response)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	scopeChan := make(chan subprocess.LogScope, 10)
+	defer close(errOnBoot)
+	defer close(request)
+	defer close(response)
+	defer stopTransport(t, notifyFromMain, notifyToMain)
+
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// mock for runtime, which crashes on the first request and is restarted.
+	go func() {
+		fd, _ := listener.Accept()
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		readFrameV2(t, fd)
+		cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+
+		fd, _ = listener.Accept()
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		header, _ := readFrameV2(t, fd)
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, []byte(`{"status_code":200}`))
+	}()
+
+	conf := &config.Configuration{IPCProtocolVersion: 2}
+	go transportMessages(
+		context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil,
+		10*time.Millisecond)
+
+	for _, expect := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		request <- entity.ContentList{Method: "POST", ResponseChan: response}
+		select {
+		case r := <-response:
+			if r.StatusCode == nil || *r.StatusCode != expect {
+				t.Errorf("StatusCode should be %d, but %v", expect, r.StatusCode)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout on receiving response")
+		}
+	}
+}
+
+func TestTransportMessage_StopWhileWaitingHello(t *testing.T) {
+	errOnBoot := make(chan int)
+	request := make(chan entity.ContentList)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	defer close(request)
+
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// mock for runtime, which is too busy to reply HELLO.
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		_, _ = io.Copy(ioutil.Discard, fd)
+	}()
+
+	conf := &config.Configuration{IPCProtocolVersion: 2}
+	go TransportMessages(
+		context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain,
+		make(chan subprocess.LogScope, 10), nil)
+	time.Sleep(100 * time.Millisecond)
+	stopTransport(t, notifyFromMain, notifyToMain)
+}
+
+func TestDialStartingRuntime(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "test_starting_runtime")
+	RemoveUDSFile(path, t)
+	defer RemoveUDSFile(path, t)
+
+	// mock for runtime, which listens on the socket after a while.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Error("Error when listening unix domain socket:", err)
+			return
+		}
+		defer cleanutil.Close(context.TODO(), listener, path)
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		_, _ = io.Copy(ioutil.Discard, fd)
+	}()
+
+	notifyFromMain := make(chan int)
+	defer close(notifyFromMain)
+	start := time.Now()
+	conn, err := dialStartingRuntime(
+		context.TODO(), &config.Configuration{StartupTimeout: 5}, path, notifyFromMain)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	cleanutil.Close(context.TODO(), conn, path)
+	if elapsed := time.Since(start); elapsed >= redialInterval {
+		t.Errorf("runtime should be connected soon after it listened, but it took %s", elapsed)
+	}
+}
+
+func TestTransportMessage_DiesBeforeReady(t *testing.T) {
+	errOnBoot := make(chan int)
+	request := make(chan entity.ContentList)
+	response := make(chan entity.Response)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	scopeChan := make(chan subprocess.LogScope, 10)
+	defer close(request)
+	defer close(response)
+	defer stopTransport(t, notifyFromMain, notifyToMain)
+
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// mock for runtime, which dies while loading and is restarted.
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2],"sends_ready":true}`))
+		cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+
+		fd, err = listener.Accept()
+		if err != nil {
+			return
 		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2],"sends_ready":true}`))
+		writeFrameV2(t, fd, FrameTypeReady, 0, nil)
+		header, _ := readFrameV2(t, fd)
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, []byte(`{"status_code":200}`))
+	}()
+
+	runtime := &subprocess.Runtime{Status: subprocess.RuntimeStatusPreparing}
+	supervisor, err := subprocess.NewSupervisor(
+		func() (*subprocess.Runtime, error) { return runtime, nil }, path, 1)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	conf := &config.Configuration{IPCProtocolVersion: 2}
+	go transportMessages(
+		context.TODO(), conf, path, supervisor, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil,
+		10*time.Millisecond)
+
+	select {
+	case request <- entity.ContentList{Method: "POST", ResponseChan: response}:
+	case <-errOnBoot:
+		t.Fatal("boot should not fail while runtime is restarted")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on sending request")
+	}
+	select {
+	case r := <-response:
+		if r.StatusCode == nil || *r.StatusCode != http.StatusOK {
+			t.Errorf("StatusCode should be %d, but %v", http.StatusOK, r.StatusCode)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on receiving response")
+	}
+	if !supervisor.IsReady() {
+		t.Error("runtime should be ready after it's restarted")
+	}
+}
+
+func TestTransportMessage_Timeout(t *testing.T) {
+	cases := []struct {
+		name            string
+		protocolVersion int
+		hello           []byte
+	}{
+		{
+			name:            "version 1",
+			protocolVersion: 1,
+			hello:           nil,
+		}, {
+			name:            "version 2",
+			protocolVersion: 2,
+			hello:           []byte(`{"versions":[1,2]}`),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errOnBoot := make(chan int)
+			request := make(chan entity.ContentList)
+			response := make(chan entity.Response)
+			notifyFromMain := make(chan int)
+			notifyToMain := make(chan int)
+			scopeChan := make(chan subprocess.LogScope, 10)
+			defer close(errOnBoot)
+			defer close(request)
+			defer close(response)
+			defer stopTransport(t, notifyFromMain, notifyToMain)
+
+			path, listener := listenTestSocket(t)
+			defer cleanutil.Close(context.TODO(), listener, path)
+
+			// mock for runtime, which never responds.
+			aborted := make(chan struct{})
+			go func() {
+				fd, _ := listener.Accept()
+				defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+				if c.hello == nil {
+					headBuf := make([]byte, 8)
+					if _, err := io.ReadFull(fd, headBuf); err != nil {
+						t.Error("Error when reading header:", err)
+					}
+					var header Header
+					if err := binary.Read(bytes.NewReader(headBuf), binary.BigEndian, &header); err != nil {
+						t.Error("Error when reading header:", err)
+					}
+					if _, err := io.ReadFull(fd, make([]byte, header.Length)); err != nil {
+						t.Error("Error when reading body:", err)
+					}
+					// proxy closes connection because runtime can't cancel the request.
+					if _, err := fd.Read(make([]byte, 1)); err != io.EOF {
+						t.Errorf("connection should be closed, but %v", err)
+					}
+				} else {
+					replyHelloV2(t, fd, c.hello)
+					reqHeader, _ := readFrameV2(t, fd)
+					cancelHeader, _ := readFrameV2(t, fd)
+					if cancelHeader.Type != FrameTypeCancel {
+						t.Errorf("frame type should be CANCEL, but %d", cancelHeader.Type)
+					}
+					if cancelHeader.RequestID != reqHeader.RequestID {
+						t.Errorf("request ID should be %d, but %d", reqHeader.RequestID, cancelHeader.RequestID)
+					}
+				}
+				close(aborted)
+			}()
+
+			conf := &config.Configuration{IPCProtocolVersion: c.protocolVersion}
+			go TransportMessages(
+				context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+
+			request <- entity.ContentList{
+				Method:       "POST",
+				ResponseChan: response,
+				Timeout:      100 * time.Millisecond,
+			}
+			select {
+			case r := <-response:
+				if r.StatusCode == nil || *r.StatusCode != http.StatusGatewayTimeout {
+					t.Errorf("StatusCode should be %d, but %v", http.StatusGatewayTimeout, r.StatusCode)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timeout on receiving response")
+			}
+			select {
+			case <-aborted:
+			case <-time.After(2 * time.Second):
+				t.Error("request should be canceled or connection should be closed")
+			}
+		})
+	}
+}
+
+func TestTransportMessage_Streaming(t *testing.T) {
+	errOnBoot := make(chan int)
+	request := make(chan entity.ContentList)
+	response := make(chan entity.Response)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	scopeChan := make(chan subprocess.LogScope, 10)
+	defer close(errOnBoot)
+	defer close(request)
+	defer close(response)
+	defer stopTransport(t, notifyFromMain, notifyToMain)
+
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// mock for runtime, which streams response.
+	go func() {
+		fd, _ := listener.Accept()
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		header, _ := readFrameV2(t, fd)
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID,
+			[]byte(`{"status_code":200,"content_type":"text/event-stream","streaming":true}`))
+		for _, chunk := range []string{"foo", "bar", ""} {
+			writeFrameV2(t, fd, FrameTypeChunk, header.RequestID, []byte(chunk))
+		}
+	}()
+
+	conf := &config.Configuration{IPCProtocolVersion: 2}
+	go TransportMessages(
+		context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+
+	request <- entity.ContentList{Method: "POST", ResponseChan: response, Ctx: context.TODO()}
+	var res entity.Response
+	select {
+	case res = <-response:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on receiving response")
+	}
+	if res.StatusCode == nil || *res.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode should be %d, but %v", http.StatusOK, res.StatusCode)
+	}
+	if res.Chunks == nil {
+		t.Fatal("Chunks should not be nil")
+	}
+	var actual []string
+	for chunk := range res.Chunks {
+		if chunk.Err != nil {
+			t.Errorf("unexpected error in chunk: %v", chunk.Err)
+		}
+		actual = append(actual, string(chunk.Data))
+	}
+	if strings.Join(actual, ",") != "foo,bar" {
+		t.Errorf("chunks should be [foo,bar], but %v", actual)
+	}
+}
+
+func TestTransportMessage_AsyncStreamingTimeout(t *testing.T) {
+	errOnBoot := make(chan int)
+	request := make(chan entity.ContentList)
+	notifyFromMain := make(chan int)
+	notifyToMain := make(chan int)
+	scopeChan := make(chan subprocess.LogScope, 10)
+	defer close(errOnBoot)
+	defer close(request)
+	defer stopTransport(t, notifyFromMain, notifyToMain)
+
+	puts := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts <- r.Method + " " + r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dataDir, err := ioutil.TempDir("", "async_streaming")
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// mock for runtime, which never finishes streaming response.
+	canceled := make(chan struct{})
+	go func() {
+		fd, _ := listener.Accept()
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		header, _ := readFrameV2(t, fd)
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, []byte(`{"status_code":200,"streaming":true}`))
+		writeFrameV2(t, fd, FrameTypeChunk, header.RequestID, []byte("foo"))
+		if cancelHeader, _ := readFrameV2(t, fd); cancelHeader.Type == FrameTypeCancel {
+			close(canceled)
+		}
+		_, _ = io.Copy(ioutil.Discard, fd)
+	}()
+
+	conf := &config.Configuration{
+		IPCProtocolVersion: 2,
+		APIURL:             server.URL,
+		OrganizationID:     "1100000000000",
+		DeploymentID:       "1400000000000",
+		RequestedDataDir:   dataDir,
+	}
+	go TransportMessages(
+		context.TODO(), conf, path, nil, request, errOnBoot, notifyFromMain, notifyToMain, scopeChan, nil)
+
+	request <- entity.ContentList{
+		Method:         "POST",
+		Ctx:            context.TODO(),
+		AsyncRequestID: "req-1",
+		AsyncARMSToken: "token",
+		Timeout:        200 * time.Millisecond,
+	}
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("streaming response should be canceled by timeout")
+	}
+	// the error is delivered after the cancel is sent to runtime.
+	select {
+	case put := <-puts:
+		if put != "PUT /organizations/1100000000000/deployments/1400000000000/results/req-1" {
+			t.Errorf("result should be sent to ARMS, but [%s]", put)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on waiting for delivery")
+	}
+	if !WaitAsyncDeliveries(2 * time.Second) {
+		t.Fatal("timeout on waiting for delivery")
+	}
+	if len(puts) != 0 {
+		t.Errorf("result should be sent once, but %d more time(s)", len(puts))
+	}
+}
+
+type fakeLedger struct {
+	begun int
+	done  int
+}
+
+func (l *fakeLedger) Begin(asyncRequestID string) bool {
+	l.begun++
+	return l.begun == 1
+}
+
+func (l *fakeLedger) Done(asyncRequestID string) {
+	l.done++
+}
+
+func TestResponseRuntimeError_DeliverInBackground(t *testing.T) {
+	// ARMS doesn't respond until unblocked.
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	conf := &config.Configuration{APIURL: server.URL}
+	cl := entity.ContentList{AsyncRequestID: "req-1", AsyncARMSToken: "token"}
+	returned := make(chan struct{})
+	go func() {
+		responseRuntimeError(context.TODO(), conf, cl, http.StatusGatewayTimeout, "timeout", nil)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("runtime should not wait for the delivery")
+	}
+
+	if WaitAsyncDeliveries(100 * time.Millisecond) {
+		t.Error("delivery should not be finished until ARMS responds")
+	}
+	close(unblock)
+	if !WaitAsyncDeliveries(2 * time.Second) {
+		t.Error("timeout on waiting for delivery")
+	}
+}
+
+func TestResponseRuntimeError_Ledger(t *testing.T) {
+	puts := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts <- r.Method + " " + r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	conf := &config.Configuration{
+		APIURL:         server.URL,
+		OrganizationID: "1100000000000",
+		DeploymentID:   "1400000000000",
+	}
+	ledger := &fakeLedger{}
+	cl := entity.ContentList{
+		AsyncRequestID: "req-1",
+		AsyncARMSToken: "token",
+		Ledger:         ledger,
+	}
+	for i := 0; i < 2; i++ {
+		responseRuntimeError(context.TODO(), conf, cl, http.StatusGatewayTimeout, "timeout", nil)
+	}
+	if !WaitAsyncDeliveries(2 * time.Second) {
+		t.Fatal("timeout on waiting for delivery")
+	}
+
+	if len(puts) != 1 {
+		t.Fatalf("result should be sent only once, but %d times", len(puts))
+	}
+	if put := <-puts; put != "PUT /organizations/1100000000000/deployments/1400000000000/results/req-1" {
+		t.Errorf("result should be sent to ARMS, but [%s]", put)
+	}
+	if ledger.done != 1 {
+		t.Errorf("delivery should be recorded once, but %d times", ledger.done)
 	}
 }
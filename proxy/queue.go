@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+)
+
+var (
+	// ErrQueueFull is returned when the queue has no room for the request.
+	ErrQueueFull = errors.New("request queue is full")
+	// ErrQueueClosed is returned when the queue doesn't accept requests any more.
+	ErrQueueClosed = errors.New("request queue is closed")
+)
+
+const (
+	laneSync = iota
+	laneAsync
+	numLanes
+)
+
+// queueEntry is a request waiting in the queue.
+type queueEntry struct {
+	contents entity.ContentList
+	lane     int
+	enqueued time.Time
+	elem     *list.Element // nil after the entry left the queue
+}
+
+// QueueStats is the number of requests waiting in the queue by lane.
+type QueueStats struct {
+	Sync  int
+	Async int
+}
+
+// Depth returns the number of all waiting requests.
+func (s QueueStats) Depth() int {
+	return s.Sync + s.Async
+}
+
+// RequestQueue holds requests until a runtime takes them.
+// It accepts up to maxDepth requests, and synchronous requests are taken
+// before asynchronous ones, because their clients are waiting for the response.
+// Requests which waited longer than maxWait are rejected with 429.
+type RequestQueue struct {
+	mu       sync.Mutex
+	lanes    [numLanes]*list.List
+	held     [numLanes]int // the number of requests taken from lanes but not yet received by runtime
+	reserved int           // the number of requests admitted but not yet pushed, see reserve
+	closed   bool
+	notify   chan struct{}
+	out      chan entity.ContentList
+	maxDepth int
+	maxWait  time.Duration
+	onExpire func(entity.ContentList)
+}
+
+// NewRequestQueue returns RequestQueue, and starts dispatching requests to Out.
+func NewRequestQueue(conf *config.Configuration) *RequestQueue {
+	q := newRequestQueue(conf.QueueMaxDepth, conf.GetQueueMaxWait(), func(cl entity.ContentList) {
+		deleteTempFiles(cl.Ctx, &cl, nil)
+		responseRuntimeError(
+			cl.Ctx, conf, cl, http.StatusTooManyRequests, "waited too long in request queue", nil)
+	})
+	go q.dispatch()
+	return q
+}
+
+func newRequestQueue(
+	maxDepth int,
+	maxWait time.Duration,
+	onExpire func(entity.ContentList)) *RequestQueue {
+
+	q := &RequestQueue{
+		notify:   make(chan struct{}, 1),
+		out:      make(chan entity.ContentList),
+		maxDepth: maxDepth,
+		maxWait:  maxWait,
+		onExpire: onExpire,
+	}
+	for i := range q.lanes {
+		q.lanes[i] = list.New()
+	}
+	return q
+}
+
+// Out returns the channel from which runtimes receive requests.
+// It is closed after the queue is closed and all waiting requests are received.
+func (q *RequestQueue) Out() <-chan entity.ContentList {
+	return q.out
+}
+
+// Stats returns the number of waiting requests by lane.
+// A request being handed to runtime is counted in its lane.
+func (q *RequestQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Sync:  q.lanes[laneSync].Len() + q.held[laneSync],
+		Async: q.lanes[laneAsync].Len() + q.held[laneAsync],
+	}
+}
+
+// MaxDepth returns the max number of requests which the queue accepts.
+func (q *RequestQueue) MaxDepth() int {
+	return q.maxDepth
+}
+
+// RetryAfter returns seconds which rejected clients should wait before retrying.
+func (q *RequestQueue) RetryAfter() int {
+	seconds := int(math.Ceil(q.maxWait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// Close stops accepting requests. Requests already in the queue are still dispatched.
+func (q *RequestQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// push adds the request to the lane by its kind.
+func (q *RequestQueue) push(cl entity.ContentList) (*queueEntry, error) {
+	return q.enqueue(cl, true)
+}
+
+// restore adds the request accepted before restart, regardless of max depth.
+func (q *RequestQueue) restore(cl entity.ContentList) error {
+	_, err := q.enqueue(cl, false)
+	return err
+}
+
+// reserve admits a request before its body is read, so that the body of the request which
+// is rejected isn't spooled to disk. The room reserved is taken by push of the reservation,
+// or freed by cancel of it.
+func (q *RequestQueue) reserve() (*reservation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.admit(); err != nil {
+		return nil, err
+	}
+	q.reserved++
+	return &reservation{queue: q}, nil
+}
+
+func (q *RequestQueue) enqueue(cl entity.ContentList, limited bool) (*queueEntry, error) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, ErrQueueClosed
+	}
+	if limited {
+		if err := q.admit(); err != nil {
+			q.mu.Unlock()
+			return nil, err
+		}
+	}
+	entry := q.pushBack(cl)
+	q.mu.Unlock()
+
+	q.signal()
+	return entry, nil
+}
+
+// admit returns error if the queue doesn't accept a request any more. It must be called with lock.
+func (q *RequestQueue) admit() error {
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.depth() >= q.maxDepth {
+		queueRejections.WithLabelValues("full").Inc()
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// pushBack adds the request to the lane by its kind. It must be called with lock.
+func (q *RequestQueue) pushBack(cl entity.ContentList) *queueEntry {
+	lane := laneSync
+	if cl.AsyncRequestID != "" {
+		lane = laneAsync
+	}
+	entry := &queueEntry{contents: cl, lane: lane, enqueued: time.Now()}
+	entry.elem = q.lanes[lane].PushBack(entry)
+	return entry
+}
+
+// remove takes the entry out of the queue, and returns false when a runtime already took it.
+func (q *RequestQueue) remove(entry *queueEntry) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry.elem == nil {
+		return false
+	}
+	q.lanes[entry.lane].Remove(entry.elem)
+	entry.elem = nil
+	return true
+}
+
+func (q *RequestQueue) depth() int {
+	depth := q.reserved
+	for i, lane := range q.lanes {
+		depth += lane.Len() + q.held[i]
+	}
+	return depth
+}
+
+func (q *RequestQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands waiting requests to runtimes in order of priority.
+func (q *RequestQueue) dispatch() {
+	defer close(q.out)
+	for {
+		cl, lane, ok := q.pop()
+		if !ok {
+			return
+		}
+		q.out <- cl
+		q.release(lane)
+	}
+}
+
+// pop waits for a request and takes it from the lane with the highest priority.
+// Asynchronous requests which waited too long are passed to onExpire, because
+// nobody is waiting for them. (synchronous ones are removed by their handlers)
+// onExpire is called in another goroutine, because delivering the error to ARMS
+// or the callback url may take long, and it must not block dispatching.
+// It returns the request and its lane, or false when the queue is closed and empty.
+func (q *RequestQueue) pop() (entity.ContentList, int, bool) {
+	for {
+		q.mu.Lock()
+		entry := q.takeFront()
+		closed := q.closed && q.depth() == 0
+		q.mu.Unlock()
+
+		if entry == nil {
+			if closed {
+				return entity.ContentList{}, 0, false
+			}
+			<-q.notify
+			continue
+		}
+		if entry.lane == laneAsync && q.maxWait > 0 && time.Since(entry.enqueued) > q.maxWait {
+			q.release(entry.lane)
+			queueRejections.WithLabelValues("timeout").Inc()
+			go q.onExpire(entry.contents)
+			continue
+		}
+		return entry.contents, entry.lane, true
+	}
+}
+
+// takeFront takes the first entry of the lane with the highest priority, and holds it
+// until runtime receives it. It returns nil when all lanes are empty.
+func (q *RequestQueue) takeFront() *queueEntry {
+	for lane, entries := range q.lanes {
+		if front := entries.Front(); front != nil {
+			entry := entries.Remove(front).(*queueEntry)
+			entry.elem = nil
+			q.held[lane]++
+			return entry
+		}
+	}
+	return nil
+}
+
+func (q *RequestQueue) release(lane int) {
+	q.mu.Lock()
+	q.held[lane]--
+	q.mu.Unlock()
+}
+
+// reservation is the room of the queue held for a request while its body is read.
+type reservation struct {
+	queue *RequestQueue
+	done  bool
+}
+
+// push adds the request to the queue in the room reserved.
+// It fails only when the queue is closed after the reservation.
+func (r *reservation) push(cl entity.ContentList) (*queueEntry, error) {
+	q := r.queue
+	q.mu.Lock()
+	if r.done {
+		q.mu.Unlock()
+		return nil, errors.New("reservation is already used")
+	}
+	r.done = true
+	q.reserved--
+	if q.closed {
+		q.mu.Unlock()
+		return nil, ErrQueueClosed
+	}
+	entry := q.pushBack(cl)
+	q.mu.Unlock()
+
+	q.signal()
+	return entry, nil
+}
+
+// cancel frees the room reserved, unless the request is already pushed.
+func (r *reservation) cancel() {
+	q := r.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !r.done {
+		r.done = true
+		q.reserved--
+	}
+}
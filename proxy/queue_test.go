@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+)
+
+func TestRequestQueue_Priority(t *testing.T) {
+	q := newRequestQueue(10, 0, nil)
+	for _, id := range []string{"async-1", "", "async-2", ""} {
+		if _, err := q.push(entity.ContentList{AsyncRequestID: id, Method: "POST"}); err != nil {
+			t.Fatal("unexpected error occurred:", err)
+		}
+	}
+	stats := q.Stats()
+	if stats.Sync != 2 || stats.Async != 2 || stats.Depth() != 4 {
+		t.Errorf("stats should be 2 sync and 2 async, but %+v", stats)
+	}
+
+	go q.dispatch()
+	q.Close()
+	if _, err := q.push(entity.ContentList{}); err != ErrQueueClosed {
+		t.Errorf("closed queue should reject request with ErrQueueClosed, but %v", err)
+	}
+
+	var order []string
+	for cl := range q.Out() {
+		order = append(order, cl.AsyncRequestID)
+	}
+	expected := []string{"", "", "async-1", "async-2"}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("requests should be dispatched in order %v, but %v", expected, order)
+	}
+}
+
+func TestRequestQueue_MaxDepth(t *testing.T) {
+	q := newRequestQueue(2, 0, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := q.push(entity.ContentList{}); err != nil {
+			t.Fatal("unexpected error occurred:", err)
+		}
+	}
+	if _, err := q.push(entity.ContentList{AsyncRequestID: "async"}); err != ErrQueueFull {
+		t.Fatalf("full queue should reject request with ErrQueueFull, but %v", err)
+	}
+
+	// the request being handed to runtime still occupies the queue.
+	go q.dispatch()
+	defer q.Close()
+	time.Sleep(50 * time.Millisecond)
+	if depth := q.Stats().Depth(); depth != 2 {
+		t.Errorf("depth should be 2, but %d", depth)
+	}
+	<-q.Out()
+	<-q.Out()
+	if _, err := q.push(entity.ContentList{}); err != nil {
+		t.Errorf("request should be accepted after runtime took requests, but %v", err)
+	}
+}
+
+func TestRequestQueue_MaxWait(t *testing.T) {
+	expired := make(chan entity.ContentList, 1)
+	q := newRequestQueue(10, 50*time.Millisecond, func(cl entity.ContentList) {
+		expired <- cl
+	})
+
+	response := make(chan entity.Response, 1)
+	syncEntry, err := q.push(entity.ContentList{ResponseChan: response})
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if _, err := q.push(entity.ContentList{AsyncRequestID: "async"}); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	// synchronous request is removed by its handler.
+	if _, ok := waitResponse(q, syncEntry, response); ok {
+		t.Error("request which waited too long should be rejected")
+	}
+	if q.Stats().Sync != 0 {
+		t.Errorf("rejected request should be removed from queue, but %+v", q.Stats())
+	}
+	if q.remove(syncEntry) {
+		t.Error("removed request should not be removed again")
+	}
+
+	// asynchronous request is passed to onExpire when runtime tries to take it.
+	go q.dispatch()
+	select {
+	case cl := <-expired:
+		if cl.AsyncRequestID != "async" {
+			t.Errorf("expired request should be [async], but [%s]", cl.AsyncRequestID)
+		}
+	case cl := <-q.Out():
+		t.Fatalf("request which waited too long should not be dispatched, but %+v", cl)
+	case <-time.After(time.Second):
+		t.Fatal("expired request should be notified")
+	}
+
+	if _, err := q.push(entity.ContentList{AsyncRequestID: "new"}); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if cl := <-q.Out(); cl.AsyncRequestID != "new" {
+		t.Errorf("request should be dispatched, but %+v", cl)
+	}
+	q.Close()
+}
+
+func TestRequestQueue_ExpireDoesNotBlock(t *testing.T) {
+	// onExpire takes long, e.g. ARMS doesn't respond.
+	unblock := make(chan struct{})
+	defer close(unblock)
+	q := newRequestQueue(10, 50*time.Millisecond, func(cl entity.ContentList) {
+		<-unblock
+	})
+	defer q.Close()
+
+	if _, err := q.push(entity.ContentList{AsyncRequestID: "expired"}); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := q.push(entity.ContentList{AsyncRequestID: "new"}); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	go q.dispatch()
+	select {
+	case cl := <-q.Out():
+		if cl.AsyncRequestID != "new" {
+			t.Errorf("request should be [new], but [%s]", cl.AsyncRequestID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expiring request should not block dispatching")
+	}
+}
+
+func TestRequestQueue_Reserve(t *testing.T) {
+	q := newRequestQueue(2, 0, nil)
+	first, err := q.reserve()
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	second, err := q.reserve()
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if _, err := q.reserve(); err != ErrQueueFull {
+		t.Fatalf("reservation over max depth should be rejected with ErrQueueFull, but %v", err)
+	}
+	if _, err := q.push(entity.ContentList{}); err != ErrQueueFull {
+		t.Fatalf("push over reservations should be rejected with ErrQueueFull, but %v", err)
+	}
+
+	if _, err := first.push(entity.ContentList{}); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	first.cancel() // no effect after push.
+	second.cancel()
+	if depth := q.Stats().Depth(); depth != 1 {
+		t.Errorf("depth should be 1, but %d", depth)
+	}
+	third, err := q.reserve()
+	if err != nil {
+		t.Fatalf("room of canceled reservation should be freed, but %v", err)
+	}
+
+	q.Close()
+	if _, err := third.push(entity.ContentList{}); err != ErrQueueClosed {
+		t.Errorf("closed queue should reject request with ErrQueueClosed, but %v", err)
+	}
+	if _, err := q.reserve(); err != ErrQueueClosed {
+		t.Errorf("closed queue should reject reservation with ErrQueueClosed, but %v", err)
+	}
+}
+
+func TestRequestQueue_Reject(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	dataDir, err := ioutil.TempDir("", "queue_reject")
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer os.RemoveAll(dataDir)
+	conf := config.NewConfiguration()
+	conf.QueueMaxDepth = 1
+	conf.QueueMaxWait = 3
+	conf.RequestedDataDir = dataDir
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	handler := getRequestHandleFunc(newRuntimePool(t, runtime), queue, &conf, nil, nil)
+
+	// fill the queue, nobody takes it.
+	if _, err := queue.push(entity.ContentList{AsyncRequestID: "async"}); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	for _, asyncID := range []string{"", "1234"} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		if asyncID != "" {
+			req.Header.Set("x-abeja-arms-async-request-id", asyncID)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("http status should be %d, but %d", http.StatusTooManyRequests, rec.Code)
+		}
+		if v := rec.Header().Get("Retry-After"); v != "3" {
+			t.Errorf("Retry-After should be 3, but [%s]", v)
+		}
+	}
+	// body of the request rejected is not written to disk.
+	if files, _ := ioutil.ReadDir(dataDir); len(files) != 0 {
+		t.Errorf("no file should be written, but %d file(s)", len(files))
+	}
+}
@@ -0,0 +1,619 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// headerV2Size is the size of HeaderV2 in bytes.
+const headerV2Size = 16
+
+// streamBufferMaxBytes is the size of CHUNK frames buffered per streaming response.
+// Chunks are buffered regardless of their number, so that a slow consumer doesn't block
+// responses of other requests on the same connection. The stream is canceled only when
+// its consumer falls behind more than this.
+var streamBufferMaxBytes = 64 << 20
+
+// errStreamOverflow is set to the stream which is canceled because its consumer is too slow.
+var errStreamOverflow = errors.New("buffer for chunks of streaming response overflowed")
+
+// runtimeConn represents the connection to runtime.
+// On protocol version 2, several requests can be in flight on it at the same time.
+type runtimeConn struct {
+	conn           net.Conn
+	version        byte
+	maxConcurrency int
+	maxBatchSize   int
+	model          map[string]interface{}
+	startupTimeout time.Duration // limits the wait for HELLO and READY frames, unlimited if 0
+	nextID         uint32
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[uint32]*ipcRequest
+	streams map[uint32]*ipcRequest
+	err     error
+	closed  bool
+	done    chan struct{}
+}
+
+// ipcRequest is the request encoded for runtime.
+type ipcRequest struct {
+	id     uint32
+	header interface{}
+	body   []byte
+
+	// followings are used on protocol version 2.
+	receiver  chan []byte
+	chunks    chan []byte
+	stream    *streamBuffer
+	canceled  chan struct{}
+	streamErr error
+}
+
+// streamBuffer queues chunks of streaming response between receiveLoop and the consumer of them.
+type streamBuffer struct {
+	mu     sync.Mutex
+	queue  [][]byte
+	size   int
+	closed bool
+	err    error
+	notify chan struct{}
+}
+
+func newStreamBuffer() *streamBuffer {
+	return &streamBuffer{notify: make(chan struct{}, 1)}
+}
+
+// push queues the chunk. It returns false if buffered chunks would exceed streamBufferMaxBytes.
+func (b *streamBuffer) push(data []byte) bool {
+	b.mu.Lock()
+	if b.size+len(data) > streamBufferMaxBytes {
+		b.mu.Unlock()
+		return false
+	}
+	b.queue = append(b.queue, data)
+	b.size += len(data)
+	b.mu.Unlock()
+	b.wakeUp()
+	return true
+}
+
+// close ends the stream after the queued chunks, with err if it didn't complete.
+func (b *streamBuffer) close(err error) {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.wakeUp()
+}
+
+func (b *streamBuffer) wakeUp() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// forward hands over the queued chunks to req.chunks in order, until the stream ends or is canceled.
+// req.chunks is closed at the end, after the error of the stream is set to req.streamErr.
+func (b *streamBuffer) forward(req *ipcRequest) {
+	defer close(req.chunks)
+	for {
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			closed, err := b.closed, b.err
+			b.mu.Unlock()
+			if closed {
+				req.streamErr = err
+				return
+			}
+			select {
+			case <-b.notify:
+			case <-req.canceled:
+				return
+			}
+			continue
+		}
+		data := b.queue[0]
+		b.queue[0] = nil
+		b.queue = b.queue[1:]
+		b.size -= len(data)
+		b.mu.Unlock()
+
+		select {
+		case req.chunks <- data:
+		case <-req.canceled:
+			return
+		}
+	}
+}
+
+// dialRuntime connects to runtime and negotiates the version of protocol.
+func dialRuntime(ctx context.Context, conf *config.Configuration, socketFilePath string) (*runtimeConn, error) {
+	return dialSupervisedRuntime(ctx, conf, socketFilePath, nil)
+}
+
+// dialSupervisedRuntime is dialRuntime which tells supervisor how far runtime has started, if it's given.
+// Runtime is loading once connected, and it's ready when the negotiation finished.
+func dialSupervisedRuntime(
+	ctx context.Context,
+	conf *config.Configuration,
+	socketFilePath string,
+	supervisor *subprocess.Supervisor) (*runtimeConn, error) {
+
+	conn, err := net.Dial("unix", socketFilePath)
+	if err != nil {
+		return nil, errors.Errorf(": %w", err)
+	}
+	if supervisor != nil {
+		supervisor.MarkLoading()
+	}
+	rc := &runtimeConn{
+		conn:           conn,
+		version:        version,
+		maxConcurrency: 1,
+		maxBatchSize:   1,
+		startupTimeout: conf.GetStartupTimeout(),
+		pending:        make(map[uint32]*ipcRequest),
+		streams:        make(map[uint32]*ipcRequest),
+		done:           make(chan struct{}),
+	}
+	if err := rc.negotiateUntilDone(ctx, conf.IPCProtocolVersion); err != nil {
+		if cerr := conn.Close(); cerr != nil {
+			log.Warning(ctx, "Error when closing connection to runtime:", cerr)
+		}
+		return nil, errors.Errorf("failed to negotiate protocol version: %w", err)
+	}
+	if rc.version == version2 {
+		go rc.receiveLoop(ctx)
+	}
+	log.Infof(
+		ctx, "connected to runtime with protocol version %d, max concurrency %d, max batch size %d",
+		rc.version, rc.maxConcurrency, rc.maxBatchSize)
+	if supervisor != nil {
+		supervisor.MarkReady(ctx, rc.Model())
+	}
+	return rc, nil
+}
+
+// negotiateUntilDone is negotiate which is aborted when ctx is done(e.g. on shutdown),
+// because runtime may take long to reply HELLO frame or to send READY frame.
+func (rc *runtimeConn) negotiateUntilDone(ctx context.Context, protocolVersion int) error {
+	negotiated := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			// unblock reading frames from runtime.
+			if err := rc.conn.SetReadDeadline(time.Now()); err != nil {
+				log.Warning(ctx, "failed to set read deadline:", err)
+			}
+		case <-negotiated:
+		}
+	}()
+	err := rc.negotiate(ctx, protocolVersion)
+	close(negotiated)
+	<-watched
+	if err == nil && ctx.Err() != nil {
+		return errors.Errorf("aborted: %w", ctx.Err())
+	}
+	return err
+}
+
+// negotiate selects the version of protocol with runtime.
+// Version 2 is spoken only when it's configured, and then the proxy sends HELLO frame
+// and waits for HELLO frame which runtime replies. Otherwise runtime speaks version 1.
+// The wait for HELLO frame (and READY frame if runtime sends it) is limited by the startup timeout.
+func (rc *runtimeConn) negotiate(ctx context.Context, protocolVersion int) error {
+	if protocolVersion != version2 {
+		return nil
+	}
+	if rc.startupTimeout > 0 {
+		if err := rc.conn.SetReadDeadline(time.Now().Add(rc.startupTimeout)); err != nil {
+			return errors.Errorf("failed to set read deadline: %w", err)
+		}
+		defer func() {
+			if err := rc.conn.SetReadDeadline(time.Time{}); err != nil {
+				log.Warning(ctx, "failed to reset read deadline:", err)
+			}
+		}()
+	}
+
+	hello, err := json.Marshal(HelloToRuntime{Version: version2})
+	if err != nil {
+		return errors.Errorf("json encode error: %w", err)
+	}
+	req := &ipcRequest{
+		header: NewHeaderV2(FrameTypeHello, 0, len(hello)),
+		body:   hello,
+	}
+	if err := rc.write(req); err != nil {
+		return errors.Errorf("failed to send HELLO frame: %w", err)
+	}
+
+	bodyBuff, err := rc.readFrame(FrameTypeHello)
+	if err != nil {
+		return err
+	}
+	var reply HelloFromRuntime
+	if err := json.Unmarshal(bodyBuff, &reply); err != nil {
+		return errors.Errorf("failed to decode body of HELLO frame: %w", err)
+	}
+	log.Debugf(ctx, "HELLO from runtime = %s", string(bodyBuff))
+	supported := false
+	for _, v := range reply.Versions {
+		if v == version2 {
+			supported = true
+		}
+	}
+	if !supported {
+		return errors.Errorf("runtime doesn't support protocol version 2: %v", reply.Versions)
+	}
+
+	rc.version = version2
+	if reply.MaxConcurrency > 1 {
+		rc.maxConcurrency = reply.MaxConcurrency
+	}
+	if reply.MaxBatchSize > 1 {
+		rc.maxBatchSize = reply.MaxBatchSize
+	}
+	if reply.SendsReady {
+		return rc.waitReady(ctx)
+	}
+	return nil
+}
+
+// waitReady waits for READY frame from runtime which is loading its model.
+func (rc *runtimeConn) waitReady(ctx context.Context) error {
+	log.Info(ctx, "wait for runtime to get ready...")
+	bodyBuff, err := rc.readFrame(FrameTypeReady)
+	if err != nil {
+		return err
+	}
+	if len(bodyBuff) == 0 {
+		return nil
+	}
+	var ready ReadyFromRuntime
+	if err := json.Unmarshal(bodyBuff, &ready); err != nil {
+		return errors.Errorf("failed to decode body of READY frame: %w", err)
+	}
+	log.Debugf(ctx, "READY from runtime = %s", string(bodyBuff))
+	rc.model = ready.Model
+	return nil
+}
+
+// readFrame reads a frame of protocol version 2 while negotiating, and returns its body.
+// It returns error when the frame isn't the expected type.
+func (rc *runtimeConn) readFrame(expected FrameType) ([]byte, error) {
+	headBuff := make([]byte, headerV2Size)
+	if _, err := io.ReadFull(rc.conn, headBuff); err != nil {
+		return nil, errors.Errorf("failed to read %s frame: %w", expected, err)
+	}
+	header, err := decodeHeaderV2(headBuff)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != expected {
+		return nil, errors.Errorf("expected %s frame, but frame type %d", expected, header.Type)
+	}
+	bodyBuff := make([]byte, header.Length)
+	if _, err := io.ReadFull(rc.conn, bodyBuff); err != nil {
+		return nil, errors.Errorf("failed to read body of %s frame: %w", expected, err)
+	}
+	return bodyBuff, nil
+}
+
+// MaxConcurrency returns the number of requests which runtime can process at the same time.
+func (rc *runtimeConn) MaxConcurrency() int {
+	return rc.maxConcurrency
+}
+
+// MaxBatchSize returns the number of requests which runtime accepts in a batch.
+func (rc *runtimeConn) MaxBatchSize() int {
+	return rc.maxBatchSize
+}
+
+// Model returns metadata of the model which runtime told in READY frame, or nil.
+func (rc *runtimeConn) Model() map[string]interface{} {
+	return rc.model
+}
+
+// encode encodes the request in the negotiated version of protocol.
+func (rc *runtimeConn) encode(cl *entity.ContentList) (*ipcRequest, error) {
+	if rc.version == version2 {
+		id := atomic.AddUint32(&rc.nextID, 1)
+		header, body, err := FromRequestV2(id, cl)
+		if err != nil {
+			return nil, err
+		}
+		return &ipcRequest{
+			id:       id,
+			header:   header,
+			body:     body,
+			chunks:   make(chan []byte),
+			stream:   newStreamBuffer(),
+			canceled: make(chan struct{}),
+		}, nil
+	}
+	header, body, err := FromRequest(cl)
+	if err != nil {
+		return nil, err
+	}
+	return &ipcRequest{header: header, body: body}, nil
+}
+
+// encodeBatch encodes the requests into a batch. It's only available on protocol version 2.
+func (rc *runtimeConn) encodeBatch(cls []*entity.ContentList) (*ipcRequest, error) {
+	if rc.version != version2 {
+		return nil, errors.New("batch isn't supported on protocol version 1")
+	}
+	id := atomic.AddUint32(&rc.nextID, 1)
+	header, body, err := FromBatchRequestV2(id, cls)
+	if err != nil {
+		return nil, err
+	}
+	return &ipcRequest{
+		id:       id,
+		header:   header,
+		body:     body,
+		canceled: make(chan struct{}),
+	}, nil
+}
+
+// send sends the request to runtime, and returns the channel which receives body of response.
+// The channel receives empty bytes when it failed to receive response.
+func (rc *runtimeConn) send(ctx context.Context, req *ipcRequest) (<-chan []byte, error) {
+	receiver := make(chan []byte, 1)
+	if rc.version != version2 {
+		if err := rc.write(req); err != nil {
+			return nil, err
+		}
+		go rc.receiveV1(ctx, receiver)
+		return receiver, nil
+	}
+
+	rc.mu.Lock()
+	if rc.err != nil {
+		rc.mu.Unlock()
+		return nil, errors.Errorf("connection to runtime is broken: %w", rc.err)
+	}
+	req.receiver = receiver
+	rc.pending[req.id] = req
+	rc.mu.Unlock()
+
+	if err := rc.write(req); err != nil {
+		rc.mu.Lock()
+		delete(rc.pending, req.id)
+		rc.mu.Unlock()
+		return nil, err
+	}
+	return receiver, nil
+}
+
+// cancel stops waiting for the response (or its chunks) of the request,
+// and sends CANCEL frame to runtime. It must not be called twice for the same request.
+// It returns false if runtime can't cancel the request because of protocol version 1.
+func (rc *runtimeConn) cancel(ctx context.Context, req *ipcRequest) bool {
+	if rc.version != version2 {
+		return false
+	}
+	rc.mu.Lock()
+	delete(rc.pending, req.id)
+	delete(rc.streams, req.id)
+	rc.mu.Unlock()
+	close(req.canceled)
+	rc.sendCancel(ctx, req.id)
+	return true
+}
+
+// abortStream cancels the stream whose consumer falls behind runtime more than streamBufferMaxBytes.
+// The consumer finds chunks closed with errStreamOverflow after the buffered ones.
+// CANCEL frame is sent asynchronously, because it's called from receiveLoop.
+func (rc *runtimeConn) abortStream(ctx context.Context, req *ipcRequest) {
+	rc.mu.Lock()
+	_, ok := rc.streams[req.id]
+	delete(rc.streams, req.id)
+	rc.mu.Unlock()
+	if !ok {
+		return
+	}
+	log.Warningf(ctx, "consumer of streaming response of request[%d] is too slow, cancel it", req.id)
+	req.stream.close(errStreamOverflow)
+	go rc.sendCancel(ctx, req.id)
+}
+
+func (rc *runtimeConn) sendCancel(ctx context.Context, id uint32) {
+	cancelReq := &ipcRequest{
+		id:     id,
+		header: NewHeaderV2(FrameTypeCancel, id, 0),
+	}
+	if err := rc.write(cancelReq); err != nil {
+		log.Warningf(ctx, "failed to send CANCEL frame of request[%d]: "+log.ErrorFormat, id, err)
+	}
+}
+
+func (rc *runtimeConn) write(req *ipcRequest) error {
+	rc.writeMu.Lock()
+	defer rc.writeMu.Unlock()
+	if err := binary.Write(rc.conn, binary.BigEndian, req.header); err != nil {
+		return errors.Errorf("Write IPC request header error: %w", err)
+	}
+	if _, err := rc.conn.Write(req.body); err != nil {
+		return errors.Errorf("Write IPC request body error: %w", err)
+	}
+	return nil
+}
+
+func (rc *runtimeConn) receiveV1(ctx context.Context, receiver chan []byte) {
+	var header Header
+	headBuff := make([]byte, 8)
+	if _, err := io.ReadFull(rc.conn, headBuff); err != nil {
+		rc.fail(ctx, errors.Errorf("Read IPC response header error: %w", err))
+		receiver <- []byte{}
+		return
+	}
+
+	if err := binary.Read(bytes.NewReader(headBuff), binary.BigEndian, &header); err != nil {
+		rc.fail(ctx, errors.Errorf("Read IPC response header error: %w", err))
+		receiver <- []byte{}
+		return
+	}
+
+	log.Debug(ctx, "response body length = "+fmt.Sprint(header.Length))
+	bodyBuff := make([]byte, header.Length)
+	if _, err := io.ReadFull(rc.conn, bodyBuff); err != nil {
+		rc.fail(ctx, errors.Errorf("Read IPC response body error: %w", err))
+		receiver <- []byte{}
+		return
+	}
+	log.Debugf(ctx, "response body = %s", string(bodyBuff))
+
+	receiver <- bodyBuff
+}
+
+// receiveLoop reads frames of protocol version 2,
+// and hands over each response to the sender of the request.
+func (rc *runtimeConn) receiveLoop(ctx context.Context) {
+	for {
+		headBuff := make([]byte, headerV2Size)
+		if _, err := io.ReadFull(rc.conn, headBuff); err != nil {
+			rc.fail(ctx, errors.Errorf("Read IPC response header error: %w", err))
+			return
+		}
+		header, err := decodeHeaderV2(headBuff)
+		if err != nil {
+			rc.fail(ctx, err)
+			return
+		}
+		bodyBuff := make([]byte, header.Length)
+		if _, err := io.ReadFull(rc.conn, bodyBuff); err != nil {
+			rc.fail(ctx, errors.Errorf("Read IPC response body error: %w", err))
+			return
+		}
+
+		switch header.Type {
+		case FrameTypeResponse:
+			log.Debugf(ctx, "response body of request[%d] = %s", header.RequestID, string(bodyBuff))
+			rc.mu.Lock()
+			req, ok := rc.pending[header.RequestID]
+			delete(rc.pending, header.RequestID)
+			if ok && isStreamingResponse(bodyBuff) {
+				rc.streams[header.RequestID] = req
+				go req.stream.forward(req)
+			}
+			rc.mu.Unlock()
+			if !ok {
+				log.Warningf(ctx, "received response of unknown or canceled request[%d]", header.RequestID)
+				continue
+			}
+			req.receiver <- bodyBuff
+		case FrameTypeChunk:
+			rc.mu.Lock()
+			req, ok := rc.streams[header.RequestID]
+			if ok && len(bodyBuff) == 0 {
+				delete(rc.streams, header.RequestID)
+			}
+			rc.mu.Unlock()
+			if !ok {
+				log.Warningf(ctx, "received chunk of unknown or canceled request[%d]", header.RequestID)
+				continue
+			}
+			if len(bodyBuff) == 0 {
+				// empty CHUNK frame is the end of stream.
+				req.stream.close(nil)
+				continue
+			}
+			if !req.stream.push(bodyBuff) {
+				rc.abortStream(ctx, req)
+			}
+		default:
+			log.Warningf(ctx, "received unexpected frame type %d from runtime", header.Type)
+		}
+	}
+}
+
+// fail marks the connection as broken, and notifies all requests in flight.
+func (rc *runtimeConn) fail(ctx context.Context, err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.closed {
+		log.Errorf(ctx, "connection to runtime is broken: "+log.ErrorFormat, err)
+	}
+	if rc.err == nil {
+		rc.err = err
+		close(rc.done)
+	}
+	for id, req := range rc.pending {
+		req.receiver <- []byte{}
+		delete(rc.pending, id)
+	}
+	for id, req := range rc.streams {
+		req.stream.close(err)
+		delete(rc.streams, id)
+	}
+}
+
+// isStreamingResponse returns result of `Will chunks of the response follow ?`.
+func isStreamingResponse(bodyBuff []byte) bool {
+	var res struct {
+		Streaming bool    `json:"streaming"`
+		ErrMsg    *string `json:"error_message"`
+	}
+	if err := json.Unmarshal(bodyBuff, &res); err != nil {
+		return false
+	}
+	return res.Streaming && res.ErrMsg == nil
+}
+
+// Done returns the channel which is closed when the connection is broken.
+func (rc *runtimeConn) Done() <-chan struct{} {
+	return rc.done
+}
+
+// Err returns the reason why the connection is broken, or nil.
+func (rc *runtimeConn) Err() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.err
+}
+
+// Close closes the connection to runtime.
+func (rc *runtimeConn) Close() error {
+	rc.mu.Lock()
+	rc.closed = true
+	rc.mu.Unlock()
+	return rc.conn.Close()
+}
+
+func decodeHeaderV2(headBuff []byte) (HeaderV2, error) {
+	var header HeaderV2
+	if err := binary.Read(bytes.NewReader(headBuff), binary.BigEndian, &header); err != nil {
+		return header, errors.Errorf("failed to decode header: %w", err)
+	}
+	if !bytes.Equal(header.Magic[:], []byte{magic0, magic1, magic2}) {
+		return header, errors.Errorf("invalid magic of header: %v", header.Magic)
+	}
+	if header.Version != version2 {
+		return header, errors.Errorf("unexpected protocol version of header: %d", header.Version)
+	}
+	return header, nil
+}
@@ -0,0 +1,643 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+)
+
+func writeFrameV2(t *testing.T, w io.Writer, frameType FrameType, requestID uint32, body []byte) {
+	t.Helper()
+	header := NewHeaderV2(frameType, requestID, len(body))
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		t.Error("Error when writing header:", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Error("Error when writing body:", err)
+	}
+}
+
+func readFrameV2(t *testing.T, r io.Reader) (HeaderV2, []byte) {
+	t.Helper()
+	headBuf := make([]byte, headerV2Size)
+	if _, err := io.ReadFull(r, headBuf); err != nil {
+		t.Error("Error when reading header:", err)
+		return HeaderV2{}, nil
+	}
+	header, err := decodeHeaderV2(headBuf)
+	if err != nil {
+		t.Error("Error when decoding header:", err)
+		return header, nil
+	}
+	bodyBuf := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, bodyBuf); err != nil {
+		t.Error("Error when reading body:", err)
+	}
+	return header, bodyBuf
+}
+
+// replyHelloV2 reads HELLO frame which the proxy sends, and replies HELLO frame as runtime of version 2.
+func replyHelloV2(t *testing.T, rw io.ReadWriter, hello []byte) {
+	t.Helper()
+	header, body := readFrameV2(t, rw)
+	if header.Type != FrameTypeHello {
+		t.Errorf("frame type should be HELLO, but %d", header.Type)
+	}
+	var fromProxy HelloToRuntime
+	if err := json.Unmarshal(body, &fromProxy); err != nil {
+		t.Error("Error when unmarshaling HELLO:", err)
+	}
+	if fromProxy.Version != version2 {
+		t.Errorf("version in HELLO should be %d, but %d", version2, fromProxy.Version)
+	}
+	writeFrameV2(t, rw, FrameTypeHello, 0, hello)
+}
+
+func listenTestSocket(t *testing.T) (string, net.Listener) {
+	t.Helper()
+	path := filepath.Join(os.TempDir(), "test_unixdomainsocket")
+	RemoveUDSFile(path, t)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("Error when listening unix domain socket:", err)
+	}
+	return path, listener
+}
+
+func TestDialRuntime_Version1(t *testing.T) {
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	go func() {
+		fd, _ := listener.Accept()
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+
+		// runtime of version 1 sends nothing until it receives request.
+		headBuf := make([]byte, 8)
+		if _, err := io.ReadFull(fd, headBuf); err != nil {
+			t.Error("Error when reading header:", err)
+		}
+		var header Header
+		if err := binary.Read(bytes.NewReader(headBuf), binary.BigEndian, &header); err != nil {
+			t.Error("Error when reading header:", err)
+		}
+		if version != header.Version {
+			t.Errorf("header.Version should be %v, but %v", version, header.Version)
+		}
+		bodyBuf := make([]byte, header.Length)
+		if _, err := io.ReadFull(fd, bodyBuf); err != nil {
+			t.Error(err)
+		}
+
+		b := []byte(`{"status_code":200}`)
+		respHeader := Header{
+			Magic:   [3]byte{magic0, magic1, magic2},
+			Version: version,
+			Length:  uint32(len(b)),
+		}
+		if err := binary.Write(fd, binary.BigEndian, respHeader); err != nil {
+			t.Error("Error when writing response header:", err)
+		}
+		if _, err := fd.Write(b); err != nil {
+			t.Error("Error when writing response body:", err)
+		}
+	}()
+
+	conn, err := dialRuntime(context.TODO(), &config.Configuration{}, path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer cleanutil.Close(context.TODO(), conn, path)
+	if conn.version != version {
+		t.Errorf("version should be %d, but %d", version, conn.version)
+	}
+	if conn.MaxConcurrency() != 1 {
+		t.Errorf("max concurrency should be 1, but %d", conn.MaxConcurrency())
+	}
+
+	req, err := conn.encode(&entity.ContentList{Method: "POST"})
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	receiver, err := conn.send(context.TODO(), req)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	select {
+	case body := <-receiver:
+		if string(body) != `{"status_code":200}` {
+			t.Errorf("response body should be [%s], but [%s]", `{"status_code":200}`, string(body))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timeout on receiving response")
+	}
+}
+
+func TestDialRuntime_ConfiguredVersion(t *testing.T) {
+	cases := []struct {
+		name            string
+		protocolVersion int
+		hello           []byte
+		expected        byte
+		success         bool
+	}{
+		{name: "not configured", protocolVersion: 0, hello: nil, expected: version, success: true},
+		{name: "version 1", protocolVersion: 1, hello: nil, expected: version, success: true},
+		{name: "version 2", protocolVersion: 2, hello: []byte(`{"versions":[1,2]}`), expected: version2, success: true},
+		{name: "version 2 without HELLO", protocolVersion: 2, hello: nil, success: false},
+		{name: "version 2 unsupported", protocolVersion: 2, hello: []byte(`{"versions":[1]}`), success: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, listener := listenTestSocket(t)
+			defer cleanutil.Close(context.TODO(), listener, path)
+
+			finished := make(chan struct{})
+			go func() {
+				defer close(finished)
+				fd, err := listener.Accept()
+				if err != nil {
+					t.Error("Error when accepting:", err)
+					return
+				}
+				defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+				if c.hello != nil {
+					replyHelloV2(t, fd, c.hello)
+				}
+				// wait until proxy closes the connection.
+				_, _ = io.Copy(ioutil.Discard, fd)
+			}()
+			defer func() { <-finished }()
+
+			conf := &config.Configuration{IPCProtocolVersion: c.protocolVersion, StartupTimeout: 1}
+			conn, err := dialRuntime(context.TODO(), conf, path)
+			if !c.success {
+				if err == nil {
+					cleanutil.Close(context.TODO(), conn, path)
+					t.Error("dial should fail without HELLO frame of version 2")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			defer cleanutil.Close(context.TODO(), conn, path)
+			if conn.version != c.expected {
+				t.Errorf("version should be %d, but %d", c.expected, conn.version)
+			}
+		})
+	}
+}
+
+// TestDialRuntime_SlowHello tests that runtime of version 2 which is slow to reply HELLO frame
+// isn't regarded as the one of version 1.
+func TestDialRuntime_SlowHello(t *testing.T) {
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		time.Sleep(700 * time.Millisecond)
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		header, _ := readFrameV2(t, fd)
+		writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, []byte(`{"status_code":200}`))
+	}()
+
+	conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2}, path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer cleanutil.Close(context.TODO(), conn, path)
+	if conn.version != version2 {
+		t.Fatalf("version should be %d, but %d", version2, conn.version)
+	}
+	req, err := conn.encode(&entity.ContentList{Method: "POST"})
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	receiver, err := conn.send(context.TODO(), req)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	select {
+	case body := <-receiver:
+		if string(body) != `{"status_code":200}` {
+			t.Errorf("response body should be [%s], but [%s]", `{"status_code":200}`, string(body))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timeout on receiving response")
+	}
+}
+
+func TestDialRuntime_Version2OutOfOrder(t *testing.T) {
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	go func() {
+		fd, _ := listener.Accept()
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2],"max_concurrency":2}`))
+
+		var ids []uint32
+		var methods []string
+		for i := 0; i < 2; i++ {
+			header, body := readFrameV2(t, fd)
+			if header.Type != FrameTypeRequest {
+				t.Errorf("frame type should be REQUEST, but %d", header.Type)
+			}
+			var cl entity.ContentList
+			if err := json.Unmarshal(body, &cl); err != nil {
+				t.Error("Error when unmarshaling body:", err)
+			}
+			ids = append(ids, header.RequestID)
+			methods = append(methods, cl.Method)
+		}
+		// answer in reverse order
+		for i := len(ids) - 1; i >= 0; i-- {
+			writeFrameV2(t, fd, FrameTypeResponse, ids[i], []byte(methods[i]))
+		}
+	}()
+
+	conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2}, path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer cleanutil.Close(context.TODO(), conn, path)
+	if conn.version != version2 {
+		t.Errorf("version should be %d, but %d", version2, conn.version)
+	}
+	if conn.MaxConcurrency() != 2 {
+		t.Errorf("max concurrency should be 2, but %d", conn.MaxConcurrency())
+	}
+
+	var receivers []<-chan []byte
+	for _, method := range []string{"POST", "PUT"} {
+		req, err := conn.encode(&entity.ContentList{Method: method})
+		if err != nil {
+			t.Fatal("unexpected error occurred:", err)
+		}
+		receiver, err := conn.send(context.TODO(), req)
+		if err != nil {
+			t.Fatal("unexpected error occurred:", err)
+		}
+		receivers = append(receivers, receiver)
+	}
+	for i, expect := range []string{"POST", "PUT"} {
+		select {
+		case body := <-receivers[i]:
+			if string(body) != expect {
+				t.Errorf("response of request[%d] should be [%s], but [%s]", i, expect, string(body))
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("timeout on receiving response of request[%d]", i)
+		}
+	}
+}
+
+func TestDialRuntime_Version2Broken(t *testing.T) {
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	go func() {
+		fd, _ := listener.Accept()
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		readFrameV2(t, fd)
+		// close connection without response
+		cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+	}()
+
+	conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2}, path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer cleanutil.Close(context.TODO(), conn, path)
+	if conn.MaxConcurrency() != 1 {
+		t.Errorf("max concurrency should be 1, but %d", conn.MaxConcurrency())
+	}
+
+	req, err := conn.encode(&entity.ContentList{Method: "POST"})
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	receiver, err := conn.send(context.TODO(), req)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	select {
+	case body := <-receiver:
+		if len(body) != 0 {
+			t.Errorf("response body should be empty, but [%s]", string(body))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timeout on receiving response")
+	}
+
+	req, err = conn.encode(&entity.ContentList{Method: "POST"})
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	if _, err := conn.send(context.TODO(), req); err == nil {
+		t.Error("send on broken connection should return error")
+	}
+}
+
+func TestDialRuntime_Version2Ready(t *testing.T) {
+	cases := []struct {
+		name      string
+		frameType FrameType
+		body      string
+		model     map[string]interface{}
+		success   bool
+	}{
+		{name: "with model", frameType: FrameTypeReady, body: `{"model":{"name":"resnet50"}}`,
+			model: map[string]interface{}{"name": "resnet50"}, success: true},
+		{name: "without model", frameType: FrameTypeReady, body: "", model: nil, success: true},
+		{name: "not READY", frameType: FrameTypeResponse, body: `{"status_code":200}`, success: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, listener := listenTestSocket(t)
+			defer cleanutil.Close(context.TODO(), listener, path)
+
+			go func() {
+				fd, _ := listener.Accept()
+				defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+				replyHelloV2(t, fd, []byte(`{"versions":[1,2],"sends_ready":true}`))
+				// runtime takes time to load model.
+				time.Sleep(200 * time.Millisecond)
+				writeFrameV2(t, fd, c.frameType, 0, []byte(c.body))
+				// wait until proxy closes the connection.
+				_, _ = io.Copy(ioutil.Discard, fd)
+			}()
+
+			conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2}, path)
+			if !c.success {
+				if err == nil {
+					cleanutil.Close(context.TODO(), conn, path)
+					t.Error("dial should fail without READY frame")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			defer cleanutil.Close(context.TODO(), conn, path)
+			if !reflect.DeepEqual(conn.Model(), c.model) {
+				t.Errorf("model should be %v, but %v", c.model, conn.Model())
+			}
+		})
+	}
+}
+
+func TestDialRuntime_ReadyTimeout(t *testing.T) {
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	// runtime hangs while loading model.
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2],"sends_ready":true}`))
+		// wait until proxy closes the connection.
+		_, _ = io.Copy(ioutil.Discard, fd)
+	}()
+
+	start := time.Now()
+	conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2, StartupTimeout: 1}, path)
+	if err == nil {
+		cleanutil.Close(context.TODO(), conn, path)
+		t.Fatal("dial should fail when READY frame doesn't arrive within startup timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("wait for READY frame should be limited by startup timeout, but %s", elapsed)
+	}
+}
+
+func TestDialRuntime_Version2Streaming(t *testing.T) {
+	cases := []struct {
+		name   string
+		broken bool
+	}{
+		{name: "completed", broken: false},
+		{name: "broken", broken: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, listener := listenTestSocket(t)
+			defer cleanutil.Close(context.TODO(), listener, path)
+
+			go func() {
+				fd, _ := listener.Accept()
+				defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+				replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+				header, _ := readFrameV2(t, fd)
+				writeFrameV2(t, fd, FrameTypeResponse, header.RequestID, []byte(`{"status_code":200,"streaming":true}`))
+				writeFrameV2(t, fd, FrameTypeChunk, header.RequestID, []byte("foo"))
+				writeFrameV2(t, fd, FrameTypeChunk, header.RequestID, []byte("bar"))
+				if !c.broken {
+					writeFrameV2(t, fd, FrameTypeChunk, header.RequestID, []byte{})
+				}
+			}()
+
+			conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2}, path)
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			defer cleanutil.Close(context.TODO(), conn, path)
+
+			req, err := conn.encode(&entity.ContentList{Method: "POST"})
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			receiver, err := conn.send(context.TODO(), req)
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			select {
+			case body := <-receiver:
+				if string(body) != `{"status_code":200,"streaming":true}` {
+					t.Errorf("response body should be streaming one, but [%s]", string(body))
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timeout on receiving response")
+			}
+
+			var actual []byte
+			timeout := time.After(2 * time.Second)
+		loop:
+			for {
+				select {
+				case data, ok := <-req.chunks:
+					if !ok {
+						break loop
+					}
+					actual = append(actual, data...)
+				case <-timeout:
+					t.Fatal("timeout on receiving chunks")
+				}
+			}
+			if string(actual) != "foobar" {
+				t.Errorf("chunks should be [foobar], but [%s]", string(actual))
+			}
+			if c.broken && req.streamErr == nil {
+				t.Error("streamErr should be set when the connection is broken")
+			}
+			if !c.broken && req.streamErr != nil {
+				t.Errorf("streamErr should be nil, but %v", req.streamErr)
+			}
+		})
+	}
+}
+
+func TestDialRuntime_Version2StreamingSlowConsumer(t *testing.T) {
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	const chunks = 1000
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		slow, _ := readFrameV2(t, fd)
+		other, _ := readFrameV2(t, fd)
+		writeFrameV2(t, fd, FrameTypeResponse, slow.RequestID, []byte(`{"status_code":200,"streaming":true}`))
+		for i := 0; i < chunks; i++ {
+			writeFrameV2(t, fd, FrameTypeChunk, slow.RequestID, []byte("foo"))
+		}
+		writeFrameV2(t, fd, FrameTypeChunk, slow.RequestID, []byte{})
+		writeFrameV2(t, fd, FrameTypeResponse, other.RequestID, []byte(`{"status_code":200}`))
+		_, _ = io.Copy(ioutil.Discard, fd)
+	}()
+
+	conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2}, path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer cleanutil.Close(context.TODO(), conn, path)
+
+	slowReq, _ := conn.encode(&entity.ContentList{Method: "POST"})
+	if _, err := conn.send(context.TODO(), slowReq); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	otherReq, _ := conn.encode(&entity.ContentList{Method: "POST"})
+	receiver, err := conn.send(context.TODO(), otherReq)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	// many chunks of slowReq are buffered, without blocking the response of otherReq.
+	select {
+	case <-receiver:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on receiving response of other request")
+	}
+	count := 0
+	for range slowReq.chunks {
+		count++
+	}
+	if count != chunks {
+		t.Errorf("chunks should be %d, but %d", chunks, count)
+	}
+	if slowReq.streamErr != nil {
+		t.Errorf("streamErr should be nil, but %v", slowReq.streamErr)
+	}
+}
+
+func TestDialRuntime_Version2StreamingOverflow(t *testing.T) {
+	defer func(max int) { streamBufferMaxBytes = max }(streamBufferMaxBytes)
+	const buffered = 16
+	streamBufferMaxBytes = buffered * len("foo")
+
+	path, listener := listenTestSocket(t)
+	defer cleanutil.Close(context.TODO(), listener, path)
+
+	canceled := make(chan uint32, 1)
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer cleanutil.Close(context.TODO(), fd, "Listener#Accept")
+		replyHelloV2(t, fd, []byte(`{"versions":[1,2]}`))
+		slow, _ := readFrameV2(t, fd)
+		other, _ := readFrameV2(t, fd)
+		writeFrameV2(t, fd, FrameTypeResponse, slow.RequestID, []byte(`{"status_code":200,"streaming":true}`))
+		for i := 0; i <= buffered; i++ {
+			writeFrameV2(t, fd, FrameTypeChunk, slow.RequestID, []byte("foo"))
+		}
+		writeFrameV2(t, fd, FrameTypeResponse, other.RequestID, []byte(`{"status_code":200}`))
+		header, _ := readFrameV2(t, fd)
+		if header.Type == FrameTypeCancel {
+			canceled <- header.RequestID
+		}
+	}()
+
+	conn, err := dialRuntime(context.TODO(), &config.Configuration{IPCProtocolVersion: 2}, path)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer cleanutil.Close(context.TODO(), conn, path)
+
+	slowReq, _ := conn.encode(&entity.ContentList{Method: "POST"})
+	if _, err := conn.send(context.TODO(), slowReq); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	otherReq, _ := conn.encode(&entity.ContentList{Method: "POST"})
+	receiver, err := conn.send(context.TODO(), otherReq)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	// chunks of slowReq are not consumed, but they should not block the response of otherReq.
+	select {
+	case body := <-receiver:
+		if string(body) != `{"status_code":200}` {
+			t.Errorf("response body should be [{\"status_code\":200}], but [%s]", string(body))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on receiving response of other request")
+	}
+	select {
+	case id := <-canceled:
+		if id != slowReq.id {
+			t.Errorf("CANCEL frame should be sent for request[%d], but [%d]", slowReq.id, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout on receiving CANCEL frame")
+	}
+
+	count := 0
+	for range slowReq.chunks {
+		count++
+	}
+	if count != buffered {
+		t.Errorf("buffered chunks should be %d, but %d", buffered, count)
+	}
+	if slowReq.streamErr != errStreamOverflow {
+		t.Errorf("streamErr should be errStreamOverflow, but %v", slowReq.streamErr)
+	}
+}
@@ -0,0 +1,621 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/convert"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+	"github.com/abeja-inc/abeja-platform-model-proxy/util/tracing"
+	proxyversion "github.com/abeja-inc/abeja-platform-model-proxy/version"
+)
+
+// === Open Inference Protocol v2
+//
+// When `v2_model_name` is set, the model is also served on the REST endpoints of
+// Open Inference Protocol v2 (a.k.a. KServe v2), so that standard inference clients
+// and gateways can talk to it without a custom adapter.
+//
+//	GET  /v2/health/live
+//	GET  /v2/health/ready
+//	GET  /v2/models/{name}[/versions/{version}]
+//	GET  /v2/models/{name}[/versions/{version}]/ready
+//	POST /v2/models/{name}[/versions/{version}]/infer
+//
+// The inference request is translated into the usual JSON request to the runtime,
+// whose body is an object of input tensors reshaped by their shape:
+//
+//	{"inputs": [{"name": "x", "shape": [2, 2], "datatype": "INT64", "data": [1, 2, 3, 4]}]}
+//	-> {"x": [[1, 2], [3, 4]]}
+//
+// and `parameters` of the request are passed as metadata of the content.
+// The JSON response of the runtime is translated into output tensors in the same way,
+// each member of the object being one tensor. Values which aren't tensors, like objects,
+// are sent as BYTES tensor of their JSON. The runtime can also return `outputs` of
+// the protocol as it is.
+
+// v2Tensor is the tensor of Open Inference Protocol v2.
+type v2Tensor struct {
+	Name       string                 `json:"name"`
+	Shape      []int64                `json:"shape"`
+	Datatype   string                 `json:"datatype"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Data       []interface{}          `json:"data"`
+}
+
+// v2RequestedOutput is the output which the client requests.
+type v2RequestedOutput struct {
+	Name string `json:"name"`
+}
+
+// v2InferenceRequest is the body of inference request.
+type v2InferenceRequest struct {
+	ID         string                 `json:"id,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Inputs     []*v2Tensor            `json:"inputs"`
+	Outputs    []*v2RequestedOutput   `json:"outputs,omitempty"`
+}
+
+// v2InferenceResponse is the body of inference response.
+type v2InferenceResponse struct {
+	ModelName    string      `json:"model_name"`
+	ModelVersion string      `json:"model_version,omitempty"`
+	ID           string      `json:"id,omitempty"`
+	Outputs      []*v2Tensor `json:"outputs"`
+}
+
+// v2ModelMetadata is the body of model metadata response.
+// Inputs and outputs are empty, because the proxy doesn't know them.
+type v2ModelMetadata struct {
+	Name     string      `json:"name"`
+	Versions []string    `json:"versions,omitempty"`
+	Platform string      `json:"platform"`
+	Inputs   []*v2Tensor `json:"inputs"`
+	Outputs  []*v2Tensor `json:"outputs"`
+}
+
+var v2Datatypes = map[string]bool{
+	"BOOL": true, "BYTES": true,
+	"UINT8": true, "UINT16": true, "UINT32": true, "UINT64": true,
+	"INT8": true, "INT16": true, "INT32": true, "INT64": true,
+	"FP16": true, "FP32": true, "FP64": true,
+}
+
+// registerV2Handlers adds HandlerFuncs of Open Inference Protocol v2 to mux.
+func registerV2Handlers(
+	mux tracing.Mux,
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue,
+	conf *config.Configuration) {
+
+	mux.HandleFunc("/v2", getV2ServerMetadataHandleFunc())
+	mux.HandleFunc("/v2/health/live", getV2HealthHandleFunc(func() bool { return true }, "live"))
+	mux.HandleFunc("/v2/health/ready", getV2HealthHandleFunc(runtimes.IsReady, "ready"))
+	mux.HandleFunc("/v2/models/", getV2ModelHandleFunc(runtimes, queue, conf))
+}
+
+func getV2ServerMetadataHandleFunc() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		outputV2Response(r.Context(), w, http.StatusOK, map[string]interface{}{
+			"name":       "abeja-platform-model-proxy",
+			"version":    proxyversion.Version,
+			"extensions": []string{},
+		})
+	}
+}
+
+// getV2HealthHandleFunc returns HandlerFunc which responds 200 when healthy returns true, otherwise 503.
+func getV2HealthHandleFunc(healthy func() bool, key string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok := healthy()
+		statusCode := http.StatusOK
+		if !ok {
+			statusCode = http.StatusServiceUnavailable
+		}
+		outputV2Response(r.Context(), w, statusCode, map[string]bool{key: ok})
+	}
+}
+
+// getV2ModelHandleFunc returns HandlerFunc for the model metadata, readiness and inference,
+// which are routed by the path under `/v2/models/`.
+func getV2ModelHandleFunc(
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue,
+	conf *config.Configuration) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/models/"), "/")
+		name := parts[0]
+		parts = parts[1:]
+		if len(parts) >= 2 && parts[0] == "versions" {
+			if conf.ModelVersion != "" && parts[1] != conf.ModelVersion {
+				outputV2Error(ctx, w, http.StatusNotFound,
+					fmt.Sprintf("version %s of model %s is not found", parts[1], name))
+				return
+			}
+			parts = parts[2:]
+		}
+		if name != conf.V2ModelName {
+			outputV2Error(ctx, w, http.StatusNotFound, fmt.Sprintf("model %s is not found", name))
+			return
+		}
+
+		if len(parts) > 1 {
+			outputV2Error(ctx, w, http.StatusNotFound, fmt.Sprintf("%s is not found", r.URL.Path))
+			return
+		}
+		action := ""
+		if len(parts) == 1 {
+			action = parts[0]
+		}
+		switch action {
+		case "":
+			if r.Method != http.MethodGet {
+				outputV2Error(ctx, w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			metadata := v2ModelMetadata{
+				Name:     name,
+				Platform: "abeja",
+				Inputs:   []*v2Tensor{},
+				Outputs:  []*v2Tensor{},
+			}
+			if conf.ModelVersion != "" {
+				metadata.Versions = []string{conf.ModelVersion}
+			}
+			outputV2Response(ctx, w, http.StatusOK, metadata)
+		case "ready":
+			if r.Method != http.MethodGet {
+				outputV2Error(ctx, w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			getV2HealthHandleFunc(runtimes.IsReady, "ready")(w, r)
+		case "infer":
+			if r.Method != http.MethodPost {
+				outputV2Error(ctx, w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			handleV2Infer(w, r, runtimes, queue, conf, name)
+		default:
+			outputV2Error(ctx, w, http.StatusNotFound, fmt.Sprintf("%s is not found", r.URL.Path))
+		}
+	}
+}
+
+// handleV2Infer translates the inference request into the request to the runtime,
+// and translates its response into the inference response.
+func handleV2Infer(
+	w http.ResponseWriter,
+	r *http.Request,
+	runtimes *subprocess.RuntimePool,
+	queue *RequestQueue,
+	conf *config.Configuration,
+	name string) {
+
+	ctx := r.Context()
+	accessLog := AccessLog{
+		start: time.Now(),
+	}
+	defer func() {
+		accessLog.log(ctx, r)
+	}()
+	if v := r.Header.Get("x-abeja-request-id"); v != "" {
+		ctx = context.WithValue(ctx, log.KeyRequestID, v) //nolint // SA1029: should not use built-in type string as key for value; define your own type to avoid collisions
+	}
+
+	timeout, err := getRequestTimeout(r, conf)
+	if err != nil {
+		outputV2Error(ctx, w, http.StatusBadRequest, err.Error())
+		accessLog.status = http.StatusBadRequest
+		return
+	}
+	if !runtimes.IsReady() {
+		outputV2Error(ctx, w, http.StatusServiceUnavailable, "service unavailable")
+		accessLog.status = http.StatusServiceUnavailable
+		return
+	}
+	// admit the request before its tensors are written to disk.
+	room, err := queue.reserve()
+	if err != nil {
+		statusCode, message := rejection(ctx, w, queue, err)
+		outputV2Error(ctx, w, statusCode, message)
+		accessLog.status = statusCode
+		return
+	}
+	defer room.cancel()
+
+	var req v2InferenceRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		outputV2Error(ctx, w, http.StatusBadRequest, fmt.Sprintf("invalid inference request: %s", err.Error()))
+		accessLog.status = http.StatusBadRequest
+		return
+	}
+	cl, err := toV2ContentList(ctx, r, conf, &req)
+	if err != nil {
+		var statusCode = http.StatusServiceUnavailable
+		if convertError, ok := err.(*convert.ConverterError); ok {
+			statusCode = convertError.StatusCode
+		}
+		outputV2Error(ctx, w, statusCode, err.Error())
+		accessLog.status = statusCode
+		return
+	}
+	cl.Timeout = timeout
+
+	res, err := dispatch(room, cl)
+	if err != nil {
+		statusCode, message := rejection(ctx, w, queue, err)
+		outputV2Error(ctx, w, statusCode, message)
+		accessLog.status = statusCode
+		deleteTempFiles(ctx, cl, nil)
+		return
+	}
+	deleteTempFiles(ctx, cl, nil)
+
+	statusCode, headers, body, err := readWholeResponse(ctx, res)
+	if err != nil {
+		var statusCode = http.StatusServiceUnavailable
+		if convertError, ok := err.(*convert.ConverterError); ok {
+			statusCode = convertError.StatusCode
+		}
+		outputV2Error(ctx, w, statusCode, err.Error())
+		accessLog.status = statusCode
+		return
+	}
+	for key, value := range headers {
+		if key != convert.KeyContentType && key != convert.KeyContentLength {
+			w.Header().Set(key, value)
+		}
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		outputV2Error(ctx, w, statusCode, v2ErrorMessage(body))
+		accessLog.status = statusCode
+		return
+	}
+
+	result := &v2InferenceResponse{ModelName: name, ModelVersion: conf.ModelVersion, ID: req.ID}
+	result.Outputs, err = toV2Outputs(headers[convert.KeyContentType], body, req.Outputs)
+	if err != nil {
+		log.Warningf(ctx, "failed to translate response of model: "+log.ErrorFormat, err)
+		outputV2Error(ctx, w, http.StatusInternalServerError, err.Error())
+		accessLog.status = http.StatusInternalServerError
+		return
+	}
+	outputV2Response(ctx, w, http.StatusOK, result)
+	accessLog.status = http.StatusOK
+}
+
+// toV2ContentList returns ContentList whose body is the object of input tensors.
+func toV2ContentList(
+	ctx context.Context,
+	r *http.Request,
+	conf *config.Configuration,
+	req *v2InferenceRequest) (*entity.ContentList, error) {
+
+	if len(req.Inputs) == 0 {
+		return nil, v2BadRequest("inputs are required")
+	}
+	inputs := make(map[string]interface{}, len(req.Inputs))
+	for _, input := range req.Inputs {
+		if input.Name == "" {
+			return nil, v2BadRequest("name of input is required")
+		}
+		if _, ok := inputs[input.Name]; ok {
+			return nil, v2BadRequest(fmt.Sprintf("input %s is duplicated", input.Name))
+		}
+		value, err := fromV2Tensor(input)
+		if err != nil {
+			return nil, err
+		}
+		inputs[input.Name] = value
+	}
+	body, err := json.Marshal(inputs)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal inputs: %w", err)
+	}
+	tmpFilePath, err := convert.ToFileFromBody(string(body), util.GetExtension(ctx, "application/json"), conf.RequestedDataDir)
+	if err != nil {
+		return nil, errors.Errorf(": %w", err)
+	}
+
+	var headers []*entity.Header
+	for key, value := range r.Header {
+		if strings.ToLower(key) == "content-length" {
+			continue
+		}
+		headers = append(headers, &entity.Header{Key: strings.ToLower(key), Values: value})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Key < headers[j].Key })
+	cl := &entity.ContentList{
+		Method:      http.MethodPost,
+		ContentType: "application/json",
+		Headers:     headers,
+		Contents: []*entity.Content{
+			{
+				Path:     &tmpFilePath,
+				Metadata: req.Parameters,
+			},
+		},
+		Ctx: ctx,
+	}
+	convert.SetRequestInfo(cl, r)
+	return cl, nil
+}
+
+// fromV2Tensor returns data of the tensor reshaped by its shape.
+// The data can be given in flat or nested array.
+func fromV2Tensor(t *v2Tensor) (interface{}, error) {
+	if !v2Datatypes[t.Datatype] {
+		return nil, v2BadRequest(fmt.Sprintf("datatype %s of input %s is not supported", t.Datatype, t.Name))
+	}
+	var flat []interface{}
+	flatten(t.Data, &flat)
+	size, ok := v2TensorSize(t.Shape, len(flat))
+	if !ok {
+		return nil, v2BadRequest(fmt.Sprintf("shape %v of input %s is invalid", t.Shape, t.Name))
+	}
+	if size != int64(len(flat)) {
+		return nil, v2BadRequest(fmt.Sprintf(
+			"input %s has %d elements, but its shape %v requires %d", t.Name, len(flat), t.Shape, size))
+	}
+	for _, v := range flat {
+		if !isV2Element(t.Datatype, v) {
+			return nil, v2BadRequest(fmt.Sprintf("input %s has element %v not of %s", t.Name, v, t.Datatype))
+		}
+	}
+	value, _ := reshape(flat, t.Shape)
+	return value, nil
+}
+
+// v2TensorSize returns the number of elements of shape.
+// It returns false if a dimension is negative or the number overflows. It also returns false
+// if reshape would make more arrays than the elements, like [1099511627776,0] with no elements,
+// so that the shape can't make the proxy allocate arrays out of proportion to the request.
+func v2TensorSize(shape []int64, elements int) (int64, bool) {
+	size := int64(1)
+	for i, dim := range shape {
+		if dim < 0 || (dim > 0 && size > math.MaxInt64/dim) {
+			return 0, false
+		}
+		size *= dim
+		if i < len(shape)-1 && size > int64(elements) {
+			return 0, false
+		}
+	}
+	return size, true
+}
+
+func flatten(v interface{}, flat *[]interface{}) {
+	if array, ok := v.([]interface{}); ok {
+		for _, e := range array {
+			flatten(e, flat)
+		}
+		return
+	}
+	*flat = append(*flat, v)
+}
+
+// reshape returns the nested array of shape from flat, and the rest of flat.
+func reshape(flat []interface{}, shape []int64) (interface{}, []interface{}) {
+	if len(shape) == 0 {
+		return flat[0], flat[1:]
+	}
+	array := make([]interface{}, shape[0])
+	for i := range array {
+		array[i], flat = reshape(flat, shape[1:])
+	}
+	return array, flat
+}
+
+func isV2Element(datatype string, v interface{}) bool {
+	switch datatype {
+	case "BOOL":
+		_, ok := v.(bool)
+		return ok
+	case "BYTES":
+		_, ok := v.(string)
+		return ok
+	default:
+		_, ok := v.(json.Number)
+		return ok
+	}
+}
+
+// toV2Outputs translates the body of response into output tensors.
+// When requested is not empty, only the outputs requested are returned.
+func toV2Outputs(contentType string, body []byte, requested []*v2RequestedOutput) ([]*v2Tensor, error) {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	var outputs []*v2Tensor
+	switch {
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, errors.Errorf("response of model is not valid JSON: %w", err)
+		}
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			outputs = []*v2Tensor{toV2Tensor("output", value)}
+		} else if raw, ok := obj["outputs"].([]interface{}); ok && len(obj) == 1 {
+			// the runtime returned outputs of the protocol.
+			data, _ := json.Marshal(raw)
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			if err := decoder.Decode(&outputs); err != nil {
+				return nil, errors.Errorf("outputs in response of model are invalid: %w", err)
+			}
+		} else {
+			keys := make([]string, 0, len(obj))
+			for key := range obj {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				outputs = append(outputs, toV2Tensor(key, obj[key]))
+			}
+		}
+	case strings.HasPrefix(mt, "text/"):
+		outputs = []*v2Tensor{{Name: "output", Shape: []int64{1}, Datatype: "BYTES", Data: []interface{}{string(body)}}}
+	default:
+		return nil, errors.Errorf("Content-Type [%s] of response of model can't be translated into tensors", contentType)
+	}
+
+	if len(requested) == 0 {
+		return outputs, nil
+	}
+	byName := make(map[string]*v2Tensor, len(outputs))
+	for _, output := range outputs {
+		byName[output.Name] = output
+	}
+	selected := make([]*v2Tensor, 0, len(requested))
+	for _, r := range requested {
+		output, ok := byName[r.Name]
+		if !ok {
+			return nil, errors.Errorf("output %s is not in response of model", r.Name)
+		}
+		selected = append(selected, output)
+	}
+	return selected, nil
+}
+
+// toV2Tensor returns the tensor of value, which is BYTES of JSON when value isn't a tensor.
+func toV2Tensor(name string, value interface{}) *v2Tensor {
+	shape, ok := shapeOf(value)
+	if ok {
+		if len(shape) == 0 {
+			// scalar is sent as the tensor of one element.
+			shape = []int64{1}
+		}
+		var flat []interface{}
+		flatten(value, &flat)
+		if datatype, ok := datatypeOf(flat); ok {
+			return &v2Tensor{Name: name, Shape: shape, Datatype: datatype, Data: flat}
+		}
+	}
+	data, _ := json.Marshal(value)
+	return &v2Tensor{Name: name, Shape: []int64{1}, Datatype: "BYTES", Data: []interface{}{string(data)}}
+}
+
+// shapeOf returns the shape of value, or false if it is ragged.
+func shapeOf(value interface{}) ([]int64, bool) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return []int64{}, true
+	}
+	if len(array) == 0 {
+		return []int64{0}, true
+	}
+	inner, ok := shapeOf(array[0])
+	if !ok {
+		return nil, false
+	}
+	for _, e := range array[1:] {
+		s, ok := shapeOf(e)
+		if !ok || !equalShape(s, inner) {
+			return nil, false
+		}
+	}
+	return append([]int64{int64(len(array))}, inner...), true
+}
+
+func equalShape(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// datatypeOf returns the datatype of elements, or false if they are mixed or not scalar.
+// Numbers are INT64 when all of them are integers, otherwise FP64.
+func datatypeOf(flat []interface{}) (string, bool) {
+	datatype := ""
+	for _, v := range flat {
+		var t string
+		switch n := v.(type) {
+		case bool:
+			t = "BOOL"
+		case string:
+			t = "BYTES"
+		case json.Number:
+			t = "INT64"
+			if _, err := n.Int64(); err != nil {
+				t = "FP64"
+			}
+		default:
+			return "", false
+		}
+		switch {
+		case datatype == "" || datatype == t:
+			datatype = t
+		case datatype == "INT64" && t == "FP64", datatype == "FP64" && t == "INT64":
+			datatype = "FP64"
+		default:
+			return "", false
+		}
+	}
+	if datatype == "" {
+		datatype = "FP64"
+	}
+	return datatype, true
+}
+
+// v2ErrorMessage returns the message in error response of model.
+func v2ErrorMessage(body []byte) string {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(body, &obj); err == nil {
+		for _, key := range []string{"error", "message", "status"} {
+			if msg, ok := obj[key].(string); ok {
+				return msg
+			}
+		}
+	}
+	return string(body)
+}
+
+func v2BadRequest(msg string) error {
+	return &convert.ConverterError{
+		Msg:        msg,
+		StatusCode: http.StatusBadRequest,
+	}
+}
+
+func outputV2Response(ctx context.Context, w http.ResponseWriter, statusCode int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf(ctx, "failed to marshal response: "+log.ErrorFormat, err)
+		statusCode = http.StatusInternalServerError
+		data = []byte("{\"error\":\"unexpected error\"}")
+	}
+	w.Header().Set(convert.KeyContentType, "application/json")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(data); err != nil {
+		log.Warningf(ctx, "Error when writing response body: "+log.ErrorFormat, err)
+	}
+}
+
+func outputV2Error(ctx context.Context, w http.ResponseWriter, statusCode int, message string) {
+	outputV2Response(ctx, w, statusCode, map[string]string{"error": message})
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+	"github.com/abeja-inc/abeja-platform-model-proxy/entity"
+	"github.com/abeja-inc/abeja-platform-model-proxy/subprocess"
+)
+
+func newV2Server(t *testing.T, runtime *subprocess.Runtime) (*HTTPServer, *RequestQueue) {
+	t.Helper()
+	conf := config.NewConfiguration()
+	conf.Port = config.DefaultHTTPListenPort
+	conf.ModelVersion = "1.0.0"
+	conf.V2ModelName = "cat"
+	queue := NewRequestQueue(&conf)
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
+	if err != nil {
+		queue.Close()
+		t.Fatal("unexpected error occurred", err)
+	}
+	return server, queue
+}
+
+func TestV2Health(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusPreparing,
+	}
+	server, queue := newV2Server(t, runtime)
+	defer queue.Close()
+
+	cases := []struct {
+		name          string
+		path          string
+		runtimeStatus subprocess.RuntimeStatus
+		httpStatus    int
+		resBody       string
+	}{
+		{
+			name:          "live",
+			path:          "/v2/health/live",
+			runtimeStatus: subprocess.RuntimeStatusPreparing,
+			httpStatus:    http.StatusOK,
+			resBody:       "{\"live\":true}",
+		}, {
+			name:          "not ready",
+			path:          "/v2/health/ready",
+			runtimeStatus: subprocess.RuntimeStatusPreparing,
+			httpStatus:    http.StatusServiceUnavailable,
+			resBody:       "{\"ready\":false}",
+		}, {
+			name:          "ready",
+			path:          "/v2/health/ready",
+			runtimeStatus: subprocess.RuntimeStatusRunning,
+			httpStatus:    http.StatusOK,
+			resBody:       "{\"ready\":true}",
+		}, {
+			name:          "model ready",
+			path:          "/v2/models/cat/versions/1.0.0/ready",
+			runtimeStatus: subprocess.RuntimeStatusRunning,
+			httpStatus:    http.StatusOK,
+			resBody:       "{\"ready\":true}",
+		}, {
+			name:          "model metadata",
+			path:          "/v2/models/cat",
+			runtimeStatus: subprocess.RuntimeStatusRunning,
+			httpStatus:    http.StatusOK,
+			resBody:       "{\"name\":\"cat\",\"versions\":[\"1.0.0\"],\"platform\":\"abeja\",\"inputs\":[],\"outputs\":[]}",
+		}, {
+			name:          "unknown model",
+			path:          "/v2/models/dog",
+			runtimeStatus: subprocess.RuntimeStatusRunning,
+			httpStatus:    http.StatusNotFound,
+			resBody:       "{\"error\":\"model dog is not found\"}",
+		}, {
+			name:          "unknown version",
+			path:          "/v2/models/cat/versions/2.0.0",
+			runtimeStatus: subprocess.RuntimeStatusRunning,
+			httpStatus:    http.StatusNotFound,
+			resBody:       "{\"error\":\"version 2.0.0 of model cat is not found\"}",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			runtime.Status = c.runtimeStatus
+			req := httptest.NewRequest("GET", c.path, nil)
+			rec := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(rec, req)
+			if c.httpStatus != rec.Code {
+				t.Errorf("http status should be %d, but %d", c.httpStatus, rec.Code)
+			}
+			if c.resBody != rec.Body.String() {
+				t.Errorf("response body should be [%s], but [%s]", c.resBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestV2Infer(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusRunning,
+	}
+	server, queue := newV2Server(t, runtime)
+	defer queue.Close()
+
+	cases := []struct {
+		name          string
+		reqBody       string
+		runtimeBody   string // expected body of request to runtime, empty if not sent
+		resStatusCode int
+		resBody       string
+		httpStatus    int
+		outputs       string
+	}{
+		{
+			name: "tensors",
+			reqBody: "{\"id\":\"42\",\"parameters\":{\"threshold\":0.5},\"inputs\":[" +
+				"{\"name\":\"x\",\"shape\":[2,2],\"datatype\":\"INT64\",\"data\":[1,2,3,4]}," +
+				"{\"name\":\"s\",\"shape\":[1],\"datatype\":\"BYTES\",\"data\":[\"foo\"]}]}",
+			runtimeBody:   "{\"s\":[\"foo\"],\"x\":[[1,2],[3,4]]}",
+			resStatusCode: http.StatusOK,
+			resBody:       "{\"y\":[[0.5,1],[2,3]],\"label\":\"cat\",\"detail\":{\"score\":1}}",
+			httpStatus:    http.StatusOK,
+			outputs: "{\"model_name\":\"cat\",\"model_version\":\"1.0.0\",\"id\":\"42\",\"outputs\":[" +
+				"{\"name\":\"detail\",\"shape\":[1],\"datatype\":\"BYTES\",\"data\":[\"{\\\"score\\\":1}\"]}," +
+				"{\"name\":\"label\",\"shape\":[1],\"datatype\":\"BYTES\",\"data\":[\"cat\"]}," +
+				"{\"name\":\"y\",\"shape\":[2,2],\"datatype\":\"FP64\",\"data\":[0.5,1,2,3]}]}",
+		}, {
+			name: "requested outputs",
+			reqBody: "{\"inputs\":[{\"name\":\"x\",\"shape\":[3],\"datatype\":\"FP32\",\"data\":[[1.5],[2],[3]]}]," +
+				"\"outputs\":[{\"name\":\"y\"}]}",
+			runtimeBody:   "{\"x\":[1.5,2,3]}",
+			resStatusCode: http.StatusOK,
+			resBody:       "{\"y\":[true,false],\"z\":1}",
+			httpStatus:    http.StatusOK,
+			outputs: "{\"model_name\":\"cat\",\"model_version\":\"1.0.0\",\"outputs\":[" +
+				"{\"name\":\"y\",\"shape\":[2],\"datatype\":\"BOOL\",\"data\":[true,false]}]}",
+		}, {
+			name:          "outputs of protocol",
+			reqBody:       "{\"inputs\":[{\"name\":\"x\",\"shape\":[],\"datatype\":\"BOOL\",\"data\":[true]}]}",
+			runtimeBody:   "{\"x\":true}",
+			resStatusCode: http.StatusOK,
+			resBody:       "{\"outputs\":[{\"name\":\"y\",\"shape\":[1],\"datatype\":\"FP16\",\"data\":[0.1]}]}",
+			httpStatus:    http.StatusOK,
+			outputs: "{\"model_name\":\"cat\",\"model_version\":\"1.0.0\",\"outputs\":[" +
+				"{\"name\":\"y\",\"shape\":[1],\"datatype\":\"FP16\",\"data\":[0.1]}]}",
+		}, {
+			name:          "error of model",
+			reqBody:       "{\"inputs\":[{\"name\":\"x\",\"shape\":[1],\"datatype\":\"INT8\",\"data\":[1]}]}",
+			runtimeBody:   "{\"x\":[1]}",
+			resStatusCode: http.StatusBadRequest,
+			resBody:       "{\"message\":\"invalid x\"}",
+			httpStatus:    http.StatusBadRequest,
+			outputs:       "{\"error\":\"invalid x\"}",
+		}, {
+			name:       "shape mismatch",
+			reqBody:    "{\"inputs\":[{\"name\":\"x\",\"shape\":[2,2],\"datatype\":\"INT64\",\"data\":[1,2,3]}]}",
+			httpStatus: http.StatusBadRequest,
+			outputs:    "{\"error\":\"input x has 3 elements, but its shape [2 2] requires 4\"}",
+		}, {
+			name:       "zero dimension after huge one",
+			reqBody:    "{\"inputs\":[{\"name\":\"x\",\"shape\":[1099511627776,0],\"datatype\":\"INT64\",\"data\":[]}]}",
+			httpStatus: http.StatusBadRequest,
+			outputs:    "{\"error\":\"shape [1099511627776 0] of input x is invalid\"}",
+		}, {
+			name:       "overflowed shape",
+			reqBody:    "{\"inputs\":[{\"name\":\"x\",\"shape\":[4294967296,4294967296],\"datatype\":\"INT64\",\"data\":[]}]}",
+			httpStatus: http.StatusBadRequest,
+			outputs:    "{\"error\":\"shape [4294967296 4294967296] of input x is invalid\"}",
+		}, {
+			name:          "empty tensor",
+			reqBody:       "{\"inputs\":[{\"name\":\"x\",\"shape\":[0,3],\"datatype\":\"INT64\",\"data\":[]}]}",
+			runtimeBody:   "{\"x\":[]}",
+			resStatusCode: http.StatusOK,
+			resBody:       "{\"y\":1}",
+			httpStatus:    http.StatusOK,
+			outputs: "{\"model_name\":\"cat\",\"model_version\":\"1.0.0\",\"outputs\":[" +
+				"{\"name\":\"y\",\"shape\":[1],\"datatype\":\"INT64\",\"data\":[1]}]}",
+		}, {
+			name:       "datatype mismatch",
+			reqBody:    "{\"inputs\":[{\"name\":\"x\",\"shape\":[1],\"datatype\":\"INT64\",\"data\":[\"1\"]}]}",
+			httpStatus: http.StatusBadRequest,
+			outputs:    "{\"error\":\"input x has element 1 not of INT64\"}",
+		}, {
+			name:       "no inputs",
+			reqBody:    "{\"inputs\":[]}",
+			httpStatus: http.StatusBadRequest,
+			outputs:    "{\"error\":\"inputs are required\"}",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if c.runtimeBody == "" {
+					return
+				}
+				cl := <-queue.Out()
+				if cl.Method != http.MethodPost || cl.ContentType != "application/json" {
+					t.Errorf("request should be POST of application/json, but %s of %s", cl.Method, cl.ContentType)
+				}
+				if !strings.HasPrefix(cl.URLPath, "/v2/models/") {
+					t.Errorf("path of request should be passed, but [%s]", cl.URLPath)
+				}
+				body, err := ioutil.ReadFile(*cl.Contents[0].Path)
+				if err != nil {
+					t.Error("unexpected error occurred", err)
+				}
+				if c.runtimeBody != string(body) {
+					t.Errorf("request body should be [%s], but [%s]", c.runtimeBody, string(body))
+				}
+				if c.name == "tensors" {
+					expected := map[string]interface{}{"threshold": json.Number("0.5")}
+					if !reflect.DeepEqual(expected, cl.Contents[0].Metadata) {
+						t.Errorf("metadata should be %v, but %v", expected, cl.Contents[0].Metadata)
+					}
+				}
+
+				f, err := ioutil.TempFile("", "")
+				if err != nil {
+					t.Error("unexpected error occurred", err)
+				}
+				filePath := f.Name()
+				if _, err := f.WriteString(c.resBody); err != nil {
+					t.Error("unexpected error occurred", err)
+				}
+				f.Close()
+				contentType := "application/json"
+				statusCode := c.resStatusCode
+				cl.ResponseChan <- entity.Response{
+					ContentType: &contentType,
+					Path:        &filePath,
+					StatusCode:  &statusCode,
+				}
+			}()
+
+			req := httptest.NewRequest("POST", "/v2/models/cat/infer", strings.NewReader(c.reqBody))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(rec, req)
+			<-done
+
+			if c.httpStatus != rec.Code {
+				t.Errorf("http status should be %d, but %d", c.httpStatus, rec.Code)
+			}
+			if c.outputs != rec.Body.String() {
+				t.Errorf("response body should be [%s], but [%s]", c.outputs, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestV2Disabled(t *testing.T) {
+	runtime := &subprocess.Runtime{
+		Cmd:    nil,
+		Status: subprocess.RuntimeStatusPreparing,
+	}
+	conf := config.NewConfiguration()
+	conf.Port = config.DefaultHTTPListenPort
+	queue := NewRequestQueue(&conf)
+	defer queue.Close()
+	server, err := CreateHTTPServer(newRuntimePool(t, runtime), queue, &conf)
+	if err != nil {
+		t.Fatal("unexpected error occurred", err)
+	}
+
+	// the request is handled as the request to the model, which isn't ready.
+	req := httptest.NewRequest("GET", "/v2/health/live", nil)
+	rec := httptest.NewRecorder()
+	server.Server.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("http status should be %d, but %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 	"time"
 
@@ -32,12 +33,34 @@ var allowedExitStatusMap = map[string][]int{
 	"python36": []int{120},
 }
 
+// protocolVersion returns the version of IPC protocol which runtime speaks.
+// It is version 1 unless it is configured, so that runtimes which only speak version 1 keep working.
+func protocolVersion(conf *config.Configuration) int {
+	if conf.IPCProtocolVersion != 0 {
+		return conf.IPCProtocolVersion
+	}
+	return 1
+}
+
 // Runtime represents process information(exec.Cmd) of runtime-process
 // and status of runtime-process.
 type Runtime struct {
 	Cmd         *exec.Cmd
 	Status      RuntimeStatus
 	RuntimeType string
+
+	mu      sync.RWMutex
+	phase   StartupPhase
+	model   map[string]interface{}
+	readyAt time.Time
+	exited  *exitResult // result of Cmd.Wait, recorded by the goroutine waiting the process
+}
+
+// exitResult is what Cmd.Wait told about the finished process.
+type exitResult struct {
+	exitCode int // -1 if the process didn't exit normally, e.g. killed by signal
+	success  bool
+	state    string
 }
 
 // RuntimeStatus represents status of runtime.
@@ -51,6 +74,31 @@ const (
 	RuntimeStatusExitedWithFailure
 )
 
+// StartupPhase represents how far runtime has started.
+type StartupPhase int
+
+// StartupPhases of runtime.
+const (
+	// StartupPhaseStarting means the process started, but the proxy hasn't connected to it yet.
+	StartupPhaseStarting StartupPhase = iota
+	// StartupPhaseLoading means the proxy connected to runtime, and runtime is loading until it gets ready.
+	StartupPhaseLoading
+	// StartupPhaseReady means runtime told that it's ready for requests.
+	StartupPhaseReady
+)
+
+func (p StartupPhase) String() string {
+	switch p {
+	case StartupPhaseStarting:
+		return "starting"
+	case StartupPhaseLoading:
+		return "loading"
+	case StartupPhaseReady:
+		return "ready"
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
 // CreateServiceRuntime starts runtime(subprocess).
 func CreateServiceRuntime(
 	conf *config.Configuration,
@@ -63,6 +111,7 @@ func CreateServiceRuntime(
 	}
 	cmd := exec.Command(command[0], command[1:]...)
 	cmd.Env = append(os.Environ(), fmt.Sprintf("ABEJA_IPC_PATH=%s", udsFilePath))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("ABEJA_IPC_PROTOCOL_VERSION=%d", protocolVersion(conf)))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("ABEJA_TRAINING_RESULT_DIR=%s", trainingResultDir))
 
 	runtime := &Runtime{
@@ -111,6 +160,7 @@ func CreateOneshotRuntime(
 	cmd := exec.Command(command[0], command[1:]...)
 
 	cmd.Env = append(os.Environ(), fmt.Sprintf("ABEJA_IPC_PATH=%s", udsFilePath))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("ABEJA_IPC_PROTOCOL_VERSION=%d", protocolVersion(conf)))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("ABEJA_TRAINING_RESULT_DIR=%s", trainingResultDir))
 
 	runtime := &Runtime{
@@ -139,7 +189,61 @@ func (r *Runtime) Kill(ctx context.Context) {
 
 // IsReady returns result of `Is subprocess ready ?`.
 func (r *Runtime) IsReady() bool {
-	return r.Status == RuntimeStatusRunning
+	return r.status() == RuntimeStatusRunning
+}
+
+// status returns Status while holding the lock, because it is updated by other goroutines.
+func (r *Runtime) status() RuntimeStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Status
+}
+
+// Phase returns how far runtime has started.
+func (r *Runtime) Phase() StartupPhase {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.phase
+}
+
+// Model returns metadata of the model which runtime told when it got ready, or nil.
+func (r *Runtime) Model() map[string]interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.model
+}
+
+// MarkLoading marks runtime as loading, when the proxy connected to it.
+func (r *Runtime) MarkLoading() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.phase == StartupPhaseStarting {
+		r.phase = StartupPhaseLoading
+	}
+}
+
+// MarkReady marks runtime as ready for requests, with metadata of the model if runtime told it.
+func (r *Runtime) MarkReady(model map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.phase = StartupPhaseReady
+	r.model = model
+	if r.readyAt.IsZero() {
+		r.readyAt = time.Now()
+	}
+	if r.Status == RuntimeStatusPreparing {
+		r.Status = RuntimeStatusRunning
+	}
+}
+
+// uptime returns how long runtime has been ready, or 0 if it has never got ready.
+func (r *Runtime) uptime() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.readyAt.IsZero() {
+		return 0
+	}
+	return time.Since(r.readyAt)
 }
 
 // IsExited returns result of `Is subprocess exited ?`.
@@ -158,7 +262,9 @@ func (r *Runtime) Start(errOnSub chan error) error {
 	}
 	go func() {
 		defer close(errOnSub)
-		if err := r.Cmd.Wait(); err != nil {
+		err := r.Cmd.Wait()
+		r.recordExit(err)
+		if err != nil {
 			switch err := err.(type) {
 			case *exec.ExitError:
 				allowedExitStatuses := allowedExitStatusMap[r.RuntimeType]
@@ -174,34 +280,33 @@ func (r *Runtime) Start(errOnSub chan error) error {
 	return nil
 }
 
-// WaitUntilStarted waits to bootstraping of subprocess.
-// NOTE: Although there is a dependence on the order of function calls,
-// it is not very good...
-func (r *Runtime) WaitUntilStarted(ctx context.Context, socketPath string) error {
-	for {
-		if _, err := os.Stat(socketPath); err == nil {
-			log.Debug(ctx, "runtime started")
-			r.Status = RuntimeStatusRunning
-			return nil
-		}
-		if r.IsExited(ctx) {
-			log.Warning(ctx, "runtime stopped unexpectedly")
-			return errors.Errorf("runtime stopped unexpectedly: %s", r.Cmd.ProcessState.String())
-		}
-		log.Debug(ctx, "runtime bootstrapping yet...")
-		time.Sleep(1 * time.Second)
+// recordExit records the result of Cmd.Wait.
+// Cmd.ProcessState must not be read except by the goroutine which called Cmd.Wait,
+// so other goroutines know the result of the process only through this record.
+func (r *Runtime) recordExit(err error) {
+	result := &exitResult{exitCode: -1, state: fmt.Sprintf("%v", err)}
+	if state := r.Cmd.ProcessState; state != nil {
+		result.exitCode = state.ExitCode()
+		result.success = state.Success()
+		result.state = state.String()
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exited = result
 }
 
 // RuntimeStatus gets status of subprocess.
 func (r *Runtime) getStatus(ctx context.Context) RuntimeStatus {
-	if r.Cmd.ProcessState == nil || !r.Cmd.ProcessState.Exited() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// exited is recorded after the process finished, including by signal(e.g. OOM killer).
+	if r.exited == nil {
 		return r.Status
 	}
-	exitCode := r.Cmd.ProcessState.ExitCode()
+	exitCode := r.exited.exitCode
 	allowedExitStatuses := allowedExitStatusMap[r.RuntimeType]
 	log.Infof(ctx, "runtime finished with exit-code: %d", exitCode)
-	if r.Cmd.ProcessState.Success() || contains(allowedExitStatuses, exitCode) {
+	if r.exited.success || contains(allowedExitStatuses, exitCode) {
 		r.Status = RuntimeStatusExitedWithSuccess
 		return RuntimeStatusExitedWithSuccess
 	}
@@ -211,7 +316,7 @@ func (r *Runtime) getStatus(ctx context.Context) RuntimeStatus {
 
 // Shutdown waits stop subprocess.
 func (r *Runtime) Shutdown(ctx context.Context, waitMax time.Duration) {
-	ticker := *time.NewTicker(waitMax)
+	ticker := time.NewTicker(waitMax)
 	r.Stop(ctx)
 	for {
 		select {
@@ -20,38 +20,60 @@ import (
 
 const maxLogSize = 1024 * 250
 
-var (
-	procCtx context.Context
-	reqCtx  context.Context
-)
+// keyIPCRequestID is the field of runtime's log in JSON, which has REQUEST ID of IPC frame
+// of the request being processed.
+const keyIPCRequestID = "ipc_request_id"
+
+// LogScope tells RuntimeLogger the request which runtime began or finished processing.
+// Ctx is the context of the request, or nil when runtime finished processing it.
+// RequestID is REQUEST ID of IPC frame on protocol version 2, and 0 on protocol version 1.
+type LogScope struct {
+	Ctx       context.Context
+	RequestID uint32
+}
 
+// RuntimeLogger proxies outputs of runtime to log.
+// Each runtime has its own RuntimeLogger, so that logs are tagged with
+// the context of the request which the runtime is processing.
+// On protocol version 2, runtime processes several requests at the same time,
+// so only the log which has `ipc_request_id` is tagged with the context of that request.
 type RuntimeLogger struct {
-	stdout *bufio.Reader
-	stderr *bufio.Reader
-	ch     chan context.Context
-	wg     sync.WaitGroup
+	stdout    *bufio.Reader
+	stderr    *bufio.Reader
+	ch        chan LogScope
+	wg        sync.WaitGroup
+	procCtx   context.Context
+	mu        sync.RWMutex
+	reqCtx    context.Context
+	reqCtxs   map[uint32]context.Context
+	scopeOnce sync.Once
+}
+
+func NewRuntimeLogger(ctx context.Context, cmd *exec.Cmd, scopeChan chan LogScope) *RuntimeLogger {
+	rl := &RuntimeLogger{
+		ch:      scopeChan,
+		procCtx: ctx,
+		reqCtxs: make(map[uint32]context.Context),
+	}
+	rl.Reattach(cmd)
+	return rl
 }
 
-func NewRuntimeLogger(ctx context.Context, cmd *exec.Cmd, scopeChan chan context.Context) *RuntimeLogger {
-	var stdoutReader, stderrReader *bufio.Reader
-	procCtx = ctx
+// Reattach replaces outputs to proxy with the ones of cmd(e.g. restarted runtime).
+// It must be called before starting cmd, and Run must be called after starting cmd.
+func (rl *RuntimeLogger) Reattach(cmd *exec.Cmd) {
+	rl.stdout, rl.stderr = nil, nil
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Warning(ctx, "failed to get stdout of subprocess: ", err)
+		log.Warning(rl.procCtx, "failed to get stdout of subprocess: ", err)
 	} else {
-		stdoutReader = bufio.NewReader(stdout)
+		rl.stdout = bufio.NewReader(stdout)
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		log.Warning(ctx, "failed to get stderr of subprocess: ", err)
+		log.Warning(rl.procCtx, "failed to get stderr of subprocess: ", err)
 	} else {
-		stderrReader = bufio.NewReader(stderr)
-	}
-
-	return &RuntimeLogger{
-		stdout: stdoutReader,
-		stderr: stderrReader,
-		ch:     scopeChan,
+		rl.stderr = bufio.NewReader(stderr)
 	}
 }
 
@@ -80,28 +102,44 @@ func waitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
 
 func (rl *RuntimeLogger) Run() {
 
-	go func() {
-		for {
-			if ctx, ok := <-rl.ch; !ok {
-				return
-			} else {
-				reqCtx = ctx
+	rl.scopeOnce.Do(func() {
+		go func() {
+			for {
+				if scope, ok := <-rl.ch; !ok {
+					return
+				} else {
+					rl.setScope(scope)
+				}
 			}
-		}
-	}()
+		}()
+	})
 
+	stdout, stderr := rl.stdout, rl.stderr
 	rl.wg.Add(2)
 	go func() {
-		proxySubprocessLogs(rl.stdout, logrus.InfoLevel)
+		rl.proxySubprocessLogs(stdout, logrus.InfoLevel)
 		rl.wg.Done()
 	}()
 	go func() {
-		proxySubprocessLogs(rl.stderr, logrus.WarnLevel)
+		rl.proxySubprocessLogs(stderr, logrus.WarnLevel)
 		rl.wg.Done()
 	}()
 }
 
-func proxySubprocessLogs(reader *bufio.Reader, defaultLogLevel logrus.Level) {
+func (rl *RuntimeLogger) setScope(scope LogScope) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	switch {
+	case scope.RequestID == 0:
+		rl.reqCtx = scope.Ctx
+	case scope.Ctx == nil:
+		delete(rl.reqCtxs, scope.RequestID)
+	default:
+		rl.reqCtxs[scope.RequestID] = scope.Ctx
+	}
+}
+
+func (rl *RuntimeLogger) proxySubprocessLogs(reader *bufio.Reader, defaultLogLevel logrus.Level) {
 	if reader == nil {
 		return
 	}
@@ -109,20 +147,20 @@ func proxySubprocessLogs(reader *bufio.Reader, defaultLogLevel logrus.Level) {
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil && !isEOForPathError(err) {
-			outputLog(fmt.Sprintf("failed to scanning user output: %T", err), logrus.WarnLevel)
+			rl.outputLog(fmt.Sprintf("failed to scanning user output: %T", err), logrus.WarnLevel)
 			continue
 		}
 		// The last \n is included, so remove it.
 		line = strings.TrimSpace(line)
 		if len(line) > maxLogSize {
 			prefix := string([]rune(line)[:64])
-			outputLog(
+			rl.outputLog(
 				fmt.Sprintf("user output is too long. Maximum of 250kB per line. [%s...]", prefix),
 				logrus.WarnLevel)
 			continue
 		}
 
-		parseAndOutputLog(line, defaultLogLevel)
+		rl.parseAndOutputLog(line, defaultLogLevel)
 
 		if err != nil && isEOForPathError(err) {
 			break
@@ -140,7 +178,7 @@ func isEOForPathError(err error) bool {
 	return false
 }
 
-func parseAndOutputLog(text string, defaultLogLevel logrus.Level) {
+func (rl *RuntimeLogger) parseAndOutputLog(text string, defaultLogLevel logrus.Level) {
 	if strings.TrimSpace(text) == "" {
 		// empty line
 		return
@@ -148,36 +186,57 @@ func parseAndOutputLog(text string, defaultLogLevel logrus.Level) {
 	jsonObj, err := simplejson.NewJson([]byte(text))
 	if err != nil {
 		// output of subprocess is plain text
-		outputLog(text, defaultLogLevel)
+		rl.outputLog(text, defaultLogLevel)
 		return
 	}
 
 	escapedJson, err := json.Marshal(text)
 	if err != nil {
-		outputLog(text, defaultLogLevel)
+		rl.outputLog(text, defaultLogLevel)
 		return
 	}
 
+	ctx := rl.scope()
+	if id, err := jsonObj.Get(keyIPCRequestID).Uint64(); err == nil {
+		ctx = rl.scopeOf(uint32(id))
+	}
+
 	levelStr, err := jsonObj.Get("log_level").String()
 	if err != nil {
 		// no log_level field in json
-		outputLog(string(escapedJson), defaultLogLevel)
+		log.Log(ctx, defaultLogLevel, string(escapedJson))
 		return
 	}
 	level, err := logrus.ParseLevel(levelStr)
 	if err != nil {
 		// unknown level
-		outputLog(string(escapedJson), defaultLogLevel)
+		log.Log(ctx, defaultLogLevel, string(escapedJson))
 		return
 	}
 
-	outputLog(string(escapedJson), level)
+	log.Log(ctx, level, string(escapedJson))
 }
 
-func outputLog(text string, level logrus.Level) {
-	if reqCtx != nil {
-		log.Log(reqCtx, level, text)
-	} else {
-		log.Log(procCtx, level, text)
+func (rl *RuntimeLogger) outputLog(text string, level logrus.Level) {
+	log.Log(rl.scope(), level, text)
+}
+
+// scope returns the context of the request which runtime of protocol version 1 is processing.
+func (rl *RuntimeLogger) scope() context.Context {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	if rl.reqCtx != nil {
+		return rl.reqCtx
+	}
+	return rl.procCtx
+}
+
+// scopeOf returns the context of the request which has REQUEST ID of IPC frame.
+func (rl *RuntimeLogger) scopeOf(id uint32) context.Context {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	if ctx, ok := rl.reqCtxs[id]; ok {
+		return ctx
 	}
+	return rl.procCtx
 }
@@ -0,0 +1,55 @@
+package subprocess
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+func TestRuntimeLoggerScope(t *testing.T) {
+	procCtx := context.WithValue(context.Background(), log.KeyRequestID, "proc")
+	ctx1 := context.WithValue(context.Background(), log.KeyRequestID, "req1")
+	ctx2 := context.WithValue(context.Background(), log.KeyRequestID, "req2")
+	rl := NewRuntimeLogger(procCtx, exec.Command("true"), make(chan LogScope))
+
+	// requests in flight at the same time on protocol version 2.
+	rl.setScope(LogScope{Ctx: ctx1, RequestID: 1})
+	rl.setScope(LogScope{Ctx: ctx2, RequestID: 2})
+	cases := []struct {
+		name   string
+		scope  context.Context
+		expect string
+	}{
+		{name: "request 1", scope: rl.scopeOf(1), expect: "req1"},
+		{name: "request 2", scope: rl.scopeOf(2), expect: "req2"},
+		{name: "unknown request", scope: rl.scopeOf(3), expect: "proc"},
+		{name: "without request id", scope: rl.scope(), expect: "proc"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := c.scope.Value(log.KeyRequestID); actual != c.expect {
+				t.Errorf("log should be tagged with %s, but %v", c.expect, actual)
+			}
+		})
+	}
+
+	rl.setScope(LogScope{RequestID: 1})
+	if actual := rl.scopeOf(1).Value(log.KeyRequestID); actual != "proc" {
+		t.Errorf("log of finished request should be tagged with proc, but %v", actual)
+	}
+	if actual := rl.scopeOf(2).Value(log.KeyRequestID); actual != "req2" {
+		t.Errorf("log of request 2 should be tagged with req2, but %v", actual)
+	}
+
+	// a request on protocol version 1.
+	rl.setScope(LogScope{Ctx: ctx1})
+	if actual := rl.scope().Value(log.KeyRequestID); actual != "req1" {
+		t.Errorf("log should be tagged with req1, but %v", actual)
+	}
+	rl.setScope(LogScope{})
+	if actual := rl.scope().Value(log.KeyRequestID); actual != "proc" {
+		t.Errorf("log should be tagged with proc, but %v", actual)
+	}
+}
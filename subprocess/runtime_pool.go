@@ -0,0 +1,144 @@
+package subprocess
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RuntimePool represents runtime-processes which serve behind one service port.
+// Each runtime is supervised by Supervisor.
+type RuntimePool struct {
+	supervisors []*Supervisor
+}
+
+// NewRuntimePool returns RuntimePool which consists of supervised runtimes.
+func NewRuntimePool(supervisors ...*Supervisor) *RuntimePool {
+	return &RuntimePool{supervisors: supervisors}
+}
+
+// Len returns the number of runtimes.
+func (p *RuntimePool) Len() int {
+	return len(p.supervisors)
+}
+
+// Supervisors returns supervisors of runtimes.
+func (p *RuntimePool) Supervisors() []*Supervisor {
+	return p.supervisors
+}
+
+// WorkerState is the state of a runtime in the pool, which is told by health check.
+type WorkerState struct {
+	State    string `json:"state"`
+	Restarts int    `json:"restarts"`
+}
+
+// IsReady returns result of `Is any subprocess ready ?`.
+// Requests are served by the ready runtimes while the others are starting or restarting.
+func (p *RuntimePool) IsReady() bool {
+	for _, s := range p.supervisors {
+		if s.IsReady() {
+			return true
+		}
+	}
+	return false
+}
+
+// Workers returns the state of each runtime.
+func (p *RuntimePool) Workers() []WorkerState {
+	workers := make([]WorkerState, len(p.supervisors))
+	for i, s := range p.supervisors {
+		workers[i] = WorkerState{State: s.State(), Restarts: s.Restarts()}
+	}
+	return workers
+}
+
+// IsExited returns result of `Is any subprocess exited and will not be restarted ?`.
+func (p *RuntimePool) IsExited(ctx context.Context) bool {
+	for _, s := range p.supervisors {
+		if s.IsExited(ctx) {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the status of runtimes as a whole.
+// It is RuntimeStatusExitedWithFailure if any runtime failed,
+// otherwise the least advanced status among runtimes.
+func (p *RuntimePool) Status() RuntimeStatus {
+	if len(p.supervisors) == 0 {
+		return RuntimeStatusPreparing
+	}
+	status := RuntimeStatusExitedWithSuccess
+	for _, s := range p.supervisors {
+		st := s.Status()
+		if st == RuntimeStatusExitedWithFailure {
+			return RuntimeStatusExitedWithFailure
+		}
+		if st < status {
+			status = st
+		}
+	}
+	return status
+}
+
+// Phase returns the least advanced startup phase among runtimes.
+func (p *RuntimePool) Phase() StartupPhase {
+	if len(p.supervisors) == 0 {
+		return StartupPhaseStarting
+	}
+	phase := StartupPhaseReady
+	for _, s := range p.supervisors {
+		if ph := s.Phase(); ph < phase {
+			phase = ph
+		}
+	}
+	return phase
+}
+
+// Model returns metadata of the model which runtimes told when they got ready, or nil.
+func (p *RuntimePool) Model() map[string]interface{} {
+	for _, s := range p.supervisors {
+		if model := s.Runtime().Model(); model != nil {
+			return model
+		}
+	}
+	return nil
+}
+
+// Start starts all runtimes.
+// errOnSub is closed when any runtime finished and will not be restarted,
+// and receives its error if it failed.
+func (p *RuntimePool) Start(ctx context.Context, errOnSub chan error) error {
+	var once sync.Once
+	for _, s := range p.supervisors {
+		errOnRuntime := make(chan error)
+		if err := s.Start(ctx, errOnRuntime); err != nil {
+			return err
+		}
+		go func() {
+			err, received := <-errOnRuntime
+			once.Do(func() {
+				defer close(errOnSub)
+				if received {
+					errOnSub <- err
+				}
+			})
+		}()
+	}
+	return nil
+}
+
+// Shutdown waits stop all subprocesses.
+func (p *RuntimePool) Shutdown(ctx context.Context, waitMax time.Duration) {
+	var wg sync.WaitGroup
+	for _, s := range p.supervisors {
+		wg.Add(1)
+		go func(s *Supervisor) {
+			defer wg.Done()
+			s.Shutdown(ctx, waitMax)
+		}(s)
+	}
+	wg.Wait()
+}
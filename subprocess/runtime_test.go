@@ -1,7 +1,15 @@
 package subprocess
 
 import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/config"
 )
@@ -24,3 +32,373 @@ func TestTrainingRuntimeLanguageError(t *testing.T) {
 		t.Errorf("`CreateRuntime(invalid_language)` should be return err")
 	}
 }
+
+func TestServiceRuntimeProtocolVersion(t *testing.T) {
+	cases := []struct {
+		name            string
+		protocolVersion int
+		expected        string
+	}{
+		{name: "not configured", protocolVersion: 0, expected: "ABEJA_IPC_PROTOCOL_VERSION=1"},
+		{name: "configured", protocolVersion: 2, expected: "ABEJA_IPC_PROTOCOL_VERSION=2"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := &config.Configuration{Runtime: "python36", IPCProtocolVersion: c.protocolVersion}
+			runtime, err := CreateServiceRuntime(conf, "/path/to/uds.sock", "/path/to/tr")
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			found := false
+			for _, env := range runtime.Cmd.Env {
+				if env == c.expected {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("environment variables should contain %s", c.expected)
+			}
+		})
+	}
+}
+
+func TestRuntimePoolStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []RuntimeStatus
+		isReady  bool
+		expect   RuntimeStatus
+	}{
+		{
+			name:     "empty",
+			statuses: []RuntimeStatus{},
+			isReady:  false,
+			expect:   RuntimeStatusPreparing,
+		}, {
+			name:     "all running",
+			statuses: []RuntimeStatus{RuntimeStatusRunning, RuntimeStatusRunning},
+			isReady:  true,
+			expect:   RuntimeStatusRunning,
+		}, {
+			name:     "partially preparing",
+			statuses: []RuntimeStatus{RuntimeStatusRunning, RuntimeStatusPreparing},
+			isReady:  true,
+			expect:   RuntimeStatusPreparing,
+		}, {
+			name:     "partially exited with success",
+			statuses: []RuntimeStatus{RuntimeStatusExitedWithSuccess, RuntimeStatusRunning},
+			isReady:  true,
+			expect:   RuntimeStatusRunning,
+		}, {
+			name:     "all exited with success",
+			statuses: []RuntimeStatus{RuntimeStatusExitedWithSuccess, RuntimeStatusExitedWithSuccess},
+			isReady:  false,
+			expect:   RuntimeStatusExitedWithSuccess,
+		}, {
+			name:     "partially exited with failure",
+			statuses: []RuntimeStatus{RuntimeStatusRunning, RuntimeStatusExitedWithFailure},
+			isReady:  true,
+			expect:   RuntimeStatusExitedWithFailure,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var supervisors []*Supervisor
+			for _, status := range c.statuses {
+				runtime := &Runtime{Status: status}
+				supervisor, err := NewSupervisor(func() (*Runtime, error) { return runtime, nil }, "", 0)
+				if err != nil {
+					t.Fatal("unexpected error occurred:", err)
+				}
+				supervisors = append(supervisors, supervisor)
+			}
+			pool := NewRuntimePool(supervisors...)
+			if pool.IsReady() != c.isReady {
+				t.Errorf("IsReady should be %t, but %t", c.isReady, pool.IsReady())
+			}
+			if pool.Status() != c.expect {
+				t.Errorf("Status should be %d, but %d", c.expect, pool.Status())
+			}
+		})
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	cases := []struct {
+		name        string
+		command     string
+		maxRestarts int
+		created     int
+		hasError    bool
+	}{
+		{
+			name:        "exited with success",
+			command:     "exit 0",
+			maxRestarts: 2,
+			created:     1,
+			hasError:    false,
+		}, {
+			name:        "exited with allowed status",
+			command:     "exit 120",
+			maxRestarts: 2,
+			created:     1,
+			hasError:    false,
+		}, {
+			name:        "crashed until crash budget is exhausted",
+			command:     "exit 1",
+			maxRestarts: 2,
+			created:     3,
+			hasError:    true,
+		}, {
+			name:        "no crash budget",
+			command:     "exit 1",
+			maxRestarts: 0,
+			created:     1,
+			hasError:    true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			socketPath := filepath.Join(os.TempDir(), "test_supervisor.sock")
+			created := 0
+			create := func() (*Runtime, error) {
+				created++
+				return &Runtime{
+					Cmd:         exec.Command("sh", "-c", c.command),
+					Status:      RuntimeStatusPreparing,
+					RuntimeType: "python36",
+				}, nil
+			}
+			supervisor, err := NewSupervisor(create, socketPath, c.maxRestarts)
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			supervisor.backOff = backoff.NewConstantBackOff(10 * time.Millisecond)
+
+			errOnSub := make(chan error)
+			if err := supervisor.Start(context.TODO(), errOnSub); err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			select {
+			case err, received := <-errOnSub:
+				if received != c.hasError {
+					t.Errorf("error should be received: %t, but %t (%v)", c.hasError, received, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout on waiting for runtime to finish")
+			}
+
+			if created != c.created {
+				t.Errorf("runtime should be created %d time(s), but %d", c.created, created)
+			}
+			if supervisor.Restarts() != c.created-1 {
+				t.Errorf("runtime should be restarted %d time(s), but %d", c.created-1, supervisor.Restarts())
+			}
+			if !supervisor.IsExited(context.TODO()) {
+				t.Error("supervisor should be exited")
+			}
+		})
+	}
+}
+
+func TestSupervisorRestart_ResetAfterStableUptime(t *testing.T) {
+	socketPath := filepath.Join(os.TempDir(), "test_supervisor_stable.sock")
+	created := 0
+	create := func() (*Runtime, error) {
+		created++
+		runtime := &Runtime{
+			Cmd:         exec.Command("sh", "-c", "exit 1"),
+			Status:      RuntimeStatusPreparing,
+			RuntimeType: "python36",
+		}
+		if created <= 3 {
+			// crashes after it had been ready longer than stableUptime.
+			runtime.Cmd = exec.Command("sh", "-c", "sleep 0.2; exit 1")
+			runtime.MarkReady(nil)
+		}
+		return runtime, nil
+	}
+	supervisor, err := NewSupervisor(create, socketPath, 1)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	supervisor.backOff = backoff.NewConstantBackOff(10 * time.Millisecond)
+	supervisor.stableUptime = 100 * time.Millisecond
+
+	errOnSub := make(chan error)
+	if err := supervisor.Start(context.TODO(), errOnSub); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	select {
+	case err, received := <-errOnSub:
+		if !received {
+			t.Errorf("error should be received, but not (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout on waiting for runtime to finish")
+	}
+
+	// 3 stable runtimes are restarted regardless of maxRestarts, and the 4th one uses the crash budget up.
+	if created != 4 {
+		t.Errorf("runtime should be created 4 times, but %d", created)
+	}
+	if supervisor.Restarts() != 1 {
+		t.Errorf("restarts should be reset to 1, but %d", supervisor.Restarts())
+	}
+}
+
+func TestSupervisorWaitUntilReady(t *testing.T) {
+	cases := []struct {
+		name     string
+		command  string
+		ready    bool
+		hasError bool
+	}{
+		{name: "ready", command: "sleep 1", ready: true, hasError: false},
+		{name: "finished before ready", command: "exit 1", ready: false, hasError: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			socketPath := filepath.Join(os.TempDir(), "test_supervisor_ready.sock")
+			create := func() (*Runtime, error) {
+				return &Runtime{
+					Cmd:         exec.Command("sh", "-c", c.command),
+					Status:      RuntimeStatusPreparing,
+					RuntimeType: "python36",
+				}, nil
+			}
+			supervisor, err := NewSupervisor(create, socketPath, 0)
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			errOnSub := make(chan error, 1)
+			if err := supervisor.Start(context.TODO(), errOnSub); err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			defer supervisor.Shutdown(context.TODO(), time.Second)
+			if c.ready {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					supervisor.MarkLoading()
+					supervisor.MarkReady(context.TODO(), nil)
+				}()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = supervisor.WaitUntilReady(ctx)
+			if hasError := err != nil; hasError != c.hasError {
+				t.Errorf("error should be returned: %t, but %v", c.hasError, err)
+			}
+			if ctx.Err() != nil {
+				t.Error("timeout on waiting for runtime to get ready")
+			}
+		})
+	}
+}
+
+func TestSupervisorStartupTimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		ready    bool
+		hasError bool
+	}{
+		{name: "not ready within timeout", ready: false, hasError: true},
+		{name: "ready within timeout", ready: true, hasError: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			socketPath := filepath.Join(os.TempDir(), "test_supervisor.sock")
+			create := func() (*Runtime, error) {
+				return &Runtime{
+					Cmd:         exec.Command("sh", "-c", "sleep 1"),
+					Status:      RuntimeStatusPreparing,
+					RuntimeType: "python36",
+				}, nil
+			}
+			supervisor, err := NewSupervisor(create, socketPath, 0)
+			if err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			supervisor.SetStartupTimeout(100 * time.Millisecond)
+
+			errOnSub := make(chan error)
+			if err := supervisor.Start(context.TODO(), errOnSub); err != nil {
+				t.Fatal("unexpected error occurred:", err)
+			}
+			if supervisor.Phase() != StartupPhaseStarting {
+				t.Errorf("phase should be %s, but %s", StartupPhaseStarting, supervisor.Phase())
+			}
+			if c.ready {
+				supervisor.MarkReady(context.TODO(), map[string]interface{}{"name": "resnet50"})
+				if supervisor.Phase() != StartupPhaseReady || !supervisor.IsReady() {
+					t.Errorf("runtime should be ready, but %s", supervisor.Phase())
+				}
+			}
+
+			start := time.Now()
+			select {
+			case err, received := <-errOnSub:
+				if received != c.hasError {
+					t.Errorf("error should be received: %t, but %t (%v)", c.hasError, received, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout on waiting for runtime to finish")
+			}
+			if killed := time.Since(start) < 500*time.Millisecond; killed != c.hasError {
+				t.Errorf("runtime should be killed by startup timeout: %t, but %t", c.hasError, killed)
+			}
+		})
+	}
+}
+
+func TestSupervisorReload(t *testing.T) {
+	socketPath := filepath.Join(os.TempDir(), "test_supervisor_reload.sock")
+	var mu sync.Mutex
+	created := 0
+	create := func() (*Runtime, error) {
+		mu.Lock()
+		created++
+		mu.Unlock()
+		return &Runtime{
+			Cmd:         exec.Command("sh", "-c", "sleep 10"),
+			Status:      RuntimeStatusPreparing,
+			RuntimeType: "python36",
+		}, nil
+	}
+	supervisor, err := NewSupervisor(create, socketPath, 0)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	supervisor.backOff = backoff.NewConstantBackOff(10 * time.Millisecond)
+
+	errOnSub := make(chan error, 1)
+	if err := supervisor.Start(context.TODO(), errOnSub); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	first := supervisor.Runtime()
+	supervisor.Reload(context.TODO())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for supervisor.Runtime() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout on waiting for runtime to reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if created != 2 {
+		t.Errorf("runtime should be created 2 times, but %d", created)
+	}
+	mu.Unlock()
+	if supervisor.Restarts() != 0 {
+		t.Errorf("reload should not be counted as restart, but %d", supervisor.Restarts())
+	}
+
+	supervisor.Shutdown(context.TODO(), 1*time.Second)
+	select {
+	case <-errOnSub:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout on waiting for runtime to finish")
+	}
+}
@@ -0,0 +1,443 @@
+package subprocess
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	errors "golang.org/x/xerrors"
+
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// defaultStableUptime is how long runtime must stay ready before its past crashes are forgiven.
+const defaultStableUptime = 10 * time.Minute
+
+// Supervisor runs runtime, and restarts it with exponential backoff when it crashed.
+// It gives up restarting when the runtime crashed more than maxRestarts times in a row.
+// The crashes are not in a row once the runtime stayed ready for stableUptime, so the backoff
+// and the count of restarts are reset then.
+// The runtime which doesn't get ready within startup timeout is killed, and handled as crashed one.
+type Supervisor struct {
+	create         func() (*Runtime, error)
+	socketPath     string
+	maxRestarts    int
+	startupTimeout time.Duration
+	stableUptime   time.Duration
+	backOff        backoff.BackOff
+	logger         *RuntimeLogger
+
+	mu         sync.RWMutex
+	runtime    *Runtime
+	restarts   int
+	restarting bool
+	reloading  bool
+	stopped    bool
+	stop       chan struct{}
+	reload     chan struct{}
+	readyOnce  sync.Once
+	ready      chan struct{} // closed when runtime got ready for the first time
+	finished   chan struct{} // closed when runtime finished and will not be restarted
+}
+
+// NewSupervisor creates runtime by create, and returns Supervisor of it.
+// create is called again each time the runtime is restarted.
+func NewSupervisor(
+	create func() (*Runtime, error),
+	socketPath string,
+	maxRestarts int) (*Supervisor, error) {
+
+	runtime, err := create()
+	if err != nil {
+		return nil, err
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // never stop by elapsed time. crash budget is maxRestarts.
+
+	return &Supervisor{
+		create:       create,
+		socketPath:   socketPath,
+		maxRestarts:  maxRestarts,
+		stableUptime: defaultStableUptime,
+		backOff:      b,
+		runtime:      runtime,
+		stop:         make(chan struct{}),
+		reload:       make(chan struct{}, 1),
+		ready:        make(chan struct{}),
+		finished:     make(chan struct{}),
+	}, nil
+}
+
+// Runtime returns the runtime currently supervised.
+func (s *Supervisor) Runtime() *Runtime {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.runtime
+}
+
+// Restarts returns the number of times the runtime restarted.
+func (s *Supervisor) Restarts() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.restarts
+}
+
+// SocketPath returns the path to socket file for communication to runtime.
+func (s *Supervisor) SocketPath() string {
+	return s.socketPath
+}
+
+// SetStartupTimeout sets the time limit for runtime to get ready after it started. 0 means no limit.
+// It must be called before Start.
+func (s *Supervisor) SetStartupTimeout(timeout time.Duration) {
+	s.startupTimeout = timeout
+}
+
+// MarkLoading marks the runtime as loading, when the proxy connected to it.
+func (s *Supervisor) MarkLoading() {
+	s.Runtime().MarkLoading()
+}
+
+// MarkReady marks the runtime as ready for requests, with metadata of the model if runtime told it.
+func (s *Supervisor) MarkReady(ctx context.Context, model map[string]interface{}) {
+	runtime := s.Runtime()
+	runtime.MarkReady(model)
+	s.readyOnce.Do(func() { close(s.ready) })
+	if model != nil {
+		log.Infof(ctx, "runtime is ready with model %v", model)
+	} else {
+		log.Info(ctx, "runtime is ready")
+	}
+}
+
+// Restart kills the runtime which doesn't respond, so that it is restarted as crashed one.
+func (s *Supervisor) Restart(ctx context.Context) {
+	runtime := s.Runtime()
+	if runtime.Cmd == nil || runtime.Cmd.Process == nil || runtime.IsExited(ctx) {
+		return
+	}
+	log.Warning(ctx, "kill runtime to restart it.")
+	runtime.Kill(ctx)
+}
+
+// Reload restarts the runtime immediately, for example after its source code is changed.
+// It is not counted as crash, and it cuts short the wait of restarting crashed runtime.
+func (s *Supervisor) Reload(ctx context.Context) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.reloading = true
+	s.mu.Unlock()
+	select {
+	case s.reload <- struct{}{}:
+	default:
+	}
+
+	runtime := s.Runtime()
+	if runtime.Cmd == nil || runtime.Cmd.Process == nil || runtime.IsExited(ctx) {
+		return
+	}
+	log.Info(ctx, "kill runtime to reload it.")
+	runtime.Kill(ctx)
+}
+
+// AttachLogger proxies outputs of runtime to log, including restarted ones.
+// It must be called before Start.
+func (s *Supervisor) AttachLogger(ctx context.Context, scopeChan chan LogScope) *RuntimeLogger {
+	s.logger = NewRuntimeLogger(ctx, s.Runtime().Cmd, scopeChan)
+	return s.logger
+}
+
+// Start starts runtime.
+// errOnSub is closed when the runtime finished and will not be restarted,
+// and receives its error if it failed.
+func (s *Supervisor) Start(ctx context.Context, errOnSub chan error) error {
+	errOnRuntime := make(chan error)
+	if err := s.Runtime().Start(errOnRuntime); err != nil {
+		return err
+	}
+	if s.logger != nil {
+		s.logger.Run()
+	}
+	go s.watch(ctx, errOnRuntime, errOnSub)
+	go s.watchStartup(ctx, s.Runtime())
+	return nil
+}
+
+// WaitUntilReady waits until runtime gets ready for the first time, which is told by MarkReady.
+// When the runtime crashed or didn't get ready within startup timeout, it also waits the restarted one.
+// It returns error if the runtime finished before it got ready, and will not be restarted.
+func (s *Supervisor) WaitUntilReady(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-s.finished:
+		select {
+		case <-s.ready:
+			return nil
+		default:
+			return errors.New("runtime finished before it got ready")
+		}
+	case <-ctx.Done():
+		return errors.Errorf(": %w", ctx.Err())
+	}
+}
+
+// watchStartup kills the runtime if it doesn't get ready within startup timeout,
+// so that it is restarted as crashed one.
+func (s *Supervisor) watchStartup(ctx context.Context, runtime *Runtime) {
+	if s.startupTimeout <= 0 {
+		return
+	}
+	select {
+	case <-time.After(s.startupTimeout):
+	case <-s.stop:
+		return
+	}
+	if runtime.Phase() == StartupPhaseReady || runtime != s.Runtime() || s.isStopped() ||
+		runtime.IsExited(ctx) {
+		return
+	}
+	log.Errorf(ctx, "runtime didn't get ready within %s (phase: %s), kill it.", s.startupTimeout, runtime.Phase())
+	runtime.Kill(ctx)
+}
+
+func (s *Supervisor) watch(ctx context.Context, errOnRuntime chan error, errOnSub chan error) {
+	defer close(errOnSub)
+	defer close(s.finished)
+	for {
+		err, received := <-errOnRuntime
+		if !s.isStopped() && s.takeReloading() {
+			next, err := s.restart(ctx, false)
+			if err != nil {
+				log.Errorf(ctx, "failed to reload runtime: "+log.ErrorFormat, err)
+				errOnSub <- err
+				return
+			}
+			if next == nil {
+				return
+			}
+			errOnRuntime = next
+			continue
+		}
+		if !received || s.isStopped() {
+			// finished normally, or stopped by Shutdown.
+			if received {
+				errOnSub <- err
+			}
+			return
+		}
+
+		log.Warningf(ctx, "runtime crashed: "+log.ErrorFormat, err)
+		s.resetIfStable(ctx)
+		if !s.canRestart() {
+			log.Errorf(ctx, "runtime crashed %d time(s), give up restarting.", s.Restarts()+1)
+			errOnSub <- err
+			return
+		}
+		next, err := s.restart(ctx, true)
+		if err != nil {
+			log.Errorf(ctx, "failed to restart runtime: "+log.ErrorFormat, err)
+			errOnSub <- err
+			return
+		}
+		if next == nil {
+			// stopped while restarting.
+			return
+		}
+		errOnRuntime = next
+	}
+}
+
+// restart starts new runtime. The crashed runtime is restarted after waiting backoff.
+// It returns nil channel if Shutdown was called while restarting.
+func (s *Supervisor) restart(ctx context.Context, crashed bool) (chan error, error) {
+	s.mu.Lock()
+	s.restarting = true
+	if crashed {
+		s.restarts++
+	}
+	restarts := s.restarts
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.restarting = false
+		s.mu.Unlock()
+	}()
+
+	if crashed {
+		wait := s.backOff.NextBackOff()
+		log.Infof(ctx, "restart runtime after %s. (%d/%d)", wait, restarts, s.maxRestarts)
+		select {
+		case <-time.After(wait):
+		case <-s.reload:
+			// reloaded while waiting. the restarted runtime loads the latest source code.
+			s.mu.Lock()
+			s.reloading = false
+			s.mu.Unlock()
+		case <-s.stop:
+			return nil, nil
+		}
+	} else {
+		s.backOff.Reset()
+		log.Info(ctx, "reload runtime.")
+	}
+
+	runtime, err := s.create()
+	if err != nil {
+		return nil, errors.Errorf("failed to create runtime: %w", err)
+	}
+	// remove socket file of crashed runtime, so that the restarted one can listen on it.
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("failed to remove socket file: %w", err)
+	}
+	if s.logger != nil {
+		s.logger.Reattach(runtime.Cmd)
+	}
+
+	errOnRuntime := make(chan error)
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	if err := runtime.Start(errOnRuntime); err != nil {
+		s.mu.Unlock()
+		return nil, errors.Errorf("failed to start runtime: %w", err)
+	}
+	s.runtime = runtime
+	s.mu.Unlock()
+
+	if s.logger != nil {
+		s.logger.Run()
+	}
+	go s.watchStartup(ctx, runtime)
+	log.Infof(ctx, "runtime restarted. (%d/%d)", restarts, s.maxRestarts)
+	return errOnRuntime, nil
+}
+
+// resetIfStable resets the backoff and the count of restarts,
+// if the crashed runtime had been ready for stableUptime.
+func (s *Supervisor) resetIfStable(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uptime := s.runtime.uptime()
+	if uptime < s.stableUptime {
+		return
+	}
+	if s.restarts > 0 {
+		log.Infof(ctx, "runtime had been ready for %s, reset the count of restarts.", uptime.Round(time.Second))
+	}
+	s.restarts = 0
+	s.backOff.Reset()
+}
+
+// takeReloading returns result of `Was Reload called ?`, and clears it.
+func (s *Supervisor) takeReloading() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reloading := s.reloading
+	s.reloading = false
+	if reloading {
+		select {
+		case <-s.reload:
+		default:
+		}
+	}
+	return reloading
+}
+
+func (s *Supervisor) isStopped() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stopped
+}
+
+func (s *Supervisor) canRestart() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.create != nil && !s.stopped && s.restarts < s.maxRestarts
+}
+
+// willRestart returns result of `Will the runtime be restarted ?`.
+func (s *Supervisor) willRestart(runtime *Runtime) bool {
+	return runtime.status() == RuntimeStatusExitedWithFailure && s.canRestart()
+}
+
+// IsReady returns result of `Is subprocess ready ?`.
+func (s *Supervisor) IsReady() bool {
+	s.mu.RLock()
+	runtime, restarting := s.runtime, s.restarting
+	s.mu.RUnlock()
+	return !restarting && runtime.IsReady()
+}
+
+// State returns `ready` if runtime is ready, the phase of startup while it's preparing(or restarting),
+// `exited` if it finished, or `failed` if it crashed and will not be restarted.
+func (s *Supervisor) State() string {
+	if s.IsReady() {
+		return "ready"
+	}
+	switch s.Status() {
+	case RuntimeStatusExitedWithSuccess:
+		return "exited"
+	case RuntimeStatusExitedWithFailure:
+		return "failed"
+	}
+	return s.Phase().String()
+}
+
+// IsExited returns result of `Is subprocess exited and will not be restarted ?`.
+func (s *Supervisor) IsExited(ctx context.Context) bool {
+	s.mu.RLock()
+	runtime, restarting := s.runtime, s.restarting
+	s.mu.RUnlock()
+	if restarting || !runtime.IsExited(ctx) {
+		return false
+	}
+	return !s.willRestart(runtime)
+}
+
+// Status returns status of runtime.
+// It is RuntimeStatusPreparing while the crashed runtime is restarting.
+func (s *Supervisor) Status() RuntimeStatus {
+	s.mu.RLock()
+	runtime, restarting := s.runtime, s.restarting
+	s.mu.RUnlock()
+	if restarting || s.willRestart(runtime) {
+		return RuntimeStatusPreparing
+	}
+	return runtime.status()
+}
+
+// Phase returns how far runtime has started.
+// It is StartupPhaseStarting while the crashed runtime is restarting.
+func (s *Supervisor) Phase() StartupPhase {
+	s.mu.RLock()
+	runtime, restarting := s.runtime, s.restarting
+	s.mu.RUnlock()
+	if restarting || s.willRestart(runtime) {
+		return StartupPhaseStarting
+	}
+	return runtime.Phase()
+}
+
+// Shutdown stops supervising, and waits stop subprocess.
+func (s *Supervisor) Shutdown(ctx context.Context, waitMax time.Duration) {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+	runtime := s.runtime
+	s.mu.Unlock()
+
+	if runtime.Cmd == nil || runtime.Cmd.Process == nil || runtime.IsExited(ctx) {
+		return
+	}
+	runtime.Shutdown(ctx, waitMax)
+}
@@ -1,11 +1,22 @@
 package util
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	errors "golang.org/x/xerrors"
 
 	"github.com/mholt/archiver"
+
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
 )
 
 // Unarchive unarchives archived file to `destPath`.
@@ -28,3 +39,141 @@ func Unarchive(filePath string, destPath string) error {
 	}
 	return nil
 }
+
+// UnarchiveStream unarchives the archive read from `r` to `destPath`.
+// tar and tar.gz are extracted while they are read, so they don't need disk space for the archive.
+// Other formats like zip need random access, so they are buffered to a temporary file
+// next to `destPath` and unarchived by `Unarchive`. The buffer isn't put in the system
+// temporary directory, because it may be too small for models.
+// `r` is read to the end even if the archive ends before, so that its writer isn't blocked.
+func UnarchiveStream(r io.Reader, destPath string) error {
+	br := bufio.NewReaderSize(r, 1024)
+	// the header of tar is the first 512 bytes, and gzip is identified by the first 2 bytes.
+	header, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return errors.Errorf("failed to read archive: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Errorf("failed to read gzip: %w", err)
+		}
+		if err := untar(gr, destPath); err != nil {
+			return err
+		}
+		// the rest is read to verify checksum of gzip.
+		if _, err := io.Copy(ioutil.Discard, gr); err != nil {
+			return errors.Errorf("failed to read gzip: %w", err)
+		}
+	case len(header) == 512 && string(header[257:262]) == "ustar":
+		if err := untar(br, destPath); err != nil {
+			return err
+		}
+	default:
+		return unarchiveBuffered(br, destPath)
+	}
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return errors.Errorf("failed to read archive: %w", err)
+	}
+	return nil
+}
+
+func unarchiveBuffered(r io.Reader, destPath string) error {
+	dir := filepath.Dir(destPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Errorf("failed to create directory for archive: %w", err)
+	}
+	fp, err := ioutil.TempFile(dir, ".archive")
+	if err != nil {
+		return errors.Errorf("failed to create temporary file for archive: %w", err)
+	}
+	filePath := fp.Name()
+	defer cleanutil.Remove(context.TODO(), filePath)
+	_, err = io.Copy(fp, r)
+	cleanutil.Close(context.TODO(), fp, filePath)
+	if err != nil {
+		return errors.Errorf("failed to buffer archive: %w", err)
+	}
+	return Unarchive(filePath, destPath)
+}
+
+// untar extracts tar read from `r` to `destPath` like archiver does,
+// except that entries out of `destPath` are rejected.
+func untar(r io.Reader, destPath string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Errorf("reading file in tar archive: %w", err)
+		}
+		to := filepath.Join(destPath, hdr.Name)
+		if !within(destPath, to) {
+			return errors.Errorf("illegal file path in tar archive: %s", hdr.Name)
+		}
+		if hdr.Typeflag != tar.TypeDir && fileExists(to) {
+			return errors.Errorf("file already exists: %s", to)
+		}
+		if err := untarFile(tr, hdr, destPath, to); err != nil {
+			return errors.Errorf("reading file in tar archive: %w", err)
+		}
+	}
+}
+
+func untarFile(r io.Reader, hdr *tar.Header, destPath string, to string) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(to, 0755)
+	case tar.TypeReg, tar.TypeRegA, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode())
+		if err != nil {
+			return err
+		}
+		defer cleanutil.Close(context.TODO(), out, to)
+		if err := out.Chmod(hdr.FileInfo().Mode()); err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		return err
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, to)
+	case tar.TypeLink:
+		target := filepath.Join(destPath, hdr.Linkname)
+		if !within(destPath, target) {
+			return errors.Errorf("illegal link in tar archive: %s", hdr.Linkname)
+		}
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		return os.Link(target, to)
+	case tar.TypeXGlobalHeader:
+		// ignore the pax global header from git-generated tarballs
+		return nil
+	default:
+		return errors.Errorf("%s: unknown type flag: %c", hdr.Name, hdr.Typeflag)
+	}
+}
+
+// within returns true if sub is within or equal to parent.
+func within(parent string, sub string) bool {
+	rel, err := filepath.Rel(parent, sub)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return !os.IsNotExist(err)
+}
@@ -1,6 +1,9 @@
 package util
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
 	"io/ioutil"
 	"os"
@@ -34,3 +37,104 @@ func TestUnarchive(t *testing.T) {
 		t.Fatalf("[%s] should be equals [%s]", string(actual), expect)
 	}
 }
+
+func tarOf(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipOf(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnarchiveStream(t *testing.T) {
+	tgz, err := ioutil.ReadFile("../test_resources/test_archive.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"main.py": "def handler():\n    return \"hello world\"\n"}
+	cases := []struct {
+		name        string
+		archive     []byte
+		trailing    int
+		expectError bool
+	}{
+		{name: "tar.gz", archive: tgz},
+		{name: "tar", archive: tarOf(t, files), trailing: 1024},
+		{name: "zip", archive: zipOf(t, files)},
+		{name: "out of destination", archive: tarOf(t, map[string]string{"../main.py": "evil"}), expectError: true},
+		{name: "broken", archive: tgz[:len(tgz)/2], expectError: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "testUnarchiveStream")
+			if err != nil {
+				t.Fatal("failed to making temporary directory for test: ", err)
+			}
+			defer cleanutil.RemoveAll(context.TODO(), dir)
+			destPath := filepath.Join(dir, "dest")
+			// archive must not be buffered in the system temporary directory.
+			orgTmpDir := os.Getenv("TMPDIR")
+			os.Setenv("TMPDIR", filepath.Join(dir, "not-exist"))
+			defer os.Setenv("TMPDIR", orgTmpDir)
+
+			// trailing bytes are read, not to block the writer.
+			r := bytes.NewReader(append(append([]byte{}, c.archive...), make([]byte, c.trailing)...))
+			err = UnarchiveStream(r, destPath)
+			if c.expectError {
+				if err == nil {
+					t.Fatal("Error should be raised")
+				}
+				if _, err := os.Stat(filepath.Join(dir, "main.py")); err == nil {
+					t.Error("file out of destination should not be written")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("failed to unarchive: ", err)
+			}
+			if r.Len() != 0 {
+				t.Errorf("reader should be read to the end, but %d bytes left", r.Len())
+			}
+			actual, err := ioutil.ReadFile(filepath.Join(destPath, "main.py"))
+			if err != nil {
+				t.Fatal("failed to read unarchived file: ", err)
+			}
+			if string(actual) != files["main.py"] {
+				t.Fatalf("[%s] should be equals [%s]", string(actual), files["main.py"])
+			}
+			if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("buffer of archive should be removed, but %d entries are in %s", len(entries), dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	errors "golang.org/x/xerrors"
+
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// chunkRetryInterval and chunkMaxRetries are variables to be shortened in tests.
+var chunkRetryInterval = time.Second
+var chunkMaxRetries = 5
+
+// downloadState is the progress of chunked download, saved next to the file to resume it.
+type downloadState struct {
+	ETag      string `json:"etag"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Done      []bool `json:"done"`
+}
+
+func downloadStatePath(destPath string) string {
+	return destPath + ".progress"
+}
+
+// loadDownloadState returns the progress of previous download, or nil if not exists.
+func loadDownloadState(destPath string) *downloadState {
+	data, err := ioutil.ReadFile(downloadStatePath(destPath))
+	if err != nil {
+		return nil
+	}
+	state := &downloadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil
+	}
+	return state
+}
+
+func saveDownloadState(destPath string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Errorf("failed to marshal progress of download: %w", err)
+	}
+	tmp := downloadStatePath(destPath) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Errorf("failed to save progress of download: %w", err)
+	}
+	if err := os.Rename(tmp, downloadStatePath(destPath)); err != nil {
+		return errors.Errorf("failed to save progress of download: %w", err)
+	}
+	return nil
+}
+
+func removeDownloadState(ctx context.Context, destPath string) {
+	if _, err := os.Stat(downloadStatePath(destPath)); err == nil {
+		cleanutil.Remove(ctx, downloadStatePath(destPath))
+	}
+}
+
+// resumable reports whether the previous download is of the same entity.
+func (s *downloadState) resumable(etag string, size int64, chunkSize int64) bool {
+	return s != nil && etag != "" && s.ETag == etag && s.Size == size && s.ChunkSize == chunkSize &&
+		int64(len(s.Done)) == (size+chunkSize-1)/chunkSize
+}
+
+// downloadChunks downloads the entity of total bytes in chunks in parallel.
+// first is the response of the first chunk.
+func (d Downloader) downloadChunks(
+	name string,
+	signedURL string,
+	first *http.Response,
+	total int64,
+	destPath string,
+	sum *checksum) error {
+
+	ctx := context.TODO()
+	chunkSize := d.chunkSize()
+	etag := first.Header.Get("ETag")
+	state := loadDownloadState(destPath)
+	if state.resumable(etag, total, chunkSize) {
+		log.Infof(ctx, "resume downloading %s", name)
+	} else {
+		state = &downloadState{
+			ETag:      etag,
+			Size:      total,
+			ChunkSize: chunkSize,
+			Done:      make([]bool, (total+chunkSize-1)/chunkSize),
+		}
+		if err := os.Truncate(destPath, 0); err != nil && !os.IsNotExist(err) {
+			return errors.Errorf("failed to truncate %s: %w", destPath, err)
+		}
+	}
+
+	fp, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0755)
+	if err != nil {
+		log.Error(ctx, "failed to open download data")
+		return errors.Errorf("failed to open %s: %w", destPath, err)
+	}
+	defer cleanutil.Close(ctx, fp, destPath)
+	if err := fp.Truncate(total); err != nil {
+		return errors.Errorf("failed to allocate %s: %w", destPath, err)
+	}
+
+	var pending []int
+	var resumed int64
+	for i, done := range state.Done {
+		if done {
+			resumed += chunkLength(i, chunkSize, total)
+		} else {
+			pending = append(pending, i)
+		}
+	}
+	p := newProgress(ctx, name, total, resumed)
+	defer p.stop()
+
+	var mu sync.Mutex
+	complete := func(i int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		state.Done[i] = true
+		return saveDownloadState(destPath, state)
+	}
+
+	// the first chunk is written from the response already received.
+	if len(pending) > 0 && pending[0] == 0 {
+		length := chunkLength(0, chunkSize, total)
+		n, err := io.Copy(&offsetWriter{w: fp}, io.TeeReader(io.LimitReader(first.Body, length), p))
+		if err == nil && n == length {
+			if err := complete(0); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		} else {
+			// it's downloaded again by workers.
+			p.add(-n)
+		}
+	}
+
+	queue := make(chan int)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		stopOnce.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	go func() {
+		defer close(queue)
+		for _, i := range pending {
+			select {
+			case queue <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < d.concurrency(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				start := int64(i) * chunkSize
+				end := start + chunkLength(i, chunkSize, total) - 1
+				if err := d.downloadChunk(ctx, name, signedURL, etag, fp, start, end, p); err != nil {
+					fail(err)
+					return
+				}
+				if err := complete(i); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if sum != nil {
+		if err := sum.verifyFile(destPath); err != nil {
+			// the chunks can't be trusted, so the next download starts from scratch.
+			removeDownloadState(ctx, destPath)
+			return errors.Errorf("failed to verify %s: %w", name, err)
+		}
+	}
+	removeDownloadState(ctx, destPath)
+	return nil
+}
+
+// downloadChunk downloads bytes from start to end (inclusive) with retry.
+// The retry resumes from the bytes already written.
+func (d Downloader) downloadChunk(
+	ctx context.Context,
+	name string,
+	signedURL string,
+	etag string,
+	w io.WriterAt,
+	start int64,
+	end int64,
+	p *progress) error {
+
+	offset := start
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = chunkRetryInterval
+	b.MaxElapsedTime = 0
+	return backoff.RetryNotify(
+		func() error {
+			resp, err := d.Client.GetThroughRange(signedURL, offset, end)
+			if err != nil {
+				return err
+			}
+			defer cleanutil.Close(ctx, resp.Body, "response body of chunk")
+			if resp.StatusCode != http.StatusPartialContent {
+				err := errors.Errorf(
+					"failed to download bytes %d-%d of %s with status %d", offset, end, name, resp.StatusCode)
+				if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+					return backoff.Permanent(err)
+				}
+				return err
+			}
+			if e := resp.Header.Get("ETag"); etag != "" && e != "" && e != etag {
+				return backoff.Permanent(errors.Errorf("%s was changed during download", name))
+			}
+			n, err := io.Copy(&offsetWriter{w: w, off: offset}, io.TeeReader(resp.Body, p))
+			offset += n
+			if err != nil {
+				return errors.Errorf("failed to download bytes %d-%d of %s: %w", offset, end, name, err)
+			}
+			if offset != end+1 {
+				return errors.Errorf("download of bytes %d-%d of %s was truncated at %d", start, end, name, offset)
+			}
+			return nil
+		},
+		backoff.WithMaxRetries(b, uint64(chunkMaxRetries)),
+		func(err error, wait time.Duration) {
+			log.Warningf(ctx, "failed to download chunk, retry after %s: "+log.ErrorFormat, wait, err)
+		})
+}
+
+func chunkLength(i int, chunkSize int64, total int64) int64 {
+	start := int64(i) * chunkSize
+	if start+chunkSize > total {
+		return total - start
+	}
+	return chunkSize
+}
+
+// parseContentRange returns the first byte and the total size from Content-Range.
+// The total size is -1 if it's unknown.
+func parseContentRange(value string) (int64, int64, error) {
+	// bytes <first>-<last>/<total or *>
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, errors.Errorf("invalid Content-Range: %s", value)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid Content-Range: %s", value)
+	}
+	first := strings.SplitN(parts[0], "-", 2)[0]
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid Content-Range: %s", value)
+	}
+	if parts[1] == "*" {
+		return start, -1, nil
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid Content-Range: %s", value)
+	}
+	return start, total, nil
+}
+
+// offsetWriter writes to w from off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.WriteAt(b, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// chunkResult is the chunk downloaded to memory.
+type chunkResult struct {
+	buf *chunkBuffer
+	err error
+}
+
+// streamChunks downloads the entity of total bytes in chunks in parallel, and writes them to w in order.
+// Chunks ahead of the one being written are limited to the concurrency.
+func (d Downloader) streamChunks(
+	name string,
+	signedURL string,
+	first *http.Response,
+	total int64,
+	w io.Writer,
+	sum *checksum) error {
+
+	ctx := context.TODO()
+	chunkSize := d.chunkSize()
+	etag := first.Header.Get("ETag")
+	n := int((total + chunkSize - 1) / chunkSize)
+	h := sum.newHash()
+	if h != nil {
+		w = io.MultiWriter(w, h)
+	}
+	p := newProgress(ctx, name, total, 0)
+	defer p.stop()
+
+	results := make([]chan chunkResult, n)
+	for i := range results {
+		results[i] = make(chan chunkResult, 1)
+	}
+	fetch := func(i int, resume func(*chunkBuffer) (int64, error)) {
+		start := int64(i) * chunkSize
+		buf := &chunkBuffer{base: start, data: make([]byte, chunkLength(i, chunkSize, total))}
+		offset := start
+		if resume != nil {
+			written, err := resume(buf)
+			if err == nil && written == int64(len(buf.data)) {
+				results[i] <- chunkResult{buf: buf}
+				return
+			}
+			offset += written
+		}
+		err := d.downloadChunk(ctx, name, signedURL, etag, buf, offset, start+int64(len(buf.data))-1, p)
+		results[i] <- chunkResult{buf: buf, err: err}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	tokens := make(chan struct{}, d.concurrency())
+	go func() {
+		for i := 1; i < n; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			go fetch(i, nil)
+		}
+	}()
+	// the first chunk is read from the response already received.
+	fetch(0, func(buf *chunkBuffer) (int64, error) {
+		body := io.TeeReader(io.LimitReader(first.Body, int64(len(buf.data))), p)
+		return io.Copy(&offsetWriter{w: buf, off: buf.base}, body)
+	})
+
+	for i := 0; i < n; i++ {
+		r := <-results[i]
+		if i > 0 {
+			<-tokens
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if _, err := w.Write(r.buf.data); err != nil {
+			return errors.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	if h != nil {
+		if err := sum.verify(h); err != nil {
+			return errors.Errorf("failed to verify %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// chunkBuffer is the chunk from base in memory.
+type chunkBuffer struct {
+	base int64
+	data []byte
+}
+
+func (c *chunkBuffer) WriteAt(b []byte, off int64) (int, error) {
+	pos := off - c.base
+	if pos < 0 || pos+int64(len(b)) > int64(len(c.data)) {
+		return 0, errors.Errorf("bytes %d-%d are out of chunk", off, off+int64(len(b))-1)
+	}
+	return copy(c.data[pos:], b), nil
+}
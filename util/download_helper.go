@@ -0,0 +1,197 @@
+package util
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
+	log "github.com/abeja-inc/abeja-platform-model-proxy/util/logging"
+)
+
+// progressInterval is the interval of logging progress of download.
+var progressInterval = 10 * time.Second
+
+// checksum is the expected digest of entity.
+type checksum struct {
+	algorithm string
+	digest    string
+}
+
+func parseChecksum(value string) (*checksum, error) {
+	algorithm, digest := "", strings.ToLower(value)
+	if i := strings.Index(digest, ":"); i >= 0 {
+		algorithm, digest = digest[:i], digest[i+1:]
+	}
+	if _, err := hex.DecodeString(digest); err != nil || digest == "" {
+		return nil, errors.Errorf("digest must be hex: %s", value)
+	}
+	if algorithm == "" {
+		switch len(digest) {
+		case md5.Size * 2:
+			algorithm = "md5"
+		case sha1.Size * 2:
+			algorithm = "sha1"
+		case sha256.Size * 2:
+			algorithm = "sha256"
+		}
+	}
+	sum := &checksum{algorithm: algorithm, digest: digest}
+	if sum.newHash() == nil {
+		return nil, errors.Errorf("unsupported checksum: %s", value)
+	}
+	if len(digest) != sum.newHash().Size()*2 {
+		return nil, errors.Errorf("length of %s digest is invalid: %s", algorithm, value)
+	}
+	return sum, nil
+}
+
+// etagChecksum returns the checksum of ETag if it's MD5 of entity, or nil.
+func etagChecksum(header http.Header) *checksum {
+	// ETag of S3 objects uploaded in multipart or encrypted by KMS or customer keys isn't MD5,
+	// and weak ETag isn't quoted hex.
+	if header.Get("x-amz-server-side-encryption") == "aws:kms" ||
+		header.Get("x-amz-server-side-encryption-customer-algorithm") != "" {
+		return nil
+	}
+	etag := header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		return nil
+	}
+	sum, err := parseChecksum("md5:" + strings.Trim(etag, `"`))
+	if err != nil {
+		return nil
+	}
+	return sum
+}
+
+// newHash returns the hash of the algorithm, or nil if checksum isn't given.
+func (c *checksum) newHash() hash.Hash {
+	if c == nil {
+		return nil
+	}
+	switch c.algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+func (c *checksum) verify(h hash.Hash) error {
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != c.digest {
+		return errors.Errorf("%s checksum mismatch: expected %s, but %s", c.algorithm, c.digest, actual)
+	}
+	return nil
+}
+
+func (c *checksum) verifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Errorf("failed to open %s: %w", path, err)
+	}
+	defer cleanutil.Close(context.TODO(), f, path)
+	h := c.newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.Errorf("failed to read %s: %w", path, err)
+	}
+	return c.verify(h)
+}
+
+// progress counts bytes downloaded, and logs them periodically.
+type progress struct {
+	ctx      context.Context
+	name     string
+	total    int64
+	resumed  int64
+	received int64
+	start    time.Time
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newProgress starts logging progress of name, whose size is total bytes (-1 if unknown).
+// resumed is bytes downloaded before.
+func newProgress(ctx context.Context, name string, total int64, resumed int64) *progress {
+	p := &progress{
+		ctx:     ctx,
+		name:    name,
+		total:   total,
+		resumed: resumed,
+		start:   time.Now(),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.log()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *progress) add(n int64) {
+	atomic.AddInt64(&p.received, n)
+}
+
+func (p *progress) stop() {
+	p.once.Do(func() {
+		close(p.done)
+		p.log()
+	})
+}
+
+func (p *progress) log() {
+	received := atomic.LoadInt64(&p.received)
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(received) / elapsed
+	}
+	total := "unknown"
+	if p.total >= 0 {
+		total = formatBytes(p.total)
+	}
+	log.Infof(p.ctx, "download progress of %s: %s of %s (%s/s)",
+		p.name, formatBytes(p.resumed+received), total, formatBytes(int64(rate)))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -18,14 +18,28 @@ import (
 
 const downloaderTimeout = 600 // 10 minutes
 
+// DefaultDownloadChunkSize is the size of each range requested at the same time.
+const DefaultDownloadChunkSize = 16 * 1024 * 1024
+
+// DefaultDownloadConcurrency is the number of ranges requested at the same time.
+const DefaultDownloadConcurrency = 4
+
 type DecoderRes interface {
 	GetDownloadURL() string
 	GetContentType() string
 }
 
+// DecoderChecksum is implemented by DecoderRes whose API gives the checksum of the entity.
+// The checksum is formatted as `<algorithm>:<hex digest>` (md5, sha1 or sha256), or hex digest only.
+type DecoderChecksum interface {
+	GetChecksum() string
+}
+
 // Downloader is struct for download entities.
 type Downloader struct {
-	Client *httpclient.RetryClient
+	Client      *httpclient.RetryClient
+	ChunkSize   int64
+	Concurrency int
 }
 
 // NewDownloader returns `Downloader`.
@@ -35,45 +49,177 @@ func NewDownloader(baseURL string, authInfo auth.AuthInfo, option *http.Client)
 		return nil, errors.Errorf("failed to build http client: %w", err)
 	}
 
-	return &Downloader{Client: httpClient}, nil
+	return &Downloader{
+		Client:      httpClient,
+		ChunkSize:   DefaultDownloadChunkSize,
+		Concurrency: DefaultDownloadConcurrency,
+	}, nil
 }
 
 // Download downloads the entity from the download_uri contained in the apipath response
 // to the `destPath`.
+// When the server supports range requests, the entity is downloaded in chunks in parallel,
+// and the download interrupted is resumed from the chunks already written to `destPath`.
+// The entity is verified with the checksum given by the API, or ETag if it's MD5 of the entity.
 func (d Downloader) Download(apiPath string, destPath string, decoderRes DecoderRes) (string, error) {
+	signedURL, sum, err := d.requestMeta(apiPath, decoderRes)
+	if err != nil {
+		return "", err
+	}
+	resp, total, err := d.requestFirst(signedURL)
+	if err != nil {
+		return "", err
+	}
+	defer cleanutil.Close(context.TODO(), resp.Body, fmt.Sprintf("response body of %s", signedURL))
 
+	if sum == nil {
+		sum = etagChecksum(resp.Header)
+	}
+	if total >= 0 {
+		err = d.downloadChunks(apiPath, signedURL, resp, total, destPath, sum)
+	} else {
+		err = downloadWhole(apiPath, resp, destPath, sum)
+	}
+	if err != nil {
+		return "", err
+	}
+	return decoderRes.GetContentType(), nil
+}
+
+// DownloadTo downloads the entity like `Download`, but writes it to `w` in order instead of a file.
+// Chunks downloaded in parallel are kept in memory until they are written,
+// and the download can't be resumed after it fails.
+// `w` may have received the entity when the verification fails.
+func (d Downloader) DownloadTo(apiPath string, w io.Writer, decoderRes DecoderRes) (string, error) {
+	signedURL, sum, err := d.requestMeta(apiPath, decoderRes)
+	if err != nil {
+		return "", err
+	}
+	resp, total, err := d.requestFirst(signedURL)
+	if err != nil {
+		return "", err
+	}
+	defer cleanutil.Close(context.TODO(), resp.Body, fmt.Sprintf("response body of %s", signedURL))
+
+	if sum == nil {
+		sum = etagChecksum(resp.Header)
+	}
+	if total >= 0 {
+		err = d.streamChunks(apiPath, signedURL, resp, total, w, sum)
+	} else {
+		err = writeWhole(apiPath, resp, w, sum)
+	}
+	if err != nil {
+		return "", err
+	}
+	return decoderRes.GetContentType(), nil
+}
+
+// requestMeta requests the API of `apiPath`, and returns the download url and checksum if given.
+func (d Downloader) requestMeta(apiPath string, decoderRes DecoderRes) (string, *checksum, error) {
 	err := d.Client.GetJson(apiPath, nil, decoderRes)
 	if err != nil {
 		log.Error(context.TODO(), "failed to request meta data")
-		return "", errors.Errorf("failed to request to %s: %w", apiPath, err)
+		return "", nil, errors.Errorf("failed to request to %s: %w", apiPath, err)
+	}
+	var sum *checksum
+	if c, ok := decoderRes.(DecoderChecksum); ok && c.GetChecksum() != "" {
+		if sum, err = parseChecksum(c.GetChecksum()); err != nil {
+			return "", nil, errors.Errorf("invalid checksum of %s: %w", apiPath, err)
+		}
 	}
+	return decoderRes.GetDownloadURL(), sum, nil
+}
 
-	signedURL := decoderRes.GetDownloadURL()
-	contentType := decoderRes.GetContentType()
-	resp2, err := d.Client.GetThrough(signedURL)
+// requestFirst requests the first chunk of the entity, and returns the response with the size of entity.
+// The size is -1 if the server doesn't support range requests, and the response has the whole entity.
+func (d Downloader) requestFirst(signedURL string) (*http.Response, int64, error) {
+	resp2, err := d.Client.GetThroughRange(signedURL, 0, d.chunkSize()-1)
 	if err != nil {
 		log.Error(context.TODO(), "failed to request download data")
-		return "", errors.Errorf("failed to request to %s: %w", signedURL, err)
+		return nil, 0, errors.Errorf("failed to request to %s: %w", signedURL, err)
+	}
+
+	if resp2.StatusCode == http.StatusPartialContent {
+		start, total, err := parseContentRange(resp2.Header.Get("Content-Range"))
+		if err != nil || start != 0 {
+			cleanutil.Close(context.TODO(), resp2.Body, fmt.Sprintf("response body of %s", signedURL))
+			return nil, 0, errors.Errorf(
+				"unexpected Content-Range [%s] from %s", resp2.Header.Get("Content-Range"), signedURL)
+		}
+		if total >= 0 {
+			return resp2, total, nil
+		}
+		// the size is unknown, so the entity is requested as a whole.
+		cleanutil.Close(context.TODO(), resp2.Body, fmt.Sprintf("response body of %s", signedURL))
+		if resp2, err = d.Client.GetThrough(signedURL); err != nil {
+			log.Error(context.TODO(), "failed to request download data")
+			return nil, 0, errors.Errorf("failed to request to %s: %w", signedURL, err)
+		}
 	}
-	defer cleanutil.Close(context.TODO(), resp2.Body, fmt.Sprintf("response body of %s", signedURL))
 	if resp2.StatusCode != http.StatusOK {
+		defer cleanutil.Close(context.TODO(), resp2.Body, fmt.Sprintf("response body of %s", signedURL))
 		msg, _ := ioutil.ReadAll(resp2.Body)
 		log.Errorf(context.TODO(), "failed to download with status %d\n", resp2.StatusCode)
-		return "", errors.Errorf(
+		return nil, 0, errors.Errorf(
 			"failed to download from %s with status %d, body = [%s]",
 			signedURL, resp2.StatusCode, msg)
 	}
+	return resp2, -1, nil
+}
+
+func (d Downloader) chunkSize() int64 {
+	if d.ChunkSize <= 0 {
+		return DefaultDownloadChunkSize
+	}
+	return d.ChunkSize
+}
+
+func (d Downloader) concurrency() int {
+	if d.Concurrency <= 0 {
+		return 1
+	}
+	return d.Concurrency
+}
+
+// downloadWhole writes the body of response to destPath, for servers not supporting range requests.
+func downloadWhole(name string, resp *http.Response, destPath string, sum *checksum) error {
+	ctx := context.TODO()
+	// the progress of previous download is useless without ranges.
+	removeDownloadState(ctx, destPath)
 
-	fp, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE, 0755)
+	fp, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
-		log.Error(context.TODO(), "failed to open download data")
-		return "", errors.Errorf("failed to open %s: %w", destPath, err)
+		log.Error(ctx, "failed to open download data")
+		return errors.Errorf("failed to open %s: %w", destPath, err)
 	}
-	defer cleanutil.Close(context.TODO(), fp, destPath)
-	if _, err = io.Copy(fp, resp2.Body); err != nil {
+	defer cleanutil.Close(ctx, fp, destPath)
+
+	return writeWhole(name, resp, fp, sum)
+}
+
+// writeWhole writes the body of response to w, and verifies it.
+func writeWhole(name string, resp *http.Response, w io.Writer, sum *checksum) error {
+	p := newProgress(context.TODO(), name, resp.ContentLength, 0)
+	defer p.stop()
+	writers := []io.Writer{w, p}
+	h := sum.newHash()
+	if h != nil {
+		writers = append(writers, h)
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), resp.Body)
+	if err != nil {
 		log.Error(context.TODO(), "failed to copy response-body")
-		return "", errors.Errorf("failed to copying response-body to %s: %w", destPath, err)
+		return errors.Errorf("failed to download %s: %w", name, err)
 	}
-
-	return contentType, nil
+	if resp.ContentLength > 0 && n != resp.ContentLength {
+		return errors.Errorf(
+			"download of %s was truncated: %d of %d bytes", name, n, resp.ContentLength)
+	}
+	if h != nil {
+		if err := sum.verify(h); err != nil {
+			return errors.Errorf("failed to verify %s: %w", name, err)
+		}
+	}
+	return nil
 }
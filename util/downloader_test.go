@@ -3,11 +3,19 @@ package util
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/abeja-inc/abeja-platform-model-proxy/util/auth"
 	cleanutil "github.com/abeja-inc/abeja-platform-model-proxy/util/clean"
@@ -380,3 +388,266 @@ func client(t *testing.T, status int, body []byte) *http.Client {
 		}
 	})
 }
+
+type checksumResJSON struct {
+	DownloadURL string `json:"download_uri"`
+	Checksum    string `json:"checksum"`
+}
+
+func (c *checksumResJSON) GetDownloadURL() string {
+	return c.DownloadURL
+}
+
+func (_ *checksumResJSON) GetContentType() string {
+	return ""
+}
+
+func (c *checksumResJSON) GetChecksum() string {
+	return c.Checksum
+}
+
+// rangeServer serves content with ranges, and records ranges requested.
+type rangeServer struct {
+	*httptest.Server
+	content  []byte
+	etag     string
+	checksum string
+	// abortAt is the first byte of range whose response is cut off halfway at once.
+	abortAt int64
+	mu      sync.Mutex
+	ranges  []string
+}
+
+func newRangeServer(t *testing.T, content []byte) *rangeServer {
+	t.Helper()
+	md5sum := md5.Sum(content)
+	s := &rangeServer{content: content, etag: fmt.Sprintf(`"%x"`, md5sum), abortAt: -1}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/source" {
+			body, _ := json.Marshal(checksumResJSON{DownloadURL: s.URL + "/blob", Checksum: s.checksum})
+			_, _ = w.Write(body)
+			return
+		}
+		rng := r.Header.Get("Range")
+		s.mu.Lock()
+		s.ranges = append(s.ranges, rng)
+		abort := s.abortAt >= 0 && strings.HasPrefix(rng, fmt.Sprintf("bytes=%d-", s.abortAt))
+		if abort {
+			s.abortAt = -1
+		}
+		s.mu.Unlock()
+		w.Header().Set("ETag", s.etag)
+		if abort {
+			var start, end int64
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+			w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(content[start : start+(end-start+1)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(content))
+	}))
+	return s
+}
+
+func (s *rangeServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.ranges...)
+}
+
+func newRangeDownloader(t *testing.T, s *rangeServer) *Downloader {
+	t.Helper()
+	downloader, err := NewDownloader(s.URL, auth.AuthInfo{AuthToken: validToken}, nil)
+	if err != nil {
+		t.Fatal("failed to NewDownloader: ", err)
+	}
+	downloader.ChunkSize = 16
+	downloader.Concurrency = 3
+	return downloader
+}
+
+func tempFilePath(t *testing.T) string {
+	t.Helper()
+	tempfile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal("failed to create tempfile:", err)
+	}
+	if err := tempfile.Close(); err != nil {
+		t.Fatal("Error when closing file:", err)
+	}
+	return tempfile.Name()
+}
+
+// setFastChunkRetry shortens the interval of retry, and returns the function to restore it.
+func setFastChunkRetry() func() {
+	interval := chunkRetryInterval
+	chunkRetryInterval = time.Millisecond
+	return func() {
+		chunkRetryInterval = interval
+	}
+}
+
+func TestDownloadChunks(t *testing.T) {
+	defer setFastChunkRetry()()
+	content := []byte(strings.Repeat("0123456789", 10))
+	s := newRangeServer(t, content)
+	defer s.Close()
+	s.abortAt = 48
+
+	filePath := tempFilePath(t)
+	defer cleanutil.Remove(context.TODO(), filePath)
+	if _, err := newRangeDownloader(t, s).Download("source", filePath, new(checksumResJSON)); err != nil {
+		t.Fatal("failed to download:", err)
+	}
+	actual, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal("failed to read download file: ", err)
+	}
+	if !bytes.Equal(actual, content) {
+		t.Fatalf("[%s] should be equals [%s]", string(actual), string(content))
+	}
+	requested := s.requested()
+	// 7 chunks and the retry of the chunk cut off, which resumes from the bytes received.
+	if len(requested) != 8 {
+		t.Errorf("8 ranges should be requested, but %v", requested)
+	}
+	resumed := false
+	for _, r := range requested {
+		if r == "bytes=56-63" {
+			resumed = true
+		}
+	}
+	if !resumed {
+		t.Errorf("chunk cut off should be resumed from the middle, but %v", requested)
+	}
+	if _, err := os.Stat(downloadStatePath(filePath)); !os.IsNotExist(err) {
+		t.Errorf("progress of download should be removed, but %v", err)
+	}
+}
+
+func TestDownloadChunks_Resume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 10))
+	s := newRangeServer(t, content)
+	defer s.Close()
+
+	filePath := tempFilePath(t)
+	defer cleanutil.Remove(context.TODO(), filePath)
+	defer cleanutil.Remove(context.TODO(), downloadStatePath(filePath))
+	// chunks from 16 to 47 were downloaded before.
+	partial := make([]byte, len(content))
+	copy(partial[16:48], content[16:48])
+	if err := ioutil.WriteFile(filePath, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := &downloadState{
+		ETag:      s.etag,
+		Size:      int64(len(content)),
+		ChunkSize: 16,
+		Done:      []bool{false, true, true, false, false, false, false},
+	}
+	if err := saveDownloadState(filePath, state); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newRangeDownloader(t, s).Download("source", filePath, new(checksumResJSON)); err != nil {
+		t.Fatal("failed to download:", err)
+	}
+	actual, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal("failed to read download file: ", err)
+	}
+	if !bytes.Equal(actual, content) {
+		t.Fatalf("[%s] should be equals [%s]", string(actual), string(content))
+	}
+	for _, r := range s.requested() {
+		if r == "bytes=16-31" || r == "bytes=32-47" {
+			t.Errorf("chunks downloaded before should not be requested, but %s", r)
+		}
+	}
+}
+
+func TestDownloadChunks_Checksum(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 10))
+	sha256sum := sha256.Sum256(content)
+	cases := []struct {
+		name        string
+		etag        string
+		checksum    string
+		expectError bool
+	}{
+		{name: "etag", expectError: false},
+		{name: "etag mismatch", etag: `"00000000000000000000000000000000"`, expectError: true},
+		{name: "multipart etag", etag: `"00000000000000000000000000000000-2"`, expectError: false},
+		{name: "checksum of api", checksum: fmt.Sprintf("sha256:%x", sha256sum), expectError: false},
+		{name: "checksum mismatch", checksum: fmt.Sprintf("sha256:%x", sha256.Sum256(nil)), expectError: true},
+		{name: "invalid checksum", checksum: "crc32:1234", expectError: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newRangeServer(t, content)
+			defer s.Close()
+			if c.etag != "" {
+				s.etag = c.etag
+			}
+			s.checksum = c.checksum
+
+			filePath := tempFilePath(t)
+			defer cleanutil.Remove(context.TODO(), filePath)
+			_, err := newRangeDownloader(t, s).Download("source", filePath, new(checksumResJSON))
+			if c.expectError {
+				if err == nil {
+					t.Fatal("Download() should be raise error")
+				}
+				if _, err := os.Stat(downloadStatePath(filePath)); !os.IsNotExist(err) {
+					t.Errorf("progress of download should be removed on mismatch, but %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("failed to download:", err)
+			}
+		})
+	}
+}
+
+func TestDownloadTo(t *testing.T) {
+	defer setFastChunkRetry()()
+	content := []byte(strings.Repeat("0123456789", 10))
+	s := newRangeServer(t, content)
+	defer s.Close()
+	s.abortAt = 32
+
+	buf := new(bytes.Buffer)
+	if _, err := newRangeDownloader(t, s).DownloadTo("source", buf, new(checksumResJSON)); err != nil {
+		t.Fatal("failed to download:", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Fatalf("[%s] should be equals [%s]", buf.String(), string(content))
+	}
+
+	// the entity is verified.
+	s.etag = `"00000000000000000000000000000000"`
+	if _, err := newRangeDownloader(t, s).DownloadTo("source", new(bytes.Buffer), new(checksumResJSON)); err == nil {
+		t.Error("DownloadTo() should be raise error")
+	}
+}
+
+func TestDownloadTo_WithoutRange(t *testing.T) {
+	authInfo := auth.AuthInfo{
+		AuthToken: validToken,
+	}
+	downloader, err := NewDownloader("http://localhost", authInfo, clientWithSourceResJSON(t, 200, validDownloadURL))
+	if err != nil {
+		t.Fatal("failed to NewDownloader: ", err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := downloader.DownloadTo("source", buf, new(SourceResJSON)); err != nil {
+		t.Fatal("failed to download:", err)
+	}
+	if buf.String() != modelCode {
+		t.Fatalf("[%s] should be equals [%s]", buf.String(), modelCode)
+	}
+}
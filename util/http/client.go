@@ -76,6 +76,20 @@ func (c *RetryClient) GetThrough(reqURL string) (*http.Response, error) {
 	return resp, err
 }
 
+// GetThroughRange requests bytes from start to end (inclusive) of reqURL like GetThrough.
+func (c *RetryClient) GetThroughRange(reqURL string, start int64, end int64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, errors.Errorf(": %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := c.client.Do(req)
+	if resp != nil && resp.StatusCode >= 500 {
+		log.Warningf(context.TODO(), "RetryClient.GetThroughRange: GET request failed(status=%d)\n%s", resp.StatusCode, c.client.LogString())
+	}
+	return resp, err
+}
+
 func (c *RetryClient) GetJson(reqPath string, param map[string]interface{}, buf interface{}) error {
 	reqUrl := c.BuildURL(reqPath, param)
 
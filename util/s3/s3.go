@@ -0,0 +1,166 @@
+// Package s3 is a minimal client of S3 and S3-compatible storage like MinIO,
+// which signs requests with AWS Signature Version 4.
+// Objects are addressed in path-style (`<endpoint>/<bucket>/<key>`),
+// which every S3-compatible storage supports.
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/config"
+)
+
+// EmptyPayloadHash is the SHA256 of empty body, used for GET requests.
+const EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+const clientTimeout = 10 * time.Minute
+
+// Client sends requests to S3.
+type Client struct {
+	endpoint        *url.URL
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+// NewClient returns the client of S3 configured by conf.
+func NewClient(conf *config.Configuration, option *http.Client) (*Client, error) {
+	if conf.S3AccessKeyID == "" || conf.S3SecretAccessKey == "" {
+		return nil, errors.New("s3_access_key_id and s3_secret_access_key need for S3, but not set")
+	}
+	region := conf.S3Region
+	if region == "" {
+		region = config.DefaultS3Region
+	}
+	endpoint := conf.S3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Errorf("invalid s3_endpoint [%s]: %w", endpoint, err)
+	}
+	if ep.Scheme != "http" && ep.Scheme != "https" {
+		return nil, errors.Errorf("unsupported scheme of s3_endpoint: %s", ep.Scheme)
+	}
+	client := option
+	if client == nil {
+		client = &http.Client{Timeout: clientTimeout}
+	}
+	return &Client{
+		endpoint:        ep,
+		region:          region,
+		accessKeyID:     conf.S3AccessKeyID,
+		secretAccessKey: conf.S3SecretAccessKey,
+		client:          client,
+	}, nil
+}
+
+// ParseURL parses `s3://<bucket>/<key>`, and returns the bucket and the key.
+func ParseURL(s3URL string) (string, string, error) {
+	u, err := url.Parse(s3URL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", errors.Errorf("invalid S3 url, it must be `s3://<bucket>/<key>`: %s", s3URL)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// NewRequest returns the request to the object. Headers may be set before it is sent by Do.
+func (c *Client) NewRequest(
+	ctx context.Context, method, bucket, key string, body io.Reader) (*http.Request, error) {
+
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + EscapePath(bucket+"/"+key)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errors.Errorf(": %w", err)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// Do signs the request whose body has payloadHash, and sends it.
+func (c *Client) Do(req *http.Request, payloadHash string) (*http.Response, error) {
+	Sign(req, payloadHash, c.accessKeyID, c.secretAccessKey, c.region, time.Now())
+	return c.client.Do(req)
+}
+
+// Sign signs the request with AWS Signature Version 4 for S3.
+// All headers set to the request before it are signed.
+func Sign(req *http.Request, payloadHash, accessKeyID, secretAccessKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		names = append(names, lk)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		canonicalHeaders.WriteString(n + ":" + headers[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// EscapePath escapes the path as URI encoding of AWS, which keeps only
+// unreserved characters and `/`.
+func EscapePath(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"context"
+
+	httptrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// DatadogTracer is the tracer which sends spans to datadog-agent.
+type DatadogTracer struct {
+	muxOptions []httptrace.MuxOption
+}
+
+// NewDatadogTracer starts tracer of datadog.
+func NewDatadogTracer(
+	startOptions []tracer.StartOption, muxOptions []httptrace.MuxOption) *DatadogTracer {
+
+	tracer.Start(startOptions...)
+	return &DatadogTracer{muxOptions: muxOptions}
+}
+
+// Start starts span of datadog.
+func (t *DatadogTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	span, ctx := tracer.StartSpanFromContext(ctx, name, tracer.Tag("span.kind", kind.String()))
+	return ctx, &datadogSpan{span: span}
+}
+
+// NewServeMux returns ServeMux of datadog.
+func (t *DatadogTracer) NewServeMux() Mux {
+	return httptrace.NewServeMux(t.muxOptions...)
+}
+
+// Shutdown stops tracer of datadog.
+func (t *DatadogTracer) Shutdown(ctx context.Context) error {
+	tracer.Stop()
+	return nil
+}
+
+type datadogSpan struct {
+	span ddtrace.Span
+}
+
+func (s *datadogSpan) SetAttribute(key string, value interface{}) {
+	s.span.SetTag(key, value)
+}
+
+func (s *datadogSpan) SetError(err error) {
+	s.span.SetTag(ext.Error, err)
+}
+
+func (s *datadogSpan) End() {
+	s.span.Finish()
+}
+
+// TraceParent returns empty string, because datadog doesn't propagate W3C traceparent.
+func (s *datadogSpan) TraceParent() string {
+	return ""
+}
@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	errors "golang.org/x/xerrors"
+
+	"github.com/abeja-inc/abeja-platform-model-proxy/version"
+)
+
+// instrumentationName is the name of instrumentation scope in OTLP.
+const instrumentationName = "github.com/abeja-inc/abeja-platform-model-proxy"
+
+// OTLPConfig is configuration of OTLPTracer.
+// Endpoint, headers and timeout of the exporter, sampler and batching are configured
+// by `OTEL_*` environment variables, which the OpenTelemetry SDK reads.
+type OTLPConfig struct {
+	// ServiceName is service.name of resource, unless `OTEL_SERVICE_NAME` or
+	// service.name in `OTEL_RESOURCE_ATTRIBUTES` is set.
+	ServiceName string
+}
+
+// OTLPTracer is the tracer of the OpenTelemetry SDK which exports spans by OTLP/HTTP.
+type OTLPTracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewOTLPTracer returns OTLPTracer, which exports spans in background.
+func NewOTLPTracer(ctx context.Context, conf OTLPConfig) (*OTLPTracer, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, errors.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	// attributes from environment variables take precedence over the default service name.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(conf.ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, errors.Errorf("failed to create resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res))
+	return &OTLPTracer{
+		provider:   provider,
+		tracer:     provider.Tracer(instrumentationName, trace.WithInstrumentationVersion(version.Version)),
+		propagator: propagation.TraceContext{},
+	}, nil
+}
+
+// Start starts span as child of the span in ctx, or of the remote span of caller.
+func (t *OTLPTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(otelSpanKind(kind)))
+	return ctx, &otlpSpan{ctx: ctx, span: span, propagator: t.propagator}
+}
+
+// NewServeMux returns Mux which starts span of kind server per request,
+// as child of the span of caller in `traceparent` header.
+func (t *OTLPTracer) NewServeMux() Mux {
+	mux := http.NewServeMux()
+	return &otlpServeMux{
+		ServeMux: mux,
+		handler: otelhttp.NewHandler(mux, "http.request",
+			otelhttp.WithTracerProvider(t.provider),
+			otelhttp.WithPropagators(t.propagator)),
+	}
+}
+
+// Shutdown exports spans which are not exported yet, and stops exporting.
+func (t *OTLPTracer) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+func otelSpanKind(kind SpanKind) trace.SpanKind {
+	switch kind {
+	case SpanKindServer:
+		return trace.SpanKindServer
+	case SpanKindClient:
+		return trace.SpanKindClient
+	default:
+		return trace.SpanKindInternal
+	}
+}
+
+type otlpSpan struct {
+	ctx        context.Context
+	span       trace.Span
+	propagator propagation.TextMapPropagator
+}
+
+func (s *otlpSpan) SetAttribute(key string, value interface{}) {
+	s.span.SetAttributes(toAttribute(key, value))
+}
+
+func (s *otlpSpan) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otlpSpan) End() {
+	s.span.End()
+}
+
+func (s *otlpSpan) TraceParent() string {
+	carrier := propagation.MapCarrier{}
+	s.propagator.Inject(s.ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+func toAttribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	case string:
+		return attribute.String(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
+
+// otlpServeMux is http.ServeMux whose requests are traced by otelhttp.
+type otlpServeMux struct {
+	*http.ServeMux
+	handler http.Handler
+}
+
+func (m *otlpServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
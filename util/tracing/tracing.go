@@ -0,0 +1,116 @@
+// Package tracing provides pluggable tracing layer.
+// The tracer is Datadog or OpenTelemetry with OTLP exporter, or no-op when neither is configured.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Span is a unit of work in trace.
+type Span interface {
+	// SetAttribute sets attribute of span.
+	SetAttribute(key string, value interface{})
+	// SetError marks span as failed by err.
+	SetError(err error)
+	// End finishes span.
+	End()
+	// TraceParent returns W3C traceparent of span, or empty string if it is not propagated.
+	TraceParent() string
+}
+
+// Mux is http request multiplexer which traces requests.
+type Mux interface {
+	http.Handler
+	Handle(pattern string, handler http.Handler)
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
+// Tracer creates spans.
+type Tracer interface {
+	// Start starts span as child of the span in ctx, and returns ctx which has the new span.
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+	// NewServeMux returns Mux which starts span per request.
+	NewServeMux() Mux
+	// Shutdown flushes spans which are not exported yet, and stops tracer.
+	Shutdown(ctx context.Context) error
+}
+
+// SpanKind represents the role of span.
+type SpanKind int
+
+// SpanKinds.
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+var (
+	mu     sync.RWMutex
+	global Tracer = NoopTracer{}
+)
+
+// SetTracer sets the tracer used by StartSpan and NewServeMux.
+func SetTracer(t Tracer) {
+	mu.Lock()
+	defer mu.Unlock()
+	global = t
+}
+
+// GetTracer returns the tracer currently used.
+func GetTracer() Tracer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return global
+}
+
+// StartSpan starts span with the current tracer.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return GetTracer().Start(ctx, name, kind)
+}
+
+// NewServeMux returns Mux of the current tracer.
+func NewServeMux() Mux {
+	return GetTracer().NewServeMux()
+}
+
+// NoopTracer is the tracer which traces nothing.
+type NoopTracer struct{}
+
+// Start returns ctx as it is and span which does nothing.
+func (NoopTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+// NewServeMux returns http.ServeMux.
+func (NoopTracer) NewServeMux() Mux {
+	return http.NewServeMux()
+}
+
+// Shutdown does nothing.
+func (NoopTracer) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) SetError(err error)                         {}
+func (noopSpan) End()                                       {}
+func (noopSpan) TraceParent() string                        { return "" }
@@ -0,0 +1,174 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNoopTracer(t *testing.T) {
+	ctx := context.Background()
+	actualCtx, span := NoopTracer{}.Start(ctx, "test", SpanKindInternal)
+	if actualCtx != ctx {
+		t.Error("NoopTracer should return ctx as it is")
+	}
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.End()
+	if span.TraceParent() != "" {
+		t.Errorf("traceparent of NoopTracer should be empty, but %s", span.TraceParent())
+	}
+}
+
+// setEnv sets environment variable, and returns the function to restore it.
+func setEnv(key, value string) func() {
+	org, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, org)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestOTLPTracer_Export(t *testing.T) {
+	received := make(chan *coltracepb.ExportTraceServiceRequest, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Content-Type should be application/x-protobuf, but %s", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Authorization") != "Bearer xxx" {
+			t.Errorf("Authorization header should be passed, but %s", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("body should be protobuf: %s", err)
+		}
+		received <- req
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer ts.Close()
+	defer setEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", ts.URL+"/v1/traces")()
+	defer setEnv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20xxx")()
+	defer setEnv("OTEL_SERVICE_NAME", "")()
+	defer setEnv("OTEL_RESOURCE_ATTRIBUTES", "")()
+
+	tracer, err := NewOTLPTracer(context.Background(), OTLPConfig{ServiceName: "test-service"})
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "parent", SpanKindServer)
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+	child.SetAttribute("http.status_code", 503)
+	child.SetError(errors.New("failed"))
+	child.End()
+	parent.End()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+
+	var req *coltracepb.ExportTraceServiceRequest
+	select {
+	case req = <-received:
+	default:
+		t.Fatal("spans should be exported")
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected structure of request: %v", req)
+	}
+	serviceName := ""
+	for _, attr := range req.ResourceSpans[0].Resource.Attributes {
+		if attr.Key == "service.name" {
+			serviceName = attr.Value.GetStringValue()
+		}
+	}
+	if serviceName != "test-service" {
+		t.Errorf("service.name of resource should be test-service, but %s", serviceName)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("2 spans should be exported, but %d", len(spans))
+	}
+	childPB, parentPB := spans[0], spans[1]
+	if childPB.Name != "child" || parentPB.Name != "parent" {
+		t.Fatalf("spans should be exported in order of end, but %s, %s", childPB.Name, parentPB.Name)
+	}
+	if string(childPB.TraceId) != string(parentPB.TraceId) {
+		t.Errorf("trace id should be shared, but %x, %x", childPB.TraceId, parentPB.TraceId)
+	}
+	if string(childPB.ParentSpanId) != string(parentPB.SpanId) {
+		t.Errorf("parent of child should be %x, but %x", parentPB.SpanId, childPB.ParentSpanId)
+	}
+	if len(parentPB.ParentSpanId) != 0 {
+		t.Errorf("root span should not have parent, but %x", parentPB.ParentSpanId)
+	}
+	if childPB.Kind != tracepb.Span_SPAN_KIND_CLIENT || parentPB.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("unexpected kinds: %s, %s", childPB.Kind, parentPB.Kind)
+	}
+	if childPB.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || childPB.Status.GetMessage() != "failed" {
+		t.Errorf("status of child should be error, but %v", childPB.Status)
+	}
+	if len(childPB.Attributes) != 1 || childPB.Attributes[0].Value.GetIntValue() != 503 {
+		t.Errorf("attributes of child should have status code, but %v", childPB.Attributes)
+	}
+}
+
+func TestOTLPTracer_ServeMux(t *testing.T) {
+	defer setEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://localhost:0/v1/traces")()
+
+	tracer, err := NewOTLPTracer(context.Background(), OTLPConfig{ServiceName: "test-service"})
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		tracer.Shutdown(ctx)
+	}()
+
+	var traceParent string
+	mux := tracer.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracer.Start(r.Context(), "inner", SpanKindInternal)
+		traceParent = span.TraceParent()
+		span.End()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("status code should be %d, but %d", http.StatusAccepted, rec.Code)
+	}
+	if len(traceParent) != 55 {
+		t.Fatalf("traceparent should be valid, but %s", traceParent)
+	}
+	if traceParent[3:35] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id of caller should be inherited, but %s", traceParent)
+	}
+	if traceParent[36:52] == "00f067aa0ba902b7" {
+		t.Errorf("span id should be of new span, but %s", traceParent)
+	}
+	if traceParent[53:] != "01" {
+		t.Errorf("sampled flag of caller should be inherited, but %s", traceParent)
+	}
+}
@@ -0,0 +1,158 @@
+// Package watch detects changes of files under directory by polling.
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ignoredDirs are directories which don't contain source code.
+var ignoredDirs = map[string]bool{
+	"__pycache__":   true,
+	"node_modules":  true,
+	".git":          true,
+	".venv":         true,
+	".mypy_cache":   true,
+	".pytest_cache": true,
+}
+
+// ignoredSuffixes are suffixes of files which are written by tools, not by users.
+var ignoredSuffixes = []string{".pyc", ".pyo", ".swp", ".swx", "~"}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watcher polls files under root, and notifies when any of them is changed.
+type Watcher struct {
+	root     string
+	interval time.Duration
+	excludes []string
+	files    map[string]fileState
+}
+
+// NewWatcher returns Watcher of files under root.
+// Files under excludes are not watched, for example directory where runtime writes.
+func NewWatcher(root string, interval time.Duration, excludes ...string) (*Watcher, error) {
+	w := &Watcher{root: root, interval: interval}
+	for _, exclude := range excludes {
+		if exclude == "" {
+			continue
+		}
+		abs, err := filepath.Abs(exclude)
+		if err != nil {
+			return nil, err
+		}
+		w.excludes = append(w.excludes, abs)
+	}
+	files, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+	w.files = files
+	return w, nil
+}
+
+// Run calls onChange with paths of changed files until stop is closed.
+// Changes are notified after they settle, so that saving several files causes one notification.
+func (w *Watcher) Run(stop <-chan int, onChange func(paths []string)) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	pending := make(map[string]bool)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		files, err := w.scan()
+		if err != nil {
+			// the directory may be in the middle of being rewritten. try again next time.
+			continue
+		}
+		changed := diff(w.files, files)
+		w.files = files
+		for _, path := range changed {
+			pending[path] = true
+		}
+		if len(changed) == 0 && len(pending) > 0 {
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			pending = make(map[string]bool)
+			onChange(paths)
+		}
+	}
+}
+
+func (w *Watcher) scan() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.Walk(w.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed while walking.
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path != w.root && (ignoredDirs[info.Name()] || w.isExcluded(path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isIgnoredFile(info.Name()) {
+			return nil
+		}
+		files[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	return files, err
+}
+
+func (w *Watcher) isExcluded(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, exclude := range w.excludes {
+		if abs == exclude {
+			return true
+		}
+	}
+	return false
+}
+
+func isIgnoredFile(name string) bool {
+	if strings.HasPrefix(name, ".#") {
+		// lock file of emacs
+		return true
+	}
+	for _, suffix := range ignoredSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func diff(before map[string]fileState, after map[string]fileState) []string {
+	var changed []string
+	for path, state := range after {
+		if prev, ok := before[path]; !ok || !prev.modTime.Equal(state.modTime) || prev.size != state.size {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
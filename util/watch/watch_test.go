@@ -0,0 +1,84 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mainPath := filepath.Join(root, "main.py")
+	if err := ioutil.WriteFile(mainPath, []byte("print(1)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	excluded := filepath.Join(root, "abejainc_training_result")
+	for _, dir := range []string{filepath.Join(root, "__pycache__"), excluded} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	watcher, err := NewWatcher(root, 10*time.Millisecond, excluded)
+	if err != nil {
+		t.Fatal("unexpected error occurred:", err)
+	}
+	changes := make(chan []string, 10)
+	stop := make(chan int)
+	defer close(stop)
+	go watcher.Run(stop, func(paths []string) {
+		changes <- paths
+	})
+
+	// changes of ignored files are not notified.
+	ignored := []string{
+		filepath.Join(root, "__pycache__", "main.cpython-36.pyc"),
+		filepath.Join(root, "main.py.swp"),
+		filepath.Join(excluded, "model.h5"),
+	}
+	for _, path := range ignored {
+		if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case paths := <-changes:
+		t.Fatalf("changes of ignored files should not be notified, but %v", paths)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	newPath := filepath.Join(root, "util.py")
+	if err := ioutil.WriteFile(mainPath, []byte("print(22)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newPath, []byte("x = 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case paths := <-changes:
+		if len(paths) != 2 || paths[0] != mainPath || paths[1] != newPath {
+			t.Errorf("changed paths should be [%s %s], but %v", mainPath, newPath, paths)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("changes should be notified")
+	}
+
+	if err := os.Remove(newPath); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case paths := <-changes:
+		if len(paths) != 1 || paths[0] != newPath {
+			t.Errorf("removed path should be notified, but %v", paths)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("removal should be notified")
+	}
+}